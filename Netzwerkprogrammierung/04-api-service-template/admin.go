@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// toggled applies middleware only while enabled is set, so that it can be
+// switched on and off at runtime.
+func toggled(enabled *atomic.Bool, middleware func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := middleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if enabled.Load() {
+				wrapped.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimitSettings describes the default rate limiter.
+type RateLimitSettings struct {
+	Algorithm string `json:"algorithm"`
+	Limit     int    `json:"limit"`
+	Window    string `json:"window"`
+	Burst     int    `json:"burst"`
+}
+
+// configuredLimiter is a limiter built from settings, which the admin API
+// reports.
+type configuredLimiter struct {
+	Limiter
+	settings RateLimitSettings
+}
+
+// limiter returns the limiter described by s.
+func (s RateLimitSettings) limiter() (Limiter, error) {
+	window, err := time.ParseDuration(s.Window)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit window %q", s.Window)
+	}
+	limiter, err := newLimiter(s.Algorithm, s.Limit, window, s.Burst)
+	if err != nil {
+		return nil, err
+	}
+	return configuredLimiter{Limiter: limiter, settings: s}, nil
+}
+
+// adminSettings are the settings that can be changed at runtime. Fields
+// left out of a change keep their value. The rate limit is only reported if
+// its limiter was built from settings, the log level only if the server
+// can change it.
+type adminSettings struct {
+	CacheEnabled     *bool              `json:"cache_enabled,omitempty"`
+	RateLimitEnabled *bool              `json:"rate_limit_enabled,omitempty"`
+	RateLimit        *RateLimitSettings `json:"rate_limit,omitempty"`
+	LogLevel         *string            `json:"log_level,omitempty"`
+}
+
+// AdminAPI serves the operational endpoints under /admin. It authenticates
+// operators with a static bearer token of its own rather than through
+// tenancy and access control, so that it stays reachable when those are
+// misconfigured. Every request is written to the audit log.
+type AdminAPI struct {
+	server  *Server
+	token   []byte
+	audit   *slog.Logger
+	started time.Time
+}
+
+// NewAdminAPI returns an admin API of server accepting token and logging to
+// audit.
+func NewAdminAPI(server *Server, token string, audit *slog.Logger) *AdminAPI {
+	return &AdminAPI{server: server, token: []byte(token), audit: audit, started: server.now()}
+}
+
+// Register mounts the admin endpoints on r under /admin.
+func (a *AdminAPI) Register(r *mux.Router) {
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(a.Middleware)
+	admin.HandleFunc("/settings", a.getSettings).Methods("GET")
+	admin.HandleFunc("/settings", a.updateSettings).Methods("PATCH")
+	admin.HandleFunc("/cache", a.listCache).Methods("GET")
+	admin.HandleFunc("/cache", a.flushCache).Methods("DELETE")
+	admin.HandleFunc("/stats", a.stats).Methods("GET")
+	admin.HandleFunc("/api-keys/{tenant}", a.createAPIKey).Methods("POST")
+	if a.server.loginGuard != nil {
+		admin.HandleFunc("/lockouts", a.listLockouts).Methods("GET")
+		admin.HandleFunc("/lockouts/accounts/{tenant}/{email}", a.unlockAccount).Methods("DELETE")
+		admin.HandleFunc("/lockouts/sources/{source}", a.unlockSource).Methods("DELETE")
+	}
+	// The pprof handlers expect their paths below /debug/pprof/.
+	admin.Handle("/debug/pprof/cmdline", http.StripPrefix("/admin", http.HandlerFunc(pprof.Cmdline)))
+	admin.Handle("/debug/pprof/profile", http.StripPrefix("/admin", http.HandlerFunc(pprof.Profile)))
+	admin.Handle("/debug/pprof/symbol", http.StripPrefix("/admin", http.HandlerFunc(pprof.Symbol)))
+	admin.Handle("/debug/pprof/trace", http.StripPrefix("/admin", http.HandlerFunc(pprof.Trace)))
+	admin.PathPrefix("/debug/pprof/").Handler(http.StripPrefix("/admin", http.HandlerFunc(pprof.Index)))
+}
+
+// statusRecorder remembers the status of a response for the audit log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Middleware answers 401 Unauthorized to requests without the admin token
+// and logs every request with its outcome.
+func (a *AdminAPI) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+			a.audit.Warn("Rejected admin request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		a.audit.Info("Admin request", "method", r.Method, "path", r.URL.Path, "query", r.URL.RawQuery,
+			"remote", r.RemoteAddr, "status", rec.status)
+	})
+}
+
+// settings returns the current runtime settings.
+func (a *AdminAPI) settings() adminSettings {
+	cache, limiting := a.server.cacheEnabled.Load(), a.server.rateLimitEnabled.Load()
+	settings := adminSettings{CacheEnabled: &cache, RateLimitEnabled: &limiting}
+	if configured, ok := a.server.rateLimits.Fallback().(configuredLimiter); ok {
+		settings.RateLimit = &configured.settings
+	}
+	if a.server.logLevel != nil {
+		level := strings.ToLower(a.server.logLevel.Level().String())
+		settings.LogLevel = &level
+	}
+	return settings
+}
+
+// getSettings handles the GET /admin/settings endpoint.
+func (a *AdminAPI) getSettings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.settings())
+}
+
+// updateSettings handles the PATCH /admin/settings endpoint. The change is
+// validated as a whole before any setting is applied.
+func (a *AdminAPI) updateSettings(w http.ResponseWriter, r *http.Request) {
+	var change adminSettings
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var level slog.Level
+	if change.LogLevel != nil {
+		if a.server.logLevel == nil {
+			http.Error(w, "The log level cannot be changed", http.StatusBadRequest)
+			return
+		}
+		if err := level.UnmarshalText([]byte(*change.LogLevel)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var limiter Limiter
+	if change.RateLimit != nil {
+		var err error
+		if limiter, err = change.RateLimit.limiter(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s := a.server
+	if change.CacheEnabled != nil {
+		previous := s.cacheEnabled.Swap(*change.CacheEnabled)
+		if previous && !*change.CacheEnabled {
+			// The responses are of no use while the cache is off.
+			s.cache.Purge()
+		}
+		a.audit.Info("Admin changed a setting", "setting", "cache_enabled", "from", previous, "to", *change.CacheEnabled)
+	}
+	if change.RateLimitEnabled != nil {
+		previous := s.rateLimitEnabled.Swap(*change.RateLimitEnabled)
+		a.audit.Info("Admin changed a setting", "setting", "rate_limit_enabled", "from", previous, "to", *change.RateLimitEnabled)
+	}
+	if change.RateLimit != nil {
+		previous := s.rateLimits.SetFallback(limiter)
+		if configured, ok := previous.(configuredLimiter); ok {
+			a.audit.Info("Admin changed a setting", "setting", "rate_limit", "from", configured.settings, "to", *change.RateLimit)
+		} else {
+			a.audit.Info("Admin changed a setting", "setting", "rate_limit", "to", *change.RateLimit)
+		}
+	}
+	if change.LogLevel != nil {
+		previous := s.logLevel.Level()
+		s.logLevel.Set(level)
+		a.audit.Info("Admin changed a setting", "setting", "log_level", "from", previous, "to", level)
+	}
+	writeJSON(w, http.StatusOK, a.settings())
+}
+
+// listCache handles the GET /admin/cache endpoint, listing the cached
+// responses whose keys start with the prefix query parameter.
+func (a *AdminAPI) listCache(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.server.cache.Entries(r.URL.Query().Get("prefix")))
+}
+
+// flushCache handles the DELETE /admin/cache endpoint. It drops the cached
+// responses whose keys start with the prefix query parameter, or all of
+// them, on every instance.
+func (a *AdminAPI) flushCache(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	a.server.invalidator.Invalidate(prefix)
+	a.audit.Info("Admin flushed the response cache", "prefix", prefix)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stats handles the GET /admin/stats endpoint with statistics of the Go
+// runtime and of the service.
+func (a *AdminAPI) stats(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"uptime_seconds":         a.server.now().Sub(a.started).Seconds(),
+		"go_version":             runtime.Version(),
+		"gomaxprocs":             runtime.GOMAXPROCS(0),
+		"goroutines":             runtime.NumGoroutine(),
+		"heap_alloc_bytes":       mem.HeapAlloc,
+		"heap_objects":           mem.HeapObjects,
+		"sys_bytes":              mem.Sys,
+		"gc_cycles":              mem.NumGC,
+		"gc_pause_total_seconds": time.Duration(mem.PauseTotalNs).Seconds(),
+		"cache_entries":          len(a.server.cache.Entries("")),
+	})
+}
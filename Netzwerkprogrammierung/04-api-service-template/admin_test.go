@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupAdmin returns a server serving the admin API with the token "secret"
+// and the buffer its audit log is written to.
+func setupAdmin(t *testing.T) (*Server, *bytes.Buffer) {
+	var audit bytes.Buffer
+	limiter, err := RateLimitSettings{Algorithm: "token-bucket", Limit: 1, Window: "1s", Burst: 3}.limiter()
+	assert.NoError(t, err)
+	server := NewServer(
+		WithAdmin("secret", slog.New(slog.NewTextHandler(&audit, nil))),
+		WithLogger(slog.Default(), new(slog.LevelVar)),
+		WithLimiter(limiter, false),
+		WithCache(NewResponseCache(time.Minute, time.Second, 1<<20, 4), false),
+	)
+	return server, &audit
+}
+
+func adminRequest(r http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	// Setup
+	r, audit := setupAdmin(t)
+	missing := httptest.NewRequest("GET", "/admin/settings", nil)
+	wrong := httptest.NewRequest("GET", "/admin/settings", nil)
+	wrong.Header.Set("Authorization", "Bearer guess")
+
+	// Execute
+	missingRR := httptest.NewRecorder()
+	r.ServeHTTP(missingRR, missing)
+	wrongRR := httptest.NewRecorder()
+	r.ServeHTTP(wrongRR, wrong)
+
+	// Validate
+	assert.Equal(t, http.StatusUnauthorized, missingRR.Code)
+	assert.Equal(t, http.StatusUnauthorized, wrongRR.Code)
+	assert.Equal(t, "no-store", wrongRR.Header().Get("Cache-Control"))
+	assert.Equal(t, 2, strings.Count(audit.String(), "Rejected admin request"))
+}
+
+func TestAdminUpdateSettings(t *testing.T) {
+	// Setup
+	r, audit := setupAdmin(t)
+	r.cacheEnabled.Store(true)
+
+	// Execute
+	rr := adminRequest(r, "PATCH", "/admin/settings",
+		`{"cache_enabled":false,"rate_limit_enabled":true,"rate_limit":{"algorithm":"gcra","limit":10,"window":"1m","burst":2},"log_level":"debug"}`)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var settings adminSettings
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &settings))
+	assert.False(t, *settings.CacheEnabled)
+	assert.True(t, *settings.RateLimitEnabled)
+	assert.Equal(t, RateLimitSettings{Algorithm: "gcra", Limit: 10, Window: "1m", Burst: 2}, *settings.RateLimit)
+	assert.Equal(t, "debug", *settings.LogLevel)
+	assert.False(t, r.cacheEnabled.Load())
+	assert.True(t, r.rateLimitEnabled.Load())
+	assert.Equal(t, slog.LevelDebug, r.logLevel.Level())
+	assert.IsType(t, &GCRALimiter{}, r.rateLimits.Fallback().(configuredLimiter).Limiter)
+	for _, setting := range []string{"cache_enabled", "rate_limit_enabled", "rate_limit", "log_level"} {
+		assert.Contains(t, audit.String(), "setting="+setting)
+	}
+	assert.Contains(t, audit.String(), "method=PATCH path=/admin/settings")
+}
+
+func TestAdminUpdateSettingsValidatesFirst(t *testing.T) {
+	// Setup
+	r, _ := setupAdmin(t)
+	r.cacheEnabled.Store(true)
+
+	// Execute
+	badLevel := adminRequest(r, "PATCH", "/admin/settings", `{"cache_enabled":false,"log_level":"loud"}`)
+	badLimit := adminRequest(r, "PATCH", "/admin/settings", `{"cache_enabled":false,"rate_limit":{"algorithm":"gcra","limit":0,"window":"1s"}}`)
+	badWindow := adminRequest(r, "PATCH", "/admin/settings", `{"cache_enabled":false,"rate_limit":{"limit":1,"window":"soon"}}`)
+
+	// Validate
+	assert.Equal(t, http.StatusBadRequest, badLevel.Code)
+	assert.Equal(t, http.StatusBadRequest, badLimit.Code)
+	assert.Equal(t, http.StatusBadRequest, badWindow.Code)
+	assert.True(t, r.cacheEnabled.Load(), "nothing is applied from an invalid change")
+}
+
+func TestAdminCache(t *testing.T) {
+	// Setup
+	r, audit := setupAdmin(t)
+	get := func(path string) {
+		req := httptest.NewRequest("GET", path, nil)
+		r.cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("users"))
+		})).ServeHTTP(httptest.NewRecorder(), req)
+	}
+	get("/v1/users/1")
+	get("/v1/users/2")
+	get("/v1/webhooks")
+	prefix := url.QueryEscape(cachePrefix(context.Background(), "/v1/users"))
+
+	// Execute
+	list := adminRequest(r, "GET", "/admin/cache?prefix="+prefix, "")
+	flush := adminRequest(r, "DELETE", "/admin/cache?prefix="+prefix, "")
+	after := adminRequest(r, "GET", "/admin/cache", "")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, list.Code)
+	var entries []CachedEntry
+	assert.NoError(t, json.Unmarshal(list.Body.Bytes(), &entries))
+	if assert.Len(t, entries, 2) {
+		assert.Contains(t, entries[0].Key, "/v1/users/1")
+		assert.Equal(t, http.StatusOK, entries[0].Status)
+		assert.Equal(t, 5, entries[0].Size)
+		assert.Equal(t, 60.0, entries[0].TTLSeconds)
+		assert.False(t, entries[0].Stale)
+	}
+	assert.Equal(t, http.StatusNoContent, flush.Code)
+	assert.NoError(t, json.Unmarshal(after.Body.Bytes(), &entries))
+	if assert.Len(t, entries, 1) {
+		assert.Contains(t, entries[0].Key, "/v1/webhooks")
+	}
+	assert.Contains(t, audit.String(), "Admin flushed the response cache")
+}
+
+func TestAdminStatsAndProfiles(t *testing.T) {
+	// Setup
+	r, audit := setupAdmin(t)
+
+	// Execute
+	stats := adminRequest(r, "GET", "/admin/stats", "")
+	index := adminRequest(r, "GET", "/admin/debug/pprof/", "")
+	goroutines := adminRequest(r, "GET", "/admin/debug/pprof/goroutine?debug=1", "")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, stats.Code)
+	var body map[string]any
+	assert.NoError(t, json.Unmarshal(stats.Body.Bytes(), &body))
+	assert.Greater(t, body["goroutines"], 0.0)
+	assert.Contains(t, body, "heap_alloc_bytes")
+	assert.Equal(t, http.StatusOK, index.Code)
+	assert.Contains(t, index.Body.String(), "goroutine")
+	assert.Equal(t, http.StatusOK, goroutines.Code)
+	assert.Contains(t, goroutines.Body.String(), "goroutine profile")
+	assert.Contains(t, audit.String(), "path=/admin/debug/pprof/goroutine")
+}
+
+func TestToggledMiddleware(t *testing.T) {
+	// Setup
+	var enabled atomic.Bool
+	blocking := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+	}
+	handler := toggled(&enabled, blocking)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func() int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		return rr.Code
+	}
+
+	// Execute and validate
+	assert.Equal(t, http.StatusOK, serve())
+	enabled.Store(true)
+	assert.Equal(t, http.StatusTeapot, serve())
+	enabled.Store(false)
+	assert.Equal(t, http.StatusOK, serve())
+}
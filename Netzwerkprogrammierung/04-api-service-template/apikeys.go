@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API keys have the form sk_<id>_<secret>. The id is stored in clear text
+// to look the key up; only a salted hash of the secret is stored, so a key
+// is shown once, when it is created or rotated.
+const (
+	apiKeyPrefix   = "sk_"
+	apiKeyIDLength = 12 // hex characters
+	apiKeyScheme   = "ApiKey "
+)
+
+// apiKeyTouchInterval limits how often the last use of a key is written.
+const apiKeyTouchInterval = time.Minute
+
+// ErrAPIKeyNotFound is returned by an APIKeyStore when no key has the
+// requested id.
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKey is the metadata of an API key. Scopes are the permissions the key
+// grants; they apply whether or not role-based access control is enabled.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Tenant     string     `json:"-"`
+	Salt       []byte     `json:"-"`
+	Hash       []byte     `json:"-"`
+}
+
+// expired reports whether the key can no longer be used at now.
+func (k APIKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// newAPIKeySecret returns a random secret with its salt and hash.
+func newAPIKeySecret() (secret string, salt, hash []byte) {
+	raw := make([]byte, 32)
+	salt = make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		panic(err)
+	}
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	secret = base64.RawURLEncoding.EncodeToString(raw)
+	return secret, salt, hashAPIKeySecret(salt, secret)
+}
+
+// hashAPIKeySecret hashes secret with salt. Secrets are 256 random bits, so
+// a fast hash is enough; the salt keeps equal hashes from revealing reuse.
+func hashAPIKeySecret(salt []byte, secret string) []byte {
+	hash := sha256.New()
+	hash.Write(salt)
+	hash.Write([]byte(secret))
+	return hash.Sum(nil)
+}
+
+// formatAPIKey returns the key handed to the client.
+func formatAPIKey(id, secret string) string {
+	return apiKeyPrefix + id + "_" + secret
+}
+
+// parseAPIKey splits a key into its id and secret.
+func parseAPIKey(key string) (id, secret string, ok bool) {
+	rest, found := strings.CutPrefix(key, apiKeyPrefix)
+	if !found || len(rest) < apiKeyIDLength+2 || rest[apiKeyIDLength] != '_' {
+		return "", "", false
+	}
+	return rest[:apiKeyIDLength], rest[apiKeyIDLength+1:], true
+}
+
+// APIKeyStore persists API keys. Lookup by id spans all tenants, since the
+// tenant of a request is only known once its key is; the other methods are
+// limited to the tenant of ctx.
+type APIKeyStore interface {
+	// LookupKey returns the key with the given id in any tenant.
+	LookupKey(ctx context.Context, id string) (APIKey, error)
+	// ListKeys returns the keys of the tenant, newest first.
+	ListKeys(ctx context.Context) ([]APIKey, error)
+	// CreateKey stores a new key.
+	CreateKey(ctx context.Context, key APIKey) error
+	// RotateKey replaces the salt and hash of a key.
+	RotateKey(ctx context.Context, id string, salt, hash []byte) error
+	// DeleteKey removes a key.
+	DeleteKey(ctx context.Context, id string) error
+	// TouchKey records a use of a key.
+	TouchKey(ctx context.Context, id string, at time.Time) error
+}
+
+// authenticateAPIKey returns the key matching the presented key, or an
+// error if it is unknown, wrong or expired.
+func (s *Server) authenticateAPIKey(ctx context.Context, presented string, now time.Time) (APIKey, error) {
+	id, secret, ok := parseAPIKey(presented)
+	if !ok {
+		return APIKey{}, ErrInvalidToken
+	}
+	key, err := s.apiKeys.LookupKey(ctx, id)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return APIKey{}, ErrInvalidToken
+	} else if err != nil {
+		return APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare(hashAPIKeySecret(key.Salt, secret), key.Hash) != 1 || key.expired(now) {
+		return APIKey{}, ErrInvalidToken
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.apiKeys.TouchKey(ctx, key.ID, now); err != nil {
+			s.logger.Warn("Failed to record the use of an API key", "key", key.ID, "error", err)
+		}
+	}
+	return key, nil
+}
+
+// apiKeyMiddleware authenticates requests carrying an
+// "Authorization: ApiKey ..." header. The key becomes the principal of the
+// request, limited to its scopes. Other requests pass through unchanged.
+func (s *Server) apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, found := strings.CutPrefix(r.Header.Get("Authorization"), apiKeyScheme)
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := s.authenticateAPIKey(r.Context(), strings.TrimSpace(presented), s.now())
+		if errors.Is(err, ErrInvalidToken) {
+			w.Header().Set("WWW-Authenticate", `ApiKey error="invalid_key"`)
+			writeProblem(w, problem{Type: problemBaseURI + "invalid-api-key", Title: "Invalid API key", Status: http.StatusUnauthorized,
+				Detail: "The API key is unknown, revoked or expired.", Instance: r.URL.Path})
+			return
+		} else if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+
+		p := &Principal{Subject: "apikey:" + key.ID, Tenant: key.Tenant, APIKey: key.ID, permissions: make(map[string]bool)}
+		for _, scope := range key.Scopes {
+			p.permissions[scope] = true
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+// apiKeyRequest is the body of POST /v1/api-keys.
+type apiKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// issuedAPIKey is the response carrying a new secret. It is the only time
+// the key is shown.
+type issuedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// keyIssuer returns the principal asking for a key secret. Anonymous
+// callers, which without access control may do anything, are refused with
+// 401 so that they cannot mint keys for themselves. Without access control
+// operators issue keys through the admin API instead.
+func keyIssuer(w http.ResponseWriter, r *http.Request) *Principal {
+	p := principalFrom(r.Context())
+	if p == nil {
+		writeProblem(w, problem{Type: problemBaseURI + "unauthenticated", Title: "Authentication required", Status: http.StatusUnauthorized,
+			Detail: "API keys can only be issued to authenticated callers.", Instance: r.URL.Path})
+	}
+	return p
+}
+
+// createAPIKey handles the POST /v1/api-keys endpoint. The scopes of the key
+// must be permissions the caller holds itself.
+func (s *Server) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	issuer := keyIssuer(w, r)
+	if issuer == nil {
+		return
+	}
+	s.issueAPIKey(w, r, tenantOrDefault(r.Context()), issuer.Subject, func(scope string) error {
+		return authorize(r.Context(), scope)
+	})
+}
+
+// createAPIKey handles the POST /admin/api-keys/{tenant} endpoint. Operators
+// may grant any scope, so that the first keys of a tenant can be issued
+// also where access control is off and nobody can issue them through the v1
+// API.
+func (a *AdminAPI) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	a.server.issueAPIKey(w, r, mux.Vars(r)["tenant"], "admin", func(string) error { return nil })
+}
+
+// issueAPIKey creates a key of tenant as requested by the body of r and
+// answers with its secret. authorizeScope reports whether the issuer may
+// grant a scope.
+func (s *Server) issueAPIKey(w http.ResponseWriter, r *http.Request, tenant, issuer string, authorizeScope func(scope string) error) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" || len(req.Name) > maxNameLength {
+		http.Error(w, fmt.Sprintf("name is required and may not exceed %d characters", maxNameLength), http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "at least one scope is required", http.StatusBadRequest)
+		return
+	}
+	now := s.now().UTC()
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !knownPermission(scope) {
+			http.Error(w, fmt.Sprintf("unknown scope %q", scope), http.StatusBadRequest)
+			return
+		}
+		if err := authorizeScope(scope); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+
+	secret, salt, hash := newAPIKeySecret()
+	key := APIKey{
+		ID:        randomHex(apiKeyIDLength / 2),
+		Name:      req.Name,
+		Scopes:    dedupe(req.Scopes),
+		CreatedAt: now.Truncate(time.Second),
+		ExpiresAt: req.ExpiresAt,
+		Tenant:    tenant,
+		CreatedBy: issuer,
+		Salt:      salt,
+		Hash:      hash,
+	}
+	if err := s.apiKeys.CreateKey(r.Context(), key); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Location", "/v1/api-keys/"+key.ID)
+	writeJSON(w, http.StatusCreated, issuedAPIKey{APIKey: key, Key: formatAPIKey(key.ID, secret)})
+}
+
+// listAPIKeys handles the GET /v1/api-keys endpoint.
+func (s *Server) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.apiKeys.ListKeys(r.Context())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// tenantAPIKey returns the key with the id of the route if it belongs to the
+// tenant of the request.
+func (s *Server) tenantAPIKey(r *http.Request) (APIKey, error) {
+	key, err := s.apiKeys.LookupKey(r.Context(), mux.Vars(r)["id"])
+	if err == nil && key.Tenant != tenantOrDefault(r.Context()) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+// getAPIKey handles the GET /v1/api-keys/{id} endpoint.
+func (s *Server) getAPIKey(w http.ResponseWriter, r *http.Request) {
+	key, err := s.tenantAPIKey(r)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, key)
+}
+
+// rotateAPIKey handles the POST /v1/api-keys/{id}/rotate endpoint. The key
+// keeps its id, scopes and expiry and gets a new secret; the old secret
+// stops working immediately.
+func (s *Server) rotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if keyIssuer(w, r) == nil {
+		return
+	}
+	key, err := s.tenantAPIKey(r)
+	if err == nil {
+		secret, salt, hash := newAPIKeySecret()
+		if err = s.apiKeys.RotateKey(r.Context(), key.ID, salt, hash); err == nil {
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, http.StatusOK, issuedAPIKey{APIKey: key, Key: formatAPIKey(key.ID, secret)})
+			return
+		}
+	}
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	writeStoreError(w, err)
+}
+
+// revokeAPIKey handles the DELETE /v1/api-keys/{id} endpoint.
+func (s *Server) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	key, err := s.tenantAPIKey(r)
+	if err == nil {
+		err = s.apiKeys.DeleteKey(r.Context(), key.ID)
+	}
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// knownPermission reports whether some role grants permission.
+func knownPermission(permission string) bool {
+	for _, permissions := range rolePermissions {
+		for _, granted := range permissions {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dedupe returns the distinct values of s in ascending order.
+func dedupe(s []string) []string {
+	seen := make(map[string]bool, len(s))
+	var distinct []string
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			distinct = append(distinct, v)
+		}
+	}
+	sort.Strings(distinct)
+	return distinct
+}
+
+// sqlAPIKeyStore is an APIKeyStore backed by the api_keys table.
+type sqlAPIKeyStore struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+}
+
+// newSQLAPIKeyStore returns an APIKeyStore using the given database handle.
+func newSQLAPIKeyStore(db *sql.DB) *sqlAPIKeyStore {
+	return &sqlAPIKeyStore{db: db, queryTimeout: 5 * time.Second}
+}
+
+const apiKeyColumns = "id, tenant_id, name, scopes, salt, hash, COALESCE(created_by, ''), created_at, expires_at, last_used_at"
+
+// scanAPIKey reads a row selected with apiKeyColumns.
+func scanAPIKey(scan func(dest ...any) error) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+	err := scan(&key.ID, &key.Tenant, &key.Name, &scopes, &key.Salt, &key.Hash, &key.CreatedBy, &key.CreatedAt, &expiresAt, &lastUsedAt)
+	key.Scopes = strings.Fields(scopes)
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	return key, err
+}
+
+func (s *sqlAPIKeyStore) LookupKey(ctx context.Context, id string) (APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	key, err := scanAPIKey(s.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = $1", id).Scan)
+	if err == sql.ErrNoRows {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, classify(ctx, err)
+}
+
+func (s *sqlAPIKeyStore) ListKeys(ctx context.Context) ([]APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE tenant_id = $1 ORDER BY created_at DESC, id", tenantOrDefault(ctx))
+	if err != nil {
+		return nil, classify(ctx, err)
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows.Scan)
+		if err != nil {
+			return nil, classify(ctx, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, classify(ctx, rows.Err())
+}
+
+func (s *sqlAPIKeyStore) CreateKey(ctx context.Context, key APIKey) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO api_keys (id, tenant_id, name, scopes, salt, hash, created_by, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9)",
+		key.ID, key.Tenant, key.Name, strings.Join(key.Scopes, " "), key.Salt, key.Hash, key.CreatedBy, key.CreatedAt, key.ExpiresAt)
+	return classify(ctx, err)
+}
+
+func (s *sqlAPIKeyStore) RotateKey(ctx context.Context, id string, salt, hash []byte) error {
+	return s.exec(ctx, "UPDATE api_keys SET salt = $1, hash = $2 WHERE id = $3", salt, hash, id)
+}
+
+func (s *sqlAPIKeyStore) DeleteKey(ctx context.Context, id string) error {
+	return s.exec(ctx, "DELETE FROM api_keys WHERE id = $1", id)
+}
+
+func (s *sqlAPIKeyStore) TouchKey(ctx context.Context, id string, at time.Time) error {
+	return s.exec(ctx, "UPDATE api_keys SET last_used_at = $1 WHERE id = $2", at, id)
+}
+
+// exec runs a statement changing a single key.
+func (s *sqlAPIKeyStore) exec(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return classify(ctx, err)
+	}
+	if requireAffected(result) != nil {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// memoryAPIKeyStore is an APIKeyStore kept in process memory.
+type memoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+// newMemoryAPIKeyStore returns an empty in-memory APIKeyStore.
+func newMemoryAPIKeyStore() *memoryAPIKeyStore {
+	return &memoryAPIKeyStore{keys: make(map[string]APIKey)}
+}
+
+func (s *memoryAPIKeyStore) LookupKey(ctx context.Context, id string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, found := s.keys[id]
+	if !found {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *memoryAPIKeyStore) ListKeys(ctx context.Context) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenant := tenantOrDefault(ctx)
+	var keys []APIKey
+	for _, key := range s.keys {
+		if key.Tenant == tenant {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.After(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+func (s *memoryAPIKeyStore) CreateKey(ctx context.Context, key APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *memoryAPIKeyStore) RotateKey(ctx context.Context, id string, salt, hash []byte) error {
+	return s.update(id, func(key *APIKey) { key.Salt, key.Hash = salt, hash })
+}
+
+func (s *memoryAPIKeyStore) DeleteKey(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.keys[id]; !found {
+		return ErrAPIKeyNotFound
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+func (s *memoryAPIKeyStore) TouchKey(ctx context.Context, id string, at time.Time) error {
+	return s.update(id, func(key *APIKey) { key.LastUsedAt = &at })
+}
+
+// update applies fn to the key with the given id.
+func (s *memoryAPIKeyStore) update(id string, fn func(key *APIKey)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, found := s.keys[id]
+	if !found {
+		return ErrAPIKeyNotFound
+	}
+	fn(&key)
+	s.keys[id] = key
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	// Setup
+	router := NewServer(WithAccessControl(testJWTSecret, []string{"root"}))
+	rootToken := "Bearer " + testToken(t, map[string]any{"sub": "root", "exp": time.Now().Add(time.Hour).Unix()})
+	serve := func(method, path, authorization, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Execute
+	created := serve("POST", "/v1/api-keys", rootToken, `{"name":"ci","scopes":["users:read","users:read"]}`)
+	var issued issuedAPIKey
+	assert.NoError(t, json.Unmarshal(created.Body.Bytes(), &issued))
+	keyAuth := "ApiKey " + issued.Key
+	read := serve("GET", "/v1/users", keyAuth, "")
+	write := serve("POST", "/v1/users", keyAuth, `{"name":"Bob"}`)
+	listed := serve("GET", "/v1/api-keys", rootToken, "")
+	rotated := serve("POST", "/v1/api-keys/"+issued.ID+"/rotate", rootToken, "")
+	var reissued issuedAPIKey
+	assert.NoError(t, json.Unmarshal(rotated.Body.Bytes(), &reissued))
+	oldSecret := serve("GET", "/v1/users", keyAuth, "")
+	newSecret := serve("GET", "/v1/users", "ApiKey "+reissued.Key, "")
+	revoked := serve("DELETE", "/v1/api-keys/"+issued.ID, rootToken, "")
+	afterRevoke := serve("GET", "/v1/users", "ApiKey "+reissued.Key, "")
+	missing := serve("GET", "/v1/api-keys/"+issued.ID, rootToken, "")
+
+	// Validate
+	assert.Equal(t, http.StatusCreated, created.Code)
+	assert.Equal(t, "no-store", created.Header().Get("Cache-Control"))
+	assert.Equal(t, "/v1/api-keys/"+issued.ID, created.Header().Get("Location"))
+	assert.True(t, strings.HasPrefix(issued.Key, apiKeyPrefix+issued.ID+"_"))
+	assert.Equal(t, []string{permUsersRead}, issued.Scopes)
+	assert.Equal(t, "root", issued.CreatedBy)
+
+	assert.Equal(t, http.StatusOK, read.Code)
+	assert.Equal(t, http.StatusForbidden, write.Code, "the key is limited to its scopes")
+
+	assert.Equal(t, http.StatusOK, listed.Code)
+	assert.NotContains(t, listed.Body.String(), issued.Key, "secrets are shown once")
+	var keys []APIKey
+	assert.NoError(t, json.Unmarshal(listed.Body.Bytes(), &keys))
+	if assert.Len(t, keys, 1) {
+		assert.NotNil(t, keys[0].LastUsedAt)
+	}
+
+	assert.Equal(t, http.StatusOK, rotated.Code)
+	assert.Equal(t, issued.ID, reissued.ID)
+	assert.NotEqual(t, issued.Key, reissued.Key)
+	assert.Equal(t, http.StatusUnauthorized, oldSecret.Code)
+	assert.Equal(t, http.StatusOK, newSecret.Code)
+	assert.Equal(t, http.StatusNoContent, revoked.Code)
+	assert.Equal(t, http.StatusUnauthorized, afterRevoke.Code)
+	assert.Equal(t, http.StatusNotFound, missing.Code)
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	// Setup
+	server := NewServer()
+	editor := withPrincipal(context.Background(), &Principal{Subject: "alice", permissions: map[string]bool{permUsersRead: true, permUsersWrite: true}})
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"name":"","scopes":["users:read"]}`, http.StatusBadRequest},
+		{`{"name":"ci","scopes":[]}`, http.StatusBadRequest},
+		{`{"name":"ci","scopes":["users:everything"]}`, http.StatusBadRequest},
+		{`{"name":"ci","scopes":["users:read"],"expires_at":"2000-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{`{"name":"ci","scopes":["users:admin"]}`, http.StatusForbidden},
+		{`{"name":"ci","scopes":["users:write"]}`, http.StatusCreated},
+	}
+
+	for _, test := range tests {
+		// Execute
+		req := httptest.NewRequest("POST", "/v1/api-keys", strings.NewReader(test.body)).WithContext(editor)
+		rr := httptest.NewRecorder()
+		server.createAPIKey(rr, req)
+
+		// Validate
+		assert.Equal(t, test.code, rr.Code, test.body)
+	}
+}
+
+func TestAPIKeysRequireAnAuthenticatedCaller(t *testing.T) {
+	// Setup
+	router := NewServer()
+	key := APIKey{ID: "0123456789abcdef", Name: "ci", Scopes: []string{permUsersRead}, Tenant: defaultTenant}
+	assert.NoError(t, router.apiKeys.CreateKey(context.Background(), key))
+
+	// Execute
+	created := httptest.NewRecorder()
+	router.ServeHTTP(created, httptest.NewRequest("POST", "/v1/api-keys", strings.NewReader(`{"name":"mine","scopes":["users:admin"]}`)))
+	rotated := httptest.NewRecorder()
+	router.ServeHTTP(rotated, httptest.NewRequest("POST", "/v1/api-keys/"+key.ID+"/rotate", nil))
+
+	// Validate
+	assert.Equal(t, http.StatusUnauthorized, created.Code, "without access control callers are anonymous")
+	assert.Contains(t, created.Body.String(), problemBaseURI+"unauthenticated")
+	assert.Equal(t, http.StatusUnauthorized, rotated.Code)
+	keys, err := router.apiKeys.ListKeys(context.Background())
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 1, "no key was created") {
+		assert.Equal(t, key.Hash, keys[0].Hash, "the secret was not rotated")
+	}
+}
+
+func TestAdminAPIIssuesKeysWithoutAccessControl(t *testing.T) {
+	// Setup
+	router := NewServer(WithAdmin("secret", nil))
+	send := func(method, target, authorization, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", authorization)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Execute
+	anonymous := send("POST", "/admin/api-keys/acme", "", `{"name":"ci","scopes":["users:read"]}`)
+	created := send("POST", "/admin/api-keys/acme", "Bearer secret", `{"name":"ci","scopes":["users:read"]}`)
+	var issued issuedAPIKey
+	json.Unmarshal(created.Body.Bytes(), &issued)
+	invalid := send("POST", "/admin/api-keys/acme", "Bearer secret", `{"name":"ci","scopes":["users:own"]}`)
+	used := send("GET", "/v1/users", "ApiKey "+issued.Key, "")
+	stored, err := router.apiKeys.LookupKey(context.Background(), issued.ID)
+	assert.NoError(t, err)
+
+	// Validate
+	assert.Equal(t, http.StatusUnauthorized, anonymous.Code)
+	assert.Equal(t, http.StatusCreated, created.Code)
+	assert.Equal(t, "acme", stored.Tenant)
+	assert.Equal(t, "admin", issued.CreatedBy)
+	assert.Equal(t, http.StatusBadRequest, invalid.Code, "operators may only grant known scopes")
+	assert.Equal(t, http.StatusOK, used.Code)
+}
+
+func TestAPIKeyMiddlewareRejectsInvalidKeys(t *testing.T) {
+	// Setup
+	server := NewServer()
+	secret, salt, hash := newAPIKeySecret()
+	expiredAt := time.Now().Add(-time.Minute)
+	assert.NoError(t, server.apiKeys.CreateKey(context.Background(), APIKey{ID: "0123456789ab", Name: "old", Scopes: []string{permUsersRead},
+		Tenant: defaultTenant, Salt: salt, Hash: hash, ExpiresAt: &expiredAt}))
+	handler := server.apiKeyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/users", nil)
+		req.Header.Set("Authorization", authorization)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Execute
+	expired := serve("ApiKey " + formatAPIKey("0123456789ab", secret))
+	unknown := serve("ApiKey " + formatAPIKey("ba9876543210", secret))
+	malformed := serve("ApiKey not-a-key")
+	bearer := serve("Bearer token")
+
+	// Validate
+	assert.Equal(t, http.StatusUnauthorized, expired.Code)
+	assert.Equal(t, "application/problem+json", expired.Header().Get("Content-Type"))
+	assert.Equal(t, http.StatusUnauthorized, unknown.Code)
+	assert.Equal(t, http.StatusUnauthorized, malformed.Code)
+	assert.Equal(t, http.StatusOK, bearer.Code, "other schemes are left to the authenticator")
+}
+
+func TestSQLAPIKeyStore(t *testing.T) {
+	// Setup
+	storeDB, storeMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer storeDB.Close()
+	s := newSQLAPIKeyStore(storeDB)
+	ctx := withTenant(context.Background(), "acme")
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	columns := []string{"id", "tenant_id", "name", "scopes", "salt", "hash", "created_by", "created_at", "expires_at", "last_used_at"}
+
+	// Mock DB response
+	storeMock.ExpectQuery("SELECT id, tenant_id, name, scopes, salt, hash, COALESCE\\(created_by, ''\\), created_at, expires_at, last_used_at FROM api_keys WHERE id = \\$1").
+		WithArgs("0123456789ab").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("0123456789ab", "acme", "ci", "users:read users:write", []byte("salt"), []byte("hash"), "root", createdAt, nil, nil))
+	storeMock.ExpectQuery("SELECT .* FROM api_keys WHERE tenant_id = \\$1 ORDER BY created_at DESC, id").
+		WithArgs("acme").WillReturnRows(sqlmock.NewRows(columns))
+	storeMock.ExpectExec("INSERT INTO api_keys").
+		WithArgs("ba9876543210", "acme", "deploy", "users:read", []byte("salt"), []byte("hash"), "", createdAt, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectExec("UPDATE api_keys SET last_used_at = \\$1 WHERE id = \\$2").
+		WithArgs(createdAt, "0123456789ab").WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectExec("DELETE FROM api_keys WHERE id = \\$1").
+		WithArgs("ffffffffffff").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Execute
+	key, lookupErr := s.LookupKey(ctx, "0123456789ab")
+	keys, listErr := s.ListKeys(ctx)
+	createErr := s.CreateKey(ctx, APIKey{ID: "ba9876543210", Tenant: "acme", Name: "deploy", Scopes: []string{permUsersRead},
+		Salt: []byte("salt"), Hash: []byte("hash"), CreatedAt: createdAt})
+	touchErr := s.TouchKey(ctx, "0123456789ab", createdAt)
+	deleteErr := s.DeleteKey(ctx, "ffffffffffff")
+
+	// Validate
+	assert.NoError(t, lookupErr)
+	assert.Equal(t, []string{permUsersRead, permUsersWrite}, key.Scopes)
+	assert.Equal(t, "acme", key.Tenant)
+	assert.Nil(t, key.ExpiresAt)
+	assert.NoError(t, listErr)
+	assert.Empty(t, keys)
+	assert.NoError(t, createErr)
+	assert.NoError(t, touchErr)
+	assert.ErrorIs(t, deleteErr, ErrAPIKeyNotFound)
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
+
+func TestClientLimiterIsolatesClients(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewTokenBucketLimiter(1, time.Second, 2)
+	limiter.now = func() time.Time { return now }
+	allow := func(client string) bool {
+		allowed, _ := limiter.Allow(client)
+		return allowed
+	}
+
+	// Execute and validate
+	assert.True(t, allow("apikey:a"))
+	assert.True(t, allow("apikey:a"))
+	assert.False(t, allow("apikey:a"), "the burst of a is used up")
+	assert.True(t, allow("apikey:b"), "b has its own bucket")
+	now = now.Add(time.Second)
+	assert.True(t, allow("apikey:a"), "a regains a token per second")
+	now = now.Add(2 * time.Minute)
+	allow("apikey:b")
+	assert.Equal(t, 1, limiter.clients.len(), "idle clients are pruned")
+}
+
+func TestClientIdentity(t *testing.T) {
+	// Setup
+	anonymous := httptest.NewRequest("GET", "/v1/users", nil)
+	anonymous.RemoteAddr = "192.0.2.1:4321"
+	withKey := anonymous.WithContext(withPrincipal(context.Background(), &Principal{Subject: "apikey:0123456789ab", APIKey: "0123456789ab"}))
+	withToken := anonymous.WithContext(withPrincipal(context.Background(), &Principal{Subject: "alice", Tenant: "acme"}))
+
+	// Execute and validate
+	assert.Equal(t, "ip:192.0.2.1", clientIdentity(anonymous))
+	assert.Equal(t, "apikey:0123456789ab", clientIdentity(withKey))
+	assert.Equal(t, "subject:acme/alice", clientIdentity(withToken))
+}
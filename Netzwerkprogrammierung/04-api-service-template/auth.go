@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are hashed with bcrypt, which reads at most 72 bytes.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+	maxEmailLength    = 254
+)
+
+// userSubjectPrefix starts the subject of tokens issued to logged-in users,
+// followed by the user id. Roles are granted to that subject.
+const userSubjectPrefix = "user:"
+
+var (
+	// ErrCredentialsNotFound is returned by a CredentialStore when no user
+	// has the requested email.
+	ErrCredentialsNotFound = errors.New("credentials not found")
+	// ErrEmailTaken is returned by a CredentialStore when another user of
+	// the tenant already has the email.
+	ErrEmailTaken = errors.New("email already in use")
+)
+
+// Credentials are the email and password hash a user logs in with.
+type Credentials struct {
+	UserID       int
+	Email        string
+	PasswordHash string
+}
+
+// CredentialStore persists the credentials of users, limited to the tenant
+// of ctx. Credentials go away with their user.
+type CredentialStore interface {
+	// FindCredentials returns the credentials with the given email or
+	// ErrCredentialsNotFound.
+	FindCredentials(ctx context.Context, email string) (Credentials, error)
+	// SetCredentials replaces the email and password hash of a user. It
+	// returns ErrUserNotFound or ErrEmailTaken.
+	SetCredentials(ctx context.Context, credentials Credentials) error
+}
+
+// normalizeEmail returns email in the form it is stored in.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validateCredentials checks an email and password before they are stored.
+func validateCredentials(email, password string) error {
+	if address, err := mail.ParseAddress(email); err != nil || address.Address != email || len(email) > maxEmailLength {
+		return &ValidationError{Field: "email", Message: "email must be a valid email address"}
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return &ValidationError{Field: "password", Message: fmt.Sprintf("password must be between %d and %d bytes long", minPasswordLength, maxPasswordLength)}
+	}
+	return nil
+}
+
+// userSubject returns the token subject of the user with the given id.
+func userSubject(id int) string {
+	return userSubjectPrefix + strconv.Itoa(id)
+}
+
+// loginUser returns the id of the user p logged in as, if p authenticated
+// with an access token issued by the login endpoint.
+func loginUser(p *Principal) (int, bool) {
+	if p == nil || p.Session == "" {
+		return 0, false
+	}
+	rest, found := strings.CutPrefix(p.Subject, userSubjectPrefix)
+	if !found {
+		return 0, false
+	}
+	id, err := strconv.Atoi(rest)
+	return id, err == nil
+}
+
+// loginRequest is the body of POST /v1/auth/login. Challenge and nonce are
+// the proof of work suspicious sources must send.
+type loginRequest struct {
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	Challenge string `json:"challenge,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+}
+
+// refreshRequest is the body of POST /v1/auth/refresh and /v1/auth/logout.
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenResponse carries the tokens of a session. The refresh token is shown
+// once; refreshing replaces it.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	SessionID    string `json:"session_id"`
+}
+
+// writeInvalidCredentials answers a login that failed, without telling
+// whether the email or the password was wrong.
+func writeInvalidCredentials(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, problem{Type: problemBaseURI + "invalid-credentials", Title: "Invalid credentials", Status: http.StatusUnauthorized,
+		Detail: "The email or password is wrong.", Instance: r.URL.Path})
+}
+
+// writeInvalidRefreshToken answers a refresh with an unusable token.
+func writeInvalidRefreshToken(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, problem{Type: problemBaseURI + "invalid-refresh-token", Title: "Invalid refresh token", Status: http.StatusUnauthorized,
+		Detail: "The refresh token is unknown, expired, already used or its session was terminated.", Instance: r.URL.Path})
+}
+
+// login handles the POST /v1/auth/login endpoint. It starts a session and
+// returns an access token with a refresh token. Attempts are admitted by the
+// login guard before the password is checked and settled with it.
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	tenant, email, source := tenantOrDefault(ctx), normalizeEmail(req.Email), remoteIP(r)
+	wait, locked, err := s.loginGuard.Allow(ctx, tenant, email, source)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	} else if wait > 0 {
+		writeLoginThrottled(w, r, wait, locked)
+		return
+	}
+	suspicious, err := s.loginGuard.Suspicious(ctx, source)
+	solved := false
+	if err == nil && suspicious {
+		solved, err = s.loginGuard.VerifyChallenge(ctx, source, req.Challenge, req.Nonce)
+	}
+	if err != nil {
+		s.abandonLogin(ctx, tenant, email, source)
+		writeStoreError(w, err)
+		return
+	} else if suspicious && !solved {
+		s.abandonLogin(ctx, tenant, email, source)
+		s.writeChallengeRequired(w, r, source)
+		return
+	}
+
+	credentials, err := s.credentials.FindCredentials(ctx, email)
+	if errors.Is(err, ErrCredentialsNotFound) {
+		// Unknown emails take as long as wrong passwords, so that the
+		// response time does not reveal which emails exist.
+		bcrypt.CompareHashAndPassword(s.dummyPasswordHash, []byte(req.Password))
+		s.loginFailed(w, r, tenant, email, source)
+		return
+	} else if err != nil {
+		s.abandonLogin(ctx, tenant, email, source)
+		writeStoreError(w, err)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(credentials.PasswordHash), []byte(req.Password)) != nil {
+		s.loginFailed(w, r, tenant, email, source)
+		return
+	}
+	if err := s.loginGuard.Succeeded(ctx, tenant, email, source); err != nil {
+		s.logger.Warn("Failed to settle a login attempt", "tenant", tenant, "email", email, "error", err)
+	}
+
+	now := s.now().UTC().Truncate(time.Second)
+	secret, salt, hash := newAPIKeySecret()
+	session := Session{
+		ID:         randomHex(sessionIDLength / 2),
+		UserID:     credentials.UserID,
+		UserAgent:  truncate(r.UserAgent(), maxUserAgentLength),
+		ClientIP:   remoteIP(r),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(s.refreshTTL),
+		Tenant:     tenantOrDefault(r.Context()),
+		Salt:       salt,
+		Hash:       hash,
+	}
+	if err := s.sessions.CreateSession(r.Context(), session); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	s.logger.Info("User logged in", "user", session.UserID, "tenant", session.Tenant, "session", session.ID)
+	s.writeTokens(w, r, session, secret)
+}
+
+// abandonLogin settles a login attempt that ended before its password was
+// checked. Attempts that cannot be settled expire on their own.
+func (s *Server) abandonLogin(ctx context.Context, tenant, email, source string) {
+	if err := s.loginGuard.Abandoned(ctx, tenant, email, source); err != nil {
+		s.logger.Warn("Failed to settle a login attempt", "tenant", tenant, "email", email, "error", err)
+	}
+}
+
+// loginFailed records a failed login and answers it.
+func (s *Server) loginFailed(w http.ResponseWriter, r *http.Request, tenant, email, source string) {
+	accountLocked, sourceLocked, err := s.loginGuard.Failed(r.Context(), tenant, email, source)
+	if err != nil {
+		s.logger.Warn("Failed to record a failed login", "tenant", tenant, "email", email, "source", source, "error", err)
+	}
+	if accountLocked {
+		s.logger.Warn("Locked an account after failed logins", "tenant", tenant, "email", email, "source", source)
+	}
+	if sourceLocked {
+		s.logger.Warn("Locked a source after failed logins", "source", source)
+	}
+	writeInvalidCredentials(w, r)
+}
+
+// refreshSession handles the POST /v1/auth/refresh endpoint. Every refresh
+// token works once: it is exchanged for a new access token and a new
+// refresh token. Presenting the replaced refresh token again means it was
+// copied, so the session is terminated. Other tokens are merely refused,
+// since the session id in them is no secret.
+func (s *Server) refreshSession(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := s.now().UTC().Truncate(time.Second)
+	session, secret, err := s.presentedSession(r.Context(), req.RefreshToken)
+	if errors.Is(err, ErrSessionNotFound) {
+		writeInvalidRefreshToken(w, r)
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if subtle.ConstantTimeCompare(hashAPIKeySecret(session.Salt, secret), session.Hash) != 1 {
+		if session.PreviousHash != nil &&
+			subtle.ConstantTimeCompare(hashAPIKeySecret(session.PreviousSalt, secret), session.PreviousHash) == 1 {
+			s.logger.Warn("Refresh token reused, terminating the session", "user", session.UserID, "tenant", session.Tenant, "session", session.ID)
+			if err := s.sessions.DeleteSession(r.Context(), session.ID); err != nil && !errors.Is(err, ErrSessionNotFound) {
+				writeStoreError(w, err)
+				return
+			}
+		}
+		writeInvalidRefreshToken(w, r)
+		return
+	}
+	if session.expired(now) {
+		writeInvalidRefreshToken(w, r)
+		return
+	}
+
+	secret, salt, hash := newAPIKeySecret()
+	previous := session.Hash
+	session.Salt, session.Hash = salt, hash
+	session.LastUsedAt, session.ExpiresAt = now, now.Add(s.refreshTTL)
+	err = s.sessions.RotateSession(r.Context(), session.ID, previous, salt, hash, session.LastUsedAt, session.ExpiresAt)
+	if errors.Is(err, ErrSessionNotFound) {
+		// A concurrent refresh with the same token won.
+		writeInvalidRefreshToken(w, r)
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	s.writeTokens(w, r, session, secret)
+}
+
+// logout handles the POST /v1/auth/logout endpoint. It terminates the
+// session of the refresh token. Unknown tokens are accepted, so that a
+// client can always discard its tokens.
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session, secret, err := s.presentedSession(r.Context(), req.RefreshToken)
+	if err == nil && subtle.ConstantTimeCompare(hashAPIKeySecret(session.Salt, secret), session.Hash) == 1 {
+		err = s.sessions.DeleteSession(r.Context(), session.ID)
+		if err == nil {
+			s.logger.Info("User logged out", "user", session.UserID, "tenant", session.Tenant, "session", session.ID)
+		}
+	}
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// presentedSession returns the session of a refresh token in the tenant of
+// ctx and the secret of the token, or ErrSessionNotFound.
+func (s *Server) presentedSession(ctx context.Context, refreshToken string) (Session, string, error) {
+	id, secret, ok := parseRefreshToken(refreshToken)
+	if !ok {
+		return Session{}, "", ErrSessionNotFound
+	}
+	session, err := s.sessions.LookupSession(ctx, id)
+	return session, secret, err
+}
+
+// writeTokens answers with a new access token for session and its refresh
+// token.
+func (s *Server) writeTokens(w http.ResponseWriter, r *http.Request, session Session, secret string) {
+	now := s.now()
+	claims := jwtClaims{
+		Subject:   userSubject(session.UserID),
+		Tenant:    tenantFrom(r.Context()),
+		SessionID: session.ID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.accessTTL).Unix(),
+	}
+	token, err := signJWT(claims, s.jwtSecret)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, tokenResponse{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.accessTTL / time.Second),
+		RefreshToken: formatRefreshToken(session.ID, secret),
+		SessionID:    session.ID,
+	})
+}
+
+// credentialsRequest is the body of PUT /v1/users/{id}/credentials.
+type credentialsRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// setCredentials handles the PUT /v1/users/{id}/credentials endpoint. A new
+// password terminates all sessions of the user.
+func (s *Server) setCredentials(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	var req credentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Email = normalizeEmail(req.Email)
+	if err := validateCredentials(req.Email, req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), s.passwordCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = s.credentials.SetCredentials(r.Context(), Credentials{UserID: id, Email: req.Email, PasswordHash: string(hash)})
+	if err == nil {
+		err = s.sessions.DeleteUserSessions(r.Context(), id)
+	}
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		http.NotFound(w, r)
+	case errors.Is(err, ErrEmailTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		writeStoreError(w, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sqlCredentialStore is a CredentialStore backed by the email and
+// password_hash columns of the users table. Its statements are scoped to the
+// tenant like those of the user store.
+type sqlCredentialStore struct {
+	users *sqlStore
+}
+
+// newSQLCredentialStore returns a CredentialStore using the given database
+// handle.
+func newSQLCredentialStore(db *sql.DB) *sqlCredentialStore {
+	return &sqlCredentialStore{users: newSQLStore(db)}
+}
+
+func (s *sqlCredentialStore) FindCredentials(ctx context.Context, email string) (Credentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.users.queryTimeout)
+	defer cancel()
+
+	// Logins read from the primary, so that a new password works at once.
+	var credentials Credentials
+	err := s.users.scoped(ctx, s.users.db, func(q dbtx) error {
+		return q.QueryRowContext(ctx, "SELECT id, email, password_hash FROM users WHERE email = $1 AND password_hash IS NOT NULL", email).
+			Scan(&credentials.UserID, &credentials.Email, &credentials.PasswordHash)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return Credentials{}, ErrCredentialsNotFound
+	}
+	return credentials, classify(ctx, err)
+}
+
+func (s *sqlCredentialStore) SetCredentials(ctx context.Context, credentials Credentials) error {
+	return s.users.write(ctx, func(q dbtx) ([]UserEvent, error) {
+		result, err := q.ExecContext(ctx, "UPDATE users SET email = $1, password_hash = $2 WHERE id = $3",
+			credentials.Email, credentials.PasswordHash, credentials.UserID)
+		if uniqueViolation(err) {
+			return nil, ErrEmailTaken
+		} else if err != nil {
+			return nil, err
+		}
+		return nil, requireAffected(result)
+	})
+}
+
+// uniqueViolation reports whether err is a PostgreSQL unique violation.
+func uniqueViolation(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == "23505"
+}
+
+// memoryCredentialStore is a CredentialStore kept in process memory next to
+// a memory UserStore, which it asks whether users still exist.
+type memoryCredentialStore struct {
+	users UserStore
+
+	mu          sync.RWMutex
+	credentials map[tenantUser]Credentials
+}
+
+// tenantUser identifies a user across tenants.
+type tenantUser struct {
+	tenant string
+	id     int
+}
+
+// newMemoryCredentialStore returns an empty in-memory CredentialStore for
+// the users in users.
+func newMemoryCredentialStore(users UserStore) *memoryCredentialStore {
+	return &memoryCredentialStore{users: users, credentials: make(map[tenantUser]Credentials)}
+}
+
+func (s *memoryCredentialStore) FindCredentials(ctx context.Context, email string) (Credentials, error) {
+	s.mu.RLock()
+	credentials, found := s.find(tenantOrDefault(ctx), email)
+	s.mu.RUnlock()
+	if !found {
+		return Credentials{}, ErrCredentialsNotFound
+	}
+	exists, err := s.users.UserExists(ctx, credentials.UserID)
+	if err != nil {
+		return Credentials{}, err
+	} else if !exists {
+		return Credentials{}, ErrCredentialsNotFound
+	}
+	return credentials, nil
+}
+
+func (s *memoryCredentialStore) SetCredentials(ctx context.Context, credentials Credentials) error {
+	exists, err := s.users.UserExists(ctx, credentials.UserID)
+	if err != nil {
+		return err
+	} else if !exists {
+		return ErrUserNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tenant := tenantOrDefault(ctx)
+	if other, found := s.find(tenant, credentials.Email); found && other.UserID != credentials.UserID {
+		if exists, err := s.users.UserExists(ctx, other.UserID); err != nil {
+			return err
+		} else if exists {
+			return ErrEmailTaken
+		}
+		delete(s.credentials, tenantUser{tenant, other.UserID})
+	}
+	s.credentials[tenantUser{tenant, credentials.UserID}] = credentials
+	return nil
+}
+
+// find returns the credentials with email in tenant. The caller must hold
+// s.mu.
+func (s *memoryCredentialStore) find(tenant, email string) (Credentials, bool) {
+	for key, credentials := range s.credentials {
+		if key.tenant == tenant && credentials.Email == email {
+			return credentials, true
+		}
+	}
+	return Credentials{}, false
+}
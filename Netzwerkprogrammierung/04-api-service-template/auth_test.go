@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// loginServer is a server letting users log in, with helpers to call it as
+// the root admin or with an access token.
+type loginServer struct {
+	*Server
+	root string
+}
+
+// newLoginServer returns a server with access control and login, with the
+// user Alice (id 1) holding the viewer role and the password
+// "correct horse". With tenancy Alice belongs to the tenant acme, where
+// root is an admin too.
+func newLoginServer(t *testing.T, options ...Option) *loginServer {
+	t.Helper()
+	// The login guard only counts failures unless a test configures it, so
+	// that wrong passwords do not delay the logins after them.
+	options = append([]Option{WithAccessControl(testJWTSecret, []string{"root", "acme/root"}), WithLogin(time.Minute, time.Hour, bcrypt.MinCost),
+		WithLoginGuard(LoginGuardSettings{FailureWindow: time.Minute})}, options...)
+	s := &loginServer{Server: NewServer(options...)}
+	s.root = "Bearer " + testToken(t, map[string]any{"sub": "root", "tenant": "acme", "exp": time.Now().Add(24 * time.Hour).Unix()})
+	assert.Equal(t, http.StatusOK, s.serve("POST", "/v1/users", s.root, `{"name":"Alice"}`).Code)
+	assert.Equal(t, http.StatusNoContent, s.serve("PUT", "/v1/users/1/credentials", s.root, `{"email":"alice@example.com","password":"correct horse"}`).Code)
+	assert.Equal(t, http.StatusCreated, s.serve("PUT", "/v1/admin/principals/user:1/roles/viewer", s.root, "").Code)
+	return s
+}
+
+// serve sends a request with the given Authorization header.
+func (s *loginServer) serve(method, target, authorization, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("User-Agent", "test-client/1.0")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	return rr
+}
+
+// login logs in with password and returns the issued tokens.
+func (s *loginServer) login(password string) (tokenResponse, *httptest.ResponseRecorder) {
+	rr := s.serve("POST", "/v1/auth/login", "", `{"email":"Alice@Example.com","password":"`+password+`"}`)
+	var tokens tokenResponse
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	return tokens, rr
+}
+
+// refresh exchanges a refresh token.
+func (s *loginServer) refresh(refreshToken string) (tokenResponse, *httptest.ResponseRecorder) {
+	rr := s.serve("POST", "/v1/auth/refresh", "", `{"refresh_token":"`+refreshToken+`"}`)
+	var tokens tokenResponse
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	return tokens, rr
+}
+
+func TestLoginIssuesTokens(t *testing.T) {
+	// Setup
+	s := newLoginServer(t)
+
+	// Execute
+	_, wrongPassword := s.login("wrong horse")
+	unknownEmail := s.serve("POST", "/v1/auth/login", "", `{"email":"bob@example.com","password":"correct horse"}`)
+	tokens, loggedIn := s.login("correct horse")
+	read := s.serve("GET", "/v1/users", "Bearer "+tokens.AccessToken, "")
+	write := s.serve("POST", "/v1/users", "Bearer "+tokens.AccessToken, `{"name":"Mallory"}`)
+	claims, claimsErr := verifyJWT(tokens.AccessToken, testJWTSecret, time.Now())
+
+	// Validate
+	assert.Equal(t, http.StatusUnauthorized, wrongPassword.Code)
+	assert.Equal(t, http.StatusUnauthorized, unknownEmail.Code)
+	assert.Equal(t, wrongPassword.Body.String(), unknownEmail.Body.String(), "the response does not tell which part was wrong")
+	assert.Equal(t, http.StatusOK, loggedIn.Code)
+	assert.Equal(t, "no-store", loggedIn.Header().Get("Cache-Control"))
+	assert.Equal(t, "Bearer", tokens.TokenType)
+	assert.Equal(t, 60, tokens.ExpiresIn)
+	assert.True(t, strings.HasPrefix(tokens.RefreshToken, refreshTokenPrefix+tokens.SessionID+"_"))
+	assert.NoError(t, claimsErr)
+	assert.Equal(t, "user:1", claims.Subject)
+	assert.Equal(t, tokens.SessionID, claims.SessionID)
+	assert.Equal(t, http.StatusOK, read.Code, "the user has the roles of its subject")
+	assert.Equal(t, http.StatusForbidden, write.Code)
+}
+
+func TestRefreshTokensRotate(t *testing.T) {
+	// Setup
+	s := newLoginServer(t)
+	first, _ := s.login("correct horse")
+
+	// Execute
+	second, refreshed := s.refresh(first.RefreshToken)
+	third, refreshedAgain := s.refresh(second.RefreshToken)
+	_, garbage := s.refresh("rt_not-a-token")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, refreshed.Code)
+	assert.Equal(t, "no-store", refreshed.Header().Get("Cache-Control"))
+	assert.Equal(t, first.SessionID, second.SessionID)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assert.Equal(t, http.StatusOK, refreshedAgain.Code)
+	assert.Equal(t, first.SessionID, third.SessionID)
+	assert.Equal(t, http.StatusUnauthorized, garbage.Code)
+}
+
+func TestReusedRefreshTokenTerminatesSession(t *testing.T) {
+	// Setup
+	s := newLoginServer(t)
+	first, _ := s.login("correct horse")
+	second, _ := s.refresh(first.RefreshToken)
+
+	// Execute
+	_, reused := s.refresh(first.RefreshToken)
+	_, current := s.refresh(second.RefreshToken)
+
+	// Validate
+	assert.Equal(t, http.StatusUnauthorized, reused.Code)
+	assert.Contains(t, reused.Body.String(), "invalid-refresh-token")
+	assert.Equal(t, http.StatusUnauthorized, current.Code, "the session of a copied token ends for everyone")
+}
+
+func TestMadeUpRefreshTokenLeavesSessionAlone(t *testing.T) {
+	// Setup
+	s := newLoginServer(t)
+	first, _ := s.login("correct horse")
+	second, _ := s.refresh(first.RefreshToken)
+
+	// Execute
+	_, madeUp := s.refresh(formatRefreshToken(second.SessionID, "garbage"))
+	_, current := s.refresh(second.RefreshToken)
+
+	// Validate
+	assert.Equal(t, http.StatusUnauthorized, madeUp.Code)
+	assert.Equal(t, http.StatusOK, current.Code, "knowing the session id is not enough to end a session")
+}
+
+func TestLogout(t *testing.T) {
+	// Setup
+	s := newLoginServer(t)
+	tokens, _ := s.login("correct horse")
+
+	// Execute
+	loggedOut := s.serve("POST", "/v1/auth/logout", "", `{"refresh_token":"`+tokens.RefreshToken+`"}`)
+	_, refreshed := s.refresh(tokens.RefreshToken)
+	again := s.serve("POST", "/v1/auth/logout", "", `{"refresh_token":"`+tokens.RefreshToken+`"}`)
+	malformed := s.serve("POST", "/v1/auth/logout", "", `{`)
+
+	// Validate
+	assert.Equal(t, http.StatusNoContent, loggedOut.Code)
+	assert.Equal(t, http.StatusUnauthorized, refreshed.Code)
+	assert.Equal(t, http.StatusNoContent, again.Code)
+	assert.Equal(t, http.StatusBadRequest, malformed.Code)
+}
+
+func TestTokensExpire(t *testing.T) {
+	// Setup
+	now := time.Now()
+	s := newLoginServer(t, WithClock(func() time.Time { return now }))
+	tokens, _ := s.login("correct horse")
+
+	// Execute
+	now = now.Add(2 * time.Minute)
+	expiredAccess := s.serve("GET", "/v1/users", "Bearer "+tokens.AccessToken, "")
+	refreshed, refresh := s.refresh(tokens.RefreshToken)
+	now = now.Add(2 * time.Hour)
+	_, expiredRefresh := s.refresh(refreshed.RefreshToken)
+
+	// Validate
+	assert.Equal(t, http.StatusUnauthorized, expiredAccess.Code)
+	assert.Equal(t, http.StatusOK, refresh.Code)
+	assert.Equal(t, http.StatusUnauthorized, expiredRefresh.Code)
+}
+
+func TestUsersTerminateTheirSessions(t *testing.T) {
+	// Setup
+	s := newLoginServer(t)
+	laptop, _ := s.login("correct horse")
+	phone, _ := s.login("correct horse")
+	auth := "Bearer " + laptop.AccessToken
+
+	// Execute
+	listed := s.serve("GET", "/v1/auth/sessions", auth, "")
+	var sessions []Session
+	json.Unmarshal(listed.Body.Bytes(), &sessions)
+	terminated := s.serve("DELETE", "/v1/auth/sessions/"+phone.SessionID, auth, "")
+	_, phoneRefresh := s.refresh(phone.RefreshToken)
+	unknown := s.serve("DELETE", "/v1/auth/sessions/0123456789abcdef", auth, "")
+	withoutLogin := s.serve("GET", "/v1/auth/sessions", s.root, "")
+	anonymous := s.serve("GET", "/v1/auth/sessions", "", "")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, listed.Code)
+	assert.Equal(t, "no-store", listed.Header().Get("Cache-Control"))
+	assert.NotContains(t, listed.Body.String(), laptop.RefreshToken)
+	if assert.Len(t, sessions, 2) {
+		for _, session := range sessions {
+			assert.Equal(t, 1, session.UserID)
+			assert.Equal(t, "test-client/1.0", session.UserAgent)
+			assert.Equal(t, "192.0.2.1", session.ClientIP)
+			assert.Equal(t, session.ID == laptop.SessionID, session.Current)
+		}
+	}
+	assert.Equal(t, http.StatusNoContent, terminated.Code)
+	assert.Equal(t, http.StatusUnauthorized, phoneRefresh.Code)
+	assert.Equal(t, http.StatusNotFound, unknown.Code)
+	assert.Equal(t, http.StatusForbidden, withoutLogin.Code)
+	assert.Equal(t, http.StatusUnauthorized, anonymous.Code)
+}
+
+func TestAdminsManageSessionsOfUsers(t *testing.T) {
+	// Setup
+	s := newLoginServer(t)
+	first, _ := s.login("correct horse")
+	second, _ := s.login("correct horse")
+	third, _ := s.login("correct horse")
+
+	// Execute
+	listed := s.serve("GET", "/v1/users/1/sessions", s.root, "")
+	var sessions []Session
+	json.Unmarshal(listed.Body.Bytes(), &sessions)
+	terminated := s.serve("DELETE", "/v1/users/1/sessions/"+first.SessionID, s.root, "")
+	_, firstRefresh := s.refresh(first.RefreshToken)
+	byUser := s.serve("GET", "/v1/users/1/sessions", "Bearer "+third.AccessToken, "")
+	allTerminated := s.serve("DELETE", "/v1/users/1/sessions", s.root, "")
+	_, secondRefresh := s.refresh(second.RefreshToken)
+	afterwards := s.serve("GET", "/v1/users/1/sessions", s.root, "")
+	unknownUser := s.serve("GET", "/v1/users/42/sessions", s.root, "")
+	terminatedAccess := s.serve("GET", "/v1/users", "Bearer "+third.AccessToken, "")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, listed.Code)
+	assert.Len(t, sessions, 3)
+	assert.Equal(t, http.StatusNoContent, terminated.Code)
+	assert.Equal(t, http.StatusUnauthorized, firstRefresh.Code)
+	assert.Equal(t, http.StatusNoContent, allTerminated.Code)
+	assert.Equal(t, http.StatusUnauthorized, secondRefresh.Code)
+	assert.JSONEq(t, `[]`, afterwards.Body.String())
+	assert.Equal(t, http.StatusNotFound, unknownUser.Code)
+	assert.Equal(t, http.StatusForbidden, byUser.Code)
+	assert.Equal(t, http.StatusUnauthorized, terminatedAccess.Code, "access tokens end with their session")
+}
+
+func TestSetCredentials(t *testing.T) {
+	// Setup
+	s := newLoginServer(t)
+	assert.Equal(t, http.StatusOK, s.serve("POST", "/v1/users", s.root, `{"name":"Bob"}`).Code)
+	before, _ := s.login("correct horse")
+	tests := []struct {
+		name, target, body string
+		status             int
+	}{
+		{"invalid email", "/v1/users/2/credentials", `{"email":"bob","password":"battery staple"}`, http.StatusBadRequest},
+		{"short password", "/v1/users/2/credentials", `{"email":"bob@example.com","password":"short"}`, http.StatusBadRequest},
+		{"long password", "/v1/users/2/credentials", `{"email":"bob@example.com","password":"` + strings.Repeat("x", 73) + `"}`, http.StatusBadRequest},
+		{"taken email", "/v1/users/2/credentials", `{"email":"ALICE@example.com","password":"battery staple"}`, http.StatusConflict},
+		{"unknown user", "/v1/users/42/credentials", `{"email":"carol@example.com","password":"battery staple"}`, http.StatusNotFound},
+		{"new password", "/v1/users/1/credentials", `{"email":"alice@example.com","password":"battery staple"}`, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Execute
+			rr := s.serve("PUT", tt.target, s.root, tt.body)
+
+			// Validate
+			assert.Equal(t, tt.status, rr.Code, rr.Body.String())
+		})
+	}
+	_, oldPassword := s.login("correct horse")
+	_, newPassword := s.login("battery staple")
+	_, refreshed := s.refresh(before.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, oldPassword.Code)
+	assert.Equal(t, http.StatusOK, newPassword.Code)
+	assert.Equal(t, http.StatusUnauthorized, refreshed.Code, "a new password ends the existing sessions")
+}
+
+func TestDeletedUsersCannotLogIn(t *testing.T) {
+	// Setup
+	s := newLoginServer(t)
+	tokens, _ := s.login("correct horse")
+
+	// Execute
+	deleted := s.serve("DELETE", "/v1/users/1", s.root, "")
+	_, loggedIn := s.login("correct horse")
+	_, refreshed := s.refresh(tokens.RefreshToken)
+
+	// Validate
+	assert.Equal(t, http.StatusNoContent, deleted.Code)
+	assert.Equal(t, http.StatusUnauthorized, loggedIn.Code)
+	assert.Equal(t, http.StatusUnauthorized, refreshed.Code)
+}
+
+func TestLoginIsTenantScoped(t *testing.T) {
+	// Setup
+	s := newLoginServer(t, WithTenancy(NewTenantResolver(testJWTSecret, "")))
+	serve := func(path, tenant, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set(tenantHeader, tenant)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Execute
+	own := serve("/v1/auth/login", "acme", `{"email":"alice@example.com","password":"correct horse"}`)
+	var tokens tokenResponse
+	json.Unmarshal(own.Body.Bytes(), &tokens)
+	foreign := serve("/v1/auth/login", "globex", `{"email":"alice@example.com","password":"correct horse"}`)
+	foreignRefresh := serve("/v1/auth/refresh", "globex", `{"refresh_token":"`+tokens.RefreshToken+`"}`)
+	claims, _ := verifyJWT(tokens.AccessToken, testJWTSecret, time.Now())
+
+	// Validate
+	assert.Equal(t, http.StatusOK, own.Code)
+	assert.Equal(t, "acme", claims.Tenant)
+	assert.Equal(t, http.StatusUnauthorized, foreign.Code)
+	assert.Equal(t, http.StatusUnauthorized, foreignRefresh.Code)
+}
+
+func TestLoginNeedsAccessControl(t *testing.T) {
+	// Setup
+	s := NewServer(WithLogin(time.Minute, time.Hour, bcrypt.MinCost))
+
+	// Execute
+	rr := serve(s, "POST", "/v1/auth/login", `{"email":"alice@example.com","password":"correct horse"}`)
+
+	// Validate
+	assert.Nil(t, s.sessions)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestSQLCredentialStore(t *testing.T) {
+	// Setup
+	storeDB, storeMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer storeDB.Close()
+	s := newSQLCredentialStore(storeDB)
+	ctx := withTenant(context.Background(), "acme")
+	uniqueViolation := &sqlStateError{state: "23505"}
+
+	// Mock DB response
+	storeMock.ExpectBegin()
+	storeMock.ExpectExec("SELECT set_config\\('app.tenant_id', \\$1, true\\)").WithArgs("acme").WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectQuery("SELECT id, email, password_hash FROM users WHERE email = \\$1 AND password_hash IS NOT NULL").
+		WithArgs("alice@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "password_hash"}).AddRow(1, "alice@example.com", "$2a$04$hash"))
+	storeMock.ExpectCommit()
+	storeMock.ExpectBegin()
+	storeMock.ExpectExec("SELECT set_config").WithArgs("acme").WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectQuery("SELECT id, email, password_hash FROM users").WithArgs("bob@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "password_hash"}))
+	storeMock.ExpectRollback()
+	storeMock.ExpectBegin()
+	storeMock.ExpectExec("SELECT set_config").WithArgs("acme").WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectExec("UPDATE users SET email = \\$1, password_hash = \\$2 WHERE id = \\$3").
+		WithArgs("alice@example.com", "$2a$04$other", 2).WillReturnError(uniqueViolation)
+	storeMock.ExpectRollback()
+	storeMock.ExpectBegin()
+	storeMock.ExpectExec("SELECT set_config").WithArgs("acme").WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectExec("UPDATE users SET email").WithArgs("carol@example.com", "$2a$04$other", 42).WillReturnResult(sqlmock.NewResult(0, 0))
+	storeMock.ExpectRollback()
+
+	// Execute
+	found, findErr := s.FindCredentials(ctx, "alice@example.com")
+	_, missingErr := s.FindCredentials(ctx, "bob@example.com")
+	takenErr := s.SetCredentials(ctx, Credentials{UserID: 2, Email: "alice@example.com", PasswordHash: "$2a$04$other"})
+	unknownErr := s.SetCredentials(ctx, Credentials{UserID: 42, Email: "carol@example.com", PasswordHash: "$2a$04$other"})
+
+	// Validate
+	assert.NoError(t, findErr)
+	assert.Equal(t, Credentials{UserID: 1, Email: "alice@example.com", PasswordHash: "$2a$04$hash"}, found)
+	assert.ErrorIs(t, missingErr, ErrCredentialsNotFound)
+	assert.ErrorIs(t, takenErr, ErrEmailTaken)
+	assert.ErrorIs(t, unknownErr, ErrUserNotFound)
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
+
+// sqlStateError is a database error with a PostgreSQL error code.
+type sqlStateError struct {
+	state string
+}
+
+func (e *sqlStateError) Error() string    { return "SQLSTATE " + e.state }
+func (e *sqlStateError) SQLState() string { return e.state }
+
+func TestSQLSessionStore(t *testing.T) {
+	// Setup
+	storeDB, storeMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer storeDB.Close()
+	s := newSQLSessionStore(storeDB)
+	ctx := withTenant(context.Background(), "acme")
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	expiresAt := createdAt.Add(time.Hour)
+	columns := []string{"id", "tenant_id", "user_id", "salt", "hash", "previous_salt", "previous_hash", "user_agent", "client_ip", "created_at", "last_used_at", "expires_at"}
+	session := Session{ID: "0123456789abcdef", Tenant: "acme", UserID: 1, Salt: []byte("salt"), Hash: []byte("hash"),
+		ClientIP: "192.0.2.1", CreatedAt: createdAt, LastUsedAt: createdAt, ExpiresAt: expiresAt}
+
+	// Mock DB response
+	storeMock.ExpectExec("INSERT INTO sessions").
+		WithArgs(session.ID, "acme", 1, []byte("salt"), []byte("hash"), "", "192.0.2.1", createdAt, createdAt, expiresAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectQuery("SELECT id, tenant_id, user_id, salt, hash, previous_salt, previous_hash, COALESCE\\(user_agent, ''\\), COALESCE\\(client_ip, ''\\), created_at, last_used_at, expires_at FROM sessions WHERE id = \\$1 AND tenant_id = \\$2").
+		WithArgs(session.ID, "acme").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(session.ID, "acme", 1, []byte("salt"), []byte("hash"), nil, nil, "", "192.0.2.1", createdAt, createdAt, expiresAt))
+	storeMock.ExpectQuery("SELECT .* FROM sessions WHERE tenant_id = \\$1 AND user_id = \\$2 ORDER BY created_at DESC, id").
+		WithArgs("acme", 1).WillReturnRows(sqlmock.NewRows(columns))
+	storeMock.ExpectExec("UPDATE sessions SET previous_salt = salt, previous_hash = hash, salt = \\$1, hash = \\$2, last_used_at = \\$3, expires_at = \\$4 WHERE id = \\$5 AND tenant_id = \\$6 AND hash = \\$7").
+		WithArgs([]byte("salt2"), []byte("hash2"), expiresAt, expiresAt.Add(time.Hour), session.ID, "acme", []byte("stale")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	storeMock.ExpectExec("DELETE FROM sessions WHERE tenant_id = \\$1 AND user_id = \\$2").WithArgs("acme", 1).WillReturnResult(sqlmock.NewResult(0, 2))
+	storeMock.ExpectExec("DELETE FROM sessions WHERE expires_at <= \\$1").WithArgs(expiresAt).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	// Execute
+	createErr := s.CreateSession(ctx, session)
+	found, lookupErr := s.LookupSession(ctx, session.ID)
+	sessions, listErr := s.ListSessions(ctx, 1)
+	rotateErr := s.RotateSession(ctx, session.ID, []byte("stale"), []byte("salt2"), []byte("hash2"), expiresAt, expiresAt.Add(time.Hour))
+	deleteErr := s.DeleteUserSessions(ctx, 1)
+	expired, expireErr := s.DeleteExpiredSessions(ctx, expiresAt)
+
+	// Validate
+	assert.NoError(t, createErr)
+	assert.NoError(t, lookupErr)
+	assert.Equal(t, session, found)
+	assert.NoError(t, listErr)
+	assert.Empty(t, sessions)
+	assert.ErrorIs(t, rotateErr, ErrSessionNotFound, "the refresh token changed in the meantime")
+	assert.NoError(t, deleteErr)
+	assert.NoError(t, expireErr)
+	assert.Equal(t, int64(3), expired)
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
+
+func TestParseRefreshToken(t *testing.T) {
+	// Execute
+	id, secret, ok := parseRefreshToken(formatRefreshToken("0123456789abcdef", "s3cret"))
+	_, _, short := parseRefreshToken("rt_0123_s3cret")
+	_, _, apiKey := parseRefreshToken(formatAPIKey("0123456789ab", "s3cret"))
+
+	// Validate
+	assert.True(t, ok)
+	assert.Equal(t, "0123456789abcdef", id)
+	assert.Equal(t, "s3cret", secret)
+	assert.False(t, short)
+	assert.False(t, apiKey)
+}
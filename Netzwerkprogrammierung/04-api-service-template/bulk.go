@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	// exportFlushInterval is the number of rows written between two flushes
+	// of the response, so clients start receiving data immediately.
+	exportFlushInterval = 500
+	// maxImportErrors caps the number of row errors reported by an import.
+	maxImportErrors = 100
+	// maxImportLineSize is the longest NDJSON line accepted by an import.
+	maxImportLineSize = 1 << 20
+)
+
+// importRowError describes why a single row of an import was rejected.
+type importRowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// importResult summarises the outcome of a POST /v1/users/import request.
+type importResult struct {
+	DryRun    bool             `json:"dry_run"`
+	Processed int              `json:"processed"`
+	Created   int              `json:"created"`
+	Updated   int              `json:"updated"`
+	Failed    int              `json:"failed"`
+	Errors    []importRowError `json:"errors"`
+}
+
+// importRow is a single decoded row of an import. The user ID is zero when
+// the row does not reference an existing user.
+type importRow struct {
+	line int
+	user User
+	err  error
+}
+
+// userWriter writes users in one of the bulk formats.
+type userWriter interface {
+	Write(user User) error
+	Flush() error
+}
+
+// csvUserWriter writes users as CSV with an "id,name" header.
+type csvUserWriter struct {
+	w *csv.Writer
+}
+
+func newCSVUserWriter(w io.Writer) *csvUserWriter {
+	c := &csvUserWriter{w: csv.NewWriter(w)}
+	// The header only reaches the client on the first flush, so it cannot
+	// fail here; csv.Writer reports write errors from Flush.
+	c.w.Write([]string{"id", "name"})
+	return c
+}
+
+func (c *csvUserWriter) Write(user User) error {
+	return c.w.Write([]string{strconv.Itoa(user.ID), user.Name})
+}
+
+func (c *csvUserWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// ndjsonUserWriter writes users as newline-delimited JSON.
+type ndjsonUserWriter struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONUserWriter(w io.Writer) *ndjsonUserWriter {
+	buf := bufio.NewWriter(w)
+	return &ndjsonUserWriter{buf: buf, enc: json.NewEncoder(buf)}
+}
+
+func (n *ndjsonUserWriter) Write(user User) error {
+	return n.enc.Encode(user)
+}
+
+func (n *ndjsonUserWriter) Flush() error {
+	return n.buf.Flush()
+}
+
+// parseBulkFormat resolves the bulk format from the format query parameter,
+// falling back to the given content type and finally to CSV.
+func parseBulkFormat(format, contentType string) (string, error) {
+	switch strings.ToLower(format) {
+	case formatCSV, formatNDJSON:
+		return strings.ToLower(format), nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported format %q, expected %q or %q", format, formatCSV, formatNDJSON)
+	}
+
+	switch {
+	case strings.HasPrefix(contentType, "application/x-ndjson"), strings.HasPrefix(contentType, "application/ndjson"):
+		return formatNDJSON, nil
+	default:
+		return formatCSV, nil
+	}
+}
+
+// exportUsers handles the GET /v1/users/export endpoint. Rows are streamed
+// from the store cursor straight to the client without buffering the whole
+// table.
+func (s *Server) exportUsers(w http.ResponseWriter, r *http.Request) {
+	format, err := parseBulkFormat(r.URL.Query().Get("format"), "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"users.%s\"", format))
+	out := &sentWriter{w: w}
+	var writer userWriter
+	if format == formatNDJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		writer = newNDJSONUserWriter(out)
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writer = newCSVUserWriter(out)
+	}
+	flusher, _ := w.(http.Flusher)
+
+	written := 0
+	err = s.users.listUsers(r.Context(), func(user User) error {
+		if err := writer.Write(user); err != nil {
+			return err
+		}
+		written++
+		if written%exportFlushInterval == 0 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		s.abortStream(w, out.sent, err, "Export aborted", written)
+	}
+}
+
+// importUsers handles the POST /v1/users/import endpoint. The body is read
+// row by row; rows carrying an id are upserted, rows without an id are
+// inserted as new users. With dry_run=true nothing is written and the result
+// reports what would have happened.
+func (s *Server) importUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format, err := parseBulkFormat(query.Get("format"), r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+
+	var rows importReader
+	if format == formatNDJSON {
+		rows = newNDJSONImportReader(r.Body)
+	} else {
+		rows, err = newCSVImportReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result := importResult{DryRun: dryRun, Errors: []importRowError{}}
+	defer func() { s.users.importFinished(r.Context(), !dryRun && result.Created+result.Updated > 0) }()
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("reading import after %d rows: %v", result.Processed, err), http.StatusBadRequest)
+			return
+		}
+		if err := r.Context().Err(); err != nil {
+			s.logger.Warn("Import aborted", "rows", result.Processed, "error", err)
+			return
+		}
+
+		result.Processed++
+		err = row.err
+		if err == nil {
+			var created bool
+			created, err = s.users.importUser(r.Context(), row.user, dryRun)
+			if errors.Is(err, ErrStoreTimeout) || errors.Is(err, ErrStoreUnavailable) {
+				// The remaining rows would fail the same way.
+				writeStoreError(w, fmt.Errorf("import aborted after %d rows: %w", result.Processed-1, err))
+				return
+			}
+			if err == nil && created {
+				result.Created++
+			} else if err == nil {
+				result.Updated++
+			}
+		}
+		if err != nil {
+			result.Failed++
+			if len(result.Errors) < maxImportErrors {
+				result.Errors = append(result.Errors, importRowError{Line: row.line, Error: err.Error()})
+			}
+		}
+	}
+
+	response, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// importReader yields the rows of an import one at a time. Next returns
+// io.EOF once the input is exhausted.
+type importReader interface {
+	Next() (importRow, error)
+}
+
+// csvImportReader reads a CSV import. The header row must contain a name
+// column and may contain an id column.
+type csvImportReader struct {
+	reader     *csv.Reader
+	idColumn   int
+	nameColumn int
+}
+
+func newCSVImportReader(body io.Reader) (*csvImportReader, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	c := &csvImportReader{reader: reader, idColumn: -1, nameColumn: -1}
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	for i, column := range header {
+		switch strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))) {
+		case "id":
+			c.idColumn = i
+		case "name":
+			c.nameColumn = i
+		}
+	}
+	if c.nameColumn < 0 {
+		return nil, errors.New("CSV header must contain a name column")
+	}
+	return c, nil
+}
+
+func (c *csvImportReader) Next() (importRow, error) {
+	if c.nameColumn < 0 {
+		return importRow{}, io.EOF
+	}
+
+	record, err := c.reader.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return importRow{line: parseErr.StartLine, err: err}, nil
+		}
+		return importRow{}, err
+	}
+
+	line, _ := c.reader.FieldPos(0)
+	row := importRow{line: line}
+	if c.nameColumn >= len(record) {
+		row.err = errors.New("missing name column")
+		return row, nil
+	}
+	row.user.Name = record[c.nameColumn]
+	if c.idColumn >= 0 && c.idColumn < len(record) && strings.TrimSpace(record[c.idColumn]) != "" {
+		row.user.ID, err = strconv.Atoi(strings.TrimSpace(record[c.idColumn]))
+		if err != nil {
+			row.err = fmt.Errorf("invalid id %q", record[c.idColumn])
+		}
+	}
+	return row, nil
+}
+
+// ndjsonImportReader reads an NDJSON import. Blank lines are skipped.
+type ndjsonImportReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newNDJSONImportReader(body io.Reader) *ndjsonImportReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineSize)
+	return &ndjsonImportReader{scanner: scanner}
+}
+
+func (n *ndjsonImportReader) Next() (importRow, error) {
+	for n.scanner.Scan() {
+		n.line++
+		data := bytes.TrimSpace(n.scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		row := importRow{line: n.line}
+		if err := json.Unmarshal(data, &row.user); err != nil {
+			row.err = fmt.Errorf("invalid JSON: %v", err)
+		}
+		return row, nil
+	}
+	if err := n.scanner.Err(); err != nil {
+		return importRow{}, err
+	}
+	return importRow{}, io.EOF
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportUsersCSV(t *testing.T) {
+	// Setup
+	req, err := http.NewRequest("GET", "/v1/users/export?format=csv", nil)
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	router, mock := newTestServer(t)
+
+	// Mock DB response
+	rows := sqlmock.NewRows([]string{"id", "name"}).
+		AddRow(1, "John Doe").
+		AddRow(2, "Doe, Jane")
+	mock.ExpectQuery("SELECT id, name FROM users ORDER BY id").WillReturnRows(rows)
+
+	// Execute
+	router.ServeHTTP(rr, req)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "id,name\n1,John Doe\n2,\"Doe, Jane\"\n", rr.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExportUsersNDJSON(t *testing.T) {
+	// Setup
+	req, err := http.NewRequest("GET", "/v1/users/export?format=ndjson", nil)
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	router, mock := newTestServer(t)
+
+	// Mock DB response
+	rows := sqlmock.NewRows([]string{"id", "name"}).
+		AddRow(1, "John Doe").
+		AddRow(2, "Jane Doe")
+	mock.ExpectQuery("SELECT id, name FROM users ORDER BY id").WillReturnRows(rows)
+
+	// Execute
+	router.ServeHTTP(rr, req)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "{\"id\":1,\"name\":\"John Doe\"}\n{\"id\":2,\"name\":\"Jane Doe\"}\n", rr.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExportUsersAbortsOnStoreErrors(t *testing.T) {
+	// Setup
+	early := httptest.NewRecorder()
+	late := httptest.NewRecorder()
+
+	// Execute
+	NewServer(WithStore(newFailingStore(10, 3))).ServeHTTP(early, httptest.NewRequest("GET", "/v1/users/export?format=ndjson", nil))
+
+	// Validate
+	assert.Equal(t, http.StatusServiceUnavailable, early.Code)
+	assert.NotContains(t, early.Body.String(), "John Doe")
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		NewServer(WithStore(newFailingStore(2*exportFlushInterval, exportFlushInterval+3))).
+			ServeHTTP(late, httptest.NewRequest("GET", "/v1/users/export?format=ndjson", nil))
+	})
+	assert.Equal(t, exportFlushInterval, strings.Count(late.Body.String(), "\n"), "the rows before the failure were flushed")
+}
+
+func TestExportUsersInvalidFormat(t *testing.T) {
+	// Setup
+	req, err := http.NewRequest("GET", "/v1/users/export?format=xml", nil)
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	router, _ := newTestServer(t)
+
+	// Execute
+	router.ServeHTTP(rr, req)
+
+	// Validate
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestImportUsersNDJSON(t *testing.T) {
+	// Setup
+	body := strings.Join([]string{
+		`{"name":"John Doe"}`,
+		`{"id":7,"name":"Jane Doe"}`,
+		``,
+		`{"id":"x"}`,
+		`{"id":8,"name":""}`,
+	}, "\n")
+	req, err := http.NewRequest("POST", "/v1/users/import?format=ndjson", strings.NewReader(body))
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	router, mock := newTestServer(t)
+	generation := router.cache.generation.Load()
+
+	// Mock DB response
+	mock.ExpectQuery("INSERT INTO users \\(name\\) VALUES \\(\\$1\\) RETURNING id").
+		WithArgs("John Doe").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery("INSERT INTO users \\(id, name\\) VALUES \\(\\$1, \\$2\\) ON CONFLICT \\(tenant_id, id\\) DO UPDATE").
+		WithArgs(7, "Jane Doe").
+		WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(false))
+
+	// Execute
+	router.ServeHTTP(rr, req)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var result importResult
+	err = json.Unmarshal(rr.Body.Bytes(), &result)
+	assert.NoError(t, err)
+	assert.False(t, result.DryRun)
+	assert.Equal(t, 4, result.Processed)
+	assert.Equal(t, 1, result.Created)
+	assert.Equal(t, 1, result.Updated)
+	assert.Equal(t, 2, result.Failed)
+	assert.Equal(t, []int{4, 5}, []int{result.Errors[0].Line, result.Errors[1].Line})
+	assert.Equal(t, "name is required", result.Errors[1].Error)
+	assert.Equal(t, generation+1, router.cache.generation.Load(), "the import invalidates the cache once")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestImportUsersCSVDryRun(t *testing.T) {
+	// Setup
+	body := "name,id\nJohn Doe,\nJane Doe,2\nJim Doe,3\n"
+	req, err := http.NewRequest("POST", "/v1/users/import?dry_run=true", strings.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "text/csv")
+	rr := httptest.NewRecorder()
+	router, mock := newTestServer(t)
+	generation := router.cache.generation.Load()
+
+	// Mock DB response
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM users WHERE id = \\$1\\)").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM users WHERE id = \\$1\\)").
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	// Execute
+	router.ServeHTTP(rr, req)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var result importResult
+	err = json.Unmarshal(rr.Body.Bytes(), &result)
+	assert.NoError(t, err)
+	assert.True(t, result.DryRun)
+	assert.Equal(t, 3, result.Processed)
+	assert.Equal(t, 2, result.Created)
+	assert.Equal(t, 1, result.Updated)
+	assert.Equal(t, 0, result.Failed)
+	assert.Equal(t, generation, router.cache.generation.Load(), "a dry run leaves the cache alone")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestImportUsersCSVMissingNameColumn(t *testing.T) {
+	// Setup
+	req, err := http.NewRequest("POST", "/v1/users/import?format=csv", strings.NewReader("id\n1\n"))
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	router, _ := newTestServer(t)
+
+	// Execute
+	router.ServeHTTP(rr, req)
+
+	// Validate
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
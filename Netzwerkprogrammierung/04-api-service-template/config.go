@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Config holds the settings that can be changed without a restart. They
+// are read from the environment at startup and can be overridden by a JSON
+// config file; settings the file leaves out keep the values from the
+// environment.
+type Config struct {
+	LogLevel                  string            `json:"log_level"`
+	RateLimit                 RateLimitSettings `json:"rate_limit"`
+	BulkRateLimit             RateLimitSettings `json:"bulk_rate_limit"`
+	CacheTTL                  string            `json:"cache_ttl"`
+	CacheNegativeTTL          string            `json:"cache_negative_ttl"`
+	CacheStaleWhileRevalidate string            `json:"cache_stale_while_revalidate"`
+	CacheStaleIfError         string            `json:"cache_stale_if_error"`
+	CORSAllowedOrigins        []string          `json:"cors_allowed_origins"`
+	TLSCertFile               string            `json:"tls_cert_file"`
+	TLSKeyFile                string            `json:"tls_key_file"`
+}
+
+// loadedConfig is a validated Config with its settings parsed.
+type loadedConfig struct {
+	Config
+	level       slog.Level
+	limiter     Limiter
+	bulkLimiter Limiter
+	lifetimes   CacheLifetimes
+	certificate *tls.Certificate // nil without TLS
+}
+
+// loadConfig reads the config file at path over base and validates the
+// result. Without a path it validates base.
+func loadConfig(path string, base Config) (*loadedConfig, error) {
+	config := base
+	// Decoding reuses the backing array of a slice.
+	config.CORSAllowedOrigins = slices.Clone(base.CORSAllowedOrigins)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+
+	if len(config.CORSAllowedOrigins) == 0 {
+		config.CORSAllowedOrigins = nil // as from the environment
+	}
+
+	loaded := &loadedConfig{Config: config}
+	if err := loaded.level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log_level %q", config.LogLevel)
+	}
+	var err error
+	if loaded.limiter, err = config.RateLimit.limiter(); err != nil {
+		return nil, fmt.Errorf("invalid rate_limit: %w", err)
+	}
+	if loaded.bulkLimiter, err = config.BulkRateLimit.limiter(); err != nil {
+		return nil, fmt.Errorf("invalid bulk_rate_limit: %w", err)
+	}
+	for _, lifetime := range []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"cache_ttl", config.CacheTTL, &loaded.lifetimes.TTL},
+		{"cache_negative_ttl", config.CacheNegativeTTL, &loaded.lifetimes.NegativeTTL},
+		{"cache_stale_while_revalidate", config.CacheStaleWhileRevalidate, &loaded.lifetimes.StaleWhileRevalidate},
+		{"cache_stale_if_error", config.CacheStaleIfError, &loaded.lifetimes.StaleIfError},
+	} {
+		d, err := time.ParseDuration(lifetime.value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid %s %q", lifetime.name, lifetime.value)
+		}
+		*lifetime.field = d
+	}
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+			return nil, errors.New("tls_cert_file and tls_key_file must be set together")
+		}
+		certificate, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS certificate: %w", err)
+		}
+		loaded.certificate = &certificate
+	}
+	return loaded, nil
+}
+
+// configChange is a setting that differs between two configs.
+type configChange struct {
+	setting  string
+	from, to any
+}
+
+// diff returns the settings of next that differ from c, named as in the
+// config file.
+func (c Config) diff(next Config) []configChange {
+	var changes []configChange
+	from, to := reflect.ValueOf(c), reflect.ValueOf(next)
+	for i := 0; i < from.NumField(); i++ {
+		if !reflect.DeepEqual(from.Field(i).Interface(), to.Field(i).Interface()) {
+			setting, _, _ := strings.Cut(from.Type().Field(i).Tag.Get("json"), ",")
+			changes = append(changes, configChange{setting: setting, from: from.Field(i).Interface(), to: to.Field(i).Interface()})
+		}
+	}
+	return changes
+}
+
+// ConfigReloader applies the config file of a server at runtime, on SIGHUP
+// and whenever the file or the TLS certificate changes. A new config is
+// validated as a whole before any setting is applied; an invalid one is
+// rejected and the server keeps running with the current settings. Only
+// changed settings are applied, so settings changed through the admin API
+// are kept unless the file changes them too.
+type ConfigReloader struct {
+	server   *Server
+	path     string // empty without a config file
+	base     Config
+	interval time.Duration
+
+	mu          sync.Mutex // serializes reloads
+	current     *loadedConfig
+	stamps      map[string]fileStamp
+	certificate atomic.Pointer[tls.Certificate]
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modified time.Time
+	size     int64
+}
+
+// NewConfigReloader returns a reloader of the config file at path for
+// server, which was started with current. Settings the file leaves out
+// fall back to base. The files are checked for changes every interval; if
+// it is not positive they are not watched and only SIGHUP reloads them.
+func NewConfigReloader(server *Server, path string, base Config, current *loadedConfig, interval time.Duration) *ConfigReloader {
+	r := &ConfigReloader{server: server, path: path, base: base, interval: interval, current: current}
+	r.certificate.Store(current.certificate)
+	r.stamps = r.stampFiles()
+	return r
+}
+
+// GetCertificate returns the current TLS certificate. It is meant for the
+// GetCertificate field of tls.Config.
+func (r *ConfigReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate := r.certificate.Load()
+	if certificate == nil {
+		return nil, errors.New("no TLS certificate configured")
+	}
+	return certificate, nil
+}
+
+// Reload reads the config file and applies the settings that changed.
+func (r *ConfigReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The files are taken as seen even if they are invalid, so that a
+	// broken file is not reported again until it changes.
+	r.stamps = r.stampFiles()
+
+	next, err := loadConfig(r.path, r.base)
+	if err == nil {
+		err = r.check(next)
+	}
+	if err != nil {
+		r.server.logger.Error("Rejected config, keeping the current one", "file", r.path, "error", err)
+		return err
+	}
+
+	s := r.server
+	lifetimesChanged := false
+	for _, change := range r.current.diff(next.Config) {
+		switch change.setting {
+		case "log_level":
+			s.logLevel.Set(next.level)
+		case "rate_limit":
+			s.rateLimits.SetFallback(next.limiter)
+		case "bulk_rate_limit":
+			for _, route := range s.bulkRoutes {
+				s.rateLimits.Limit(route, next.bulkLimiter)
+			}
+		case "cache_ttl", "cache_negative_ttl", "cache_stale_while_revalidate", "cache_stale_if_error":
+			lifetimesChanged = true
+		case "cors_allowed_origins":
+			// check made sure the origins are accepted.
+			s.cors.SetOrigins(next.CORSAllowedOrigins)
+		}
+		s.logger.Info("Config changed", "setting", change.setting, "from", change.from, "to", change.to)
+	}
+	if lifetimesChanged {
+		s.cache.SetLifetimes(next.lifetimes)
+	}
+	// Certificates are renewed in place, so they are swapped even if the
+	// file names stay the same.
+	if previous := r.certificate.Swap(next.certificate); next.certificate != nil &&
+		!slices.EqualFunc(previous.Certificate, next.certificate.Certificate, bytes.Equal) {
+		s.logger.Info("Reloaded TLS certificate", "file", next.TLSCertFile)
+	}
+	r.current = next
+	return nil
+}
+
+// check rejects changes the server cannot make without a restart.
+func (r *ConfigReloader) check(next *loadedConfig) error {
+	if next.LogLevel != r.current.LogLevel && r.server.logLevel == nil {
+		return errors.New("the log level of the server cannot be changed")
+	}
+	if len(next.CORSAllowedOrigins) > 0 && r.server.cors == nil {
+		return errors.New("CORS was not enabled at startup")
+	}
+	if r.server.cors != nil {
+		if err := r.server.cors.CheckOrigins(next.CORSAllowedOrigins); err != nil {
+			return err
+		}
+	}
+	if (next.certificate == nil) != (r.current.certificate == nil) {
+		return errors.New("TLS cannot be switched on or off without a restart")
+	}
+	return nil
+}
+
+// stampFiles returns the versions of the config file and the TLS
+// certificate files.
+func (r *ConfigReloader) stampFiles() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, path := range []string{r.path, r.current.TLSCertFile, r.current.TLSKeyFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{modified: info.ModTime(), size: info.Size()}
+		} else {
+			stamps[path] = fileStamp{}
+		}
+	}
+	return stamps
+}
+
+// filesChanged reports whether a watched file changed since the last
+// reload.
+func (r *ConfigReloader) filesChanged() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stamps := r.stampFiles()
+	for path, stamp := range stamps {
+		if previous, found := r.stamps[path]; !found || !previous.modified.Equal(stamp.modified) || previous.size != stamp.size {
+			return true
+		}
+	}
+	return false
+}
+
+// Run reloads the config on SIGHUP and when the files change until ctx is
+// cancelled.
+func (r *ConfigReloader) Run(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	// Without a watch interval the nil channel never fires.
+	var tick <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			r.server.logger.Info("Reloading the config after SIGHUP")
+			r.Reload()
+		case <-tick:
+			if r.filesChanged() {
+				r.server.logger.Info("Reloading the config after a file changed")
+				r.Reload()
+			}
+		}
+	}
+}
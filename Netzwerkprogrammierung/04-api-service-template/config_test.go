@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testConfig returns the settings of the environment in .env.
+func testConfig() Config {
+	return Config{
+		LogLevel:                  "info",
+		RateLimit:                 RateLimitSettings{Algorithm: "token-bucket", Limit: 1, Window: "1s", Burst: 3},
+		BulkRateLimit:             RateLimitSettings{Algorithm: "sliding-log", Limit: 5, Window: "1m0s", Burst: 1},
+		CacheTTL:                  "10s",
+		CacheNegativeTTL:          "2s",
+		CacheStaleWhileRevalidate: "5s",
+		CacheStaleIfError:         "5m0s",
+		CORSAllowedOrigins:        []string{"https://app.example.com"},
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+// setupReloader returns a server started with the config file at path over
+// testConfig, its reloader and the buffer the server logs to.
+func setupReloader(t *testing.T, path string) (*Server, *ConfigReloader, *bytes.Buffer) {
+	t.Helper()
+	base := testConfig()
+	config, err := loadConfig(path, base)
+	assert.NoError(t, err)
+	var logs bytes.Buffer
+	level := new(slog.LevelVar)
+	level.Set(config.level)
+	cache := NewResponseCache(config.lifetimes.TTL, config.lifetimes.NegativeTTL, 1<<20, 4)
+	cache.SetLifetimes(config.lifetimes)
+	cors, err := NewCORS(config.CORSAllowedOrigins, []string{"GET"}, nil, false, time.Minute)
+	assert.NoError(t, err)
+	server := NewServer(
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil)), level),
+		WithCache(cache, true),
+		WithLimiter(config.limiter, true),
+		WithBulkLimiter(config.bulkLimiter),
+		WithCORS(cors),
+	)
+	return server, NewConfigReloader(server, path, base, config, time.Second), &logs
+}
+
+func TestLoadConfigOverridesEnvironment(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, path, `{"log_level":"warn","rate_limit":{"limit":10},"cache_ttl":"1m","cors_allowed_origins":["https://other.example.com"]}`)
+	base := testConfig()
+
+	// Execute
+	config, err := loadConfig(path, base)
+
+	// Validate
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelWarn, config.level)
+	assert.Equal(t, RateLimitSettings{Algorithm: "token-bucket", Limit: 10, Window: "1s", Burst: 3}, config.RateLimit,
+		"settings left out of an object keep their values")
+	assert.Equal(t, CacheLifetimes{TTL: time.Minute, NegativeTTL: 2 * time.Second, StaleWhileRevalidate: 5 * time.Second, StaleIfError: 5 * time.Minute},
+		config.lifetimes)
+	assert.Equal(t, []string{"https://other.example.com"}, config.CORSAllowedOrigins)
+	assert.Equal(t, testConfig(), base, "the environment is not changed")
+	assert.Nil(t, config.certificate)
+}
+
+func TestLoadConfigRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"malformed", `{"log_level":`, "invalid config file"},
+		{"unknown setting", `{"cache_tll":"1m"}`, "unknown field"},
+		{"log level", `{"log_level":"loud"}`, "invalid log_level"},
+		{"rate limit", `{"rate_limit":{"algorithm":"leaky-bucket"}}`, "invalid rate_limit"},
+		{"bulk rate limit", `{"bulk_rate_limit":{"limit":0}}`, "invalid bulk_rate_limit"},
+		{"lifetime", `{"cache_stale_if_error":"forever"}`, "invalid cache_stale_if_error"},
+		{"negative lifetime", `{"cache_ttl":"-1s"}`, "invalid cache_ttl"},
+		{"certificate without key", `{"tls_cert_file":"cert.pem"}`, "must be set together"},
+		{"missing certificate", `{"tls_cert_file":"missing.pem","tls_key_file":"missing.key"}`, "invalid TLS certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Setup
+			path := filepath.Join(t.TempDir(), "config.json")
+			writeFile(t, path, tt.content)
+
+			// Execute
+			_, err := loadConfig(path, testConfig())
+
+			// Validate
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestConfigReloaderAppliesChanges(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, path, `{}`)
+	server, reloader, logs := setupReloader(t, path)
+	writeFile(t, path, `{
+		"log_level": "debug",
+		"rate_limit": {"algorithm": "gcra", "limit": 10, "window": "1m", "burst": 2},
+		"bulk_rate_limit": {"limit": 1},
+		"cache_ttl": "30s",
+		"cors_allowed_origins": ["https://*.example.com"]
+	}`)
+
+	// Execute
+	err := reloader.Reload()
+
+	// Validate
+	assert.NoError(t, err)
+	assert.Equal(t, slog.LevelDebug, server.logLevel.Level())
+	assert.Equal(t, RateLimitSettings{Algorithm: "gcra", Limit: 10, Window: "1m", Burst: 2},
+		server.rateLimits.Fallback().(configuredLimiter).settings)
+	for _, route := range server.bulkRoutes {
+		assert.Equal(t, 1, server.rateLimits.routes[route].(configuredLimiter).settings.Limit)
+	}
+	assert.Equal(t, 30*time.Second, server.cache.Lifetimes().TTL)
+	assert.Equal(t, 5*time.Minute, server.cache.Lifetimes().StaleIfError)
+	assert.True(t, server.cors.allowedOrigin("https://admin.example.com"))
+	for _, setting := range []string{"log_level", "rate_limit", "bulk_rate_limit", "cache_ttl", "cors_allowed_origins"} {
+		assert.Contains(t, logs.String(), "msg=\"Config changed\" setting="+setting)
+	}
+	assert.Contains(t, logs.String(), "from=10s to=30s")
+	assert.NotContains(t, logs.String(), "setting=cache_negative_ttl", "unchanged settings are not logged")
+}
+
+func TestConfigReloaderKeepsChangesFromAdminAPI(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, path, `{}`)
+	server, reloader, _ := setupReloader(t, path)
+	adminLimiter := NewGCRALimiter(100, time.Second, 1)
+	server.rateLimits.SetFallback(adminLimiter)
+	writeFile(t, path, `{"cache_ttl":"30s"}`)
+
+	// Execute
+	err := reloader.Reload()
+
+	// Validate
+	assert.NoError(t, err)
+	assert.Same(t, adminLimiter, server.rateLimits.Fallback())
+}
+
+func TestConfigReloaderRejectsInvalidConfig(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, path, `{"cache_ttl":"30s"}`)
+	server, reloader, logs := setupReloader(t, path)
+	writeFile(t, path, `{"cache_ttl":"1m","log_level":"loud"}`)
+
+	// Execute
+	err := reloader.Reload()
+
+	// Validate
+	assert.ErrorContains(t, err, "invalid log_level")
+	assert.Equal(t, 30*time.Second, server.cache.Lifetimes().TTL, "nothing is applied from an invalid config")
+	assert.Equal(t, slog.LevelInfo, server.logLevel.Level())
+	assert.Contains(t, logs.String(), "Rejected config, keeping the current one")
+
+	// Setup
+	writeFile(t, path, `{"cache_ttl":"1m"}`)
+
+	// Execute
+	err = reloader.Reload()
+
+	// Validate
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, server.cache.Lifetimes().TTL, "a fixed config is applied")
+}
+
+func TestConfigReloaderRejectsChangesNeedingRestart(t *testing.T) {
+	// Setup
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	writeFile(t, path, `{}`)
+	base := testConfig()
+	base.CORSAllowedOrigins = nil
+	config, err := loadConfig(path, base)
+	assert.NoError(t, err)
+	reloader := NewConfigReloader(NewServer(), path, base, config, time.Second)
+	certFile, keyFile := writeTestCertificate(t, dir, "api.example.com")
+
+	// Execute
+	writeFile(t, path, `{"cors_allowed_origins":["https://app.example.com"]}`)
+	corsErr := reloader.Reload()
+	writeFile(t, path, `{"log_level":"debug"}`)
+	levelErr := reloader.Reload()
+	writeFile(t, path, `{"tls_cert_file":"`+certFile+`","tls_key_file":"`+keyFile+`"}`)
+	tlsErr := reloader.Reload()
+
+	// Validate
+	assert.ErrorContains(t, corsErr, "CORS was not enabled at startup")
+	assert.ErrorContains(t, levelErr, "log level of the server cannot be changed")
+	assert.ErrorContains(t, tlsErr, "TLS cannot be switched on or off")
+}
+
+func TestConfigReloaderRejectsAnyOriginWithCredentials(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, path, `{}`)
+	base := testConfig()
+	config, err := loadConfig(path, base)
+	assert.NoError(t, err)
+	cors, err := NewCORS(config.CORSAllowedOrigins, []string{"GET"}, nil, true, time.Minute)
+	assert.NoError(t, err)
+	reloader := NewConfigReloader(NewServer(WithCORS(cors)), path, base, config, time.Second)
+
+	// Execute
+	writeFile(t, path, `{"cors_allowed_origins":["*"]}`)
+	err = reloader.Reload()
+
+	// Validate
+	assert.ErrorIs(t, err, errCORSAnyOriginWithCredentials)
+	assert.False(t, cors.allowedOrigin("https://evil.example.org"))
+	assert.True(t, cors.allowedOrigin("https://app.example.com"), "the previous origins stay in use")
+}
+
+func TestConfigReloaderDetectsFileChanges(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, path, `{}`)
+	_, reloader, _ := setupReloader(t, path)
+
+	// Execute and validate
+	assert.False(t, reloader.filesChanged())
+	writeFile(t, path, `{"cache_ttl":"30s"}`)
+	assert.True(t, reloader.filesChanged())
+	assert.NoError(t, reloader.Reload())
+	assert.False(t, reloader.filesChanged())
+	writeFile(t, path, `{"cache_ttl":"forever"}`)
+	assert.Error(t, reloader.Reload())
+	assert.False(t, reloader.filesChanged(), "an invalid file is not reloaded again until it changes")
+}
+
+func TestConfigReloaderWithoutWatchInterval(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, path, `{}`)
+	server, reloader, _ := setupReloader(t, path)
+	reloader.interval = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// Execute
+	writeFile(t, path, `{"cache_ttl":"30s"}`)
+	reloader.Run(ctx)
+
+	// Validate
+	assert.Equal(t, 10*time.Second, server.cache.Lifetimes().TTL, "changed files are not watched")
+}
+
+func TestConfigReloaderSwapsTLSCertificate(t *testing.T) {
+	// Setup
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	certFile, keyFile := writeTestCertificate(t, dir, "old.example.com")
+	writeFile(t, path, `{"tls_cert_file":"`+certFile+`","tls_key_file":"`+keyFile+`"}`)
+	_, reloader, logs := setupReloader(t, path)
+	before, err := reloader.GetCertificate(nil)
+	assert.NoError(t, err)
+
+	// Execute
+	writeTestCertificate(t, dir, "renewed.example.com")
+	changed := reloader.filesChanged()
+	err = reloader.Reload()
+
+	// Validate
+	assert.True(t, changed, "renewed certificates are noticed")
+	assert.NoError(t, err)
+	after, _ := reloader.GetCertificate(nil)
+	assert.Equal(t, "old.example.com", certificateName(t, before))
+	assert.Equal(t, "renewed.example.com", certificateName(t, after))
+	assert.Contains(t, logs.String(), "Reloaded TLS certificate")
+}
+
+// writeTestCertificate writes a self-signed certificate for name and its
+// key to dir and returns their paths.
+func writeTestCertificate(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+func certificateName(t *testing.T, certificate *tls.Certificate) string {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	assert.NoError(t, err)
+	return leaf.Subject.CommonName
+}
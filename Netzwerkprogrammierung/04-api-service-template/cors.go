@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// CORS answers cross-origin requests from browsers. Origins are matched
+// exactly or, for patterns like "https://*.example.com", by subdomain; "*"
+// allows any origin.
+type CORS struct {
+	origins     atomic.Pointer[corsOrigins]
+	methods     []string
+	headers     map[string]bool // lower case
+	anyHeader   bool
+	exposed     []string
+	credentials bool
+	maxAge      time.Duration
+}
+
+// errCORSAnyOriginWithCredentials rejects allowing every origin to send
+// credentials: any website could then act with the cookies and tokens of
+// its visitors.
+var errCORSAnyOriginWithCredentials = errors.New(`CORS origin "*" cannot be combined with credentials`)
+
+// corsOrigins are the origins a CORS handler allows.
+type corsOrigins struct {
+	exact     map[string]bool
+	wildcards [][2]string // prefix and suffix around the "*"
+	any       bool
+}
+
+// NewCORS returns a CORS handler allowing the given origins to call the
+// methods with the headers. If credentials is set, browsers send cookies
+// and Authorization headers along; "*" is refused as an origin then.
+// Preflight responses may be cached by the browser for maxAge.
+func NewCORS(origins, methods, headers []string, credentials bool, maxAge time.Duration) (*CORS, error) {
+	c := &CORS{
+		headers:     make(map[string]bool),
+		credentials: credentials,
+		maxAge:      maxAge,
+		exposed:     []string{"Location", "Retry-After", idempotencyReplayedHeader},
+	}
+	if err := c.SetOrigins(origins); err != nil {
+		return nil, err
+	}
+	for _, method := range methods {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			c.methods = append(c.methods, method)
+		}
+	}
+	for _, header := range headers {
+		header = strings.ToLower(strings.TrimSpace(header))
+		if header == "*" {
+			c.anyHeader = true
+		} else if header != "" {
+			c.headers[header] = true
+		}
+	}
+	return c, nil
+}
+
+// CheckOrigins returns an error if SetOrigins would refuse origins.
+func (c *CORS) CheckOrigins(origins []string) error {
+	if !c.credentials {
+		return nil
+	}
+	for _, origin := range origins {
+		if strings.TrimSpace(origin) == "*" {
+			return errCORSAnyOriginWithCredentials
+		}
+	}
+	return nil
+}
+
+// SetOrigins replaces the allowed origins. The origins in use are kept if
+// the new ones are refused.
+func (c *CORS) SetOrigins(origins []string) error {
+	if err := c.CheckOrigins(origins); err != nil {
+		return err
+	}
+	allowed := &corsOrigins{exact: make(map[string]bool)}
+	for _, origin := range origins {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		switch {
+		case origin == "":
+		case origin == "*":
+			allowed.any = true
+		case strings.Contains(origin, "*"):
+			prefix, suffix, _ := strings.Cut(origin, "*")
+			allowed.wildcards = append(allowed.wildcards, [2]string{prefix, suffix})
+		default:
+			allowed.exact[origin] = true
+		}
+	}
+	c.origins.Store(allowed)
+	return nil
+}
+
+// allowedOrigin reports whether origin may call the API.
+func (c *CORS) allowedOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	allowed := c.origins.Load()
+	if allowed.any || allowed.exact[origin] {
+		return true
+	}
+	for _, wildcard := range allowed.wildcards {
+		prefix, suffix := wildcard[0], wildcard[1]
+		if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+			continue
+		}
+		// The wildcard stands for subdomains only, not for a path, port
+		// or credentials smuggled into the origin.
+		if subdomain := origin[len(prefix) : len(origin)-len(suffix)]; !strings.ContainsAny(subdomain, "/:@") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedMethod reports whether method may be used cross-origin.
+func (c *CORS) allowedMethod(method string) bool {
+	for _, allowed := range c.methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHeaders reports whether all headers of a preflight request, a
+// comma-separated list, may be sent cross-origin.
+func (c *CORS) allowedHeaders(requested string) bool {
+	if c.anyHeader {
+		return true
+	}
+	for _, header := range strings.Split(requested, ",") {
+		if header = strings.ToLower(strings.TrimSpace(header)); header != "" && !c.headers[header] {
+			return false
+		}
+	}
+	return true
+}
+
+// Handler wraps the router: it answers preflight requests itself, since
+// the router has no OPTIONS routes, and adds the CORS headers to the
+// responses of allowed origins.
+func (c *CORS) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if !c.allowedOrigin(origin) || !c.allowedMethod(r.Header.Get("Access-Control-Request-Method")) ||
+				!c.allowedHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+				http.Error(w, "CORS preflight rejected", http.StatusForbidden)
+				return
+			}
+			c.allowOrigin(w, origin)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				w.Header().Set("Access-Control-Allow-Headers", requested)
+			}
+			if c.maxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.maxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if c.allowedOrigin(origin) {
+			c.allowOrigin(w, origin)
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.exposed, ", "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowOrigin sets the headers granting origin access.
+func (c *CORS) allowOrigin(w http.ResponseWriter, origin string) {
+	if c.origins.Load().any {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
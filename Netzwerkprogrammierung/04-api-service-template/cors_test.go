@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	// Setup
+	cors, err := NewCORS([]string{"https://app.example.org", "https://*.example.com"}, nil, nil, false, 0)
+	assert.NoError(t, err)
+
+	// Execute and validate
+	assert.True(t, cors.allowedOrigin("https://app.example.org"))
+	assert.True(t, cors.allowedOrigin("https://APP.example.org"))
+	assert.True(t, cors.allowedOrigin("https://shop.example.com"))
+	assert.True(t, cors.allowedOrigin("https://eu.shop.example.com"))
+	assert.False(t, cors.allowedOrigin("https://example.com"), "the wildcard requires a subdomain")
+	assert.False(t, cors.allowedOrigin("http://shop.example.com"))
+	assert.False(t, cors.allowedOrigin("https://evil.com/.example.com"))
+	assert.False(t, cors.allowedOrigin("https://shop.example.com.evil.com"))
+	assert.False(t, cors.allowedOrigin("https://other.example.org"))
+}
+
+func TestCORSPreflight(t *testing.T) {
+	// Setup
+	cors, err := NewCORS([]string{"https://*.example.com"}, []string{"GET", "POST"}, []string{"Authorization", "Content-Type"}, true, 10*time.Minute)
+	assert.NoError(t, err)
+	handler := cors.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", "/v1/users", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		req.Header.Set("Access-Control-Request-Headers", headers)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Execute
+	allowed := preflight("https://shop.example.com", "POST", "authorization, content-type")
+	wrongMethod := preflight("https://shop.example.com", "DELETE", "")
+	wrongHeader := preflight("https://shop.example.com", "GET", "X-Debug")
+	wrongOrigin := preflight("https://evil.com", "GET", "")
+
+	// Validate
+	assert.Equal(t, http.StatusNoContent, allowed.Code)
+	assert.Equal(t, "https://shop.example.com", allowed.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", allowed.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET, POST", allowed.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "authorization, content-type", allowed.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", allowed.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, allowed.Header().Values("Vary"), "Origin")
+	for _, rr := range []*httptest.ResponseRecorder{wrongMethod, wrongHeader, wrongOrigin} {
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCORSActualRequests(t *testing.T) {
+	// Setup
+	handler := func(cors *CORS) http.Handler {
+		return cors.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	serve := func(h http.Handler, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/users", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	publicCORS, err := NewCORS([]string{"*"}, []string{"GET"}, nil, false, 0)
+	assert.NoError(t, err)
+	public := handler(publicCORS)
+	credentialsCORS, err := NewCORS([]string{"https://*.test"}, []string{"GET"}, nil, true, 0)
+	assert.NoError(t, err)
+	withCredentials := handler(credentialsCORS)
+
+	// Execute
+	anyOrigin := serve(public, "https://a.test")
+	echoed := serve(withCredentials, "https://a.test")
+	sameOrigin := serve(public, "")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, anyOrigin.Code)
+	assert.Equal(t, "*", anyOrigin.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, anyOrigin.Header().Get("Access-Control-Expose-Headers"), "Location")
+	assert.Equal(t, "https://a.test", echoed.Header().Get("Access-Control-Allow-Origin"), "patterns are answered with the origin")
+	assert.Equal(t, "true", echoed.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, http.StatusOK, sameOrigin.Code)
+	assert.Empty(t, sameOrigin.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, sameOrigin.Header().Get("Vary"))
+}
+
+func TestCORSRefusesAnyOriginWithCredentials(t *testing.T) {
+	// Setup
+	cors, err := NewCORS([]string{"https://app.example.com"}, []string{"GET"}, nil, true, 0)
+	assert.NoError(t, err)
+
+	// Execute
+	_, newErr := NewCORS([]string{"https://app.example.com", " * "}, []string{"GET"}, nil, true, 0)
+	setErr := cors.SetOrigins([]string{"*"})
+
+	// Validate
+	assert.ErrorIs(t, newErr, errCORSAnyOriginWithCredentials)
+	assert.ErrorIs(t, setErr, errCORSAnyOriginWithCredentials)
+	assert.False(t, cors.allowedOrigin("https://evil.example.org"))
+	assert.True(t, cors.allowedOrigin("https://app.example.com"), "refused origins leave the current ones in place")
+}
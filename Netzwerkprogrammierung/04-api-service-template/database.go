@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// poolConfig holds the connection pool limits of the database handle.
+type poolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// poolConfigFromEnv reads the pool limits from DB_MAX_OPEN_CONNS,
+// DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME.
+func poolConfigFromEnv() poolConfig {
+	return poolConfig{
+		MaxOpenConns:    envInt("DB_MAX_OPEN_CONNS", 25),
+		MaxIdleConns:    envInt("DB_MAX_IDLE_CONNS", 25),
+		ConnMaxLifetime: envDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+		ConnMaxIdleTime: envDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute),
+	}
+}
+
+// apply sets the limits on db.
+func (c poolConfig) apply(db *sql.DB) {
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+}
+
+// connectBackoff returns the wait before the connection attempt following
+// the given number of failed attempts: base doubled per attempt, capped at
+// max, of which a random half is jitter so restarting instances do not
+// reconnect in lockstep.
+func connectBackoff(attempts int, base, max time.Duration) time.Duration {
+	wait := max
+	if attempts <= 30 {
+		wait = min(base<<(attempts-1), max)
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
+
+// connectWithRetry opens the database and waits until it answers a ping,
+// retrying with exponential backoff until ctx is done.
+func connectWithRetry(ctx context.Context, dsn string, pool poolConfig, logger *slog.Logger) (*sql.DB, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	pool.apply(db)
+
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err = db.PingContext(pingCtx)
+		cancel()
+		if err == nil {
+			logger.Info("Connected to the database")
+			return db, nil
+		}
+
+		wait := connectBackoff(attempt, 500*time.Millisecond, 10*time.Second)
+		logger.Warn("Failed to connect to the database", "attempt", attempt, "retry_in", wait.Round(time.Millisecond), "error", err)
+		select {
+		case <-ctx.Done():
+			db.Close()
+			return nil, fmt.Errorf("could not connect to the database after %d attempts: %w", attempt, err)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// ErrCircuitOpen is returned instead of calling the database while the
+// circuit breaker is open. It wraps ErrStoreUnavailable.
+var ErrCircuitOpen = fmt.Errorf("%w: circuit breaker open", ErrStoreUnavailable)
+
+// CircuitBreaker stops calls to the database after threshold consecutive
+// failures. While open it fails calls immediately; after openTimeout it
+// half-opens and lets a single probe call through, whose outcome closes or
+// reopens it. Only ErrStoreUnavailable and ErrStoreTimeout count as
+// failures, errors caused by the request do not.
+type CircuitBreaker struct {
+	threshold   int
+	openTimeout time.Duration
+	now         func() time.Time
+	logger      *slog.Logger
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+	rejected uint64
+	opened   uint64
+}
+
+// NewCircuitBreaker returns a closed breaker.
+func NewCircuitBreaker(threshold int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		now:         time.Now,
+		logger:      slog.Default(),
+		state:       breakerClosed,
+	}
+}
+
+// Allow reports whether a call may proceed. Every allowed call must be
+// followed by Record with its result.
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && b.now().Sub(b.openedAt) >= b.openTimeout {
+		b.logger.Info("Database circuit breaker half-open, probing")
+		b.state = breakerHalfOpen
+	}
+	switch {
+	case b.state == breakerClosed:
+		return nil
+	case b.state == breakerHalfOpen && !b.probing:
+		b.probing = true
+		return nil
+	default:
+		b.rejected++
+		return ErrCircuitOpen
+	}
+}
+
+// Record reports the result of an allowed call.
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probe := b.state == breakerHalfOpen && b.probing
+	b.probing = false
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client gave up; this says nothing about the database.
+	case errors.Is(err, ErrStoreUnavailable) || errors.Is(err, ErrStoreTimeout):
+		b.failures++
+		if probe || (b.state == breakerClosed && b.failures >= b.threshold) {
+			b.logger.Warn("Database circuit breaker open", "failures", b.failures, "error", err)
+			b.state = breakerOpen
+			b.openedAt = b.now()
+			b.opened++
+		}
+	default:
+		if b.state != breakerClosed {
+			b.logger.Info("Database circuit breaker closed")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+	}
+}
+
+// State returns breakerClosed, breakerOpen or breakerHalfOpen.
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && b.now().Sub(b.openedAt) >= b.openTimeout {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// guard runs fn if the breaker allows it and records the result.
+func (b *CircuitBreaker) guard(fn func() error) error {
+	if err := b.Allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.Record(err)
+	return err
+}
+
+// breakerStats are the counters of a CircuitBreaker for metrics.
+type breakerStats struct {
+	State    string
+	Rejected uint64
+	Opened   uint64
+}
+
+// Stats returns the current state and counters.
+func (b *CircuitBreaker) Stats() breakerStats {
+	state := b.State()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStats{State: state, Rejected: b.rejected, Opened: b.opened}
+}
+
+// breakerStore guards every call to a UserStore with a CircuitBreaker.
+type breakerStore struct {
+	next    UserStore
+	breaker *CircuitBreaker
+}
+
+// newBreakerStore returns a UserStore calling next through breaker.
+func newBreakerStore(next UserStore, breaker *CircuitBreaker) *breakerStore {
+	return &breakerStore{next: next, breaker: breaker}
+}
+
+func (s *breakerStore) EachUser(ctx context.Context, fn func(User) error) error {
+	return s.breaker.guard(func() error { return s.next.EachUser(ctx, fn) })
+}
+
+func (s *breakerStore) GetUser(ctx context.Context, id int) (user User, err error) {
+	err = s.breaker.guard(func() error {
+		user, err = s.next.GetUser(ctx, id)
+		return err
+	})
+	return user, err
+}
+
+func (s *breakerStore) GetUsers(ctx context.Context, ids []int) (users []User, err error) {
+	err = s.breaker.guard(func() error {
+		users, err = s.next.GetUsers(ctx, ids)
+		return err
+	})
+	return users, err
+}
+
+func (s *breakerStore) PageUsers(ctx context.Context, afterID, limit int) (users []User, err error) {
+	err = s.breaker.guard(func() error {
+		users, err = s.next.PageUsers(ctx, afterID, limit)
+		return err
+	})
+	return users, err
+}
+
+func (s *breakerStore) UserExists(ctx context.Context, id int) (exists bool, err error) {
+	err = s.breaker.guard(func() error {
+		exists, err = s.next.UserExists(ctx, id)
+		return err
+	})
+	return exists, err
+}
+
+func (s *breakerStore) CreateUser(ctx context.Context, user User) (created User, err error) {
+	err = s.breaker.guard(func() error {
+		created, err = s.next.CreateUser(ctx, user)
+		return err
+	})
+	return created, err
+}
+
+func (s *breakerStore) UpsertUser(ctx context.Context, user User) (created bool, err error) {
+	err = s.breaker.guard(func() error {
+		created, err = s.next.UpsertUser(ctx, user)
+		return err
+	})
+	return created, err
+}
+
+func (s *breakerStore) UpdateUser(ctx context.Context, user User) error {
+	return s.breaker.guard(func() error { return s.next.UpdateUser(ctx, user) })
+}
+
+func (s *breakerStore) DeleteUser(ctx context.Context, id int) error {
+	return s.breaker.guard(func() error { return s.next.DeleteUser(ctx, id) })
+}
+
+// The stores below guard the other tables with the CircuitBreaker of the
+// user store, so that an unavailable database fails every request fast.
+
+// breakerRoleStore guards every call to a RoleStore with a CircuitBreaker.
+type breakerRoleStore struct {
+	next    RoleStore
+	breaker *CircuitBreaker
+}
+
+func (s *breakerRoleStore) Roles(ctx context.Context, principal string) (roles []string, err error) {
+	err = s.breaker.guard(func() error {
+		roles, err = s.next.Roles(ctx, principal)
+		return err
+	})
+	return roles, err
+}
+
+func (s *breakerRoleStore) GrantRole(ctx context.Context, principal, role string) (granted bool, err error) {
+	err = s.breaker.guard(func() error {
+		granted, err = s.next.GrantRole(ctx, principal, role)
+		return err
+	})
+	return granted, err
+}
+
+func (s *breakerRoleStore) RevokeRole(ctx context.Context, principal, role string) error {
+	return s.breaker.guard(func() error { return s.next.RevokeRole(ctx, principal, role) })
+}
+
+// breakerAPIKeyStore guards every call to an APIKeyStore with a
+// CircuitBreaker.
+type breakerAPIKeyStore struct {
+	next    APIKeyStore
+	breaker *CircuitBreaker
+}
+
+func (s *breakerAPIKeyStore) LookupKey(ctx context.Context, id string) (key APIKey, err error) {
+	err = s.breaker.guard(func() error {
+		key, err = s.next.LookupKey(ctx, id)
+		return err
+	})
+	return key, err
+}
+
+func (s *breakerAPIKeyStore) ListKeys(ctx context.Context) (keys []APIKey, err error) {
+	err = s.breaker.guard(func() error {
+		keys, err = s.next.ListKeys(ctx)
+		return err
+	})
+	return keys, err
+}
+
+func (s *breakerAPIKeyStore) CreateKey(ctx context.Context, key APIKey) error {
+	return s.breaker.guard(func() error { return s.next.CreateKey(ctx, key) })
+}
+
+func (s *breakerAPIKeyStore) RotateKey(ctx context.Context, id string, salt, hash []byte) error {
+	return s.breaker.guard(func() error { return s.next.RotateKey(ctx, id, salt, hash) })
+}
+
+func (s *breakerAPIKeyStore) DeleteKey(ctx context.Context, id string) error {
+	return s.breaker.guard(func() error { return s.next.DeleteKey(ctx, id) })
+}
+
+func (s *breakerAPIKeyStore) TouchKey(ctx context.Context, id string, at time.Time) error {
+	return s.breaker.guard(func() error { return s.next.TouchKey(ctx, id, at) })
+}
+
+// breakerQuotaStore guards every call to a QuotaStore with a CircuitBreaker.
+type breakerQuotaStore struct {
+	next    QuotaStore
+	breaker *CircuitBreaker
+}
+
+func (s *breakerQuotaStore) Consume(ctx context.Context, client string, windows []quotaWindow) (used []int64, allowed bool, err error) {
+	err = s.breaker.guard(func() error {
+		used, allowed, err = s.next.Consume(ctx, client, windows)
+		return err
+	})
+	return used, allowed, err
+}
+
+func (s *breakerQuotaStore) DeleteExpired(ctx context.Context, period string, start time.Time) (deleted int64, err error) {
+	err = s.breaker.guard(func() error {
+		deleted, err = s.next.DeleteExpired(ctx, period, start)
+		return err
+	})
+	return deleted, err
+}
+
+// breakerSessionStore guards every call to a SessionStore with a
+// CircuitBreaker.
+type breakerSessionStore struct {
+	next    SessionStore
+	breaker *CircuitBreaker
+}
+
+func (s *breakerSessionStore) LookupSession(ctx context.Context, id string) (session Session, err error) {
+	err = s.breaker.guard(func() error {
+		session, err = s.next.LookupSession(ctx, id)
+		return err
+	})
+	return session, err
+}
+
+func (s *breakerSessionStore) ListSessions(ctx context.Context, userID int) (sessions []Session, err error) {
+	err = s.breaker.guard(func() error {
+		sessions, err = s.next.ListSessions(ctx, userID)
+		return err
+	})
+	return sessions, err
+}
+
+func (s *breakerSessionStore) CreateSession(ctx context.Context, session Session) error {
+	return s.breaker.guard(func() error { return s.next.CreateSession(ctx, session) })
+}
+
+func (s *breakerSessionStore) RotateSession(ctx context.Context, id string, previous, salt, hash []byte, usedAt, expiresAt time.Time) error {
+	return s.breaker.guard(func() error { return s.next.RotateSession(ctx, id, previous, salt, hash, usedAt, expiresAt) })
+}
+
+func (s *breakerSessionStore) DeleteSession(ctx context.Context, id string) error {
+	return s.breaker.guard(func() error { return s.next.DeleteSession(ctx, id) })
+}
+
+func (s *breakerSessionStore) DeleteUserSessions(ctx context.Context, userID int) error {
+	return s.breaker.guard(func() error { return s.next.DeleteUserSessions(ctx, userID) })
+}
+
+func (s *breakerSessionStore) DeleteExpiredSessions(ctx context.Context, now time.Time) (deleted int64, err error) {
+	err = s.breaker.guard(func() error {
+		deleted, err = s.next.DeleteExpiredSessions(ctx, now)
+		return err
+	})
+	return deleted, err
+}
+
+// breakerCredentialStore guards every call to a CredentialStore with a
+// CircuitBreaker.
+type breakerCredentialStore struct {
+	next    CredentialStore
+	breaker *CircuitBreaker
+}
+
+func (s *breakerCredentialStore) FindCredentials(ctx context.Context, email string) (credentials Credentials, err error) {
+	err = s.breaker.guard(func() error {
+		credentials, err = s.next.FindCredentials(ctx, email)
+		return err
+	})
+	return credentials, err
+}
+
+func (s *breakerCredentialStore) SetCredentials(ctx context.Context, credentials Credentials) error {
+	return s.breaker.guard(func() error { return s.next.SetCredentials(ctx, credentials) })
+}
+
+// breakerLoginGuardStore guards every call to a LoginGuardStore with a
+// CircuitBreaker.
+type breakerLoginGuardStore struct {
+	next    LoginGuardStore
+	breaker *CircuitBreaker
+}
+
+func (s *breakerLoginGuardStore) UpdateRecords(ctx context.Context, keys []guardKey, fn func(recs []*failureRecord)) error {
+	return s.breaker.guard(func() error { return s.next.UpdateRecords(ctx, keys, fn) })
+}
+
+func (s *breakerLoginGuardStore) GetRecord(ctx context.Context, key guardKey) (rec *failureRecord, err error) {
+	err = s.breaker.guard(func() error {
+		rec, err = s.next.GetRecord(ctx, key)
+		return err
+	})
+	return rec, err
+}
+
+func (s *breakerLoginGuardStore) ListRecords(ctx context.Context) (recs map[guardKey]failureRecord, err error) {
+	err = s.breaker.guard(func() error {
+		recs, err = s.next.ListRecords(ctx)
+		return err
+	})
+	return recs, err
+}
+
+func (s *breakerLoginGuardStore) DeleteRecord(ctx context.Context, key guardKey) (deleted bool, err error) {
+	err = s.breaker.guard(func() error {
+		deleted, err = s.next.DeleteRecord(ctx, key)
+		return err
+	})
+	return deleted, err
+}
+
+func (s *breakerLoginGuardStore) UseChallenge(ctx context.Context, challenge string, expires time.Time) (fresh bool, err error) {
+	err = s.breaker.guard(func() error {
+		fresh, err = s.next.UseChallenge(ctx, challenge, expires)
+		return err
+	})
+	return fresh, err
+}
+
+func (s *breakerLoginGuardStore) DeleteStale(ctx context.Context, now, failedBefore, attemptedBefore time.Time) (deleted int64, err error) {
+	err = s.breaker.guard(func() error {
+		deleted, err = s.next.DeleteStale(ctx, now, failedBefore, attemptedBefore)
+		return err
+	})
+	return deleted, err
+}
+
+// breakerWebhookStore guards every call to a WebhookStore with a
+// CircuitBreaker.
+type breakerWebhookStore struct {
+	next    WebhookStore
+	breaker *CircuitBreaker
+}
+
+func (s *breakerWebhookStore) CreateSubscription(ctx context.Context, sub WebhookSubscription) (created WebhookSubscription, err error) {
+	err = s.breaker.guard(func() error {
+		created, err = s.next.CreateSubscription(ctx, sub)
+		return err
+	})
+	return created, err
+}
+
+func (s *breakerWebhookStore) ListSubscriptions(ctx context.Context) (subs []WebhookSubscription, err error) {
+	err = s.breaker.guard(func() error {
+		subs, err = s.next.ListSubscriptions(ctx)
+		return err
+	})
+	return subs, err
+}
+
+func (s *breakerWebhookStore) GetSubscription(ctx context.Context, id int) (sub WebhookSubscription, err error) {
+	err = s.breaker.guard(func() error {
+		sub, err = s.next.GetSubscription(ctx, id)
+		return err
+	})
+	return sub, err
+}
+
+func (s *breakerWebhookStore) UpdateSubscription(ctx context.Context, sub WebhookSubscription) error {
+	return s.breaker.guard(func() error { return s.next.UpdateSubscription(ctx, sub) })
+}
+
+func (s *breakerWebhookStore) DeleteSubscription(ctx context.Context, id int) error {
+	return s.breaker.guard(func() error { return s.next.DeleteSubscription(ctx, id) })
+}
+
+func (s *breakerWebhookStore) SubscriptionSucceeded(ctx context.Context, id int) error {
+	return s.breaker.guard(func() error { return s.next.SubscriptionSucceeded(ctx, id) })
+}
+
+func (s *breakerWebhookStore) SubscriptionFailed(ctx context.Context, id, disableAfter int, reason string) (sub WebhookSubscription, err error) {
+	err = s.breaker.guard(func() error {
+		sub, err = s.next.SubscriptionFailed(ctx, id, disableAfter, reason)
+		return err
+	})
+	return sub, err
+}
+
+func (s *breakerWebhookStore) CreateDelivery(ctx context.Context, delivery WebhookDelivery) (created WebhookDelivery, err error) {
+	err = s.breaker.guard(func() error {
+		created, err = s.next.CreateDelivery(ctx, delivery)
+		return err
+	})
+	return created, err
+}
+
+func (s *breakerWebhookStore) GetDelivery(ctx context.Context, id int) (delivery WebhookDelivery, err error) {
+	err = s.breaker.guard(func() error {
+		delivery, err = s.next.GetDelivery(ctx, id)
+		return err
+	})
+	return delivery, err
+}
+
+func (s *breakerWebhookStore) ListDeliveries(ctx context.Context, subscriptionID int) (deliveries []WebhookDelivery, err error) {
+	err = s.breaker.guard(func() error {
+		deliveries, err = s.next.ListDeliveries(ctx, subscriptionID)
+		return err
+	})
+	return deliveries, err
+}
+
+func (s *breakerWebhookStore) UpdateDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	return s.breaker.guard(func() error { return s.next.UpdateDelivery(ctx, delivery) })
+}
+
+func (s *breakerWebhookStore) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) (deliveries []WebhookDelivery, err error) {
+	err = s.breaker.guard(func() error {
+		deliveries, err = s.next.ClaimDeliveries(ctx, now, lease, limit)
+		return err
+	})
+	return deliveries, err
+}
+
+// breakerInvalidationBus guards the invalidations an InvalidationBus
+// publishes with a CircuitBreaker. Subscriptions reconnect by themselves
+// and are not guarded.
+type breakerInvalidationBus struct {
+	next    InvalidationBus
+	breaker *CircuitBreaker
+}
+
+func (b *breakerInvalidationBus) Publish(ctx context.Context, inv Invalidation) error {
+	return b.breaker.guard(func() error { return b.next.Publish(ctx, inv) })
+}
+
+func (b *breakerInvalidationBus) Subscribe(ctx context.Context, handle func(Invalidation), resync func()) {
+	b.next.Subscribe(ctx, handle, resync)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCircuitBreakerOpensAndHalfOpens(t *testing.T) {
+	// Setup
+	now := time.Unix(0, 0)
+	b := NewCircuitBreaker(2, 10*time.Second)
+	b.now = func() time.Time { return now }
+	unavailable := ErrStoreUnavailable
+
+	// Execute and validate
+	assert.NoError(t, b.Allow())
+	b.Record(ErrUserNotFound) // request errors do not count
+	assert.NoError(t, b.Allow())
+	b.Record(unavailable)
+	assert.NoError(t, b.Allow())
+	b.Record(ErrStoreTimeout)
+	assert.Equal(t, breakerOpen, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+	assert.ErrorIs(t, b.Allow(), ErrStoreUnavailable)
+
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, breakerHalfOpen, b.State())
+	assert.NoError(t, b.Allow(), "the first call after the timeout probes")
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen, "only one probe at a time")
+	b.Record(unavailable)
+	assert.Equal(t, breakerOpen, b.State(), "a failed probe reopens")
+
+	now = now.Add(10 * time.Second)
+	assert.NoError(t, b.Allow())
+	b.Record(nil)
+	assert.Equal(t, breakerClosed, b.State())
+	assert.NoError(t, b.Allow())
+
+	stats := b.Stats()
+	assert.Equal(t, uint64(2), stats.Opened)
+	assert.Equal(t, uint64(3), stats.Rejected)
+}
+
+func TestBreakerStoreFailsFast(t *testing.T) {
+	// Setup
+	storeDB, storeMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer storeDB.Close()
+	s := newBreakerStore(newSQLStore(storeDB), NewCircuitBreaker(3, time.Minute))
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	// Mock DB response
+	for i := 0; i < 3; i++ {
+		storeMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WillReturnError(refused)
+	}
+
+	// Execute
+	var errs []error
+	for i := 0; i < 5; i++ {
+		_, err := s.GetUser(context.Background(), 1)
+		errs = append(errs, err)
+	}
+
+	// Validate
+	for _, err := range errs[:3] {
+		assert.ErrorIs(t, err, refused)
+	}
+	for _, err := range errs[3:] {
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+	}
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
+
+func TestConnectBackoff(t *testing.T) {
+	// Execute and validate
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second, 100: 10 * time.Second} {
+		wait := connectBackoff(attempt, time.Second, 10*time.Second)
+		assert.GreaterOrEqual(t, wait, want/2)
+		assert.LessOrEqual(t, wait, want)
+	}
+}
+
+func TestServerGuardsAllStoresWithBreaker(t *testing.T) {
+	// Setup
+	breaker := NewCircuitBreaker(1, time.Minute)
+	s, mock := newTestServer(t, WithCircuitBreaker(breaker), WithQuotas(10, 0),
+		WithAccessControl([]byte("secret"), nil), WithLogin(time.Minute, time.Hour, bcrypt.MinCost))
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	ctx := context.Background()
+
+	// Mock DB response
+	mock.ExpectQuery("SELECT role FROM principal_roles").WillReturnError(refused)
+
+	// Execute
+	_, rolesErr := s.roles.Roles(ctx, "alice")
+	_, keyErr := s.apiKeys.LookupKey(ctx, "key")
+	_, webhookErr := s.webhooks.store.ListSubscriptions(ctx)
+	_, _, quotaErr := s.quotas.store.Consume(ctx, "client", []quotaWindow{{period: "day", start: time.Now(), limit: 10}})
+	_, sessionErr := s.sessions.LookupSession(ctx, "session")
+	_, credentialsErr := s.credentials.FindCredentials(ctx, "alice@example.com")
+	_, guardErr := s.loginGuard.store.ListRecords(ctx)
+	busErr := s.invalidator.bus.Publish(ctx, Invalidation{})
+
+	// Validate
+	assert.ErrorIs(t, rolesErr, refused)
+	for _, err := range []error{keyErr, webhookErr, quotaErr, sessionErr, credentialsErr, guardErr, busErr} {
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReadinessAndMetricsReportBreaker(t *testing.T) {
+	// Setup
+	now := time.Unix(0, 0)
+	breaker := NewCircuitBreaker(1, time.Minute)
+	breaker.now = func() time.Time { return now }
+	router, _ := newTestServer(t, WithCircuitBreaker(breaker))
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	// Execute
+	ready := get("/readyz")
+	assert.NoError(t, breaker.Allow())
+	breaker.Record(ErrStoreUnavailable)
+	notReady := get("/readyz")
+	metricsBody := get("/metrics").Body.String()
+	live := get("/healthz")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, ready.Code)
+	assert.JSONEq(t, `{"status":"ready","database":"up","circuit_breaker":"closed"}`, ready.Body.String())
+	assert.Equal(t, http.StatusServiceUnavailable, notReady.Code)
+	assert.JSONEq(t, `{"status":"unavailable","database":"down","circuit_breaker":"open"}`, notReady.Body.String())
+	assert.Contains(t, metricsBody, "# TYPE db_circuit_breaker_state gauge\n")
+	assert.Contains(t, metricsBody, `db_circuit_breaker_state{state="open"} 1`+"\n")
+	assert.Contains(t, metricsBody, `db_circuit_breaker_state{state="closed"} 0`+"\n")
+	assert.Contains(t, metricsBody, "db_circuit_breaker_opened_total 1\n")
+	assert.Contains(t, metricsBody, "db_pool_open_connections ")
+	assert.Equal(t, http.StatusOK, live.Code)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// User lifecycle event types.
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+)
+
+// userEventTypes lists every event type a subscriber can receive.
+var userEventTypes = []string{EventUserCreated, EventUserUpdated, EventUserDeleted}
+
+// UserEvent describes a change to a user. For user.deleted only the id of
+// Data is set. Tenant is the tenant owning the user if tenancy is enabled.
+type UserEvent struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Tenant     string    `json:"tenant,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       User      `json:"data"`
+}
+
+// newUserEvent returns an event of the given type with a random id.
+func newUserEvent(eventType string, user User) UserEvent {
+	return UserEvent{
+		ID:         randomHex(16),
+		Type:       eventType,
+		OccurredAt: time.Now().UTC(),
+		Data:       user,
+	}
+}
+
+// randomHex returns n random bytes encoded as hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// eventingStore wraps a UserStore and emits a UserEvent after every
+// successful mutation.
+type eventingStore struct {
+	UserStore
+	emit func(UserEvent)
+}
+
+// newEventingStore returns a UserStore passing every lifecycle event of next
+// to emit.
+func newEventingStore(next UserStore, emit func(UserEvent)) *eventingStore {
+	return &eventingStore{UserStore: next, emit: emit}
+}
+
+// emitFor emits an event of the given type in the tenant of ctx.
+func (s *eventingStore) emitFor(ctx context.Context, eventType string, user User) {
+	event := newUserEvent(eventType, user)
+	event.Tenant = tenantFrom(ctx)
+	s.emit(event)
+}
+
+func (s *eventingStore) CreateUser(ctx context.Context, user User) (User, error) {
+	user, err := s.UserStore.CreateUser(ctx, user)
+	if err == nil {
+		s.emitFor(ctx, EventUserCreated, user)
+	}
+	return user, err
+}
+
+func (s *eventingStore) UpsertUser(ctx context.Context, user User) (bool, error) {
+	created, err := s.UserStore.UpsertUser(ctx, user)
+	if err == nil && created {
+		s.emitFor(ctx, EventUserCreated, user)
+	} else if err == nil {
+		s.emitFor(ctx, EventUserUpdated, user)
+	}
+	return created, err
+}
+
+func (s *eventingStore) UpdateUser(ctx context.Context, user User) error {
+	err := s.UserStore.UpdateUser(ctx, user)
+	if err == nil {
+		s.emitFor(ctx, EventUserUpdated, user)
+	}
+	return err
+}
+
+func (s *eventingStore) DeleteUser(ctx context.Context, id int) error {
+	err := s.UserStore.DeleteUser(ctx, id)
+	if err == nil {
+		s.emitFor(ctx, EventUserDeleted, User{ID: id})
+	}
+	return err
+}
@@ -5,7 +5,9 @@ go 1.22.3
 require (
 	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/gorilla/mux v1.8.1
+	github.com/graph-gophers/graphql-go v1.5.0
 	github.com/jackc/pgx/v4 v4.18.3
+	golang.org/x/crypto v0.20.0
 	golang.org/x/time v0.5.0
 )
 
@@ -24,6 +26,5 @@ require (
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
 	github.com/jackc/pgtype v1.14.0 // indirect
 	github.com/stretchr/testify v1.9.0
-	golang.org/x/crypto v0.20.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 )
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+)
+
+const (
+	// maxGraphQLBodySize bounds the size of a GraphQL request.
+	maxGraphQLBodySize = 1 << 20
+	// maxUsersPageSize is the largest page the users query returns.
+	maxUsersPageSize = 100
+)
+
+// userQuerySchema is the part of the schema served over GET.
+const userQuerySchema = `
+type Query {
+	"Looks up a user by id."
+	user(id: ID!): User
+	"Lists users in ascending id order."
+	users(
+		"The page size, at most 100."
+		first: Int = 20
+		"The endCursor of the previous page."
+		after: String
+	): UserConnection!
+}
+
+"A user of the system."
+type User {
+	id: ID!
+	name: String!
+}
+
+"A page of users in ascending id order."
+type UserConnection {
+	nodes: [User!]!
+	pageInfo: PageInfo!
+}
+
+"Pagination state of a connection."
+type PageInfo {
+	hasNextPage: Boolean!
+	"The cursor to pass as after to fetch the next page."
+	endCursor: String
+}
+`
+
+// userSchema is the schema served at /graphql over POST.
+const userSchema = userQuerySchema + `
+type Mutation {
+	createUser(name: String!): User!
+	updateUser(id: ID!, name: String!): User!
+	"Deletes a user and returns true."
+	deleteUser(id: ID!): Boolean!
+}
+`
+
+// gqlNoMutations is the error graphql-go returns when a mutation is sent to
+// a schema without mutations, here the one served over GET.
+const gqlNoMutations = "no mutations are offered by the schema"
+
+// userCursor encodes the opaque cursor pointing after the given user.
+func userCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("user:" + strconv.Itoa(id)))
+}
+
+// parseUserCursor decodes a cursor returned by userCursor.
+func parseUserCursor(cursor string) (int, bool) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(string(decoded), "user:"))
+	return id, err == nil && strings.HasPrefix(string(decoded), "user:")
+}
+
+// parseUserID converts an ID argument to a user id.
+func parseUserID(arg graphql.ID) (int, error) {
+	id, err := strconv.Atoi(string(arg))
+	if err != nil || id <= 0 {
+		return 0, gqlUserError("BAD_USER_INPUT", "id must be a positive integer")
+	}
+	return id, nil
+}
+
+// gqlError is an error reported to the client with a code in its
+// extensions.
+type gqlError struct {
+	message    string
+	extensions map[string]any
+}
+
+func (e *gqlError) Error() string { return e.message }
+
+// Extensions is read by graphql-go to fill in the extensions of the error.
+func (e *gqlError) Extensions() map[string]any { return e.extensions }
+
+// gqlUserError returns an error reported to the client with the given code.
+func gqlUserError(code, format string, args ...any) *gqlError {
+	return &gqlError{message: fmt.Sprintf(format, args...), extensions: map[string]any{"code": code}}
+}
+
+// gqlPlan is the cost of an operation. Every user a query can return costs
+// one point, and every mutation one point. The operation is planned by
+// executing it once with resolvers that only add up their cost, so that
+// fragments, aliases, variables and directives count exactly as they will
+// when it runs. Nothing is read or written until the whole operation is
+// known to fit the budget. The plan also collects the ids of the user
+// fields, so that they are loaded together (see gqlUserLoader).
+type gqlPlan struct {
+	cost atomic.Int64
+
+	mu      sync.Mutex
+	userIDs []int
+}
+
+type gqlPlanKey struct{}
+
+// planning returns the plan of ctx if the resolvers only plan the operation.
+func planning(ctx context.Context) (*gqlPlan, bool) {
+	plan, ok := ctx.Value(gqlPlanKey{}).(*gqlPlan)
+	return plan, ok
+}
+
+// charge adds cost to the plan of ctx and reports whether the resolver
+// only plans and has to return without doing the work.
+func charge(ctx context.Context, cost int) bool {
+	plan, ok := planning(ctx)
+	if ok {
+		plan.cost.Add(int64(cost))
+	}
+	return ok
+}
+
+// gqlUserLoader loads the users looked up by id in one request with a
+// single store call, instead of one call per user field.
+type gqlUserLoader struct {
+	ids   []int
+	once  sync.Once
+	users map[int]User
+	err   error
+}
+
+type gqlUserLoaderKey struct{}
+
+// load returns the user with id, loading all planned users on the first
+// call. Ids missing from the plan are looked up on their own.
+func (l *gqlUserLoader) load(ctx context.Context, users *userService, id int) (User, error) {
+	if !slices.Contains(l.ids, id) {
+		return users.findUser(ctx, id)
+	}
+	l.once.Do(func() {
+		var found []User
+		found, l.err = users.findUsers(ctx, l.ids)
+		l.users = make(map[int]User, len(found))
+		for _, user := range found {
+			l.users[user.ID] = user
+		}
+	})
+	if l.err != nil {
+		return User{}, l.err
+	}
+	user, found := l.users[id]
+	if !found {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// gqlResolver resolves the root fields of the schema.
+type gqlResolver struct {
+	users  *userService
+	logger *slog.Logger
+}
+
+// fieldError maps errors of the business layer to errors for the client.
+// Anything unexpected is logged and reported as an internal error.
+func (res *gqlResolver) fieldError(err error) error {
+	var validationErr *ValidationError
+	var permissionErr *PermissionError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &validationErr):
+		gqlErr := gqlUserError("BAD_USER_INPUT", "%s", validationErr.Message)
+		gqlErr.extensions["field"] = validationErr.Field
+		return gqlErr
+	case errors.As(err, &permissionErr):
+		gqlErr := gqlUserError("FORBIDDEN", "Permission denied")
+		gqlErr.extensions["missingPermission"] = permissionErr.Permission
+		return gqlErr
+	case errors.Is(err, ErrUserNotFound):
+		return gqlUserError("NOT_FOUND", "User not found")
+	case errors.Is(err, ErrStoreTimeout):
+		return gqlUserError("TIMEOUT", "Database operation timed out")
+	case errors.Is(err, ErrStoreUnavailable):
+		return gqlUserError("SERVICE_UNAVAILABLE", "Database unavailable")
+	default:
+		res.logger.Error("GraphQL field failed", "error", err)
+		return gqlUserError("INTERNAL_SERVER_ERROR", "Internal server error")
+	}
+}
+
+func (res *gqlResolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*gqlUser, error) {
+	id, err := parseUserID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	if plan, ok := planning(ctx); ok {
+		plan.cost.Add(1)
+		plan.mu.Lock()
+		plan.userIDs = append(plan.userIDs, id)
+		plan.mu.Unlock()
+		return nil, nil
+	}
+	user, err := ctx.Value(gqlUserLoaderKey{}).(*gqlUserLoader).load(ctx, res.users, id)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, res.fieldError(err)
+	}
+	return &gqlUser{user}, nil
+}
+
+func (res *gqlResolver) Users(ctx context.Context, args struct {
+	First int32
+	After *string
+}) (*gqlUserConnection, error) {
+	first := int(args.First)
+	if first < 0 || first > maxUsersPageSize {
+		return nil, gqlUserError("BAD_USER_INPUT", "first must be between 0 and %d", maxUsersPageSize)
+	}
+	afterID := 0
+	if args.After != nil {
+		var ok bool
+		if afterID, ok = parseUserCursor(*args.After); !ok {
+			return nil, gqlUserError("BAD_USER_INPUT", "after is not a valid cursor")
+		}
+	}
+	if charge(ctx, max(first, 1)) {
+		return &gqlUserConnection{}, nil
+	}
+
+	page, err := res.users.pageUsers(ctx, afterID, first+1)
+	if err != nil {
+		return nil, res.fieldError(err)
+	}
+	return &gqlUserConnection{nodes: page[:min(first, len(page))], hasNextPage: len(page) > first}, nil
+}
+
+func (res *gqlResolver) CreateUser(ctx context.Context, args struct{ Name string }) (*gqlUser, error) {
+	if charge(ctx, 1) {
+		return &gqlUser{User{Name: args.Name}}, nil
+	}
+	user, err := res.users.addUser(ctx, User{Name: args.Name})
+	if err != nil {
+		return nil, res.fieldError(err)
+	}
+	return &gqlUser{user}, nil
+}
+
+func (res *gqlResolver) UpdateUser(ctx context.Context, args struct {
+	ID   graphql.ID
+	Name string
+}) (*gqlUser, error) {
+	id, err := parseUserID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	user := User{ID: id, Name: args.Name}
+	if charge(ctx, 1) {
+		return &gqlUser{user}, nil
+	}
+	if err := res.users.saveUser(ctx, user); err != nil {
+		return nil, res.fieldError(err)
+	}
+	return &gqlUser{user}, nil
+}
+
+func (res *gqlResolver) DeleteUser(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	id, err := parseUserID(args.ID)
+	if err != nil {
+		return false, err
+	}
+	if charge(ctx, 1) {
+		return true, nil
+	}
+	if err := res.users.removeUser(ctx, id); err != nil {
+		return false, res.fieldError(err)
+	}
+	return true, nil
+}
+
+// gqlUser resolves the User type.
+type gqlUser struct{ user User }
+
+func (u *gqlUser) ID() graphql.ID { return graphql.ID(strconv.Itoa(u.user.ID)) }
+func (u *gqlUser) Name() string   { return u.user.Name }
+
+// gqlUserConnection resolves the UserConnection and PageInfo types.
+type gqlUserConnection struct {
+	nodes       []User
+	hasNextPage bool
+}
+
+func (c *gqlUserConnection) Nodes() []*gqlUser {
+	users := make([]*gqlUser, len(c.nodes))
+	for i, user := range c.nodes {
+		users[i] = &gqlUser{user}
+	}
+	return users
+}
+
+func (c *gqlUserConnection) PageInfo() *gqlUserConnection { return c }
+func (c *gqlUserConnection) HasNextPage() bool            { return c.hasNextPage }
+
+func (c *gqlUserConnection) EndCursor() *string {
+	if len(c.nodes) == 0 {
+		return nil
+	}
+	cursor := userCursor(c.nodes[len(c.nodes)-1].ID)
+	return &cursor
+}
+
+// GraphQLServer serves the users schema over HTTP. Queries nested deeper
+// than maxDepth are rejected when they are validated; operations costing
+// more than maxComplexity points (see gqlPlan) are rejected with
+// QUERY_TOO_COMPLEX before they run.
+type GraphQLServer struct {
+	schema        *graphql.Schema
+	querySchema   *graphql.Schema // without mutations, for GET requests
+	maxComplexity int
+}
+
+// NewGraphQLServer returns a server for the users schema.
+func NewGraphQLServer(users *userService, logger *slog.Logger, maxDepth, maxComplexity int) *GraphQLServer {
+	resolver := &gqlResolver{users: users, logger: logger}
+	options := []graphql.SchemaOpt{graphql.MaxDepth(maxDepth)}
+	return &GraphQLServer{
+		schema:        graphql.MustParseSchema(userSchema, resolver, options...),
+		querySchema:   graphql.MustParseSchema(userQuerySchema, resolver, options...),
+		maxComplexity: maxComplexity,
+	}
+}
+
+// ServeHTTP accepts queries as GET parameters or as a JSON POST body with
+// query, operationName and variables. Mutations must be posted.
+func (s *GraphQLServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Query         string         `json:"query"`
+		OperationName string         `json:"operationName"`
+		Variables     map[string]any `json:"variables"`
+	}
+
+	schema := s.schema
+	switch r.Method {
+	case http.MethodGet:
+		schema = s.querySchema
+		query := r.URL.Query()
+		params.Query = query.Get("query")
+		params.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &params.Variables); err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, "Variables are invalid JSON.", "")
+				return
+			}
+		}
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxGraphQLBodySize+1))
+		if err != nil || len(body) > maxGraphQLBodySize {
+			writeGraphQLError(w, http.StatusRequestEntityTooLarge, "Request body too large.", "")
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql") {
+			params.Query = string(body)
+			break
+		}
+		if err := json.Unmarshal(body, &params); err != nil {
+			writeGraphQLError(w, http.StatusBadRequest, "Body is not a valid GraphQL request: "+err.Error(), "")
+			return
+		}
+	}
+	if params.Query == "" {
+		writeGraphQLError(w, http.StatusBadRequest, "Must provide query string.", "")
+		return
+	}
+
+	if errs := schema.ValidateWithVariables(params.Query, params.Variables); len(errs) > 0 {
+		for _, err := range errs {
+			if err.Rule == "MaxDepthExceeded" {
+				err.Extensions = map[string]any{"code": "QUERY_TOO_DEEP"}
+			}
+		}
+		writeGraphQL(w, http.StatusBadRequest, &graphql.Response{Errors: errs})
+		return
+	}
+
+	plan := &gqlPlan{}
+	planned := schema.Exec(context.WithValue(r.Context(), gqlPlanKey{}, plan), params.Query, params.OperationName, params.Variables)
+	if len(planned.Errors) == 1 && planned.Errors[0].Message == gqlNoMutations {
+		w.Header().Set("Allow", http.MethodPost)
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "Mutations must be sent with POST.", "")
+		return
+	}
+	if plan.cost.Load() > int64(s.maxComplexity) {
+		writeGraphQLError(w, http.StatusBadRequest,
+			fmt.Sprintf("Query may return more than %d users.", s.maxComplexity), "QUERY_TOO_COMPLEX")
+		return
+	}
+	ctx := context.WithValue(r.Context(), gqlUserLoaderKey{}, &gqlUserLoader{ids: plan.userIDs})
+	writeGraphQL(w, http.StatusOK, schema.Exec(ctx, params.Query, params.OperationName, params.Variables))
+}
+
+// writeGraphQLError writes a response without data carrying a single error
+// with the given message and, unless empty, code.
+func writeGraphQLError(w http.ResponseWriter, status int, message, code string) {
+	err := &gqlerrors.QueryError{Message: message}
+	if code != "" {
+		err.Extensions = map[string]any{"code": code}
+	}
+	writeGraphQL(w, status, &graphql.Response{Errors: []*gqlerrors.QueryError{err}})
+}
+
+func writeGraphQL(w http.ResponseWriter, status int, response *graphql.Response) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
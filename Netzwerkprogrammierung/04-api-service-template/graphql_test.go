@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postGraphQL(t *testing.T, handler http.Handler, query string, variables map[string]any) (int, map[string]any) {
+	body, err := json.Marshal(map[string]any{"query": query, "variables": variables})
+	assert.NoError(t, err)
+	req, err := http.NewRequest("POST", "/graphql", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	var response map[string]any
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return rr.Code, response
+}
+
+func TestGraphQLQueriesAndMutations(t *testing.T) {
+	// Setup
+	router := NewServer()
+	for _, name := range []string{"John Doe", "Jane Doe", "Jim Doe"} {
+		_, err := router.users.addUser(context.Background(), User{Name: name})
+		assert.NoError(t, err)
+	}
+
+	// Execute
+	_, created := postGraphQL(t, router, `mutation Create($name: String!) { createUser(name: $name) { id name } }`, map[string]any{"name": "Jill Doe"})
+	_, updated := postGraphQL(t, router, `mutation { updateUser(id: 2, name: "Janet Doe") { ...UserFields } } fragment UserFields on User { id name __typename }`, nil)
+	_, deleted := postGraphQL(t, router, `mutation { deleteUser(id: "3") }`, nil)
+	_, firstPage := postGraphQL(t, router, `{ users(first: 2) { nodes { id name } pageInfo { hasNextPage endCursor } } }`, nil)
+	cursor := firstPage["data"].(map[string]any)["users"].(map[string]any)["pageInfo"].(map[string]any)["endCursor"]
+	_, secondPage := postGraphQL(t, router, `query Next($after: String) { users(first: 2, after: $after) { nodes { id } pageInfo { hasNextPage } } }`, map[string]any{"after": cursor})
+	_, skipped := postGraphQL(t, router, `query($withName: Boolean!) { user(id: 1) { id name @include(if: $withName) } }`, map[string]any{"withName": false})
+
+	// Validate
+	assert.Equal(t, map[string]any{"createUser": map[string]any{"id": "4", "name": "Jill Doe"}}, created["data"])
+	assert.Equal(t, map[string]any{"updateUser": map[string]any{"id": "2", "name": "Janet Doe", "__typename": "User"}}, updated["data"])
+	assert.Equal(t, map[string]any{"deleteUser": true}, deleted["data"])
+	assert.Equal(t, map[string]any{"users": map[string]any{
+		"nodes":    []any{map[string]any{"id": "1", "name": "John Doe"}, map[string]any{"id": "2", "name": "Janet Doe"}},
+		"pageInfo": map[string]any{"hasNextPage": true, "endCursor": userCursor(2)},
+	}}, firstPage["data"])
+	assert.Equal(t, map[string]any{"users": map[string]any{
+		"nodes":    []any{map[string]any{"id": "4"}},
+		"pageInfo": map[string]any{"hasNextPage": false},
+	}}, secondPage["data"])
+	assert.Equal(t, map[string]any{"user": map[string]any{"id": "1"}}, skipped["data"])
+}
+
+// countingStore counts the user lookups of a store.
+type countingStore struct {
+	UserStore
+	getUser  atomic.Int32
+	getUsers atomic.Int32
+}
+
+func (s *countingStore) GetUser(ctx context.Context, id int) (User, error) {
+	s.getUser.Add(1)
+	return s.UserStore.GetUser(ctx, id)
+}
+
+func (s *countingStore) GetUsers(ctx context.Context, ids []int) ([]User, error) {
+	s.getUsers.Add(1)
+	return s.UserStore.GetUsers(ctx, ids)
+}
+
+func TestGraphQLBatchesUserLookups(t *testing.T) {
+	// Setup
+	store := &countingStore{UserStore: newMemoryStore()}
+	router := NewServer(WithStore(store))
+	for _, name := range []string{"John Doe", "Jane Doe", "Jim Doe"} {
+		_, err := router.users.addUser(context.Background(), User{Name: name})
+		assert.NoError(t, err)
+	}
+
+	// Execute
+	status, response := postGraphQL(t, router, `query($id: ID!) {
+		a: user(id: 1) { id name } b: user(id: 2) { name } c: user(id: $id) { id } d: user(id: 7) { id } e: user(id: 1) { name }
+	}`, map[string]any{"id": "3"})
+
+	// Validate
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, map[string]any{
+		"a": map[string]any{"id": "1", "name": "John Doe"},
+		"b": map[string]any{"name": "Jane Doe"},
+		"c": map[string]any{"id": "3"},
+		"d": nil,
+		"e": map[string]any{"name": "John Doe"},
+	}, response["data"])
+	assert.Equal(t, int32(1), store.getUsers.Load())
+	assert.Zero(t, store.getUser.Load())
+}
+
+func TestGraphQLRejectsTooExpensiveQueries(t *testing.T) {
+	// Setup
+	server := NewServer(WithGraphQLLimits(3, 50))
+
+	// Execute
+	deepStatus, deep := postGraphQL(t, server, `{ users { pageInfo { ...Info } } } fragment Info on PageInfo { hasNextPage }`, nil)
+	okStatus, _ := postGraphQL(t, server, `{ users(first: 30) { nodes { id name } } }`, nil)
+	complexStatus, complex := postGraphQL(t, server, `{ users(first: 100) { nodes { id name } } }`, nil)
+	aliasedStatus, aliased := postGraphQL(t, server, `{ a: users(first: 30) { nodes { id } } b: users(first: 30) { nodes { id } } }`, nil)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, deepStatus)
+	assert.Nil(t, deep["errors"])
+	assert.Equal(t, http.StatusOK, okStatus)
+	assert.Equal(t, http.StatusBadRequest, complexStatus)
+	assert.Nil(t, complex["data"])
+	assert.Equal(t, "QUERY_TOO_COMPLEX", complex["errors"].([]any)[0].(map[string]any)["extensions"].(map[string]any)["code"])
+	assert.Equal(t, http.StatusBadRequest, aliasedStatus, "the budget is shared by all fields of a request")
+	assert.Nil(t, aliased["data"])
+
+	tooDeepStatus, tooDeep := postGraphQL(t, NewServer(WithGraphQLLimits(2, 100)), `{ users { pageInfo { hasNextPage } } }`, nil)
+	assert.Equal(t, http.StatusBadRequest, tooDeepStatus)
+	assert.Equal(t, "QUERY_TOO_DEEP", tooDeep["errors"].([]any)[0].(map[string]any)["extensions"].(map[string]any)["code"])
+
+}
+
+func TestGraphQLRejectsTooExpensiveMutationsBeforeWriting(t *testing.T) {
+	// Setup
+	server := NewServer(WithGraphQLLimits(15, 3))
+
+	// Execute
+	status, response := postGraphQL(t, server, `mutation {
+		a: createUser(name: "A") { id } b: createUser(name: "B") { id } c: createUser(name: "C") { id }
+		d: createUser(name: "D") { id } e: createUser(name: "E") { id }
+	}`, nil)
+
+	// Validate
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Nil(t, response["data"])
+	exists, _ := server.store.UserExists(context.Background(), 1)
+	assert.False(t, exists, "no part of a rejected operation runs")
+}
+
+func TestGraphQLIntrospection(t *testing.T) {
+	// Setup
+	query := `
+		query IntrospectionQuery {
+			__schema {
+				queryType { name }
+				mutationType { name }
+				subscriptionType { name }
+				types { ...FullType }
+				directives { name locations args { ...InputValue } }
+			}
+			user: __type(name: "User") { name fields { name type { ...TypeRef } } }
+		}
+		fragment FullType on __Type {
+			kind name description
+			fields(includeDeprecated: true) { name args { ...InputValue } type { ...TypeRef } isDeprecated deprecationReason }
+			inputFields { ...InputValue }
+			interfaces { ...TypeRef }
+			enumValues(includeDeprecated: true) { name isDeprecated }
+			possibleTypes { ...TypeRef }
+		}
+		fragment InputValue on __InputValue { name description type { ...TypeRef } defaultValue }
+		fragment TypeRef on __Type { kind name ofType { kind name ofType { kind name ofType { kind name } } } }`
+
+	// Execute
+	status, response := postGraphQL(t, NewServer(), query, nil)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, status)
+	assert.Nil(t, response["errors"])
+	data := response["data"].(map[string]any)
+	schema := data["__schema"].(map[string]any)
+	assert.Equal(t, map[string]any{"name": "Query"}, schema["queryType"])
+	assert.Equal(t, map[string]any{"name": "Mutation"}, schema["mutationType"])
+	assert.Nil(t, schema["subscriptionType"])
+
+	types := map[string]map[string]any{}
+	for _, item := range schema["types"].([]any) {
+		t := item.(map[string]any)
+		types[t["name"].(string)] = t
+	}
+	for _, name := range []string{"Query", "Mutation", "User", "UserConnection", "PageInfo", "ID", "Int", "String", "Boolean", "__Schema", "__Type", "__TypeKind"} {
+		assert.Contains(t, types, name)
+	}
+	usersArgs := types["Query"]["fields"].([]any)[1].(map[string]any)["args"].([]any)
+	assert.Equal(t, "20", usersArgs[0].(map[string]any)["defaultValue"])
+
+	assert.Equal(t, map[string]any{"name": "User", "fields": []any{
+		map[string]any{"name": "id", "type": map[string]any{"kind": "NON_NULL", "name": nil, "ofType": map[string]any{"kind": "SCALAR", "name": "ID", "ofType": nil}}},
+		map[string]any{"name": "name", "type": map[string]any{"kind": "NON_NULL", "name": nil, "ofType": map[string]any{"kind": "SCALAR", "name": "String", "ofType": nil}}},
+	}}, data["user"])
+}
+
+func TestGraphQLErrors(t *testing.T) {
+	// Setup
+	router := NewServer()
+
+	tests := []struct {
+		name    string
+		query   string
+		status  int
+		message string
+	}{
+		{"syntax", "{ users { nodes { id }", http.StatusBadRequest, `syntax error: unexpected "", expecting Ident`},
+		{"unknown field", "{ users { nodes { email } } }", http.StatusBadRequest, `Cannot query field "email" on type "User".`},
+		{"missing argument", "{ user { id } }", http.StatusBadRequest, `Field "user" argument "id" of type "ID!" is required but not provided.`},
+		{"missing subfields", "{ users }", http.StatusBadRequest, `Field "users" of type "UserConnection!" must have a selection of subfields. Did you mean "users { ... }"?`},
+		{"fragment cycle", "{ users { ...A } } fragment A on UserConnection { ...A }", http.StatusBadRequest, `Cannot spread fragment "A" within itself.`},
+		{"wrong argument type", `{ users(first: "ten") { nodes { id } } }`, http.StatusBadRequest, "Argument \"first\" has invalid value \"ten\".\nExpected type \"Int\", found \"ten\"."},
+		{"resolver error", `{ users(first: -1) { nodes { id } } }`, http.StatusOK, `first must be between 0 and 100`},
+		{"validation error", `mutation { createUser(name: "  ") { id } }`, http.StatusOK, `name is required`},
+		{"not found", `mutation { deleteUser(id: 7) }`, http.StatusOK, `User not found`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Execute
+			status, response := postGraphQL(t, router, tt.query, nil)
+
+			// Validate
+			assert.Equal(t, tt.status, status)
+			if assert.Len(t, response["errors"], 1) {
+				assert.Equal(t, tt.message, response["errors"].([]any)[0].(map[string]any)["message"])
+			}
+			if tt.status == http.StatusOK {
+				// The failed field is non-null, so the null reaches the root.
+				assert.Contains(t, response, "data")
+				assert.Nil(t, response["data"])
+			} else {
+				assert.NotContains(t, response, "data")
+			}
+		})
+	}
+}
+
+func TestGraphQLOverGET(t *testing.T) {
+	// Setup
+	router := NewServer()
+	get := func(query string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/graphql?"+url.Values{"query": {query}}.Encode(), nil)
+		assert.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Execute
+	query := get(`{ users { nodes { id } } }`)
+	mutation := get(`mutation { createUser(name: "John Doe") { id } }`)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, query.Code)
+	assert.JSONEq(t, `{"data":{"users":{"nodes":[]}}}`, query.Body.String())
+	assert.Equal(t, http.StatusMethodNotAllowed, mutation.Code)
+	assert.Equal(t, http.MethodPost, mutation.Header().Get("Allow"))
+	exists, _ := router.store.UserExists(context.Background(), 1)
+	assert.False(t, exists)
+}
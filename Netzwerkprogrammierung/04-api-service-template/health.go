@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// readinessPingTimeout bounds the database ping of a readiness check.
+const readinessPingTimeout = 2 * time.Second
+
+// liveness handles GET /healthz. The process is alive as long as it answers.
+func liveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readiness handles GET /readyz. The service is ready when the database
+// answers and the circuit breaker is not open; load balancers take it out of
+// rotation otherwise.
+func (s *Server) readiness(w http.ResponseWriter, r *http.Request) {
+	status := map[string]string{"status": "ready"}
+	if s.db == nil {
+		// Running on the in-memory store.
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+
+	ready := true
+	if s.breaker != nil {
+		state := s.breaker.State()
+		status["circuit_breaker"] = state
+		ready = state != breakerOpen
+	}
+	if ready {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessPingTimeout)
+		defer cancel()
+		if err := s.db.PingContext(ctx); err != nil {
+			status["database_error"] = err.Error()
+			ready = false
+		}
+	}
+
+	if !ready {
+		status["status"] = "unavailable"
+		status["database"] = "down"
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	status["database"] = "up"
+	writeJSON(w, http.StatusOK, status)
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+// metric writes one sample. help and typ are written for the first sample
+// of a metric only, so pass them empty for further samples.
+func (m metricsWriter) metric(name, typ, help string, value float64, labels ...string) {
+	if help != "" {
+		fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+		}
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(m.w, "%s %g\n", name, value)
+}
+
+// metrics handles GET /metrics.
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := metricsWriter{w: w}
+
+	if s.breaker != nil {
+		stats := s.breaker.Stats()
+		for i, state := range []string{breakerClosed, breakerOpen, breakerHalfOpen} {
+			help := ""
+			if i == 0 {
+				help = "Whether the database circuit breaker is in the given state."
+			}
+			value := 0.0
+			if stats.State == state {
+				value = 1
+			}
+			m.metric("db_circuit_breaker_state", "gauge", help, value, "state", state)
+		}
+		m.metric("db_circuit_breaker_opened_total", "counter", "Times the database circuit breaker opened.", float64(stats.Opened))
+		m.metric("db_circuit_breaker_rejected_total", "counter", "Database calls failed fast by the open circuit breaker.", float64(stats.Rejected))
+	}
+
+	if s.replicas != nil {
+		stats := s.replicas.Stats()
+		for i, replica := range stats {
+			help := ""
+			if i == 0 {
+				help = "Whether the read replica is in rotation."
+			}
+			healthy := 0.0
+			if replica.Healthy {
+				healthy = 1
+			}
+			m.metric("db_replica_healthy", "gauge", help, healthy, "replica", replica.Name)
+		}
+		for i, replica := range stats {
+			help := ""
+			if i == 0 {
+				help = "Replication lag of the read replica at its last health check."
+			}
+			m.metric("db_replica_lag_seconds", "gauge", help, replica.Lag.Seconds(), "replica", replica.Name)
+		}
+	}
+
+	if s.db != nil {
+		stats := s.db.Stats()
+		m.metric("db_pool_max_open_connections", "gauge", "Maximum number of open database connections.", float64(stats.MaxOpenConnections))
+		m.metric("db_pool_open_connections", "gauge", "Open database connections.", float64(stats.OpenConnections))
+		m.metric("db_pool_in_use_connections", "gauge", "Database connections in use.", float64(stats.InUse))
+		m.metric("db_pool_idle_connections", "gauge", "Idle database connections.", float64(stats.Idle))
+		m.metric("db_pool_wait_count_total", "counter", "Connections waited for.", float64(stats.WaitCount))
+		m.metric("db_pool_wait_seconds_total", "counter", "Time spent waiting for connections.", stats.WaitDuration.Seconds())
+	}
+}
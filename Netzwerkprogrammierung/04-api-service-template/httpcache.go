@@ -0,0 +1,671 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"hash/maphash"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const cacheStatusHeader = "X-Cache"
+
+// processStart anchors the monotonic clock of the response cache.
+var processStart = time.Now()
+
+// monotonicNanos returns the nanoseconds since the process started. Unlike
+// the wall clock it never jumps, so lifetimes survive clock adjustments.
+func monotonicNanos() int64 {
+	return int64(time.Since(processStart))
+}
+
+// ResponseCache is a shared HTTP cache for GET responses. It stores status,
+// headers and body and follows the Cache-Control directives of requests
+// and responses: responses marked no-store, no-cache or private are not
+// stored, s-maxage takes precedence over max-age, and responses without
+// either are kept for a default time. 404 responses are kept briefly, so
+// that lookups of missing resources do not all reach the database.
+//
+// Concurrent misses of the same response are coalesced: one request runs
+// the handler while the others wait for its response. As soon as the
+// response turns out not to be storable, the others run the handler
+// themselves. Routes serving streams are best left out with Bypass. Expired responses
+// are served once more while a background request refreshes them, and in
+// place of server errors, for the windows set in its CacheLifetimes. The
+// stale-while-revalidate and stale-if-error directives of a response
+// override both windows.
+//
+// Responses are spread over shards by a hash of their key, each with a lock
+// of its own, so that parallel requests for different resources do not
+// contend. Lookups only take a read lock.
+type ResponseCache struct {
+	lifetimes atomic.Pointer[CacheLifetimes]
+	maxBody   int
+	nanotime  func() int64
+
+	seed   maphash.Seed
+	shards []cacheShard
+	// generation counts invalidations, so that responses fetched while
+	// one happened are not stored.
+	generation atomic.Uint64
+
+	mu     sync.RWMutex
+	bypass map[*mux.Route]bool
+}
+
+// CacheLifetimes are the lifetimes a ResponseCache gives responses whose
+// Cache-Control header does not set them.
+type CacheLifetimes struct {
+	TTL                  time.Duration // of successful responses
+	NegativeTTL          time.Duration // of 404 responses
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+}
+
+// cacheShard is one partition of a ResponseCache.
+type cacheShard struct {
+	mu        sync.RWMutex
+	entries   map[string]*cacheEntry
+	flights   map[string]*cacheFlight
+	lastSweep int64
+}
+
+// cacheEntry holds the variants of one resource. vary names the request
+// headers that select a variant, as listed in the Vary response header.
+type cacheEntry struct {
+	vary     []string
+	variants map[string]*cachedResponse
+}
+
+// cachedResponse is a stored response with its lifetime and the windows
+// after it in which it may still be served stale. stored is a reading of
+// the monotonic clock of the cache.
+type cachedResponse struct {
+	storedResponse
+	stored               int64
+	ttl                  time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+}
+
+// retainedUntil returns when the response becomes useless.
+func (c *cachedResponse) retainedUntil() int64 {
+	return c.stored + int64(c.ttl+max(c.staleWhileRevalidate, c.staleIfError))
+}
+
+// cacheFlight is a request running the handler for a missing response.
+// response is the response it served, if other requests may share it.
+type cacheFlight struct {
+	done     chan struct{}
+	landed   sync.Once
+	response *cachedResponse
+	status   string
+}
+
+// NewResponseCache returns a cache keeping responses without an explicit
+// lifetime for defaultTTL and 404 responses for negativeTTL. Responses with
+// bodies larger than maxBody bytes are not stored. shards is rounded up to
+// a power of two.
+func NewResponseCache(defaultTTL, negativeTTL time.Duration, maxBody, shards int) *ResponseCache {
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	c := &ResponseCache{
+		maxBody:  maxBody,
+		nanotime: monotonicNanos,
+		seed:     maphash.MakeSeed(),
+		shards:   make([]cacheShard, n),
+		bypass:   make(map[*mux.Route]bool),
+	}
+	c.lifetimes.Store(&CacheLifetimes{TTL: defaultTTL, NegativeTTL: negativeTTL})
+	for i := range c.shards {
+		c.shards[i].entries = make(map[string]*cacheEntry)
+		c.shards[i].flights = make(map[string]*cacheFlight)
+	}
+	return c
+}
+
+// Bypass leaves the responses of route out of the cache, for routes whose
+// responses are never stored, such as streams, so that concurrent requests
+// do not wait for each other.
+func (c *ResponseCache) Bypass(route *mux.Route) *mux.Route {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bypass[route] = true
+	return route
+}
+
+// bypassed reports whether r must not be answered from the cache. Besides
+// the routes passed to Bypass, this holds for requests of event streams.
+func (c *ResponseCache) bypassed(r *http.Request) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bypass[mux.CurrentRoute(r)] || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// Lifetimes returns the lifetimes of responses without explicit ones.
+func (c *ResponseCache) Lifetimes() CacheLifetimes {
+	return *c.lifetimes.Load()
+}
+
+// SetLifetimes replaces the lifetimes of responses without explicit ones.
+// Responses already stored keep theirs.
+func (c *ResponseCache) SetLifetimes(lifetimes CacheLifetimes) {
+	c.lifetimes.Store(&lifetimes)
+}
+
+// shard returns the shard holding key.
+func (c *ResponseCache) shard(key string) *cacheShard {
+	return &c.shards[maphash.String(c.seed, key)&uint64(len(c.shards)-1)]
+}
+
+// parseCacheControl returns the directives of a Cache-Control header with
+// their values, if any.
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+// seconds returns the value of a delta-seconds directive.
+func seconds(directives map[string]string, name string) (time.Duration, bool) {
+	arg, found := directives[name]
+	if !found {
+		return 0, false
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		return 0, true // an invalid lifetime means stale
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// ttl returns how long a response may be stored, or zero if it may not be.
+func (c *ResponseCache) ttl(status int, header http.Header) time.Duration {
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return 0
+	}
+	if header.Get("Set-Cookie") != "" || slices.Contains(varyHeaders(header), "*") ||
+		strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		return 0
+	}
+	directives := parseCacheControl(strings.Join(header.Values("Cache-Control"), ","))
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, found := directives[name]; found {
+			return 0
+		}
+	}
+	if ttl, found := seconds(directives, "s-maxage"); found {
+		return ttl
+	}
+	if ttl, found := seconds(directives, "max-age"); found {
+		return ttl
+	}
+	if status == http.StatusNotFound {
+		return c.lifetimes.Load().NegativeTTL
+	}
+	return c.lifetimes.Load().TTL
+}
+
+// varyHeaders returns the canonical names listed in the Vary headers.
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// variantKey identifies the variant of r selected by the vary headers.
+func variantKey(r *http.Request, vary []string) string {
+	var key strings.Builder
+	for _, name := range vary {
+		key.WriteString(strings.Join(r.Header.Values(name), ","))
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+// lookup returns the response stored for r under key, fresh or stale, and
+// its age.
+func (c *ResponseCache) lookup(key string, r *http.Request) (*cachedResponse, time.Duration, bool) {
+	shard := c.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	entry, found := shard.entries[key]
+	if !found {
+		return nil, 0, false
+	}
+	now := c.nanotime()
+	response, found := entry.variants[variantKey(r, entry.vary)]
+	if !found || now >= response.retainedUntil() {
+		return nil, 0, false
+	}
+	return response, time.Duration(now - response.stored), true
+}
+
+// store keeps response for ttl under key and returns the stored response.
+func (c *ResponseCache) store(key string, r *http.Request, response storedResponse, ttl time.Duration) *cachedResponse {
+	shard := c.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := c.nanotime()
+	if time.Duration(now-shard.lastSweep) > time.Minute {
+		for k, entry := range shard.entries {
+			for variant, stored := range entry.variants {
+				if now >= stored.retainedUntil() {
+					delete(entry.variants, variant)
+				}
+			}
+			if len(entry.variants) == 0 {
+				delete(shard.entries, k)
+			}
+		}
+		shard.lastSweep = now
+	}
+
+	vary := varyHeaders(response.header)
+	entry, found := shard.entries[key]
+	if !found || !slices.Equal(entry.vary, vary) {
+		// A resource changing its Vary header invalidates all variants.
+		entry = &cacheEntry{vary: vary, variants: make(map[string]*cachedResponse)}
+		shard.entries[key] = entry
+	}
+	lifetimes := c.lifetimes.Load()
+	stored := &cachedResponse{storedResponse: response, stored: now, ttl: ttl,
+		staleWhileRevalidate: lifetimes.StaleWhileRevalidate, staleIfError: lifetimes.StaleIfError}
+	directives := parseCacheControl(strings.Join(response.header.Values("Cache-Control"), ","))
+	if window, found := seconds(directives, "stale-while-revalidate"); found {
+		stored.staleWhileRevalidate = window
+	}
+	if window, found := seconds(directives, "stale-if-error"); found {
+		stored.staleIfError = window
+	}
+	entry.variants[variantKey(r, vary)] = stored
+	return stored
+}
+
+// Invalidate drops the responses whose keys start with one of prefixes.
+func (c *ResponseCache) Invalidate(prefixes ...string) {
+	c.generation.Add(1)
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mu.Lock()
+		for key := range shard.entries {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(key, prefix) {
+					delete(shard.entries, key)
+					break
+				}
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// Purge drops all responses.
+func (c *ResponseCache) Purge() {
+	c.generation.Add(1)
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mu.Lock()
+		clear(shard.entries)
+		shard.mu.Unlock()
+	}
+}
+
+// CachedEntry describes a stored response for inspection.
+type CachedEntry struct {
+	Key        string   `json:"key"`
+	Vary       []string `json:"vary,omitempty"`
+	Status     int      `json:"status"`
+	Size       int      `json:"size"`
+	AgeSeconds float64  `json:"age_seconds"`
+	TTLSeconds float64  `json:"ttl_seconds"`
+	Stale      bool     `json:"stale"`
+}
+
+// Entries returns the responses whose keys start with prefix, sorted by
+// key. Every variant of a resource is listed on its own.
+func (c *ResponseCache) Entries(prefix string) []CachedEntry {
+	now := c.nanotime()
+	entries := []CachedEntry{}
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mu.RLock()
+		for key, entry := range shard.entries {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			for _, response := range entry.variants {
+				if now >= response.retainedUntil() {
+					continue
+				}
+				age := time.Duration(now - response.stored)
+				entries = append(entries, CachedEntry{
+					Key:        key,
+					Vary:       entry.vary,
+					Status:     response.status,
+					Size:       len(response.body),
+					AgeSeconds: age.Seconds(),
+					TTLSeconds: response.ttl.Seconds(),
+					Stale:      age >= response.ttl,
+				})
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	slices.SortFunc(entries, func(a, b CachedEntry) int { return strings.Compare(a.Key, b.Key) })
+	return entries
+}
+
+// join returns the flight fetching the response for r under key. leader is
+// true if the caller started it and must call land when done.
+func (c *ResponseCache) join(key string, r *http.Request) (flight *cacheFlight, flightKey string, leader bool) {
+	shard := c.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	// Until a response names its Vary headers, requests for the same URL
+	// are assumed to ask for the same variant.
+	flightKey = key
+	if entry, found := shard.entries[key]; found {
+		flightKey += "\x00" + variantKey(r, entry.vary)
+	}
+	if flight, found := shard.flights[flightKey]; found {
+		return flight, flightKey, false
+	}
+	flight = &cacheFlight{done: make(chan struct{})}
+	shard.flights[flightKey] = flight
+	return flight, flightKey, true
+}
+
+// land ends a flight for key and releases the requests waiting for it with
+// the response they may share, if any. Only the first call has an effect.
+func (c *ResponseCache) land(key, flightKey string, flight *cacheFlight, response *cachedResponse, status string) {
+	flight.landed.Do(func() {
+		shard := c.shard(key)
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+
+		delete(shard.flights, flightKey)
+		flight.response, flight.status = response, status
+		close(flight.done)
+	})
+}
+
+// Middleware answers GET requests from the cache and stores the responses
+// of the handler. Requests may bypass the cache with "Cache-Control:
+// no-store", skip stored responses with "no-cache" and limit their age
+// with "max-age". Responses carry an X-Cache header telling whether they
+// were served from the cache (HIT), stale from the cache (STALE) or by the
+// handler (MISS) and, if from the cache, their Age.
+func (c *ResponseCache) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || c.bypassed(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		directives := parseCacheControl(r.Header.Get("Cache-Control"))
+		if _, noStore := directives["no-store"]; noStore {
+			w.Header().Set(cacheStatusHeader, "MISS")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := cacheKey(r)
+		var stale *cachedResponse
+		if _, noCache := directives["no-cache"]; !noCache {
+			if response, age, found := c.lookup(key, r); found {
+				maxAge, limited := seconds(directives, "max-age")
+				switch {
+				case age < response.ttl && (!limited || age <= maxAge):
+					c.serve(w, response, "HIT")
+					return
+				case !limited && age < response.ttl+response.staleWhileRevalidate:
+					c.revalidate(key, r, next)
+					c.serve(w, response, "STALE")
+					return
+				case age < response.ttl+response.staleIfError:
+					stale = response
+				}
+			}
+		}
+
+		flight, flightKey, leader := c.join(key, r)
+		if !leader {
+			select {
+			case <-flight.done:
+			case <-r.Context().Done():
+				return
+			}
+			if flight.response != nil {
+				c.serve(w, flight.response, flight.status)
+				return
+			}
+			// The response may not be shared; fetch one of our own.
+			c.fetch(w, r, next, key, stale, nil)
+			return
+		}
+		var response *cachedResponse
+		var status string
+		defer func() { c.land(key, flightKey, flight, response, status) }()
+		response, status = c.fetch(w, r, next, key, stale, func() { c.land(key, flightKey, flight, nil, "") })
+	})
+}
+
+// revalidate refreshes the response for r in the background, unless a
+// request is fetching it already. The refresh keeps the values of the
+// request context, such as the tenant and principal, but not its deadline.
+func (c *ResponseCache) revalidate(key string, r *http.Request, next http.Handler) {
+	flight, flightKey, leader := c.join(key, r)
+	if !leader {
+		return
+	}
+	refresh := r.Clone(context.WithoutCancel(r.Context()))
+	go func() {
+		var response *cachedResponse
+		var status string
+		defer func() { c.land(key, flightKey, flight, response, status) }()
+		defer func() {
+			// An aborted refresh leaves the stale response in place; outside
+			// the HTTP server the panic would end the process.
+			if err := recover(); err != nil && err != http.ErrAbortHandler {
+				panic(err)
+			}
+		}()
+		response, status = c.fetch(&discardWriter{header: make(http.Header)}, refresh, next, key, nil, nil)
+	}()
+}
+
+// fetch runs the handler and stores its response. If stale is set, server
+// errors are replaced with the stale response. It returns the response it
+// served and its cache status if other requests may share it. Handlers
+// aborting a response they started, such as a list whose store failed
+// after the first rows, panic with http.ErrAbortHandler, so that nothing
+// is stored; neither are responses the client did not receive in full.
+// unstorable, if set, is called once it is clear that the response will
+// not be stored.
+func (c *ResponseCache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, key string, stale *cachedResponse,
+	unstorable func()) (*cachedResponse, string) {
+	// Headers set so far belong to outer middlewares and are computed
+	// for every request, so they are not stored.
+	before := w.Header().Clone()
+	generation := c.generation.Load()
+	w.Header().Set(cacheStatusHeader, "MISS")
+	recorder := &cacheRecorder{ResponseWriter: w, status: http.StatusOK, ttl: c.ttl, limit: c.maxBody, fallback: stale != nil,
+		unstorable: unstorable}
+	next.ServeHTTP(recorder, r)
+	if !recorder.wroteHeader {
+		recorder.WriteHeader(http.StatusOK)
+	}
+
+	if recorder.suppressed {
+		for name := range w.Header() {
+			delete(w.Header(), name)
+		}
+		for name, values := range before {
+			w.Header()[name] = values
+		}
+		c.serve(w, stale, "STALE")
+		return stale, "STALE"
+	}
+	// A response fetched across an invalidation may predate the change
+	// that caused it.
+	if recorder.lifetime > 0 && !recorder.overflow && !recorder.failed && r.Context().Err() == nil &&
+		c.generation.Load() == generation {
+		return c.store(key, r, storedResponse{status: recorder.status, header: addedHeaders(before, recorder.header), body: recorder.body.Bytes()}, recorder.lifetime), "HIT"
+	}
+	return nil, ""
+}
+
+// serve writes a stored response with the given cache status.
+func (c *ResponseCache) serve(w http.ResponseWriter, response *cachedResponse, status string) {
+	for name, values := range response.header {
+		if name == "Vary" {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Duration(c.nanotime()-response.stored).Seconds())))
+	w.Header().Set(cacheStatusHeader, status)
+	w.WriteHeader(response.status)
+	w.Write(response.body)
+}
+
+// addedHeaders returns the headers of after that are missing from or differ
+// from before. Vary values are compared one by one.
+func addedHeaders(before, after http.Header) http.Header {
+	added := make(http.Header)
+	for name, values := range after {
+		if name == cacheStatusHeader {
+			continue
+		}
+		if name == "Vary" {
+			for _, value := range values {
+				if !slices.Contains(before[name], value) {
+					added.Add(name, value)
+				}
+			}
+			continue
+		}
+		if !slices.Equal(before[name], values) {
+			added[name] = values
+		}
+	}
+	return added
+}
+
+// cacheRecorder passes a response through to the client and keeps a copy
+// if the response may be stored. Whether it may be stored is decided when
+// the header is written, so that streams are not buffered. With fallback
+// set, server errors are suppressed, so that a stale response can be
+// served instead.
+type cacheRecorder struct {
+	http.ResponseWriter
+	ttl         func(status int, header http.Header) time.Duration
+	limit       int
+	fallback    bool
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	wroteHeader bool
+	lifetime    time.Duration
+	overflow    bool
+	suppressed  bool
+	failed      bool // a write to the client failed
+	unstorable  func()
+}
+
+// giveUp notes that the response will not be stored.
+func (rec *cacheRecorder) giveUp() {
+	if rec.unstorable != nil {
+		rec.unstorable()
+		rec.unstorable = nil
+	}
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = status
+	if rec.fallback && status >= http.StatusInternalServerError {
+		rec.suppressed = true
+		return
+	}
+	rec.header = rec.ResponseWriter.Header().Clone()
+	rec.lifetime = rec.ttl(status, rec.header)
+	if rec.lifetime <= 0 {
+		rec.giveUp()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.suppressed {
+		return len(p), nil
+	}
+	if rec.lifetime > 0 && !rec.overflow {
+		if rec.body.Len()+len(p) > rec.limit {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+			rec.giveUp()
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	if err != nil {
+		rec.failed = true
+		rec.giveUp()
+	}
+	return n, err
+}
+
+// Flush sends buffered data to the client, for handlers streaming their
+// response.
+func (rec *cacheRecorder) Flush() {
+	if rec.suppressed {
+		return
+	}
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// discardWriter is the ResponseWriter of background refreshes, whose
+// responses only go to the cache.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardWriter) WriteHeader(status int)      {}
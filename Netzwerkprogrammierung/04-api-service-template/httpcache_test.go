@@ -0,0 +1,537 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingCacheHandler answers with the number of calls so far, using the
+// given status and headers.
+func countingCacheHandler(calls *int, status int, header http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"calls":%d}`, *calls)
+	})
+}
+
+// newTestResponseCache returns a cache with a clock the test controls.
+func newTestResponseCache(now *time.Time) *ResponseCache {
+	c := NewResponseCache(10*time.Second, 2*time.Second, 1<<10, 4)
+	c.nanotime = func() int64 { return now.UnixNano() }
+	return c
+}
+
+func serveCached(h http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestResponseCacheStoresFullResponses(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	h := newTestResponseCache(&now).Middleware(countingCacheHandler(&calls, http.StatusOK, nil))
+
+	// Execute
+	miss := serveCached(h, "/v1/users?limit=5&offset=10", nil)
+	now = now.Add(3 * time.Second)
+	hit := serveCached(h, "/v1/users?offset=10&limit=5", nil)
+	now = now.Add(8 * time.Second)
+	expired := serveCached(h, "/v1/users?limit=5&offset=10", nil)
+
+	// Validate
+	assert.Equal(t, "MISS", miss.Header().Get(cacheStatusHeader))
+	assert.Empty(t, miss.Header().Get("Age"))
+	assert.Equal(t, http.StatusOK, hit.Code)
+	assert.Equal(t, "HIT", hit.Header().Get(cacheStatusHeader))
+	assert.Equal(t, "3", hit.Header().Get("Age"))
+	assert.Equal(t, "application/json", hit.Header().Get("Content-Type"))
+	assert.Equal(t, `{"calls":1}`, hit.Body.String())
+	assert.Equal(t, "MISS", expired.Header().Get(cacheStatusHeader))
+	assert.Equal(t, 2, calls)
+}
+
+func TestResponseCacheHonoursResponseCacheControl(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		cacheControl string
+		wait         time.Duration
+		cached       bool
+	}{
+		{"no-store", http.StatusOK, "no-store", 0, false},
+		{"no-cache", http.StatusOK, "no-cache", 0, false},
+		{"private", http.StatusOK, "private, max-age=60", 0, false},
+		{"max-age", http.StatusOK, "max-age=60", 30 * time.Second, true},
+		{"s-maxage over max-age", http.StatusOK, "max-age=60, s-maxage=5", 30 * time.Second, false},
+		{"negative caching", http.StatusNotFound, "", time.Second, true},
+		{"negative caching expires", http.StatusNotFound, "", 3 * time.Second, false},
+		{"server errors", http.StatusInternalServerError, "max-age=60", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Setup
+			now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			calls := 0
+			header := http.Header{}
+			if test.cacheControl != "" {
+				header.Set("Cache-Control", test.cacheControl)
+			}
+			h := newTestResponseCache(&now).Middleware(countingCacheHandler(&calls, test.status, header))
+
+			// Execute
+			serveCached(h, "/v1/users/1", nil)
+			now = now.Add(test.wait)
+			second := serveCached(h, "/v1/users/1", nil)
+
+			// Validate
+			assert.Equal(t, test.status, second.Code)
+			if test.cached {
+				assert.Equal(t, "HIT", second.Header().Get(cacheStatusHeader))
+				assert.Equal(t, 1, calls)
+			} else {
+				assert.Equal(t, "MISS", second.Header().Get(cacheStatusHeader))
+				assert.Equal(t, 2, calls)
+			}
+		})
+	}
+}
+
+func TestResponseCacheHonoursRequestCacheControl(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	h := newTestResponseCache(&now).Middleware(countingCacheHandler(&calls, http.StatusOK, nil))
+
+	// Execute
+	bypassed := serveCached(h, "/v1/users/1", http.Header{"Cache-Control": {"no-store"}})
+	serveCached(h, "/v1/users/1", nil)
+	now = now.Add(5 * time.Second)
+	tooOld := serveCached(h, "/v1/users/1", http.Header{"Cache-Control": {"max-age=2"}})
+	revalidated := serveCached(h, "/v1/users/1", http.Header{"Cache-Control": {"no-cache"}})
+	hit := serveCached(h, "/v1/users/1", nil)
+
+	// Validate
+	assert.Equal(t, `{"calls":1}`, bypassed.Body.String())
+	assert.Equal(t, `{"calls":3}`, tooOld.Body.String())
+	assert.Equal(t, `{"calls":4}`, revalidated.Body.String())
+	assert.Equal(t, `{"calls":4}`, hit.Body.String(), "responses fetched with no-cache are stored")
+	assert.Equal(t, "HIT", hit.Header().Get(cacheStatusHeader))
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	h := newTestResponseCache(&now).Middleware(countingCacheHandler(&calls, http.StatusOK, http.Header{"Vary": {"Accept-Language"}}))
+	german := http.Header{"Accept-Language": {"de"}}
+	english := http.Header{"Accept-Language": {"en"}}
+
+	// Execute
+	serveCached(h, "/v1/users/1", german)
+	serveCached(h, "/v1/users/1", english)
+	germanAgain := serveCached(h, "/v1/users/1", german)
+	englishAgain := serveCached(h, "/v1/users/1", english)
+
+	// Validate
+	assert.Equal(t, `{"calls":1}`, germanAgain.Body.String())
+	assert.Equal(t, `{"calls":2}`, englishAgain.Body.String())
+	assert.Equal(t, "Accept-Language", englishAgain.Header().Get("Vary"))
+	assert.Equal(t, 2, calls)
+}
+
+func TestResponseCacheSkipsVaryStarAndLargeBodies(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	varyAll := newTestResponseCache(&now).Middleware(countingCacheHandler(&calls, http.StatusOK, http.Header{"Vary": {"*"}}))
+	large := newTestResponseCache(&now).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write(make([]byte, 2<<10))
+	}))
+
+	// Execute
+	serveCached(varyAll, "/v1/users/1", nil)
+	varied := serveCached(varyAll, "/v1/users/1", nil)
+	serveCached(large, "/v1/users", nil)
+	tooLarge := serveCached(large, "/v1/users", nil)
+
+	// Validate
+	assert.Equal(t, "MISS", varied.Header().Get(cacheStatusHeader))
+	assert.Equal(t, "MISS", tooLarge.Header().Get(cacheStatusHeader))
+	assert.Len(t, tooLarge.Body.Bytes(), 2<<10)
+	assert.Equal(t, 4, calls)
+}
+
+func TestResponseCacheKeepsHeadersOfOuterMiddlewares(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	cached := newTestResponseCache(&now).Middleware(countingCacheHandler(&calls, http.StatusOK, nil))
+	cors, err := NewCORS([]string{"https://*.example.com"}, []string{"GET"}, nil, true, 0)
+	assert.NoError(t, err)
+	h := cors.Handler(cached)
+
+	// Execute
+	serveCached(h, "/v1/users/1", http.Header{"Origin": {"https://a.example.com"}})
+	hit := serveCached(h, "/v1/users/1", http.Header{"Origin": {"https://b.example.com"}})
+
+	// Validate
+	assert.Equal(t, "HIT", hit.Header().Get(cacheStatusHeader))
+	assert.Equal(t, "https://b.example.com", hit.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, []string{"Origin"}, hit.Header().Values("Vary"))
+}
+
+func TestCacheKeyNormalisesQuery(t *testing.T) {
+	// Setup
+	a := httptest.NewRequest("GET", "/v1/users?b=2&a=1&a=0", nil)
+	b := httptest.NewRequest("GET", "/v1/users?a=1&a=0&b=2", nil)
+
+	// Execute and validate
+	assert.Equal(t, "/v1/users?a=1&a=0&b=2", cacheKey(a))
+	assert.Equal(t, cacheKey(a), cacheKey(b))
+}
+
+func TestResponseCacheCoalescesMisses(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := newTestResponseCache(&now).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1}`))
+	}))
+
+	// Execute
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 10)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = serveCached(h, "/v1/users/1", nil)
+		}(i)
+	}
+	assert.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond) // let the other requests join the flight
+	close(release)
+	wg.Wait()
+
+	// Validate
+	assert.Equal(t, int32(1), calls.Load())
+	misses := 0
+	for _, rr := range responses {
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, `{"id":1}`, rr.Body.String())
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+		if rr.Header().Get(cacheStatusHeader) == "MISS" {
+			misses++
+		}
+	}
+	assert.Equal(t, 1, misses)
+}
+
+func TestResponseCacheReleasesWaitersOfUnstorableResponses(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := newTestResponseCache(&now).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		if calls.Add(1) == 1 {
+			<-release
+		}
+	}))
+
+	// Execute
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- serveCached(h, "/v1/users/events", nil) }()
+	assert.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- serveCached(h, "/v1/users/events", nil) }()
+
+	// Validate
+	select {
+	case rr := <-second:
+		assert.Equal(t, http.StatusOK, rr.Code)
+	case <-time.After(time.Second):
+		t.Error("the second stream waited for the first one to end")
+	}
+	close(release)
+	<-first
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestResponseCacheStaleWhileRevalidate(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var calls atomic.Int32
+	c := newTestResponseCache(&now)
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=30")
+		fmt.Fprintf(w, `{"calls":%d}`, calls.Add(1))
+	}))
+
+	// Execute
+	serveCached(h, "/v1/users/1", nil)
+	now = now.Add(5 * time.Second)
+	stale := serveCached(h, "/v1/users/1", nil)
+	assert.Eventually(t, func() bool {
+		shard := c.shard("/v1/users/1")
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		return calls.Load() == 2 && len(shard.flights) == 0
+	}, time.Second, time.Millisecond)
+	refreshed := serveCached(h, "/v1/users/1", nil)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, stale.Code)
+	assert.Equal(t, "STALE", stale.Header().Get(cacheStatusHeader))
+	assert.Equal(t, "5", stale.Header().Get("Age"))
+	assert.Equal(t, `{"calls":1}`, stale.Body.String())
+	assert.Equal(t, "HIT", refreshed.Header().Get(cacheStatusHeader))
+	assert.Equal(t, `{"calls":2}`, refreshed.Body.String())
+}
+
+func TestResponseCacheStaleIfError(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	c := newTestResponseCache(&now)
+	lifetimes := c.Lifetimes()
+	lifetimes.StaleIfError = time.Minute
+	c.SetLifetimes(lifetimes)
+	failing := false
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			writeStoreError(w, ErrStoreUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":1}`))
+	}))
+
+	// Execute
+	serveCached(h, "/v1/users/1", nil)
+	failing = true
+	now = now.Add(30 * time.Second)
+	stale := serveCached(h, "/v1/users/1", nil)
+	now = now.Add(time.Minute)
+	failed := serveCached(h, "/v1/users/1", nil)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, stale.Code)
+	assert.Equal(t, "STALE", stale.Header().Get(cacheStatusHeader))
+	assert.Equal(t, "application/json", stale.Header().Get("Content-Type"))
+	assert.Empty(t, stale.Header().Get("Retry-After"), "headers of the error are dropped")
+	assert.Equal(t, `{"id":1}`, stale.Body.String())
+	assert.Equal(t, http.StatusServiceUnavailable, failed.Code, "past stale-if-error the error is passed on")
+	assert.Equal(t, "MISS", failed.Header().Get(cacheStatusHeader))
+}
+
+func TestResponseCacheSkipsAbortedResponses(t *testing.T) {
+	// Setup
+	router := NewServer(WithStore(newFailingStore(4*streamFlushInterval, 2*streamFlushInterval+3)),
+		WithCache(NewResponseCache(time.Minute, time.Minute, 1<<20, 4), true))
+	first := httptest.NewRecorder()
+	second := httptest.NewRecorder()
+
+	// Execute and validate
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() { router.ServeHTTP(first, httptest.NewRequest("GET", "/v1/users", nil)) })
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() { router.ServeHTTP(second, httptest.NewRequest("GET", "/v1/users", nil)) },
+		"the truncated list was not stored")
+	assert.Equal(t, "MISS", second.Header().Get(cacheStatusHeader))
+}
+
+func TestResponseCacheSkipsResponsesOfDisconnectedClients(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	h := newTestResponseCache(&now).Middleware(countingCacheHandler(&calls, http.StatusOK, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Execute
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/users/1", nil).WithContext(ctx))
+	next := serveCached(h, "/v1/users/1", nil)
+
+	// Validate
+	assert.Equal(t, "MISS", next.Header().Get(cacheStatusHeader))
+	assert.Equal(t, 2, calls)
+}
+
+func TestResponseCacheSurvivesAbortedRefreshes(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var calls atomic.Int32
+	c := newTestResponseCache(&now)
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=30")
+		fmt.Fprintf(w, `{"calls":%d}`, calls.Add(1))
+		if calls.Load() > 1 {
+			panic(http.ErrAbortHandler)
+		}
+	}))
+
+	// Execute
+	serveCached(h, "/v1/users/1", nil)
+	now = now.Add(5 * time.Second)
+	serveCached(h, "/v1/users/1", nil)
+	assert.Eventually(t, func() bool {
+		shard := c.shard("/v1/users/1")
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		return calls.Load() == 2 && len(shard.flights) == 0
+	}, time.Second, time.Millisecond)
+	stale := serveCached(h, "/v1/users/1", nil)
+
+	// Validate
+	assert.Equal(t, "STALE", stale.Header().Get(cacheStatusHeader), "the aborted refresh was not stored")
+	assert.Equal(t, `{"calls":1}`, stale.Body.String())
+}
+
+// legacyCache is the single-mutex cache the response cache replaced, kept
+// as the baseline of the benchmarks.
+type legacyCache struct {
+	mu    sync.Mutex
+	items map[string]legacyCacheItem
+}
+
+type legacyCacheItem struct {
+	value      string
+	expiration int64
+}
+
+func (c *legacyCache) Set(key, value string, duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items[key] = legacyCacheItem{value: value, expiration: time.Now().Add(duration).Unix()}
+}
+
+func (c *legacyCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, found := c.items[key]
+	if !found || item.expiration < time.Now().Unix() {
+		return "", false
+	}
+	return item.value, true
+}
+
+// benchmarkKeys returns the keys the benchmarks spread their requests over.
+func benchmarkKeys() ([]string, []*http.Request) {
+	keys := make([]string, 1024)
+	requests := make([]*http.Request, len(keys))
+	for i := range keys {
+		requests[i] = httptest.NewRequest("GET", fmt.Sprintf("/v1/users/%d", i), nil)
+		keys[i] = cacheKey(requests[i])
+	}
+	return keys, requests
+}
+
+// Run with -cpu 1,4,8 to see how the caches scale with parallel requests:
+//
+//	go test -run '^$' -bench ResponseCache -cpu 1,4,8
+func BenchmarkResponseCacheLookup(b *testing.B) {
+	keys, requests := benchmarkKeys()
+	b.Run("legacy", func(b *testing.B) {
+		c := &legacyCache{items: make(map[string]legacyCacheItem)}
+		for _, key := range keys {
+			c.Set(key, `{"id":1,"name":"Alice"}`, time.Hour)
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				c.Get(keys[i%len(keys)])
+			}
+		})
+	})
+	for _, shards := range []int{1, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := NewResponseCache(time.Hour, time.Hour, 1<<20, shards)
+			for i, key := range keys {
+				c.store(key, requests[i], storedResponse{status: http.StatusOK, header: http.Header{}, body: []byte(`{"id":1,"name":"Alice"}`)}, time.Hour)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					c.lookup(keys[i%len(keys)], requests[i%len(keys)])
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkResponseCacheMixed stores one response for every nine lookups.
+func BenchmarkResponseCacheMixed(b *testing.B) {
+	keys, requests := benchmarkKeys()
+	body := `{"id":1,"name":"Alice"}`
+	b.Run("legacy", func(b *testing.B) {
+		c := &legacyCache{items: make(map[string]legacyCacheItem)}
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if key := keys[i%len(keys)]; i%10 == 0 {
+					c.Set(key, body, time.Hour)
+				} else {
+					c.Get(key)
+				}
+			}
+		})
+	})
+	for _, shards := range []int{1, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := NewResponseCache(time.Hour, time.Hour, 1<<20, shards)
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if n := i % len(keys); i%10 == 0 {
+						c.store(keys[n], requests[n], storedResponse{status: http.StatusOK, header: http.Header{}, body: []byte(body)}, time.Hour)
+					} else {
+						c.lookup(keys[n], requests[n])
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkResponseCacheMiddleware serves cache hits through the middleware.
+func BenchmarkResponseCacheMiddleware(b *testing.B) {
+	_, requests := benchmarkKeys()
+	for _, shards := range []int{1, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			h := NewResponseCache(time.Hour, time.Hour, 1<<20, shards).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"id":1,"name":"Alice"}`))
+			}))
+			for _, req := range requests {
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					h.ServeHTTP(httptest.NewRecorder(), requests[i%len(requests)])
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	// maxIdempotencyKeyLength bounds the accepted Idempotency-Key values.
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentBodySize bounds the request bodies that are fingerprinted.
+	// Requests with a key and a larger body are rejected.
+	maxIdempotentBodySize = 1 << 20
+)
+
+// storedResponse is a response kept for replaying to retried requests.
+type storedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyRecord tracks one Idempotency-Key. response is nil while the
+// first request is still being handled; done is closed once it finished.
+type idempotencyRecord struct {
+	fingerprint string
+	response    *storedResponse
+	done        chan struct{}
+	expiration  time.Time
+}
+
+// IdempotencyStore remembers the responses of POST requests carrying an
+// Idempotency-Key for a configurable window.
+type IdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]*idempotencyRecord
+	ttl       time.Duration
+	wait      time.Duration
+	now       func() time.Time
+	logger    *slog.Logger
+	lastSweep time.Time
+}
+
+// NewIdempotencyStore returns a store keeping responses for ttl. Duplicates
+// arriving while the first request is in flight wait up to wait for it to
+// finish before they are answered with 409 Conflict.
+func NewIdempotencyStore(ttl, wait time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		records: make(map[string]*idempotencyRecord),
+		ttl:     ttl,
+		wait:    wait,
+		now:     time.Now,
+		logger:  slog.Default(),
+	}
+}
+
+// begin looks up key. If the key is unknown or expired a new in-flight record
+// is registered and returned with owner set to true.
+func (s *IdempotencyStore) begin(key, fingerprint string) (record *idempotencyRecord, owner bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, r := range s.records {
+			if r.response != nil && now.After(r.expiration) {
+				delete(s.records, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if r, found := s.records[key]; found && (r.response == nil || !now.After(r.expiration)) {
+		return r, false
+	}
+	r := &idempotencyRecord{fingerprint: fingerprint, done: make(chan struct{})}
+	s.records[key] = r
+	return r, true
+}
+
+// finish stores the response for key. Server errors are not stored, so that
+// a retry gets another chance to succeed, and neither are responses marked
+// no-store, which may carry secrets that must only be shown once.
+func (s *IdempotencyStore) finish(key string, record *idempotencyRecord, response *storedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, noStore := parseCacheControl(response.header.Get("Cache-Control"))["no-store"]
+	if response.status >= http.StatusInternalServerError || noStore {
+		delete(s.records, key)
+	} else {
+		record.response = response
+		record.expiration = s.now().Add(s.ttl)
+	}
+	close(record.done)
+}
+
+// result returns the stored response of record, or nil if it is in flight.
+func (s *IdempotencyStore) result(record *idempotencyRecord) *storedResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return record.response
+}
+
+// Middleware makes POST requests carrying an Idempotency-Key safe to retry:
+// the first response is stored together with a fingerprint of the request
+// and replayed for later requests with the same key.
+func (s *IdempotencyStore) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
+			return
+		}
+		// Keys are chosen by clients and only unique per client, so that
+		// nobody is answered with the response to another caller.
+		key = tenantFrom(r.Context()) + " " + clientIdentity(r) + " " + key
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodySize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxIdempotentBodySize {
+			http.Error(w, "Request body too large for an Idempotency-Key", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+
+		record, owner := s.begin(key, fingerprint)
+		if record.fingerprint != fingerprint {
+			http.Error(w, "Idempotency-Key reused with a different request", http.StatusUnprocessableEntity)
+			return
+		}
+		if !owner {
+			s.replay(w, r, record)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			response := recorder.response()
+			if !completed {
+				// The handler panicked; never replay what it left behind.
+				response.status = http.StatusInternalServerError
+			}
+			s.finish(key, record, response)
+		}()
+		next.ServeHTTP(recorder, r)
+		completed = true
+	})
+}
+
+// replay answers a duplicate request with the stored response, waiting for
+// an in-flight original to finish first.
+func (s *IdempotencyStore) replay(w http.ResponseWriter, r *http.Request, record *idempotencyRecord) {
+	timer := time.NewTimer(s.wait)
+	defer timer.Stop()
+	select {
+	case <-record.done:
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+
+	response := s.result(record)
+	if response == nil {
+		// Either still in flight or the original failed and was discarded.
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(s.wait.Seconds()))))
+		http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+		return
+	}
+
+	s.logger.Info("Replaying stored response", "idempotency_key", r.Header.Get(idempotencyKeyHeader))
+	for name, values := range response.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(idempotencyReplayedHeader, "true")
+	w.WriteHeader(response.status)
+	w.Write(response.body)
+}
+
+// requestFingerprint identifies a request by method, URI and body.
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method)
+	hash.Write([]byte{0})
+	io.WriteString(hash, r.URL.RequestURI())
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder passes a response through to the client while keeping a
+// copy of its status, headers and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = status
+	rec.header = rec.ResponseWriter.Header().Clone()
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+// response returns the recorded response.
+func (rec *responseRecorder) response() *storedResponse {
+	if !rec.wroteHeader {
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	return &storedResponse{status: rec.status, header: rec.header, body: rec.body.Bytes()}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingHandler answers with 201 and the request body and counts its calls.
+func countingHandler(calls *int32, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		if release != nil {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/v1/users/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1,"name":"John Doe"}`))
+	})
+}
+
+func idempotentRequest(key, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/v1/users", strings.NewReader(body))
+	req.Header.Set(idempotencyKeyHeader, key)
+	return req
+}
+
+func TestIdempotencyReplaysStoredResponse(t *testing.T) {
+	// Setup
+	var calls int32
+	handler := NewIdempotencyStore(time.Hour, 0).Middleware(countingHandler(&calls, nil))
+
+	// Execute
+	first := httptest.NewRecorder()
+	handler.ServeHTTP(first, idempotentRequest("key-1", `{"name":"John Doe"}`))
+	second := httptest.NewRecorder()
+	handler.ServeHTTP(second, idempotentRequest("key-1", `{"name":"John Doe"}`))
+
+	// Validate
+	assert.Equal(t, int32(1), calls)
+	assert.Equal(t, http.StatusCreated, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, "/v1/users/1", second.Header().Get("Location"))
+	assert.Equal(t, "application/json", second.Header().Get("Content-Type"))
+	assert.Equal(t, "true", second.Header().Get(idempotencyReplayedHeader))
+	assert.Empty(t, first.Header().Get(idempotencyReplayedHeader))
+}
+
+func TestIdempotencyRejectsMismatchedPayload(t *testing.T) {
+	// Setup
+	var calls int32
+	handler := NewIdempotencyStore(time.Hour, 0).Middleware(countingHandler(&calls, nil))
+
+	// Execute
+	handler.ServeHTTP(httptest.NewRecorder(), idempotentRequest("key-1", `{"name":"John Doe"}`))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, idempotentRequest("key-1", `{"name":"Jane Doe"}`))
+
+	// Validate
+	assert.Equal(t, int32(1), calls)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+}
+
+func TestIdempotencyConcurrentDuplicate(t *testing.T) {
+	// Setup
+	var calls int32
+	release := make(chan struct{})
+	handler := NewIdempotencyStore(time.Hour, 10*time.Millisecond).Middleware(countingHandler(&calls, release))
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), idempotentRequest("key-1", `{}`))
+		close(done)
+	}()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Execute
+	conflict := httptest.NewRecorder()
+	handler.ServeHTTP(conflict, idempotentRequest("key-1", `{}`))
+	close(release)
+	<-done
+	replayed := httptest.NewRecorder()
+	handler.ServeHTTP(replayed, idempotentRequest("key-1", `{}`))
+
+	// Validate
+	assert.Equal(t, http.StatusConflict, conflict.Code)
+	assert.Equal(t, "1", conflict.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusCreated, replayed.Code)
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	// Setup
+	var calls int32
+	now := time.Now()
+	store := NewIdempotencyStore(time.Minute, 0)
+	store.now = func() time.Time { return now }
+	handler := store.Middleware(countingHandler(&calls, nil))
+
+	// Execute
+	handler.ServeHTTP(httptest.NewRecorder(), idempotentRequest("key-1", `{}`))
+	now = now.Add(2 * time.Minute)
+	handler.ServeHTTP(httptest.NewRecorder(), idempotentRequest("key-1", `{"name":"changed"}`))
+
+	// Validate
+	assert.Equal(t, int32(2), calls)
+}
+
+func TestIdempotencyDoesNotStoreServerErrors(t *testing.T) {
+	// Setup
+	var calls int32
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+	handler := NewIdempotencyStore(time.Hour, 0).Middleware(failing)
+
+	// Execute
+	handler.ServeHTTP(httptest.NewRecorder(), idempotentRequest("key-1", `{}`))
+	handler.ServeHTTP(httptest.NewRecorder(), idempotentRequest("key-1", `{}`))
+
+	// Validate
+	assert.Equal(t, int32(2), calls)
+}
+
+func TestIdempotencyKeysAreScopedToTheCaller(t *testing.T) {
+	// Setup
+	var calls int32
+	handler := NewIdempotencyStore(time.Hour, 0).Middleware(countingHandler(&calls, nil))
+	as := func(subject string) *http.Request {
+		req := idempotentRequest("key-1", `{"name":"John Doe"}`)
+		ctx := withTenant(req.Context(), "acme")
+		return req.WithContext(withPrincipal(ctx, &Principal{Subject: subject, Tenant: "acme"}))
+	}
+
+	// Execute
+	handler.ServeHTTP(httptest.NewRecorder(), as("alice"))
+	again := httptest.NewRecorder()
+	handler.ServeHTTP(again, as("alice"))
+	other := httptest.NewRecorder()
+	handler.ServeHTTP(other, as("bob"))
+
+	// Validate
+	assert.Equal(t, int32(2), calls)
+	assert.Equal(t, "true", again.Header().Get(idempotencyReplayedHeader))
+	assert.Empty(t, other.Header().Get(idempotencyReplayedHeader), "bob must not get the response to alice")
+}
+
+func TestIdempotencyDoesNotStoreNoStoreResponses(t *testing.T) {
+	// Setup
+	var calls int32
+	secret := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"key":"secret"}`))
+	})
+	handler := NewIdempotencyStore(time.Hour, 0).Middleware(secret)
+
+	// Execute
+	handler.ServeHTTP(httptest.NewRecorder(), idempotentRequest("key-1", `{}`))
+	second := httptest.NewRecorder()
+	handler.ServeHTTP(second, idempotentRequest("key-1", `{}`))
+
+	// Validate
+	assert.Equal(t, int32(2), calls)
+	assert.Empty(t, second.Header().Get(idempotencyReplayedHeader))
+}
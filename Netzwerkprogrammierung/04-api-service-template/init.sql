@@ -1,4 +1,220 @@
+-- Schema of the service. The script is idempotent: PostgreSQL runs it on
+-- an empty data directory only, so existing databases are migrated by
+-- running it again as the database owner (see README.md).
 CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,
     name VARCHAR(100)
 );
+
+-- Multi-tenancy: every user belongs to a tenant, and row-level security
+-- limits every statement to the rows of the tenant the API sets in
+-- app.tenant_id for its transaction. Without a tenant (tenancy disabled)
+-- the rows of the default tenant are used. Ids are unique per tenant.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(63) NOT NULL
+    DEFAULT COALESCE(NULLIF(current_setting('app.tenant_id', true), ''), 'default');
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_index WHERE indrelid = 'users'::regclass AND indisprimary AND indnatts = 2) THEN
+        ALTER TABLE users DROP CONSTRAINT users_pkey;
+        ALTER TABLE users ADD PRIMARY KEY (tenant_id, id);
+    END IF;
+END $$;
+
+ALTER TABLE users ENABLE ROW LEVEL SECURITY;
+ALTER TABLE users FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON users;
+CREATE POLICY tenant_isolation ON users
+    USING (tenant_id = COALESCE(NULLIF(current_setting('app.tenant_id', true), ''), 'default'))
+    WITH CHECK (tenant_id = COALESCE(NULLIF(current_setting('app.tenant_id', true), ''), 'default'));
+
+-- Superusers bypass row-level security, so the API connects as this role.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'api') THEN
+        CREATE ROLE api LOGIN PASSWORD 'api';
+    END IF;
+END $$;
+GRANT SELECT, INSERT, UPDATE, DELETE ON users TO api;
+GRANT USAGE, SELECT, UPDATE ON SEQUENCE users_id_seq TO api;
+
+-- Credentials users log in with. Emails are stored in lower case and are
+-- unique per tenant; passwords are bcrypt hashes.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(254);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash VARCHAR(72);
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (tenant_id, email);
+
+-- Announce every change to the users table on the user_changes channel, so
+-- the API can stream it to clients, including writes made by other
+-- instances or directly in the database. Changed credentials are not
+-- announced. The changes are numbered from user_change_seq, so that every
+-- instance streams them with the same event id.
+CREATE SEQUENCE IF NOT EXISTS user_change_seq;
+GRANT USAGE ON SEQUENCE user_change_seq TO api;
+
+CREATE OR REPLACE FUNCTION notify_user_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('user_changes', json_build_object('seq', nextval('user_change_seq'), 'op', TG_OP, 'tenant', OLD.tenant_id, 'id', OLD.id)::text);
+    ELSE
+        PERFORM pg_notify('user_changes', json_build_object('seq', nextval('user_change_seq'), 'op', TG_OP, 'tenant', NEW.tenant_id, 'id', NEW.id, 'name', NEW.name)::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_notify_change ON users;
+CREATE TRIGGER users_notify_change
+    AFTER INSERT OR UPDATE OF id, name OR DELETE ON users
+    FOR EACH ROW EXECUTE FUNCTION notify_user_change();
+
+-- Transactional outbox: user mutations record their events here in the same
+-- transaction, and the API relays them to the event consumers.
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    aggregate_id INTEGER NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    available_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    published_at TIMESTAMPTZ
+);
+
+-- User ids are unique per tenant, so the events of a user are ordered by
+-- tenant and user id.
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(63) NOT NULL DEFAULT 'default';
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (id) WHERE published_at IS NULL;
+DROP INDEX IF EXISTS outbox_pending_aggregate_idx;
+CREATE INDEX IF NOT EXISTS outbox_pending_tenant_aggregate_idx ON outbox (tenant_id, aggregate_id, id) WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS outbox_published_at_idx ON outbox (published_at) WHERE published_at IS NOT NULL;
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON outbox TO api;
+GRANT USAGE, SELECT ON SEQUENCE outbox_id_seq TO api;
+
+-- Webhook subscriptions and their delivery logs, shared by all instances.
+-- The secret is kept in clear, as it signs every delivery. Pending
+-- deliveries are claimed by the instance attempting them until
+-- next_attempt_at.
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL,
+    url TEXT NOT NULL,
+    events TEXT NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT true,
+    consecutive_failures INTEGER NOT NULL DEFAULT 0,
+    disabled_reason TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhook_subscriptions_tenant_idx ON webhook_subscriptions (tenant_id, id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+    tenant_id VARCHAR(63) NOT NULL,
+    event JSONB NOT NULL,
+    status VARCHAR(10) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_status INTEGER,
+    last_error TEXT,
+    next_attempt_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON webhook_subscriptions, webhook_deliveries TO api;
+GRANT USAGE, SELECT ON SEQUENCE webhook_subscriptions_id_seq, webhook_deliveries_id_seq TO api;
+
+-- Roles assigned to principals (token subjects) per tenant, managed through
+-- the /v1/admin API. The API filters on tenant_id itself.
+CREATE TABLE IF NOT EXISTS principal_roles (
+    tenant_id VARCHAR(63) NOT NULL,
+    principal VARCHAR(255) NOT NULL,
+    role VARCHAR(50) NOT NULL,
+    granted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant_id, principal, role)
+);
+
+GRANT SELECT, INSERT, DELETE ON principal_roles TO api;
+
+-- API keys. Only a salted SHA-256 hash of the secret is stored; the id is
+-- the clear-text part of the key used to look it up across tenants.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id VARCHAR(12) PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    scopes TEXT NOT NULL,
+    salt BYTEA NOT NULL,
+    hash BYTEA NOT NULL,
+    created_by VARCHAR(255),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS api_keys_tenant_idx ON api_keys (tenant_id, created_at);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON api_keys TO api;
+
+-- Request quotas of API keys per day and month, counted here so that they
+-- survive restarts and are shared by all instances. The counts of past
+-- periods are deleted.
+CREATE TABLE IF NOT EXISTS quota_usage (
+    client VARCHAR(255) NOT NULL,
+    period VARCHAR(5) NOT NULL,
+    period_start TIMESTAMPTZ NOT NULL,
+    used BIGINT NOT NULL,
+    PRIMARY KEY (client, period, period_start)
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON quota_usage TO api;
+
+-- Login sessions of users. Only a salted SHA-256 hash of the current
+-- refresh token is stored; refreshing replaces it, so every refresh token
+-- works once. The hash of the replaced token is kept to recognise its
+-- reuse. Sessions are deleted with their user.
+CREATE TABLE IF NOT EXISTS sessions (
+    id VARCHAR(16) PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL,
+    user_id INTEGER NOT NULL,
+    salt BYTEA NOT NULL,
+    hash BYTEA NOT NULL,
+    user_agent VARCHAR(255),
+    client_ip VARCHAR(45),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (tenant_id, user_id) REFERENCES users (tenant_id, id) ON DELETE CASCADE
+);
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS previous_salt BYTEA;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS previous_hash BYTEA;
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (tenant_id, user_id);
+CREATE INDEX IF NOT EXISTS sessions_expires_at_idx ON sessions (expires_at);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON sessions TO api;
+
+-- Failed logins per account (tenant and email) or per source address
+-- (source), and the solved login challenges, shared by all instances. The
+-- API deletes the records that no longer matter.
+CREATE TABLE IF NOT EXISTS login_failures (
+    tenant_id VARCHAR(63) NOT NULL,
+    email TEXT NOT NULL,
+    source TEXT NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    pending INTEGER NOT NULL DEFAULT 0,
+    last_attempt TIMESTAMPTZ,
+    last_failure TIMESTAMPTZ,
+    locked_until TIMESTAMPTZ,
+    PRIMARY KEY (tenant_id, email, source)
+);
+
+CREATE TABLE IF NOT EXISTS login_challenges (
+    challenge TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON login_failures, login_challenges TO api;
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// invalidationChannel is the PostgreSQL notification channel carrying cache
+// invalidations between instances.
+const invalidationChannel = "cache_invalidations"
+
+// Invalidation names the cached responses to drop on every instance by the
+// prefixes of their cache keys. Origin identifies the sending instance.
+type Invalidation struct {
+	Origin   string   `json:"origin"`
+	Prefixes []string `json:"prefixes"`
+}
+
+// InvalidationBus broadcasts invalidations to all instances, including the
+// sender.
+type InvalidationBus interface {
+	// Publish sends inv to all subscribers.
+	Publish(ctx context.Context, inv Invalidation) error
+	// Subscribe calls handle for every invalidation until ctx is done.
+	// resync is called whenever invalidations may have been missed, for
+	// instance after a lost connection, and the subscriber must assume
+	// that anything may have changed.
+	Subscribe(ctx context.Context, handle func(Invalidation), resync func())
+}
+
+// pgInvalidationBus is an InvalidationBus using PostgreSQL LISTEN/NOTIFY.
+type pgInvalidationBus struct {
+	db     *sql.DB
+	logger *slog.Logger
+}
+
+// newPGInvalidationBus returns an InvalidationBus on the given database.
+func newPGInvalidationBus(db *sql.DB, logger *slog.Logger) *pgInvalidationBus {
+	return &pgInvalidationBus{db: db, logger: logger}
+}
+
+func (b *pgInvalidationBus) Publish(ctx context.Context, inv Invalidation) error {
+	payload, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", invalidationChannel, string(payload))
+	return classify(ctx, err)
+}
+
+func (b *pgInvalidationBus) Subscribe(ctx context.Context, handle func(Invalidation), resync func()) {
+	go listenLoop(ctx, b.db, b.logger, invalidationChannel, func(payload string) {
+		var inv Invalidation
+		if err := json.Unmarshal([]byte(payload), &inv); err != nil {
+			b.logger.Warn("Ignoring malformed cache invalidation", "payload", payload, "error", err)
+			return
+		}
+		handle(inv)
+	}, resync)
+}
+
+// memoryInvalidationBus is an InvalidationBus within one process, for a
+// single instance and for tests running several.
+type memoryInvalidationBus struct {
+	mu          sync.Mutex
+	subscribers map[*func(Invalidation)]bool
+}
+
+// newMemoryInvalidationBus returns an InvalidationBus without subscribers.
+func newMemoryInvalidationBus() *memoryInvalidationBus {
+	return &memoryInvalidationBus{subscribers: make(map[*func(Invalidation)]bool)}
+}
+
+func (b *memoryInvalidationBus) Publish(ctx context.Context, inv Invalidation) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for handle := range b.subscribers {
+		(*handle)(inv)
+	}
+	return nil
+}
+
+func (b *memoryInvalidationBus) Subscribe(ctx context.Context, handle func(Invalidation), resync func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscribers[&handle] = true
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, &handle)
+	}()
+}
+
+// CacheInvalidator keeps the response cache of this instance consistent
+// with writes on all instances. Invalidations apply to the local cache at
+// once and are published in batches, so that bulk writes send few
+// notifications. Responses missed by a lost invalidation stay at most
+// until they expire, and a resync purges the whole cache. Invalidations
+// failing to publish are retried with the next batch.
+type CacheInvalidator struct {
+	cache      *ResponseCache
+	bus        InvalidationBus
+	logger     *slog.Logger
+	origin     string
+	timeout    time.Duration
+	retryDelay time.Duration
+
+	mu      sync.Mutex
+	pending map[string]bool
+	wake    chan struct{}
+}
+
+// NewCacheInvalidator returns an invalidator for cache sending through bus.
+func NewCacheInvalidator(cache *ResponseCache, bus InvalidationBus, logger *slog.Logger) *CacheInvalidator {
+	return &CacheInvalidator{
+		cache:      cache,
+		bus:        bus,
+		logger:     logger,
+		origin:     randomHex(8),
+		timeout:    5 * time.Second,
+		retryDelay: time.Second,
+		pending:    make(map[string]bool),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Invalidate drops the responses starting with prefixes on all instances.
+// It is a no-op on a nil CacheInvalidator, so callers need not check
+// whether caching is enabled.
+func (i *CacheInvalidator) Invalidate(prefixes ...string) {
+	if i == nil {
+		return
+	}
+	i.cache.Invalidate(prefixes...)
+
+	i.queue(prefixes)
+	select {
+	case i.wake <- struct{}{}:
+	default:
+	}
+}
+
+// queue adds prefixes to the pending invalidations.
+func (i *CacheInvalidator) queue(prefixes []string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, prefix := range prefixes {
+		i.pending[prefix] = true
+	}
+}
+
+// Run subscribes to the bus and publishes pending invalidations until ctx
+// is cancelled.
+func (i *CacheInvalidator) Run(ctx context.Context) {
+	i.bus.Subscribe(ctx, i.apply, func() {
+		i.logger.Warn("Purging the response cache after missing invalidations")
+		i.cache.Purge()
+	})
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-i.wake:
+		case <-retry:
+		case <-ctx.Done():
+			return
+		}
+		retry = nil
+		if !i.publish(ctx) {
+			retry = time.After(i.retryDelay)
+		}
+	}
+}
+
+// apply drops the responses named by an invalidation of another instance.
+func (i *CacheInvalidator) apply(inv Invalidation) {
+	if inv.Origin != i.origin {
+		i.cache.Invalidate(inv.Prefixes...)
+	}
+}
+
+// publish sends the pending invalidations as one. If that fails, they are
+// queued again and publish reports false.
+func (i *CacheInvalidator) publish(ctx context.Context) bool {
+	i.mu.Lock()
+	inv := Invalidation{Origin: i.origin}
+	for prefix := range i.pending {
+		inv.Prefixes = append(inv.Prefixes, prefix)
+	}
+	clear(i.pending)
+	i.mu.Unlock()
+	if len(inv.Prefixes) == 0 {
+		return true
+	}
+
+	publishCtx, cancel := context.WithTimeout(ctx, i.timeout)
+	defer cancel()
+	if err := i.bus.Publish(publishCtx, inv); err != nil {
+		i.logger.Warn("Failed to publish cache invalidation, retrying", "prefixes", inv.Prefixes, "retry_in", i.retryDelay, "error", err)
+		i.queue(inv.Prefixes)
+		return false
+	}
+	return true
+}
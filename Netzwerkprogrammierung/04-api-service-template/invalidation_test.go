@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// cached reports whether c holds a response for the GET request of target.
+func cached(c *ResponseCache, target string) bool {
+	req := httptest.NewRequest("GET", target, nil)
+	_, _, found := c.lookup(cacheKey(req), req)
+	return found
+}
+
+// fillCache stores a response for every target in c.
+func fillCache(c *ResponseCache, targets ...string) {
+	for _, target := range targets {
+		req := httptest.NewRequest("GET", target, nil)
+		c.store(cacheKey(req), req, storedResponse{status: http.StatusOK, header: http.Header{}, body: []byte(`{}`)}, time.Minute)
+	}
+}
+
+func TestCacheInvalidationReachesAllInstances(t *testing.T) {
+	// Setup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := newMemoryInvalidationBus()
+	cacheA := NewResponseCache(time.Minute, time.Second, 1<<20, 4)
+	cacheB := NewResponseCache(time.Minute, time.Second, 1<<20, 4)
+	a := NewCacheInvalidator(cacheA, bus, slog.Default())
+	b := NewCacheInvalidator(cacheB, bus, slog.Default())
+	go a.Run(ctx)
+	go b.Run(ctx)
+	fillCache(cacheA, "/v1/users/1", "/v1/users?limit=5", "/v1/webhooks")
+	fillCache(cacheB, "/v1/users/1", "/v1/users?limit=5", "/v1/webhooks")
+	assert.Eventually(t, func() bool {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		return len(bus.subscribers) == 2
+	}, time.Second, time.Millisecond)
+
+	// Execute
+	a.Invalidate("/v1/users")
+
+	// Validate
+	assert.False(t, cached(cacheA, "/v1/users/1"), "the local cache is invalidated at once")
+	assert.False(t, cached(cacheA, "/v1/users?limit=5"))
+	assert.Eventually(t, func() bool {
+		return !cached(cacheB, "/v1/users/1") && !cached(cacheB, "/v1/users?limit=5")
+	}, time.Second, time.Millisecond)
+	assert.True(t, cached(cacheA, "/v1/webhooks"))
+	assert.True(t, cached(cacheB, "/v1/webhooks"))
+}
+
+// resyncBus is an InvalidationBus reporting a lost connection on subscribe.
+type resyncBus struct{ memoryInvalidationBus }
+
+func (b *resyncBus) Subscribe(ctx context.Context, handle func(Invalidation), resync func()) {
+	resync()
+}
+
+func TestCacheInvalidatorPurgesOnResync(t *testing.T) {
+	// Setup
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewResponseCache(time.Minute, time.Second, 1<<20, 4)
+	fillCache(c, "/v1/users/1", "/v1/webhooks")
+	invalidator := NewCacheInvalidator(c, &resyncBus{}, slog.Default())
+	done := make(chan struct{})
+
+	// Execute
+	go func() {
+		invalidator.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return !cached(c, "/v1/users/1") }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+
+	// Validate
+	assert.False(t, cached(c, "/v1/webhooks"))
+}
+
+// failingBus is an InvalidationBus failing the first publishes.
+type failingBus struct {
+	*memoryInvalidationBus
+	failures atomic.Int32
+}
+
+func (b *failingBus) Publish(ctx context.Context, inv Invalidation) error {
+	if b.failures.Add(-1) >= 0 {
+		return ErrStoreUnavailable
+	}
+	return b.memoryInvalidationBus.Publish(ctx, inv)
+}
+
+func TestCacheInvalidatorRetriesFailedPublishes(t *testing.T) {
+	// Setup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bus := &failingBus{memoryInvalidationBus: newMemoryInvalidationBus()}
+	bus.failures.Store(2)
+	var received []Invalidation
+	var mu sync.Mutex
+	bus.Subscribe(ctx, func(inv Invalidation) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, inv)
+	}, func() {})
+	invalidator := NewCacheInvalidator(NewResponseCache(time.Minute, time.Second, 1<<20, 4), bus, slog.Default())
+	invalidator.retryDelay = time.Millisecond
+	go invalidator.Run(ctx)
+
+	// Execute
+	invalidator.Invalidate("/v1/users")
+
+	// Validate
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 1
+	}, time.Second, time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"/v1/users"}, received[0].Prefixes, "the failed invalidation was queued again")
+}
+
+func TestResponseCacheSkipsResponsesFetchedAcrossInvalidation(t *testing.T) {
+	// Setup
+	c := NewResponseCache(time.Minute, time.Second, 1<<20, 4)
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A write lands while the response is being read.
+		c.Invalidate("/v1/users")
+		w.Write([]byte(`{"id":1,"name":"Alice"}`))
+	}))
+
+	// Execute
+	serveCached(h, "/v1/users/1", nil)
+
+	// Validate
+	assert.False(t, cached(c, "/v1/users/1"))
+}
+
+func TestWritesInvalidateTenantUsers(t *testing.T) {
+	// Setup
+	c := NewResponseCache(time.Minute, time.Second, 1<<20, 4)
+	server := NewServer(WithStore(newTenantMemoryStore()), WithCache(c, true))
+	acme := withTenant(context.Background(), "acme")
+	for _, tenant := range []string{"acme", "globex"} {
+		req := httptest.NewRequest("GET", "/v1/users", nil)
+		req = req.WithContext(withTenant(req.Context(), tenant))
+		c.store(cacheKey(req), req, storedResponse{status: http.StatusOK, header: http.Header{}, body: []byte(`[]`)}, time.Minute)
+	}
+
+	// Execute
+	_, err := server.users.addUser(acme, User{Name: "Alice"})
+
+	// Validate
+	assert.NoError(t, err)
+	_, _, acmeCached := c.lookup("acme /v1/users", httptest.NewRequest("GET", "/v1/users", nil))
+	_, _, globexCached := c.lookup("globex /v1/users", httptest.NewRequest("GET", "/v1/users", nil))
+	assert.False(t, acmeCached)
+	assert.True(t, globexCached, "other tenants keep their responses")
+}
+
+func TestPGInvalidationBusPublish(t *testing.T) {
+	// Setup
+	busDB, busMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer busDB.Close()
+	bus := newPGInvalidationBus(busDB, slog.Default())
+
+	// Mock DB response
+	busMock.ExpectExec("SELECT pg_notify\\(\\$1, \\$2\\)").
+		WithArgs(invalidationChannel, `{"origin":"a1","prefixes":["acme /v1/users"]}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Execute
+	err = bus.Publish(context.Background(), Invalidation{Origin: "a1", Prefixes: []string{"acme /v1/users"}})
+
+	// Validate
+	assert.NoError(t, err)
+	assert.NoError(t, busMock.ExpectationsWereMet())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the clock skew tolerated when checking exp and nbf.
+const jwtLeeway = 30 * time.Second
+
+// ErrInvalidToken is returned for a bearer token that is malformed, not
+// signed with the configured secret or outside its validity period.
+var ErrInvalidToken = errors.New("invalid token")
+
+// jwtClaims are the registered and service specific claims this service
+// reads from a token. Unknown claims are ignored.
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	Tenant    string `json:"tenant,omitempty"`
+	SessionID string `json:"sid,omitempty"` // login session of tokens issued by the service
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf,omitempty"`
+}
+
+// verifyJWT checks a compact HS256 token against secret and returns its
+// claims. Tokens must carry an exp claim. Other algorithms, including
+// "none", are rejected.
+func verifyJWT(token string, secret []byte, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return jwtClaims{}, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return jwtClaims{}, ErrInvalidToken
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return jwtClaims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// decodeJWTSegment decodes a base64url encoded JSON segment into v.
+func decodeJWTSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// signJWT returns an HS256 token for claims. The service signs the access
+// tokens of logged-in users; other tokens come from an external issuer.
+func signJWT(claims any, secret []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,816 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// challengeTTL is how long a proof-of-work challenge can be solved.
+const challengeTTL = 5 * time.Minute
+
+// pendingLoginWait is how long an attempt waits for the attempts in flight
+// that lock its account or source if they fail.
+const pendingLoginWait = time.Second
+
+// pendingLoginTTL is how long an admitted attempt stays pending at most.
+const pendingLoginTTL = time.Minute
+
+// loginGuardCleanupInterval is how often the records of the login guard
+// that no longer matter are deleted.
+const loginGuardCleanupInterval = time.Minute
+
+// loginGuardMaxRecords bounds the failure records kept in process memory.
+const loginGuardMaxRecords = 100_000
+
+// LoginGuardSettings configure a LoginGuard. A threshold of zero disables
+// its measure.
+type LoginGuardSettings struct {
+	// FailureWindow is how long failures are remembered after the last one.
+	FailureWindow time.Duration
+	// BaseDelay is the wait after the first failure of an account or
+	// source. It doubles with every further failure up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// AccountLockThreshold and SourceLockThreshold are the failures after
+	// which an account or a source address is locked for LockoutDuration.
+	AccountLockThreshold int
+	SourceLockThreshold  int
+	LockoutDuration      time.Duration
+	// ChallengeThreshold is the failures after which a source must solve a
+	// proof-of-work challenge of ChallengeDifficulty leading zero bits with
+	// every login.
+	ChallengeThreshold  int
+	ChallengeDifficulty int
+}
+
+// defaultLoginGuardSettings are used unless the server is configured
+// otherwise. Sources lock much later than accounts, as many clients may
+// share an address.
+var defaultLoginGuardSettings = LoginGuardSettings{
+	FailureWindow:        15 * time.Minute,
+	BaseDelay:            time.Second,
+	MaxDelay:             30 * time.Second,
+	AccountLockThreshold: 10,
+	SourceLockThreshold:  100,
+	LockoutDuration:      15 * time.Minute,
+	ChallengeThreshold:   5,
+	ChallengeDifficulty:  18,
+}
+
+// failureRecord counts the failed logins of an account or a source.
+// Attempts admitted by Allow are pending until they are settled as failed
+// or succeeded.
+type failureRecord struct {
+	failures    int
+	pending     int
+	lastAttempt time.Time
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// idle reports whether rec holds neither failures, a lockout nor pending
+// attempts, so that it can be deleted.
+func (rec *failureRecord) idle() bool {
+	return rec.failures == 0 && rec.pending == 0 && rec.lockedUntil.IsZero()
+}
+
+// lastActive returns the latest time rec matters for.
+func (rec *failureRecord) lastActive() time.Time {
+	latest := rec.lastAttempt
+	for _, t := range []time.Time{rec.lastFailure, rec.lockedUntil} {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// expirePending forgets the pending attempts of rec once the last one was
+// admitted pendingLoginTTL ago, as the instance admitting them may have
+// stopped before settling them.
+func expirePending(rec *failureRecord, now time.Time) {
+	if rec.pending > 0 && now.Sub(rec.lastAttempt) >= pendingLoginTTL {
+		rec.pending = 0
+	}
+}
+
+// guardKey identifies the record of an account or of a source address.
+// Accounts are identified by the email they log in with, whether or not a
+// user has that email, so that lockouts do not reveal which emails exist.
+type guardKey struct {
+	tenant string
+	email  string
+	source string
+}
+
+// accountKey returns the key of the account of tenant and email.
+func accountKey(tenant, email string) guardKey {
+	return guardKey{tenant: tenant, email: email}
+}
+
+// sourceKey returns the key of a source address.
+func sourceKey(source string) guardKey {
+	return guardKey{source: source}
+}
+
+// LoginLockout describes the failed logins of an account or a source.
+type LoginLockout struct {
+	Tenant      string     `json:"tenant,omitempty"`
+	Email       string     `json:"email,omitempty"`
+	Source      string     `json:"source,omitempty"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	Challenged  bool       `json:"challenged,omitempty"`
+}
+
+// LoginLockouts are the accounts and sources with recent failed logins.
+type LoginLockouts struct {
+	Accounts []LoginLockout `json:"accounts"`
+	Sources  []LoginLockout `json:"sources"`
+}
+
+// LoginGuard protects the login against guessing passwords. It counts
+// failed logins per account and per source address. After every failure
+// the next attempt has to wait, twice as long each time, and after enough
+// failures the account or the source is locked for a while. Sources with
+// several failures must also solve a proof-of-work challenge with every
+// login, which makes guessing expensive without bothering other clients.
+//
+// The counts are kept in a LoginGuardStore. Instances sharing the store,
+// such as all instances using the same database, count together.
+type LoginGuard struct {
+	settings LoginGuardSettings
+	key      []byte // signs challenges
+	store    LoginGuardStore
+	now      func() time.Time
+}
+
+// NewLoginGuard returns a LoginGuard with settings keeping its counts in
+// store. Challenges are signed with a key derived from secret, so that
+// every instance sharing the secret accepts them.
+func NewLoginGuard(settings LoginGuardSettings, secret []byte, store LoginGuardStore) *LoginGuard {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("login challenges"))
+	return &LoginGuard{
+		settings: settings,
+		key:      mac.Sum(nil),
+		store:    store,
+		now:      time.Now,
+	}
+}
+
+// failures returns the failures of rec that are still remembered at now.
+func (g *LoginGuard) failures(rec *failureRecord, now time.Time) int {
+	if rec == nil || now.Sub(rec.lastFailure) >= g.settings.FailureWindow {
+		return 0
+	}
+	return rec.failures
+}
+
+// wait returns how long the next attempt covered by rec has to wait at now
+// and whether that is because of a lockout. Pending attempts count as
+// failures that happen now, so that parallel attempts cannot pass the
+// delay or the lockout together. With shared set, as for sources, they
+// only delay attempts once there are failures, so that clients behind one
+// address can log in at the same time.
+func (g *LoginGuard) wait(rec *failureRecord, threshold int, shared bool, now time.Time) (time.Duration, bool) {
+	if now.Before(rec.lockedUntil) {
+		return rec.lockedUntil.Sub(now), true
+	}
+	failures, last := g.failures(rec, now), rec.lastFailure
+	if threshold > 0 && rec.pending > 0 && failures+rec.pending >= threshold {
+		return pendingLoginWait, false
+	}
+	if rec.pending > 0 && (!shared || failures > 0) {
+		failures, last = failures+rec.pending, now
+	}
+	if failures == 0 || g.settings.BaseDelay <= 0 {
+		return 0, false
+	}
+	delay := g.settings.BaseDelay
+	for i := 1; i < failures && delay < g.settings.MaxDelay; i++ {
+		delay *= 2
+	}
+	if next := last.Add(min(delay, g.settings.MaxDelay)); now.Before(next) {
+		return next.Sub(now), false
+	}
+	return 0, false
+}
+
+// attemptKeys returns the keys of the records covering a login, the
+// account first as LoginGuardStore.UpdateRecords expects.
+func attemptKeys(tenant, email, source string) []guardKey {
+	return []guardKey{accountKey(tenant, email), sourceKey(source)}
+}
+
+// Allow returns how long a login to the account of tenant and email from
+// source has to wait, and whether the account or the source is locked.
+// Without a wait the attempt is admitted and pending until it is settled
+// with Failed, Succeeded or Abandoned.
+func (g *LoginGuard) Allow(ctx context.Context, tenant, email, source string) (wait time.Duration, locked bool, err error) {
+	now := g.now()
+	err = g.store.UpdateRecords(ctx, attemptKeys(tenant, email, source), func(recs []*failureRecord) {
+		account, src := recs[0], recs[1]
+		expirePending(account, now)
+		expirePending(src, now)
+		accountWait, accountLocked := g.wait(account, g.settings.AccountLockThreshold, false, now)
+		sourceWait, sourceLocked := g.wait(src, g.settings.SourceLockThreshold, true, now)
+		if wait, locked = max(accountWait, sourceWait), accountLocked || sourceLocked; wait > 0 {
+			return
+		}
+		for _, rec := range recs {
+			rec.pending++
+			rec.lastAttempt = now
+		}
+	})
+	return wait, locked, err
+}
+
+// settle ends a pending attempt of rec, if there is one.
+func settle(rec *failureRecord) {
+	if rec.pending > 0 {
+		rec.pending--
+	}
+}
+
+// Suspicious reports whether logins from source must solve a challenge.
+func (g *LoginGuard) Suspicious(ctx context.Context, source string) (bool, error) {
+	if g.settings.ChallengeThreshold <= 0 {
+		return false, nil
+	}
+	now := g.now()
+	rec, err := g.store.GetRecord(ctx, sourceKey(source))
+	if err != nil {
+		return false, err
+	}
+	return g.failures(rec, now) >= g.settings.ChallengeThreshold, nil
+}
+
+// Failed records a failed login, settling its pending attempt, and reports
+// whether it locked the account or the source.
+func (g *LoginGuard) Failed(ctx context.Context, tenant, email, source string) (accountLocked, sourceLocked bool, err error) {
+	now := g.now()
+	err = g.store.UpdateRecords(ctx, attemptKeys(tenant, email, source), func(recs []*failureRecord) {
+		for _, rec := range recs {
+			expirePending(rec, now)
+			settle(rec)
+		}
+		accountLocked = g.fail(recs[0], g.settings.AccountLockThreshold, now)
+		sourceLocked = g.fail(recs[1], g.settings.SourceLockThreshold, now)
+	})
+	return accountLocked, sourceLocked, err
+}
+
+// fail counts a failure in rec and locks it when it reaches threshold.
+// Failures stay counted during the lockout, so that a failure right after
+// it locks again.
+func (g *LoginGuard) fail(rec *failureRecord, threshold int, now time.Time) bool {
+	rec.failures = g.failures(rec, now) + 1
+	rec.lastFailure = now
+	if threshold > 0 && rec.failures >= threshold && !now.Before(rec.lockedUntil) {
+		rec.lockedUntil = now.Add(g.settings.LockoutDuration)
+		return true
+	}
+	return false
+}
+
+// Succeeded settles a pending attempt as a successful login and forgets the
+// failures of its account. The failures of the source are kept, as an
+// attacker may own one of the accounts it tries.
+func (g *LoginGuard) Succeeded(ctx context.Context, tenant, email, source string) error {
+	return g.store.UpdateRecords(ctx, attemptKeys(tenant, email, source), func(recs []*failureRecord) {
+		settle(recs[0])
+		settle(recs[1])
+		recs[0].failures, recs[0].lockedUntil = 0, time.Time{}
+	})
+}
+
+// Abandoned settles a pending attempt that ended before its password was
+// checked, without counting it.
+func (g *LoginGuard) Abandoned(ctx context.Context, tenant, email, source string) error {
+	return g.store.UpdateRecords(ctx, attemptKeys(tenant, email, source), func(recs []*failureRecord) {
+		settle(recs[0])
+		settle(recs[1])
+	})
+}
+
+// UnlockAccount forgets the failures of an account and reports whether
+// there were any.
+func (g *LoginGuard) UnlockAccount(ctx context.Context, tenant, email string) (bool, error) {
+	return g.store.DeleteRecord(ctx, accountKey(tenant, email))
+}
+
+// UnlockSource forgets the failures of a source and reports whether there
+// were any.
+func (g *LoginGuard) UnlockSource(ctx context.Context, source string) (bool, error) {
+	return g.store.DeleteRecord(ctx, sourceKey(source))
+}
+
+// Lockouts returns the accounts and sources with remembered failures or
+// lockouts, the most recent failure first.
+func (g *LoginGuard) Lockouts(ctx context.Context) (LoginLockouts, error) {
+	now := g.now()
+	records, err := g.store.ListRecords(ctx)
+	if err != nil {
+		return LoginLockouts{}, err
+	}
+
+	lockouts := LoginLockouts{Accounts: []LoginLockout{}, Sources: []LoginLockout{}}
+	for key, rec := range records {
+		lockout := LoginLockout{Failures: g.failures(&rec, now), LastFailure: rec.lastFailure}
+		if now.Before(rec.lockedUntil) {
+			lockout.LockedUntil = &rec.lockedUntil
+		}
+		if lockout.Failures == 0 && lockout.LockedUntil == nil {
+			continue
+		}
+		if key.source == "" {
+			lockout.Tenant, lockout.Email = key.tenant, key.email
+			lockouts.Accounts = append(lockouts.Accounts, lockout)
+			continue
+		}
+		lockout.Source = key.source
+		lockout.Challenged = g.settings.ChallengeThreshold > 0 && lockout.Failures >= g.settings.ChallengeThreshold
+		lockouts.Sources = append(lockouts.Sources, lockout)
+	}
+	for _, list := range [][]LoginLockout{lockouts.Accounts, lockouts.Sources} {
+		sort.Slice(list, func(i, j int) bool { return list[i].LastFailure.After(list[j].LastFailure) })
+	}
+	return lockouts, nil
+}
+
+// Cleanup deletes the records without remembered failures, lockouts or
+// pending attempts and the challenges that expired, and returns the number
+// of records deleted.
+func (g *LoginGuard) Cleanup(ctx context.Context) (int64, error) {
+	now := g.now()
+	return g.store.DeleteStale(ctx, now, now.Add(-g.settings.FailureWindow), now.Add(-pendingLoginTTL))
+}
+
+// cleanLoginGuard runs the cleanup of the login guard every
+// loginGuardCleanupInterval until ctx is cancelled.
+func (s *Server) cleanLoginGuard(ctx context.Context) {
+	ticker := time.NewTicker(loginGuardCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := s.loginGuard.Cleanup(ctx)
+			if err != nil {
+				s.logger.Warn("Failed to clean up login failures", "error", err)
+			} else if deleted > 0 {
+				s.logger.Debug("Forgot login failures", "count", deleted)
+			}
+		}
+	}
+}
+
+// NewChallenge returns a proof-of-work challenge for source. It carries its
+// expiry and is signed for source, so the guard does not need to remember
+// it until it is solved.
+func (g *LoginGuard) NewChallenge(source string) string {
+	payload := make([]byte, 8+16)
+	binary.BigEndian.PutUint64(payload, uint64(g.now().Add(challengeTTL).Unix()))
+	if _, err := rand.Read(payload[8:]); err != nil {
+		panic(err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + g.signChallenge(source, encoded)
+}
+
+// signChallenge returns the signature of an encoded challenge for source.
+func (g *LoginGuard) signChallenge(source, encoded string) string {
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write([]byte(source))
+	mac.Write([]byte{0})
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyChallenge reports whether nonce solves a challenge issued to source:
+// the SHA-256 hash of "<challenge>:<nonce>" must start with the configured
+// number of zero bits. Every challenge can be solved once.
+func (g *LoginGuard) VerifyChallenge(ctx context.Context, source, challenge, nonce string) (bool, error) {
+	encoded, signature, found := strings.Cut(challenge, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(g.signChallenge(source, encoded))) {
+		return false, nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(payload) != 8+16 {
+		return false, nil
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	if !g.now().Before(expires) || leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) < g.settings.ChallengeDifficulty {
+		return false, nil
+	}
+	return g.store.UseChallenge(ctx, challenge, expires)
+}
+
+// leadingZeroBits returns the number of zero bits hash starts with.
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	n := 0
+	for _, b := range hash {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// writeLoginThrottled answers a login that has to wait.
+func writeLoginThrottled(w http.ResponseWriter, r *http.Request, wait time.Duration, locked bool) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	p := problem{Type: problemBaseURI + "login-delayed", Title: "Too many failed logins", Status: http.StatusTooManyRequests,
+		Detail: "Wait " + strconv.Itoa(seconds) + " seconds before trying again.", Instance: r.URL.Path}
+	if locked {
+		p.Type, p.Title = problemBaseURI+"login-locked", "Login locked"
+		p.Detail = "Logins are locked after too many failures. Try again in " + strconv.Itoa(seconds) + " seconds or ask an administrator to unlock them."
+	}
+	writeProblem(w, p)
+}
+
+// writeChallengeRequired answers a login from a suspicious source without a
+// valid solution with a new challenge.
+func (s *Server) writeChallengeRequired(w http.ResponseWriter, r *http.Request, source string) {
+	difficulty := s.loginGuard.settings.ChallengeDifficulty
+	writeProblem(w, problem{Type: problemBaseURI + "challenge-required", Title: "Proof of work required", Status: http.StatusPreconditionRequired,
+		Detail: "Find a nonce such that the SHA-256 hash of \"<challenge>:<nonce>\" starts with " + strconv.Itoa(difficulty) +
+			" zero bits and send challenge and nonce with the login.",
+		Instance: r.URL.Path, Challenge: s.loginGuard.NewChallenge(source), Difficulty: difficulty})
+}
+
+// listLockouts handles the GET /admin/lockouts endpoint.
+func (a *AdminAPI) listLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := a.server.loginGuard.Lockouts(r.Context())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, lockouts)
+}
+
+// unlockAccount handles the DELETE /admin/lockouts/accounts/{tenant}/{email}
+// endpoint.
+func (a *AdminAPI) unlockAccount(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, email := vars["tenant"], normalizeEmail(vars["email"])
+	found, err := a.server.loginGuard.UnlockAccount(r.Context(), tenant, email)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	} else if !found {
+		http.NotFound(w, r)
+		return
+	}
+	a.audit.Info("Admin unlocked an account", "tenant", tenant, "email", email)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unlockSource handles the DELETE /admin/lockouts/sources/{source} endpoint.
+func (a *AdminAPI) unlockSource(w http.ResponseWriter, r *http.Request) {
+	source := mux.Vars(r)["source"]
+	found, err := a.server.loginGuard.UnlockSource(r.Context(), source)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	} else if !found {
+		http.NotFound(w, r)
+		return
+	}
+	a.audit.Info("Admin unlocked a source", "source", source)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginGuardStore keeps the failure records and the solved challenges of a
+// LoginGuard.
+type LoginGuardStore interface {
+	// UpdateRecords calls fn with the records of keys, empty ones for keys
+	// without a record, and saves the changes fn makes. Updates of the same
+	// records run one after another; records are locked in the order of
+	// keys, so callers pass the keys of accounts before those of sources.
+	// Records fn leaves idle are deleted.
+	UpdateRecords(ctx context.Context, keys []guardKey, fn func(recs []*failureRecord)) error
+	// GetRecord returns the record of key, or nil if there is none.
+	GetRecord(ctx context.Context, key guardKey) (*failureRecord, error)
+	// ListRecords returns all records.
+	ListRecords(ctx context.Context) (map[guardKey]failureRecord, error)
+	// DeleteRecord deletes the record of key and reports whether there was
+	// one.
+	DeleteRecord(ctx context.Context, key guardKey) (bool, error)
+	// UseChallenge remembers challenge as solved until it expires and
+	// reports whether it was not solved before.
+	UseChallenge(ctx context.Context, challenge string, expires time.Time) (bool, error)
+	// DeleteStale deletes the records that are not locked at now, whose
+	// last failure was at or before failedBefore and that have no pending
+	// attempts admitted after attemptedBefore, together with the challenges
+	// expired at now. It returns the number of records deleted.
+	DeleteStale(ctx context.Context, now, failedBefore, attemptedBefore time.Time) (int64, error)
+}
+
+// stale reports whether rec would be deleted by DeleteStale.
+func (rec *failureRecord) stale(now, failedBefore, attemptedBefore time.Time) bool {
+	return !rec.lastFailure.After(failedBefore) && !now.Before(rec.lockedUntil) &&
+		(rec.pending == 0 || !rec.lastAttempt.After(attemptedBefore))
+}
+
+// sqlLoginGuardStore is a LoginGuardStore backed by the login_failures and
+// login_challenges tables, shared by all instances.
+type sqlLoginGuardStore struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+}
+
+// newSQLLoginGuardStore returns a LoginGuardStore using db.
+func newSQLLoginGuardStore(db *sql.DB) *sqlLoginGuardStore {
+	return &sqlLoginGuardStore{db: db, queryTimeout: 5 * time.Second}
+}
+
+// failureRecordColumns are the columns read by scanFailureRecord.
+const failureRecordColumns = "failures, pending, last_attempt, last_failure, locked_until"
+
+// scanFailureRecord reads the failureRecordColumns of a row.
+func scanFailureRecord(scan func(dest ...any) error) (*failureRecord, error) {
+	var rec failureRecord
+	var lastAttempt, lastFailure, lockedUntil sql.NullTime
+	if err := scan(&rec.failures, &rec.pending, &lastAttempt, &lastFailure, &lockedUntil); err != nil {
+		return nil, err
+	}
+	rec.lastAttempt, rec.lastFailure, rec.lockedUntil = lastAttempt.Time, lastFailure.Time, lockedUntil.Time
+	return &rec, nil
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (s *sqlLoginGuardStore) UpdateRecords(ctx context.Context, keys []guardKey, fn func(recs []*failureRecord)) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	return classify(ctx, s.updateRecords(ctx, keys, fn))
+}
+
+func (s *sqlLoginGuardStore) updateRecords(ctx context.Context, keys []guardKey, fn func(recs []*failureRecord)) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	recs := make([]*failureRecord, len(keys))
+	for i, key := range keys {
+		// The upsert locks the record, a new one as well, until the
+		// transaction ends.
+		row := tx.QueryRowContext(ctx,
+			`INSERT INTO login_failures (tenant_id, email, source) VALUES ($1, $2, $3)
+			ON CONFLICT (tenant_id, email, source) DO UPDATE SET source = EXCLUDED.source
+			RETURNING `+failureRecordColumns,
+			key.tenant, key.email, key.source)
+		if recs[i], err = scanFailureRecord(row.Scan); err != nil {
+			return err
+		}
+	}
+	fn(recs)
+	for i, key := range keys {
+		rec := recs[i]
+		if rec.idle() {
+			_, err = tx.ExecContext(ctx, "DELETE FROM login_failures WHERE tenant_id = $1 AND email = $2 AND source = $3",
+				key.tenant, key.email, key.source)
+		} else {
+			_, err = tx.ExecContext(ctx,
+				"UPDATE login_failures SET failures = $4, pending = $5, last_attempt = $6, last_failure = $7, locked_until = $8 WHERE tenant_id = $1 AND email = $2 AND source = $3",
+				key.tenant, key.email, key.source,
+				rec.failures, rec.pending, nullTime(rec.lastAttempt), nullTime(rec.lastFailure), nullTime(rec.lockedUntil))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlLoginGuardStore) GetRecord(ctx context.Context, key guardKey) (*failureRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	row := s.db.QueryRowContext(ctx,
+		"SELECT "+failureRecordColumns+" FROM login_failures WHERE tenant_id = $1 AND email = $2 AND source = $3",
+		key.tenant, key.email, key.source)
+	rec, err := scanFailureRecord(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return rec, classify(ctx, err)
+}
+
+func (s *sqlLoginGuardStore) ListRecords(ctx context.Context) (map[guardKey]failureRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT tenant_id, email, source, "+failureRecordColumns+" FROM login_failures")
+	if err != nil {
+		return nil, classify(ctx, err)
+	}
+	defer rows.Close()
+
+	records := make(map[guardKey]failureRecord)
+	for rows.Next() {
+		var key guardKey
+		rec, err := scanFailureRecord(func(dest ...any) error {
+			return rows.Scan(append([]any{&key.tenant, &key.email, &key.source}, dest...)...)
+		})
+		if err != nil {
+			return nil, classify(ctx, err)
+		}
+		records[key] = *rec
+	}
+	return records, classify(ctx, rows.Err())
+}
+
+func (s *sqlLoginGuardStore) DeleteRecord(ctx context.Context, key guardKey) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, "DELETE FROM login_failures WHERE tenant_id = $1 AND email = $2 AND source = $3",
+		key.tenant, key.email, key.source)
+	if err != nil {
+		return false, classify(ctx, err)
+	}
+	return requireAffected(result) == nil, nil
+}
+
+func (s *sqlLoginGuardStore) UseChallenge(ctx context.Context, challenge string, expires time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx,
+		"INSERT INTO login_challenges (challenge, expires_at) VALUES ($1, $2) ON CONFLICT (challenge) DO NOTHING",
+		challenge, expires)
+	if err != nil {
+		return false, classify(ctx, err)
+	}
+	return requireAffected(result) == nil, nil
+}
+
+func (s *sqlLoginGuardStore) DeleteStale(ctx context.Context, now, failedBefore, attemptedBefore time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx,
+		`DELETE FROM login_failures WHERE (last_failure IS NULL OR last_failure <= $2)
+		AND (locked_until IS NULL OR locked_until <= $1) AND (pending = 0 OR last_attempt <= $3)`,
+		now, failedBefore, attemptedBefore)
+	if err != nil {
+		return 0, classify(ctx, err)
+	}
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM login_challenges WHERE expires_at <= $1", now); err != nil {
+		return 0, classify(ctx, err)
+	}
+	return result.RowsAffected()
+}
+
+// memoryLoginGuardStore is a LoginGuardStore kept in process memory, so
+// that every instance counts on its own. It keeps at most maxRecords
+// records and evicts those that mattered least recently, locked ones last,
+// when it would exceed them.
+type memoryLoginGuardStore struct {
+	mu         sync.Mutex
+	records    map[guardKey]*failureRecord
+	solved     map[string]time.Time // used challenges until they expire
+	maxRecords int
+}
+
+// newMemoryLoginGuardStore returns an empty in-memory LoginGuardStore.
+func newMemoryLoginGuardStore() *memoryLoginGuardStore {
+	return &memoryLoginGuardStore{
+		records:    make(map[guardKey]*failureRecord),
+		solved:     make(map[string]time.Time),
+		maxRecords: loginGuardMaxRecords,
+	}
+}
+
+func (s *memoryLoginGuardStore) UpdateRecords(_ context.Context, keys []guardKey, fn func(recs []*failureRecord)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	missing := 0
+	for _, key := range keys {
+		if _, found := s.records[key]; !found {
+			missing++
+		}
+	}
+	s.makeRoom(missing)
+	recs := make([]*failureRecord, len(keys))
+	for i, key := range keys {
+		rec, found := s.records[key]
+		if !found {
+			rec = &failureRecord{}
+			s.records[key] = rec
+		}
+		recs[i] = rec
+	}
+	fn(recs)
+	for i, key := range keys {
+		if recs[i].idle() {
+			delete(s.records, key)
+		}
+	}
+	return nil
+}
+
+// makeRoom makes room for n more records without exceeding s.maxRecords.
+// If needed, the records that mattered least recently are evicted down to
+// nine tenths of the limit, so that eviction does not run again with every
+// attempt. The caller must hold s.mu.
+func (s *memoryLoginGuardStore) makeRoom(n int) {
+	if len(s.records)+n <= s.maxRecords {
+		return
+	}
+	keys := make([]guardKey, 0, len(s.records))
+	for key := range s.records {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.records[keys[i]].lastActive().Before(s.records[keys[j]].lastActive())
+	})
+	for _, key := range keys[:max(len(keys)-s.maxRecords*9/10, 0)] {
+		delete(s.records, key)
+	}
+}
+
+func (s *memoryLoginGuardStore) GetRecord(_ context.Context, key guardKey) (*failureRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, found := s.records[key]
+	if !found {
+		return nil, nil
+	}
+	copied := *rec
+	return &copied, nil
+}
+
+func (s *memoryLoginGuardStore) ListRecords(context.Context) (map[guardKey]failureRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make(map[guardKey]failureRecord, len(s.records))
+	for key, rec := range s.records {
+		records[key] = *rec
+	}
+	return records, nil
+}
+
+func (s *memoryLoginGuardStore) DeleteRecord(_ context.Context, key guardKey) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.records[key]
+	delete(s.records, key)
+	return found, nil
+}
+
+func (s *memoryLoginGuardStore) UseChallenge(_ context.Context, challenge string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, used := s.solved[challenge]; used {
+		return false, nil
+	}
+	s.solved[challenge] = expires
+	return true, nil
+}
+
+func (s *memoryLoginGuardStore) DeleteStale(_ context.Context, now, failedBefore, attemptedBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for key, rec := range s.records {
+		if rec.stale(now, failedBefore, attemptedBefore) {
+			delete(s.records, key)
+			deleted++
+		}
+	}
+	for challenge, expires := range s.solved {
+		if !now.Before(expires) {
+			delete(s.solved, challenge)
+		}
+	}
+	return deleted, nil
+}
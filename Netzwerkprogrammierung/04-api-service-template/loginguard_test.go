@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// solveChallenge returns a nonce solving challenge at difficulty.
+func solveChallenge(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		nonce := strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) >= difficulty {
+			return nonce
+		}
+	}
+}
+
+func TestLoginGuardDelaysAndLocks(t *testing.T) {
+	// Setup
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	guard := NewLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, BaseDelay: time.Second, MaxDelay: 4 * time.Second,
+		AccountLockThreshold: 4, SourceLockThreshold: 6, LockoutDuration: 10 * time.Minute}, []byte(testJWTSecret), newMemoryLoginGuardStore())
+	guard.now = func() time.Time { return now }
+	fail := func(email string) (bool, bool) {
+		now = now.Add(time.Minute)
+		accountLocked, sourceLocked, _ := guard.Failed(ctx, "acme", email, "192.0.2.1")
+		return accountLocked, sourceLocked
+	}
+
+	// Execute and validate
+	wait, locked, _ := guard.Allow(ctx, "acme", "alice@example.com", "192.0.2.1")
+	assert.Zero(t, wait)
+	assert.False(t, locked)
+
+	fail("alice@example.com")
+	wait, _, _ = guard.Allow(ctx, "acme", "alice@example.com", "198.51.100.7")
+	assert.Equal(t, time.Second, wait, "the account waits wherever the login comes from")
+	fail("alice@example.com")
+	wait, _, _ = guard.Allow(ctx, "acme", "bob@example.com", "192.0.2.1")
+	assert.Equal(t, 2*time.Second, wait, "the source waits whatever account it tries")
+	fail("alice@example.com")
+	wait, _, _ = guard.Allow(ctx, "acme", "alice@example.com", "198.51.100.7")
+	assert.Equal(t, 4*time.Second, wait)
+	now = now.Add(4 * time.Second)
+	wait, _, _ = guard.Allow(ctx, "acme", "alice@example.com", "198.51.100.7")
+	assert.Zero(t, wait, "the delay has passed")
+
+	accountLocked, sourceLocked := fail("alice@example.com")
+	assert.True(t, accountLocked)
+	assert.False(t, sourceLocked)
+	wait, locked, _ = guard.Allow(ctx, "acme", "alice@example.com", "198.51.100.7")
+	assert.Equal(t, 10*time.Minute, wait)
+	assert.True(t, locked)
+	wait, _, _ = guard.Allow(ctx, "other", "alice@example.com", "198.51.100.7")
+	assert.Zero(t, wait, "accounts are tenant-scoped")
+
+	fail("bob@example.com")
+	_, sourceLocked = fail("carol@example.com")
+	assert.True(t, sourceLocked)
+	_, locked, _ = guard.Allow(ctx, "acme", "dave@example.com", "192.0.2.1")
+	assert.True(t, locked)
+
+	lockouts, err := guard.Lockouts(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, lockouts.Accounts, 3) {
+		assert.Equal(t, "carol@example.com", lockouts.Accounts[0].Email, "the most recent failure comes first")
+	}
+	if assert.Len(t, lockouts.Sources, 1) {
+		assert.Equal(t, 6, lockouts.Sources[0].Failures)
+		assert.NotNil(t, lockouts.Sources[0].LockedUntil)
+	}
+
+	now = now.Add(10 * time.Minute)
+	_, locked, _ = guard.Allow(ctx, "acme", "alice@example.com", "198.51.100.7")
+	assert.False(t, locked, "lockouts end after their duration")
+	assert.NoError(t, guard.Succeeded(ctx, "acme", "alice@example.com", "198.51.100.7"))
+	found, err := guard.UnlockAccount(ctx, "acme", "alice@example.com")
+	assert.NoError(t, err)
+	assert.False(t, found, "a successful login forgets the failures")
+	found, err = guard.UnlockSource(ctx, "192.0.2.1")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	now = now.Add(time.Hour)
+	lockouts, err = guard.Lockouts(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, lockouts.Accounts, "failures are forgotten after the window")
+}
+
+func TestLoginGuardAdmitsParallelAttemptsOnce(t *testing.T) {
+	// Setup
+	ctx := context.Background()
+	delayed := NewLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, BaseDelay: time.Second, MaxDelay: time.Minute}, []byte(testJWTSecret), newMemoryLoginGuardStore())
+	locking := NewLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, AccountLockThreshold: 3, LockoutDuration: time.Hour}, []byte(testJWTSecret), newMemoryLoginGuardStore())
+	burst := func(guard *LoginGuard) int {
+		var admitted atomic.Int32
+		var wg sync.WaitGroup
+		for i := range 50 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				source := "192.0.2." + strconv.Itoa(i)
+				if wait, _, _ := guard.Allow(ctx, "acme", "alice@example.com", source); wait == 0 {
+					admitted.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		return int(admitted.Load())
+	}
+
+	// Execute
+	delayedAdmitted := burst(delayed)
+	lockingAdmitted := burst(locking)
+	for range lockingAdmitted {
+		locking.Failed(ctx, "acme", "alice@example.com", "192.0.2.1")
+	}
+	_, locked, _ := locking.Allow(ctx, "acme", "alice@example.com", "198.51.100.7")
+	sharedWait, _, _ := delayed.Allow(ctx, "acme", "bob@example.com", "192.0.2.1")
+
+	// Validate
+	assert.Equal(t, 1, delayedAdmitted, "an attempt in flight delays the next one")
+	assert.Equal(t, 3, lockingAdmitted, "no more attempts pass than the lockout allows")
+	assert.True(t, locked)
+	assert.Zero(t, sharedWait, "attempts in flight do not delay other accounts of a source without failures")
+}
+
+func TestLoginGuardSettlesAttempts(t *testing.T) {
+	// Setup
+	ctx := context.Background()
+	store := newMemoryLoginGuardStore()
+	guard := NewLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, BaseDelay: time.Second, MaxDelay: time.Minute}, []byte(testJWTSecret), store)
+
+	// Execute and validate
+	guard.Allow(ctx, "acme", "alice@example.com", "192.0.2.1")
+	wait, _, _ := guard.Allow(ctx, "acme", "alice@example.com", "192.0.2.1")
+	assert.Equal(t, time.Second, wait)
+	guard.Abandoned(ctx, "acme", "alice@example.com", "192.0.2.1")
+	wait, _, _ = guard.Allow(ctx, "acme", "alice@example.com", "192.0.2.1")
+	assert.Zero(t, wait, "abandoned attempts are not counted")
+	guard.Succeeded(ctx, "acme", "alice@example.com", "192.0.2.1")
+	wait, _, _ = guard.Allow(ctx, "acme", "alice@example.com", "192.0.2.1")
+	assert.Zero(t, wait)
+	guard.Failed(ctx, "acme", "alice@example.com", "192.0.2.1")
+	assert.Empty(t, store.records[accountKey("acme", "alice@example.com")].pending)
+	assert.Empty(t, store.records[sourceKey("192.0.2.1")].pending)
+}
+
+func TestLoginGuardInstancesShareFailures(t *testing.T) {
+	// Setup
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	settings := LoginGuardSettings{FailureWindow: time.Hour, AccountLockThreshold: 2, LockoutDuration: time.Hour}
+	store := newMemoryLoginGuardStore()
+	a := NewLoginGuard(settings, []byte(testJWTSecret), store)
+	b := NewLoginGuard(settings, []byte(testJWTSecret), store)
+	for _, guard := range []*LoginGuard{a, b} {
+		guard.now = func() time.Time { return now }
+	}
+
+	// Execute
+	a.Allow(ctx, "acme", "alice@example.com", "192.0.2.1")
+	a.Failed(ctx, "acme", "alice@example.com", "192.0.2.1")
+	b.Allow(ctx, "acme", "alice@example.com", "198.51.100.7")
+	_, locking, _ := b.Failed(ctx, "acme", "alice@example.com", "198.51.100.7")
+	wait, locked, err := a.Allow(ctx, "acme", "alice@example.com", "203.0.113.9")
+
+	// Validate
+	assert.False(t, locking)
+	assert.NoError(t, err)
+	assert.True(t, locked, "failures on every instance count towards the lockout")
+	assert.Equal(t, time.Hour, wait)
+}
+
+func TestLoginGuardExpiresPendingAttempts(t *testing.T) {
+	// Setup
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	guard := NewLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, BaseDelay: time.Second, MaxDelay: time.Minute},
+		[]byte(testJWTSecret), newMemoryLoginGuardStore())
+	guard.now = func() time.Time { return now }
+
+	// Execute
+	guard.Allow(ctx, "acme", "alice@example.com", "192.0.2.1")
+	pendingWait, _, _ := guard.Allow(ctx, "acme", "alice@example.com", "192.0.2.1")
+	now = now.Add(pendingLoginTTL)
+	expiredWait, _, _ := guard.Allow(ctx, "acme", "alice@example.com", "192.0.2.1")
+
+	// Validate
+	assert.Equal(t, time.Second, pendingWait)
+	assert.Zero(t, expiredWait, "attempts that were never settled stop counting")
+}
+
+func TestMemoryLoginGuardStoreBoundsItsRecords(t *testing.T) {
+	// Setup
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := newMemoryLoginGuardStore()
+	store.maxRecords = 10
+	guard := NewLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, AccountLockThreshold: 1, LockoutDuration: time.Hour},
+		[]byte(testJWTSecret), store)
+	guard.now = func() time.Time { return now }
+	guard.Failed(ctx, "acme", "locked@example.com", "192.0.2.1")
+
+	// Execute
+	for i := range 20 {
+		now = now.Add(time.Second)
+		guard.Allow(ctx, "acme", "user"+strconv.Itoa(i)+"@example.com", "192.0.2.1")
+	}
+
+	// Validate
+	assert.LessOrEqual(t, len(store.records), 10)
+	assert.Contains(t, store.records, accountKey("acme", "locked@example.com"), "locked accounts are evicted last")
+	assert.Contains(t, store.records, accountKey("acme", "user19@example.com"), "the most recent records are kept")
+	assert.NotContains(t, store.records, accountKey("acme", "user0@example.com"))
+}
+
+func TestLoginGuardCleanup(t *testing.T) {
+	// Setup
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := newMemoryLoginGuardStore()
+	guard := NewLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, AccountLockThreshold: 2, LockoutDuration: 2 * time.Hour,
+		ChallengeDifficulty: 1}, []byte(testJWTSecret), store)
+	guard.now = func() time.Time { return now }
+	guard.Failed(ctx, "acme", "alice@example.com", "192.0.2.1")
+	guard.Failed(ctx, "acme", "alice@example.com", "192.0.2.1")
+	guard.Allow(ctx, "acme", "bob@example.com", "198.51.100.7")
+	challenge := guard.NewChallenge("192.0.2.1")
+	guard.VerifyChallenge(ctx, "192.0.2.1", challenge, solveChallenge(challenge, 1))
+
+	// Execute
+	now = now.Add(90 * time.Minute)
+	deleted, err := guard.Cleanup(ctx)
+
+	// Validate
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), deleted, "the source of alice and both records of bob are forgotten")
+	assert.Contains(t, store.records, accountKey("acme", "alice@example.com"), "locked accounts are kept")
+	assert.Empty(t, store.solved, "expired challenges are forgotten")
+}
+
+func TestSQLLoginGuardStore(t *testing.T) {
+	// Setup
+	storeDB, storeMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer storeDB.Close()
+	store := newSQLLoginGuardStore(storeDB)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	guard := NewLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, BaseDelay: time.Second, MaxDelay: time.Minute},
+		[]byte(testJWTSecret), store)
+	guard.now = func() time.Time { return now }
+	columns := []string{"failures", "pending", "last_attempt", "last_failure", "locked_until"}
+	upsert := "INSERT INTO login_failures \\(tenant_id, email, source\\) VALUES \\(\\$1, \\$2, \\$3\\)\\s+" +
+		"ON CONFLICT \\(tenant_id, email, source\\) DO UPDATE SET source = EXCLUDED.source\\s+" +
+		"RETURNING failures, pending, last_attempt, last_failure, locked_until"
+
+	// Mock DB response
+	storeMock.ExpectBegin()
+	storeMock.ExpectQuery(upsert).WithArgs("acme", "alice@example.com", "").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, 0, nil, now.Add(-time.Minute), nil))
+	storeMock.ExpectQuery(upsert).WithArgs("", "", "192.0.2.1").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(0, 0, nil, nil, nil))
+	storeMock.ExpectExec("UPDATE login_failures SET failures = \\$4, pending = \\$5, last_attempt = \\$6, last_failure = \\$7, locked_until = \\$8 "+
+		"WHERE tenant_id = \\$1 AND email = \\$2 AND source = \\$3").
+		WithArgs("acme", "alice@example.com", "", 1, 1, now, now.Add(-time.Minute), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectExec("UPDATE login_failures SET").
+		WithArgs("", "", "192.0.2.1", 0, 1, now, nil, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectCommit()
+	storeMock.ExpectBegin()
+	storeMock.ExpectQuery(upsert).WithArgs("acme", "alice@example.com", "").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(0, 1, now, nil, nil))
+	storeMock.ExpectQuery(upsert).WithArgs("", "", "192.0.2.1").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(0, 1, now, nil, nil))
+	storeMock.ExpectExec("DELETE FROM login_failures WHERE tenant_id = \\$1 AND email = \\$2 AND source = \\$3").
+		WithArgs("acme", "alice@example.com", "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectExec("DELETE FROM login_failures WHERE tenant_id = \\$1").
+		WithArgs("", "", "192.0.2.1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectCommit()
+	storeMock.ExpectExec("INSERT INTO login_challenges \\(challenge, expires_at\\) VALUES \\(\\$1, \\$2\\) ON CONFLICT \\(challenge\\) DO NOTHING").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	storeMock.ExpectExec("DELETE FROM login_failures WHERE \\(last_failure IS NULL OR last_failure <= \\$2\\)").
+		WithArgs(now, now.Add(-time.Hour), now.Add(-pendingLoginTTL)).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	storeMock.ExpectExec("DELETE FROM login_challenges WHERE expires_at <= \\$1").
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// Execute
+	ctx := context.Background()
+	wait, _, allowErr := guard.Allow(ctx, "acme", "alice@example.com", "192.0.2.1")
+	abandonErr := guard.Abandoned(ctx, "acme", "alice@example.com", "192.0.2.1")
+	challenge := guard.NewChallenge("192.0.2.1")
+	solved, verifyErr := guard.VerifyChallenge(ctx, "192.0.2.1", challenge, "0")
+	deleted, cleanupErr := guard.Cleanup(ctx)
+
+	// Validate
+	assert.NoError(t, allowErr)
+	assert.Zero(t, wait, "the delay after the failure has passed")
+	assert.NoError(t, abandonErr)
+	assert.NoError(t, verifyErr)
+	assert.False(t, solved, "a challenge solved on another instance is refused")
+	assert.NoError(t, cleanupErr)
+	assert.Equal(t, int64(4), deleted)
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
+
+func TestLoginGuardChallenges(t *testing.T) {
+	// Setup
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	guard := NewLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, ChallengeThreshold: 2, ChallengeDifficulty: 8}, []byte(testJWTSecret), newMemoryLoginGuardStore())
+	guard.now = func() time.Time { return now }
+	other := NewLoginGuard(guard.settings, []byte("another secret"), newMemoryLoginGuardStore())
+	other.now = guard.now
+	suspicious := func(source string) bool {
+		found, err := guard.Suspicious(ctx, source)
+		assert.NoError(t, err)
+		return found
+	}
+	verify := func(g *LoginGuard, source, challenge, nonce string) bool {
+		solved, err := g.VerifyChallenge(ctx, source, challenge, nonce)
+		assert.NoError(t, err)
+		return solved
+	}
+
+	// Execute
+	guard.Failed(ctx, "acme", "alice@example.com", "192.0.2.1")
+	suspiciousAfterOne := suspicious("192.0.2.1")
+	guard.Failed(ctx, "acme", "bob@example.com", "192.0.2.1")
+	challenge := guard.NewChallenge("192.0.2.1")
+	nonce := solveChallenge(challenge, 8)
+	wrongNonce := "x"
+	for leadingZeroBits(sha256.Sum256([]byte(challenge+":"+wrongNonce))) >= 8 {
+		wrongNonce += "x"
+	}
+	expired := guard.NewChallenge("192.0.2.1")
+	expiredNonce := solveChallenge(expired, 8)
+
+	// Validate
+	assert.False(t, suspiciousAfterOne)
+	assert.True(t, suspicious("192.0.2.1"))
+	assert.False(t, suspicious("198.51.100.7"))
+	assert.False(t, verify(guard, "192.0.2.1", challenge, wrongNonce))
+	assert.False(t, verify(guard, "198.51.100.7", challenge, nonce), "challenges are bound to their source")
+	assert.False(t, verify(other, "192.0.2.1", challenge, nonce), "challenges are signed")
+	assert.False(t, verify(guard, "192.0.2.1", "not-a-challenge", nonce))
+	assert.True(t, verify(guard, "192.0.2.1", challenge, nonce))
+	assert.False(t, verify(guard, "192.0.2.1", challenge, nonce), "challenges can be solved once")
+	now = now.Add(challengeTTL)
+	assert.False(t, verify(guard, "192.0.2.1", expired, expiredNonce))
+}
+
+func TestLoginIsThrottled(t *testing.T) {
+	// Setup
+	now := time.Now()
+	s := newLoginServer(t, WithClock(func() time.Time { return now }), WithAdmin("secret", nil),
+		WithLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, BaseDelay: time.Second, MaxDelay: time.Minute,
+			AccountLockThreshold: 2, LockoutDuration: 10 * time.Minute}))
+
+	// Execute
+	_, wrong := s.login("wrong")
+	_, early := s.login("correct horse")
+	now = now.Add(time.Second)
+	_, locking := s.login("wrong")
+	now = now.Add(time.Minute)
+	_, locked := s.login("correct horse")
+	lockouts := adminRequest(s, "GET", "/admin/lockouts", "")
+	unlocked := adminRequest(s, "DELETE", "/admin/lockouts/accounts/default/Alice@Example.com", "")
+	unknown := adminRequest(s, "DELETE", "/admin/lockouts/accounts/default/alice@example.com", "")
+	unknownSource := adminRequest(s, "DELETE", "/admin/lockouts/sources/198.51.100.7", "")
+	_, loggedIn := s.login("correct horse")
+
+	// Validate
+	assert.Equal(t, http.StatusUnauthorized, wrong.Code)
+	assert.Equal(t, http.StatusTooManyRequests, early.Code)
+	assert.Equal(t, "1", early.Header().Get("Retry-After"))
+	assert.Contains(t, early.Body.String(), problemBaseURI+"login-delayed")
+	assert.Equal(t, http.StatusUnauthorized, locking.Code)
+	assert.Equal(t, http.StatusTooManyRequests, locked.Code, "the right password does not open a locked account")
+	assert.Equal(t, "540", locked.Header().Get("Retry-After"))
+	assert.Contains(t, locked.Body.String(), problemBaseURI+"login-locked")
+	assert.Equal(t, http.StatusOK, lockouts.Code)
+	var listed LoginLockouts
+	assert.NoError(t, json.Unmarshal(lockouts.Body.Bytes(), &listed))
+	if assert.Len(t, listed.Accounts, 1) && assert.Len(t, listed.Sources, 1) {
+		assert.Equal(t, LoginLockout{Tenant: defaultTenant, Email: "alice@example.com", Failures: 2},
+			LoginLockout{Tenant: listed.Accounts[0].Tenant, Email: listed.Accounts[0].Email, Failures: listed.Accounts[0].Failures})
+		assert.NotNil(t, listed.Accounts[0].LockedUntil)
+		assert.Equal(t, "192.0.2.1", listed.Sources[0].Source)
+	}
+	assert.Equal(t, http.StatusNoContent, unlocked.Code)
+	assert.Equal(t, http.StatusNotFound, unknown.Code)
+	assert.Equal(t, http.StatusNotFound, unknownSource.Code)
+	assert.Equal(t, http.StatusOK, loggedIn.Code)
+}
+
+func TestParallelLoginsAreThrottled(t *testing.T) {
+	// Setup
+	s := newLoginServer(t, WithLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, BaseDelay: time.Second, MaxDelay: time.Minute}))
+
+	// Execute
+	codes := make([]int, 20)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, rr := s.login("wrong")
+			codes[i] = rr.Code
+		}()
+	}
+	wg.Wait()
+
+	// Validate
+	counts := map[int]int{}
+	for _, code := range codes {
+		counts[code]++
+	}
+	assert.Equal(t, map[int]int{http.StatusUnauthorized: 1, http.StatusTooManyRequests: 19}, counts)
+}
+
+func TestLoginRequiresChallengeFromSuspiciousSources(t *testing.T) {
+	// Setup
+	s := newLoginServer(t, WithAdmin("secret", nil),
+		WithLoginGuard(LoginGuardSettings{FailureWindow: time.Hour, ChallengeThreshold: 2, ChallengeDifficulty: 8}))
+	s.login("wrong")
+	s.login("wrong")
+
+	// Execute
+	_, challenged := s.login("correct horse")
+	var p problem
+	json.Unmarshal(challenged.Body.Bytes(), &p)
+	nonce := solveChallenge(p.Challenge, p.Difficulty)
+	solved := s.serve("POST", "/v1/auth/login", "",
+		`{"email":"alice@example.com","password":"correct horse","challenge":"`+p.Challenge+`","nonce":"`+nonce+`"}`)
+	replayed := s.serve("POST", "/v1/auth/login", "",
+		`{"email":"alice@example.com","password":"correct horse","challenge":"`+p.Challenge+`","nonce":"`+nonce+`"}`)
+	unlocked := adminRequest(s, "DELETE", "/admin/lockouts/sources/192.0.2.1", "")
+	_, afterUnlock := s.login("correct horse")
+
+	// Validate
+	assert.Equal(t, http.StatusPreconditionRequired, challenged.Code)
+	assert.Equal(t, problemBaseURI+"challenge-required", p.Type)
+	assert.Equal(t, 8, p.Difficulty)
+	assert.NotEmpty(t, p.Challenge)
+	assert.Equal(t, http.StatusOK, solved.Code)
+	assert.Equal(t, http.StatusPreconditionRequired, replayed.Code, "the source stays suspicious after a success")
+	assert.Equal(t, http.StatusNoContent, unlocked.Code)
+	assert.Equal(t, http.StatusOK, afterUnlock.Code)
+}
@@ -2,291 +2,249 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
-	"github.com/gorilla/mux"
 	_ "github.com/jackc/pgx/v4/stdlib"
-	"golang.org/x/time/rate"
+	"golang.org/x/crypto/bcrypt"
 )
 
-// User represents a user in the system.
-type User struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
-}
-
-var (
-	db               *sql.DB
-	cache            = Cache{items: make(map[string]CacheItem)}
-	rateLimiter      = rate.NewLimiter(1, 3) // 1 request per second, burst size of 3
-	cacheEnabled     bool
-	rateLimitEnabled bool
-)
-
-// Cache represents a simple in-memory cache.
-type Cache struct {
-	mu    sync.Mutex
-	items map[string]CacheItem
-}
-
-// CacheItem represents a single item in the cache.
-type CacheItem struct {
-	value      string
-	expiration int64
-}
-
-// Set adds an item to the cache with an expiration duration.
-func (c *Cache) Set(key, value string, duration time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	expiration := time.Now().Add(duration).Unix()
-	c.items[key] = CacheItem{
-		value:      value,
-		expiration: expiration,
-	}
-}
-
-// Get retrieves an item from the cache.
-func (c *Cache) Get(key string) (string, bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	item, found := c.items[key]
-	if !found || item.expiration < time.Now().Unix() {
-		return "", false
-	}
-	return item.value, true
-}
-
 func main() {
 	apiURL := os.Getenv("API_URL")
 	apiPort := os.Getenv("API_PORT")
-	cacheEnabled, _ = strconv.ParseBool(os.Getenv("ENABLE_CACHE"))
-	rateLimitEnabled, _ = strconv.ParseBool(os.Getenv("ENABLE_RATE_LIMITING"))
-
-	var err error
-	db, err = connectWithRetry(5, 2*time.Second)
+	// The settings that can be changed at runtime are read from the
+	// environment and the config file.
+	configFile := os.Getenv("CONFIG_FILE")
+	base := Config{
+		LogLevel: envString("LOG_LEVEL", "info"),
+		RateLimit: RateLimitSettings{
+			Algorithm: envString("RATE_LIMIT_ALGORITHM", "token-bucket"),
+			Limit:     envInt("RATE_LIMIT", 1),
+			Window:    envDuration("RATE_LIMIT_WINDOW", time.Second).String(),
+			Burst:     envInt("RATE_LIMIT_BURST", 3),
+		},
+		BulkRateLimit: RateLimitSettings{
+			Algorithm: envString("BULK_RATE_LIMIT_ALGORITHM", "sliding-log"),
+			Limit:     envInt("BULK_RATE_LIMIT", 5),
+			Window:    envDuration("BULK_RATE_LIMIT_WINDOW", time.Minute).String(),
+			Burst:     1,
+		},
+		CacheTTL:                  envDuration("CACHE_TTL", 10*time.Second).String(),
+		CacheNegativeTTL:          envDuration("CACHE_NEGATIVE_TTL", 2*time.Second).String(),
+		CacheStaleWhileRevalidate: envDuration("CACHE_STALE_WHILE_REVALIDATE", 5*time.Second).String(),
+		CacheStaleIfError:         envDuration("CACHE_STALE_IF_ERROR", 5*time.Minute).String(),
+		CORSAllowedOrigins:        envList("CORS_ALLOWED_ORIGINS", nil),
+		TLSCertFile:               os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:                os.Getenv("TLS_KEY_FILE"),
+	}
+	config, err := loadConfig(configFile, base)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
-	}
-	defer db.Close()
-
-	r := mux.NewRouter()
-
-	v1 := r.PathPrefix("/v1").Subrouter()
-	v1.HandleFunc("/users", getUsersV1).Methods("GET")
-	v1.HandleFunc("/users", createUser).Methods("POST")
-	v1.HandleFunc("/users/{id}", getUser).Methods("GET")
-	v1.HandleFunc("/users/{id}", updateUser).Methods("PUT")
-	v1.HandleFunc("/users/{id}", deleteUser).Methods("DELETE")
-
-	if cacheEnabled {
-		v1.Use(cacheMiddleware)
-	}
-	if rateLimitEnabled {
-		v1.Use(rateLimiterMiddleware)
-	}
-
-	serverAddress := fmt.Sprintf("%s:%s", apiURL, apiPort)
-	fmt.Printf("Starting server on http://%s\n", serverAddress)
-	log.Fatal(http.ListenAndServe(serverAddress, r))
-}
-
-// connectWithRetry attempts to connect to the database with retry logic.
-func connectWithRetry(attempts int, sleep time.Duration) (*sql.DB, error) {
-	var db *sql.DB
-	var err error
-	dsn := os.Getenv("DATABASE_URL")
-	for i := 0; i < attempts; i++ {
-		db, err = sql.Open("pgx", dsn)
-		if err == nil {
-			err = db.Ping()
-			if err == nil {
-				log.Println("Successfully connected to the database.")
-				return db, nil
-			}
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	// Messages of the log package are written at info, so higher levels
+	// silence the routine log.
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(config.level)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	slog.SetDefault(logger)
+
+	cache := NewResponseCache(config.lifetimes.TTL, config.lifetimes.NegativeTTL, 1<<20, 64)
+	cache.SetLifetimes(config.lifetimes)
+	options := []Option{
+		WithLogger(logger, logLevel),
+		WithCache(cache, envBool("ENABLE_CACHE", false)),
+		WithLimiter(config.limiter, envBool("ENABLE_RATE_LIMITING", false)),
+		WithBulkLimiter(config.bulkLimiter),
+		WithQuotas(int64(envInt("QUOTA_DAILY", 0)), int64(envInt("QUOTA_MONTHLY", 0))),
+		WithIdempotency(envDuration("IDEMPOTENCY_TTL", 24*time.Hour), envDuration("IDEMPOTENCY_WAIT", 2*time.Second)),
+		WithEventStream(envDuration("SSE_HEARTBEAT", 15*time.Second)),
+		WithGraphQLLimits(envInt("GRAPHQL_MAX_DEPTH", 15), envInt("GRAPHQL_MAX_COMPLEXITY", 1000)),
+		WithSecurityHeaders(NewSecurityHeaders(os.Getenv("CONTENT_SECURITY_POLICY"), os.Getenv("REFERRER_POLICY"),
+			envDuration("HSTS_MAX_AGE", 365*24*time.Hour))),
+	}
+	if envBool("ENABLE_TENANCY", false) {
+		options = append(options, WithTenancy(NewTenantResolver([]byte(os.Getenv("JWT_SECRET")), os.Getenv("TENANT_BASE_DOMAIN"))))
+	}
+	if envBool("ENABLE_RBAC", false) {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			log.Fatal("ENABLE_RBAC requires JWT_SECRET to verify bearer tokens.")
 		}
-		log.Printf("Failed to connect to the database. Attempt %d/%d. Retrying in %v...", i+1, attempts, sleep)
-		time.Sleep(sleep)
+		options = append(options, WithAccessControl([]byte(secret), strings.Split(os.Getenv("RBAC_ADMINS"), ",")))
 	}
-	return nil, fmt.Errorf("could not connect to the database after %d attempts: %w", attempts, err)
-}
-
-// rateLimiterMiddleware is a middleware that limits the rate of requests.
-func rateLimiterMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !rateLimiter.Allow() {
-			http.Error(w, "Too many requests", http.StatusTooManyRequests)
-			return
+	if envBool("ENABLE_LOGIN", false) {
+		if !envBool("ENABLE_RBAC", false) {
+			log.Fatal("ENABLE_LOGIN requires ENABLE_RBAC to verify the tokens issued to users.")
 		}
-		next.ServeHTTP(w, r)
-	})
-}
-
-// cacheMiddleware is a middleware that caches responses.
-func cacheMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if value, found := cache.Get(r.RequestURI); found {
-			w.Write([]byte(value))
-			return
+		cost := envInt("PASSWORD_HASH_COST", 12)
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			log.Fatalf("PASSWORD_HASH_COST must be between %d and %d.", bcrypt.MinCost, bcrypt.MaxCost)
 		}
-		next.ServeHTTP(w, r)
-	})
-}
-
-// getUsersV1 handles the GET /v1/users endpoint.
-func getUsersV1(w http.ResponseWriter, r *http.Request) {
-	if cacheEnabled {
-		if value, found := cache.Get(r.RequestURI); found {
-			w.Write([]byte(value))
-			return
+		options = append(options, WithLogin(envDuration("ACCESS_TOKEN_TTL", 15*time.Minute), envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour), cost))
+		defaults := defaultLoginGuardSettings
+		difficulty := envInt("LOGIN_CHALLENGE_DIFFICULTY", defaults.ChallengeDifficulty)
+		if difficulty < 0 || difficulty > 32 {
+			log.Fatal("LOGIN_CHALLENGE_DIFFICULTY must be between 0 and 32.")
 		}
-	}
-
-	rows, err := db.Query("SELECT id, name FROM users")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var users []User
-	for rows.Next() {
-		var user User
-		if err := rows.Scan(&user.ID, &user.Name); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		options = append(options, WithLoginGuard(LoginGuardSettings{
+			FailureWindow:        envDuration("LOGIN_FAILURE_WINDOW", defaults.FailureWindow),
+			BaseDelay:            envDuration("LOGIN_DELAY_BASE", defaults.BaseDelay),
+			MaxDelay:             envDuration("LOGIN_DELAY_MAX", defaults.MaxDelay),
+			AccountLockThreshold: envInt("LOGIN_ACCOUNT_LOCK_THRESHOLD", defaults.AccountLockThreshold),
+			SourceLockThreshold:  envInt("LOGIN_SOURCE_LOCK_THRESHOLD", defaults.SourceLockThreshold),
+			LockoutDuration:      envDuration("LOGIN_LOCKOUT_DURATION", defaults.LockoutDuration),
+			ChallengeThreshold:   envInt("LOGIN_CHALLENGE_THRESHOLD", defaults.ChallengeThreshold),
+			ChallengeDifficulty:  difficulty,
+		}))
+	}
+	if len(config.CORSAllowedOrigins) > 0 {
+		cors, err := NewCORS(config.CORSAllowedOrigins,
+			envList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "DELETE"}),
+			envList("CORS_ALLOWED_HEADERS", []string{"Authorization", "Content-Type", idempotencyKeyHeader, tenantHeader, consistencyHeader, sessionHeader, "Last-Event-ID"}),
+			envBool("CORS_ALLOW_CREDENTIALS", false),
+			envDuration("CORS_MAX_AGE", 10*time.Minute))
+		if err != nil {
+			log.Fatalf("Invalid CORS settings: %v", err)
 		}
-		users = append(users, user)
-	}
-
-	if users == nil {
-		users = []User{} // Ensure we return an empty array instead of nil
-	}
-
-	response, _ := json.Marshal(users)
-	if cacheEnabled {
-		cache.Set(r.RequestURI, string(response), 10*time.Second)
+		options = append(options, WithCORS(cors))
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(response)
-}
-
-// createUser handles the POST /v1/users endpoint.
-func createUser(w http.ResponseWriter, r *http.Request) {
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	err := db.QueryRow("INSERT INTO users (name) VALUES ($1) RETURNING id", user.Name).Scan(&user.ID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// The admin API is only served with a token to authenticate operators.
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		audit := slog.New(slog.NewTextHandler(os.Stderr, nil)).With("log", "audit")
+		options = append(options, WithAdmin(token, audit))
 	}
 
-	response, _ := json.Marshal(user)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(response)
-}
-
-// getUser handles the GET /v1/users/{id} endpoint.
-func getUser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if cacheEnabled {
-		if value, found := cache.Get(r.RequestURI); found {
-			w.Write([]byte(value))
-			return
+	if os.Getenv("USER_STORE") == "memory" {
+		log.Println("Using the in-memory user store.")
+	} else {
+		connectCtx, cancelConnect := context.WithTimeout(ctx, envDuration("DB_CONNECT_TIMEOUT", time.Minute))
+		db, err := connectWithRetry(connectCtx, os.Getenv("DATABASE_URL"), poolConfigFromEnv(), logger)
+		cancelConnect()
+		if err != nil {
+			log.Fatalf("Failed to connect to database: %v", err)
+		}
+		defer db.Close()
+		options = append(options,
+			WithDatabase(db),
+			WithQueryTimeouts(envDuration("DB_QUERY_TIMEOUT", 5*time.Second), envDuration("DB_STREAM_TIMEOUT", 5*time.Minute)),
+			WithCircuitBreaker(NewCircuitBreaker(envInt("DB_BREAKER_THRESHOLD", 5), envDuration("DB_BREAKER_OPEN_TIMEOUT", 10*time.Second))))
+		if urls := os.Getenv("DATABASE_REPLICA_URLS"); urls != "" {
+			handles, err := openReplicas(urls, poolConfigFromEnv())
+			if err != nil {
+				log.Fatalf("Failed to open read replicas: %v", err)
+			}
+			replicas := NewReplicaRouter(handles,
+				envDuration("REPLICA_MAX_LAG", 5*time.Second),
+				envDuration("REPLICA_CHECK_INTERVAL", 5*time.Second),
+				envDuration("READ_YOUR_WRITES_WINDOW", 5*time.Second))
+			defer replicas.Close()
+			options = append(options, WithReplicas(replicas))
+			log.Printf("Reading from %d replicas.", len(handles))
+		}
+		if envBool("ENABLE_OUTBOX", false) {
+			poll := envDuration("OUTBOX_POLL_INTERVAL", defaultOutboxInterval)
+			if poll <= 0 {
+				log.Fatal("OUTBOX_POLL_INTERVAL must be positive.")
+			}
+			options = append(options, WithOutbox(poll, envDuration("OUTBOX_RETENTION", 7*24*time.Hour)))
 		}
 	}
 
-	var user User
-	err = db.QueryRow("SELECT id, name FROM users WHERE id = $1", id).Scan(&user.ID, &user.Name)
-	if err == sql.ErrNoRows {
-		http.NotFound(w, r)
-		return
-	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	server := NewServer(options...)
+	go server.Run(ctx)
+	reloader := NewConfigReloader(server, configFile, base, config, envDuration("CONFIG_WATCH_INTERVAL", 5*time.Second))
+	go reloader.Run(ctx)
 
-	response, _ := json.Marshal(user)
-	if cacheEnabled {
-		cache.Set(r.RequestURI, string(response), 10*time.Second)
+	serverAddress := fmt.Sprintf("%s:%s", apiURL, apiPort)
+	if config.certificate != nil {
+		// The certificate is looked up per handshake, so that renewed
+		// certificates are used without a restart.
+		fmt.Printf("Starting server on https://%s\n", serverAddress)
+		httpServer := &http.Server{Addr: serverAddress, Handler: server, TLSConfig: &tls.Config{GetCertificate: reloader.GetCertificate}}
+		log.Fatal(httpServer.ListenAndServeTLS("", ""))
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(response)
+	fmt.Printf("Starting server on http://%s\n", serverAddress)
+	log.Fatal(http.ListenAndServe(serverAddress, server))
 }
 
-// updateUser handles the PUT /v1/users/{id} endpoint.
-func updateUser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
+// envDuration reads a duration such as "90s" from the environment variable
+// key, falling back to def if it is unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+		log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+		return def
 	}
+	return d
+}
 
-	var updatedUser User
-	if err := json.NewDecoder(r.Body).Decode(&updatedUser); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// envInt reads an integer from the environment variable key, falling back
+// to def if it is unset or invalid.
+func envInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
 	}
-
-	result, err := db.Exec("UPDATE users SET name = $1 WHERE id = $2", updatedUser.Name, id)
+	n, err := strconv.Atoi(value)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+		return def
 	}
+	return n
+}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil || rowsAffected == 0 {
-		http.NotFound(w, r)
-		return
+// envString reads the environment variable key, falling back to def if it
+// is unset.
+func envString(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
 	}
-
-	updatedUser.ID = id
-	response, _ := json.Marshal(updatedUser)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(response)
+	return def
 }
 
-// deleteUser handles the DELETE /v1/users/{id} endpoint.
-func deleteUser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+// envBool reads a boolean from the environment variable key, falling back
+// to def if it is unset or invalid.
+func envBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
 	}
-
-	result, err := db.Exec("DELETE FROM users WHERE id = $1", id)
+	b, err := strconv.ParseBool(value)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+		return def
 	}
+	return b
+}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil || rowsAffected == 0 {
-		http.NotFound(w, r)
-		return
+// envList reads a comma-separated list from the environment variable key,
+// falling back to def if it is unset.
+func envList(key string, def []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
-
-	w.WriteHeader(http.StatusNoContent)
+	return list
 }
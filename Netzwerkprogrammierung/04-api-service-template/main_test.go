@@ -3,49 +3,21 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"log"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strings"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 )
 
-var mock sqlmock.Sqlmock
-
-func setupRouter() *mux.Router {
-	r := mux.NewRouter()
-
-	v1 := r.PathPrefix("/v1").Subrouter()
-	v1.HandleFunc("/users", getUsersV1).Methods("GET")
-	v1.HandleFunc("/users", createUser).Methods("POST")
-	v1.HandleFunc("/users/{id}", getUser).Methods("GET")
-	v1.HandleFunc("/users/{id}", updateUser).Methods("PUT")
-	v1.HandleFunc("/users/{id}", deleteUser).Methods("DELETE")
-
-	return r
-}
-
-func TestMain(m *testing.M) {
-	var err error
-	db, mock, err = sqlmock.New()
-	if err != nil {
-		log.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
-	}
-	defer db.Close()
-
-	os.Exit(m.Run())
-}
-
 func TestGetUsers(t *testing.T) {
 	// Setup
 	req, err := http.NewRequest("GET", "/v1/users", nil)
 	assert.NoError(t, err)
 	rr := httptest.NewRecorder()
-	router := setupRouter()
+	router, mock := newTestServer(t)
 
 	// Mock DB response
 	rows := sqlmock.NewRows([]string{"id", "name"}).
@@ -73,7 +45,7 @@ func TestCreateUser(t *testing.T) {
 	req, err := http.NewRequest("POST", "/v1/users", bytes.NewBuffer(userJSON))
 	assert.NoError(t, err)
 	rr := httptest.NewRecorder()
-	router := setupRouter()
+	router, mock := newTestServer(t)
 
 	// Mock DB response
 	mock.ExpectQuery("INSERT INTO users \\(name\\) VALUES \\(\\$1\\) RETURNING id").
@@ -91,12 +63,28 @@ func TestCreateUser(t *testing.T) {
 	assert.Equal(t, "John Doe", createdUser.Name)
 }
 
+func TestRESTKeepsAcceptingUnvalidatedNames(t *testing.T) {
+	// Setup
+	server := NewServer()
+	long := strings.Repeat("x", maxNameLength+1)
+
+	// Execute
+	created := serve(server, "POST", "/v1/users", `{"name":""}`)
+	updated := serve(server, "PUT", "/v1/users/1", `{"name":"`+long+`"}`)
+	rpc := postRPC(t, server, `{"jsonrpc":"2.0","method":"users.update","params":{"id":1,"name":""},"id":1}`)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, created.Code, "the v1 REST API does not validate names")
+	assert.Equal(t, http.StatusOK, updated.Code)
+	assert.Contains(t, rpc.Body.String(), "name is required", "the other APIs do")
+}
+
 func TestGetUser(t *testing.T) {
 	// Setup
 	req, err := http.NewRequest("GET", "/v1/users/1", nil)
 	assert.NoError(t, err)
 	rr := httptest.NewRecorder()
-	router := setupRouter()
+	router, mock := newTestServer(t)
 
 	// Mock DB response
 	row := sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "John Doe")
@@ -122,7 +110,7 @@ func TestUpdateUser(t *testing.T) {
 	req, err := http.NewRequest("PUT", "/v1/users/1", bytes.NewBuffer(userJSON))
 	assert.NoError(t, err)
 	rr := httptest.NewRecorder()
-	router := setupRouter()
+	router, mock := newTestServer(t)
 
 	// Mock DB response
 	mock.ExpectExec("UPDATE users SET name = \\$1 WHERE id = \\$2").
@@ -145,7 +133,7 @@ func TestDeleteUser(t *testing.T) {
 	req, err := http.NewRequest("DELETE", "/v1/users/1", nil)
 	assert.NoError(t, err)
 	rr := httptest.NewRecorder()
-	router := setupRouter()
+	router, mock := newTestServer(t)
 
 	// Mock DB response
 	mock.ExpectExec("DELETE FROM users WHERE id = \\$1").
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// outboxClaimLease is how long a row claimed by a relay is out of reach of
+// the relays of other instances. If it is neither published nor failed by
+// then, for example because the instance stopped, it is claimed again.
+const outboxClaimLease = time.Minute
+
+// defaultOutboxInterval is the poll interval of relays created without a
+// positive one.
+const defaultOutboxInterval = time.Second
+
+// maxOutboxBackoff caps the delay before a failed outbox row is retried.
+const maxOutboxBackoff = 5 * time.Minute
+
+// Publisher delivers user events to their consumers. The outbox relay
+// delivers at least once, so consumers must tolerate duplicates; UserEvent.ID
+// identifies them.
+type Publisher interface {
+	Publish(ctx context.Context, event UserEvent) error
+}
+
+// PublisherFunc adapts a function to the Publisher interface.
+type PublisherFunc func(ctx context.Context, event UserEvent) error
+
+// Publish calls f(ctx, event).
+func (f PublisherFunc) Publish(ctx context.Context, event UserEvent) error {
+	return f(ctx, event)
+}
+
+// insertOutboxEvent records event in the outbox as part of tx.
+func insertOutboxEvent(ctx context.Context, tx dbtx, event UserEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO outbox (tenant_id, aggregate_id, event_type, payload) VALUES ($1, $2, $3, $4)",
+		cmp.Or(event.Tenant, defaultTenant), event.Data.ID, event.Type, string(payload))
+	return err
+}
+
+// OutboxRelay publishes the rows of the outbox table. Rows of the same user
+// are published in the order they were written: when one fails, the later
+// rows of that user wait until it went through. The relays of all
+// instances share the work; each row is claimed by one of them.
+type OutboxRelay struct {
+	db        *sql.DB
+	publisher Publisher
+	batchSize int
+	interval  time.Duration
+	retention time.Duration
+	logger    *slog.Logger
+}
+
+// NewOutboxRelay returns a relay polling the outbox every interval and
+// deleting published rows once they are older than retention. An interval
+// that is not positive falls back to defaultOutboxInterval.
+func NewOutboxRelay(db *sql.DB, publisher Publisher, interval, retention time.Duration) *OutboxRelay {
+	if interval <= 0 {
+		interval = defaultOutboxInterval
+	}
+	return &OutboxRelay{
+		db:        db,
+		publisher: publisher,
+		batchSize: 100,
+		interval:  interval,
+		retention: retention,
+		logger:    slog.Default(),
+	}
+}
+
+// Run relays the outbox until ctx is cancelled.
+func (o *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	lastCleanup := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			published, err := o.relayBatch(ctx)
+			if err != nil && ctx.Err() == nil {
+				o.logger.Warn("Relaying the outbox failed", "error", err)
+			}
+			// Keep going while rows are being published, as every batch
+			// holds only the oldest row of each user.
+			if err != nil || published == 0 {
+				break
+			}
+		}
+
+		if time.Since(lastCleanup) >= o.retention/10 {
+			deleted, err := o.cleanup(ctx)
+			if err != nil && ctx.Err() == nil {
+				o.logger.Warn("Cleaning up the outbox failed", "error", err)
+			} else if deleted > 0 {
+				o.logger.Info("Deleted published outbox rows", "count", deleted)
+			}
+			lastCleanup = time.Now()
+		}
+	}
+}
+
+// outboxRow is a pending row of the outbox.
+type outboxRow struct {
+	id          int64
+	aggregateID int
+	payload     string
+	attempts    int
+}
+
+// relayBatch claims a batch of due rows, publishes them and returns how
+// many were published. Only the oldest unpublished row of each user is
+// claimed, so a claimed or waiting row holds up the later rows of its user.
+// Claiming moves the rows out of reach of other relays for
+// outboxClaimLease, so that they are published without holding a
+// transaction or a lock.
+func (o *OutboxRelay) relayBatch(ctx context.Context) (int, error) {
+	rows, err := o.db.QueryContext(ctx,
+		`UPDATE outbox SET available_at = now() + make_interval(secs => $2) WHERE id IN (
+			SELECT id FROM outbox o WHERE published_at IS NULL AND available_at <= now() AND NOT EXISTS (
+				SELECT 1 FROM outbox e WHERE e.tenant_id = o.tenant_id AND e.aggregate_id = o.aggregate_id AND e.id < o.id AND e.published_at IS NULL)
+			ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED)
+		RETURNING id, aggregate_id, payload, attempts`,
+		o.batchSize, outboxClaimLease.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	var batch []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		if err := rows.Scan(&row.id, &row.aggregateID, &row.payload, &row.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	slices.SortFunc(batch, func(a, b outboxRow) int { return cmp.Compare(a.id, b.id) })
+
+	// The rows belong to different users, so they are published at once.
+	errs := make([]error, len(batch))
+	var wg sync.WaitGroup
+	for i, row := range batch {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var event UserEvent
+			if errs[i] = json.Unmarshal([]byte(row.payload), &event); errs[i] == nil {
+				errs[i] = o.publisher.Publish(ctx, event)
+			}
+		}()
+	}
+	wg.Wait()
+
+	published := 0
+	for i, row := range batch {
+		if errs[i] != nil {
+			backoff := min(time.Duration(1<<min(row.attempts, 16))*time.Second, maxOutboxBackoff)
+			_, err := o.db.ExecContext(ctx,
+				"UPDATE outbox SET attempts = attempts + 1, last_error = $2, available_at = now() + make_interval(secs => $3) WHERE id = $1",
+				row.id, errs[i].Error(), backoff.Seconds())
+			if err != nil {
+				return published, err
+			}
+			continue
+		}
+		if _, err := o.db.ExecContext(ctx, "UPDATE outbox SET published_at = now() WHERE id = $1", row.id); err != nil {
+			return published, err
+		}
+		published++
+	}
+	return published, nil
+}
+
+// cleanup deletes published rows older than the retention period.
+func (o *OutboxRelay) cleanup(ctx context.Context) (int64, error) {
+	result, err := o.db.ExecContext(ctx,
+		"DELETE FROM outbox WHERE published_at < now() - make_interval(secs => $1)",
+		o.retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func outboxPayload(eventType string, user User) string {
+	payload, _ := json.Marshal(newUserEvent(eventType, user))
+	return string(payload)
+}
+
+func TestSQLStoreWritesOutboxInTransaction(t *testing.T) {
+	// Setup
+	outboxDB, outboxMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer outboxDB.Close()
+	s := newSQLStore(outboxDB)
+	s.outbox = true
+
+	// Mock DB response
+	outboxMock.ExpectBegin()
+	outboxMock.ExpectQuery("INSERT INTO users \\(name\\) VALUES \\(\\$1\\) RETURNING id").
+		WithArgs("John Doe").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	outboxMock.ExpectExec("INSERT INTO outbox \\(tenant_id, aggregate_id, event_type, payload\\)").
+		WithArgs("default", 1, EventUserCreated, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	outboxMock.ExpectCommit()
+	outboxMock.ExpectBegin()
+	outboxMock.ExpectExec("SELECT set_config\\('app.tenant_id', \\$1, true\\)").
+		WithArgs("acme").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	outboxMock.ExpectQuery("INSERT INTO users \\(name\\) VALUES \\(\\$1\\) RETURNING id").
+		WithArgs("Jane Doe").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	outboxMock.ExpectExec("INSERT INTO outbox \\(tenant_id, aggregate_id, event_type, payload\\)").
+		WithArgs("acme", 1, EventUserCreated, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	outboxMock.ExpectCommit()
+	outboxMock.ExpectBegin()
+	outboxMock.ExpectExec("UPDATE users SET name = \\$1 WHERE id = \\$2").
+		WithArgs("Nobody", 42).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	outboxMock.ExpectRollback()
+
+	// Execute
+	user, err := s.CreateUser(context.Background(), User{Name: "John Doe"})
+	assert.NoError(t, err)
+	_, tenantErr := s.CreateUser(withTenant(context.Background(), "acme"), User{Name: "Jane Doe"})
+	updateErr := s.UpdateUser(context.Background(), User{ID: 42, Name: "Nobody"})
+
+	// Validate
+	assert.Equal(t, 1, user.ID)
+	assert.NoError(t, tenantErr)
+	assert.ErrorIs(t, updateErr, ErrUserNotFound)
+	assert.NoError(t, outboxMock.ExpectationsWereMet())
+}
+
+func TestOutboxRelayPublishesClaimedRows(t *testing.T) {
+	// Setup
+	outboxDB, outboxMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer outboxDB.Close()
+	var mu sync.Mutex
+	var published []int
+	publisher := PublisherFunc(func(ctx context.Context, event UserEvent) error {
+		if event.Data.Name == "unreachable" {
+			return errors.New("consumer unavailable")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		published = append(published, event.Data.ID)
+		return nil
+	})
+	relay := NewOutboxRelay(outboxDB, publisher, time.Second, time.Hour)
+
+	// Mock DB response
+	outboxMock.ExpectQuery("UPDATE outbox SET available_at = now\\(\\) \\+ make_interval\\(secs => \\$2\\) WHERE id IN \\(\\s+"+
+		"SELECT id FROM outbox o WHERE published_at IS NULL AND available_at <= now\\(\\) AND NOT EXISTS \\(\\s+"+
+		"SELECT 1 FROM outbox e WHERE e.tenant_id = o.tenant_id AND e.aggregate_id = o.aggregate_id AND e.id < o.id AND e.published_at IS NULL\\)\\s+"+
+		"ORDER BY id LIMIT \\$1 FOR UPDATE SKIP LOCKED\\)\\s+RETURNING id, aggregate_id, payload, attempts").
+		WithArgs(100, float64(60)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "aggregate_id", "payload", "attempts"}).
+			AddRow(2, 2, outboxPayload(EventUserCreated, User{ID: 2, Name: "Jane Doe"}), 0).
+			AddRow(1, 1, outboxPayload(EventUserCreated, User{ID: 1, Name: "unreachable"}), 2))
+	outboxMock.ExpectExec("UPDATE outbox SET attempts = attempts \\+ 1, last_error = \\$2").
+		WithArgs(int64(1), "consumer unavailable", float64(4)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	outboxMock.ExpectExec("UPDATE outbox SET published_at = now\\(\\) WHERE id = \\$1").
+		WithArgs(int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Execute
+	count, err := relay.relayBatch(context.Background())
+
+	// Validate
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, []int{2}, published)
+	assert.NoError(t, outboxMock.ExpectationsWereMet())
+}
+
+func TestOutboxRelayWithoutDueRows(t *testing.T) {
+	// Setup
+	outboxDB, outboxMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer outboxDB.Close()
+	relay := NewOutboxRelay(outboxDB, PublisherFunc(func(context.Context, UserEvent) error {
+		t.Fatal("nothing must be published without a claimed row")
+		return nil
+	}), time.Second, time.Hour)
+
+	// Mock DB response
+	outboxMock.ExpectQuery("UPDATE outbox SET available_at").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "aggregate_id", "payload", "attempts"}))
+	outboxMock.ExpectExec("DELETE FROM outbox WHERE published_at < now\\(\\) - make_interval\\(secs => \\$1\\)").
+		WithArgs(float64(3600)).
+		WillReturnResult(sqlmock.NewResult(0, 7))
+
+	// Execute
+	count, err := relay.relayBatch(context.Background())
+	assert.NoError(t, err)
+	deleted, cleanupErr := relay.cleanup(context.Background())
+
+	// Validate
+	assert.Equal(t, 0, count)
+	assert.NoError(t, cleanupErr)
+	assert.Equal(t, int64(7), deleted)
+	assert.NoError(t, outboxMock.ExpectationsWereMet())
+}
+
+func TestOutboxRelayFallsBackToDefaultInterval(t *testing.T) {
+	// Execute
+	relay := NewOutboxRelay(nil, nil, 0, time.Hour)
+
+	// Validate
+	assert.Equal(t, defaultOutboxInterval, relay.interval)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// listenRetryDelay is the pause before listenLoop reconnects after a failure.
+const listenRetryDelay = 5 * time.Second
+
+// listenLoop LISTENs on a PostgreSQL notification channel and calls handle
+// with the payload of every notification until ctx is cancelled. Lost
+// connections are logged to logger and re-established after
+// listenRetryDelay. Notifications sent
+// while no connection listens are lost; if subscribed is not nil it is
+// called every time the channel is listened to again, so that callers can
+// catch up.
+func listenLoop(ctx context.Context, db *sql.DB, logger *slog.Logger, channel string, handle func(payload string), subscribed func()) {
+	for {
+		err := listen(ctx, db, logger, channel, handle, subscribed)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn("Listening for notifications failed", "channel", channel, "retry_in", listenRetryDelay, "error", err)
+
+		select {
+		case <-time.After(listenRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listen holds one connection out of the pool for the LISTEN session. The
+// connection is always discarded afterwards, so it never returns to the pool
+// still subscribed to the channel.
+func listen(ctx context.Context, db *sql.DB, logger *slog.Logger, channel string, handle func(payload string), subscribed func()) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("LISTEN requires the pgx driver, got %T", driverConn)
+		}
+		pgConn := stdlibConn.Conn()
+		if _, err := pgConn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			return errors.Join(err, driver.ErrBadConn)
+		}
+		logger.Info("Listening for notifications", "channel", channel)
+		if subscribed != nil {
+			subscribed()
+		}
+
+		for {
+			notification, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				return errors.Join(err, driver.ErrBadConn)
+			}
+			handle(notification.Payload)
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// problemBaseURI prefixes the type URIs of the problems this service
+// reports.
+const problemBaseURI = "https://api.example.com/problems/"
+
+// problem is an RFC 9457 problem details object. Extension members that do
+// not apply to a problem are omitted.
+type problem struct {
+	Type              string `json:"type"`
+	Title             string `json:"title"`
+	Status            int    `json:"status"`
+	Detail            string `json:"detail,omitempty"`
+	Instance          string `json:"instance,omitempty"`
+	MissingPermission string `json:"missing_permission,omitempty"`
+	Challenge         string `json:"challenge,omitempty"`
+	Difficulty        int    `json:"difficulty,omitempty"`
+}
+
+// writeProblem writes p as application/problem+json with its status.
+func writeProblem(w http.ResponseWriter, p problem) {
+	response, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	w.Write(response)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quotaPeriod is a calendar period a quota applies to, in UTC.
+type quotaPeriod struct {
+	name  string
+	limit int64
+}
+
+// bounds returns the start and end of the period containing now.
+func (p quotaPeriod) bounds(now time.Time) (start, end time.Time) {
+	now = now.UTC()
+	if p.name == "month" {
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// quotaCleanupInterval is how often the counts of past periods are deleted.
+const quotaCleanupInterval = time.Hour
+
+// quotaWindow is the current period of a quota.
+type quotaWindow struct {
+	period string
+	start  time.Time
+	limit  int64
+}
+
+// QuotaStore counts the requests of clients per period. The counts must
+// survive restarts and be shared by all instances.
+type QuotaStore interface {
+	// Consume counts a request of client in every window unless the limit
+	// of one of them was reached already, in which case it counts the
+	// request in none of them. It returns the count of every window and
+	// whether the request was counted.
+	Consume(ctx context.Context, client string, windows []quotaWindow) ([]int64, bool, error)
+	// DeleteExpired deletes the counts of period that started before start
+	// and returns their number.
+	DeleteExpired(ctx context.Context, period string, start time.Time) (int64, error)
+}
+
+// Quotas limits the requests per day and per month of every API key. Unlike
+// the rate limits they are counted in the database, so that they hold
+// across restarts and instances. Requests not authenticated with an API key
+// are not counted.
+type Quotas struct {
+	store   QuotaStore
+	periods []quotaPeriod
+	timeout time.Duration
+	now     func() time.Time
+	logger  *slog.Logger
+}
+
+// NewQuotas returns quotas of daily and monthly requests counted in store.
+// A limit of zero disables the period.
+func NewQuotas(store QuotaStore, daily, monthly int64) *Quotas {
+	q := &Quotas{store: store, timeout: time.Second, now: time.Now, logger: slog.Default()}
+	if daily > 0 {
+		q.periods = append(q.periods, quotaPeriod{name: "day", limit: daily})
+	}
+	if monthly > 0 {
+		q.periods = append(q.periods, quotaPeriod{name: "month", limit: monthly})
+	}
+	return q
+}
+
+// Middleware answers 429 Too Many Requests once the quota of a period is
+// used up, with Retry-After pointing at the start of the next period.
+// Remaining requests are reported in X-Quota-Remaining for the strictest
+// period. If the quota store fails, requests are let through, as an outage
+// of the counters should not become an outage of the API.
+func (q *Quotas) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := principalFrom(r.Context())
+		if p == nil || p.APIKey == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), q.timeout)
+		defer cancel()
+		now := q.now()
+		windows := make([]quotaWindow, len(q.periods))
+		for i, period := range q.periods {
+			start, _ := period.bounds(now)
+			windows[i] = quotaWindow{period: period.name, start: start, limit: period.limit}
+		}
+		// All periods are checked before any is consumed, so that a request
+		// rejected by one period does not use up the quota of another.
+		used, allowed, err := q.store.Consume(ctx, clientIdentity(r), windows)
+		if err != nil {
+			q.logger.Warn("Quota check failed, allowing the request", "key", p.APIKey, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		remaining := int64(-1)
+		for i, period := range q.periods {
+			if !allowed && used[i] >= period.limit {
+				_, end := period.bounds(now)
+				w.Header().Set("X-Quota-Remaining", "0")
+				writeTooManyRequests(w, end.Sub(now), fmt.Sprintf("The quota of %d requests per %s is used up", period.limit, period.name))
+				return
+			}
+			if left := period.limit - used[i]; remaining < 0 || left < remaining {
+				remaining = left
+			}
+		}
+		if remaining >= 0 {
+			w.Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Cleanup deletes the counts of the periods before the current ones, also
+// of periods no longer limited, and returns their number.
+func (q *Quotas) Cleanup(ctx context.Context) (int64, error) {
+	var deleted int64
+	for _, name := range []string{"day", "month"} {
+		start, _ := quotaPeriod{name: name}.bounds(q.now())
+		n, err := q.store.DeleteExpired(ctx, name, start)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// cleanQuotas deletes the counts of past periods until ctx is cancelled.
+func (s *Server) cleanQuotas(ctx context.Context) {
+	ticker := time.NewTicker(quotaCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := s.quotas.Cleanup(ctx)
+			if err != nil {
+				s.logger.Warn("Failed to delete expired quota counts", "error", err)
+			} else if deleted > 0 {
+				s.logger.Info("Deleted expired quota counts", "count", deleted)
+			}
+		}
+	}
+}
+
+// sqlQuotaStore is a QuotaStore backed by the quota_usage table.
+type sqlQuotaStore struct {
+	db *sql.DB
+}
+
+// newSQLQuotaStore returns a QuotaStore using the given database handle.
+func newSQLQuotaStore(db *sql.DB) *sqlQuotaStore {
+	return &sqlQuotaStore{db: db}
+}
+
+// Consume increments the counts of all windows in one transaction and rolls
+// it back if one of them exceeds its limit. The incremented rows stay locked
+// until then, so that concurrent requests on several instances cannot exceed
+// the limits. Windows are always passed in the same order, so the locks are
+// taken in the same order too.
+func (s *sqlQuotaStore) Consume(ctx context.Context, client string, windows []quotaWindow) ([]int64, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, classify(ctx, err)
+	}
+	defer tx.Rollback()
+
+	used := make([]int64, len(windows))
+	allowed := true
+	for i, window := range windows {
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO quota_usage (client, period, period_start, used) VALUES ($1, $2, $3, 1)
+			ON CONFLICT (client, period, period_start) DO UPDATE SET used = quota_usage.used + 1
+			RETURNING used`,
+			client, window.period, window.start).Scan(&used[i])
+		if err != nil {
+			return nil, false, classify(ctx, err)
+		}
+		allowed = allowed && used[i] <= window.limit
+	}
+	if !allowed {
+		// The rollback undoes the increments.
+		for i := range used {
+			used[i]--
+		}
+		return used, false, nil
+	}
+	return used, true, classify(ctx, tx.Commit())
+}
+
+func (s *sqlQuotaStore) DeleteExpired(ctx context.Context, period string, start time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM quota_usage WHERE period = $1 AND period_start < $2", period, start)
+	if err != nil {
+		return 0, classify(ctx, err)
+	}
+	return result.RowsAffected()
+}
+
+// memoryQuotaStore is a QuotaStore kept in process memory, for a single
+// instance without PostgreSQL.
+type memoryQuotaStore struct {
+	mu    sync.Mutex
+	usage map[memoryQuotaKey]int64
+}
+
+// newMemoryQuotaStore returns an empty in-memory QuotaStore.
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{usage: make(map[memoryQuotaKey]int64)}
+}
+
+// memoryQuotaKey identifies the count of a client in a period.
+type memoryQuotaKey struct {
+	client string
+	period string
+	start  time.Time
+}
+
+func (s *memoryQuotaStore) Consume(ctx context.Context, client string, windows []quotaWindow) ([]int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used := make([]int64, len(windows))
+	allowed := true
+	for i, window := range windows {
+		used[i] = s.usage[memoryQuotaKey{client, window.period, window.start}]
+		allowed = allowed && used[i] < window.limit
+	}
+	if !allowed {
+		return used, false, nil
+	}
+	for i, window := range windows {
+		used[i]++
+		s.usage[memoryQuotaKey{client, window.period, window.start}] = used[i]
+	}
+	return used, true, nil
+}
+
+func (s *memoryQuotaStore) DeleteExpired(ctx context.Context, period string, start time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for key := range s.usage {
+		if key.period == period && key.start.Before(start) {
+			delete(s.usage, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
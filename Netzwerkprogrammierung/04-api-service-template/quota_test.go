@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingQuotaStore is a QuotaStore whose database is down.
+type failingQuotaStore struct{}
+
+func (failingQuotaStore) Consume(ctx context.Context, client string, windows []quotaWindow) ([]int64, bool, error) {
+	return nil, false, errors.New("connection refused")
+}
+
+func (failingQuotaStore) DeleteExpired(ctx context.Context, period string, start time.Time) (int64, error) {
+	return 0, errors.New("connection refused")
+}
+
+func quotaRequest(q *Quotas, apiKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/v1/users", nil)
+	req.RemoteAddr = "192.0.2.1:4321"
+	if apiKey != "" {
+		req = req.WithContext(withPrincipal(req.Context(), &Principal{Subject: "key", Tenant: "acme", APIKey: apiKey}))
+	}
+	rr := httptest.NewRecorder()
+	q.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestQuotasPerDay(t *testing.T) {
+	// Setup
+	clock := newFakeClock() // 12:00 UTC
+	quotas := NewQuotas(newMemoryQuotaStore(), 2, 100)
+	quotas.now = clock.Now
+
+	// Execute
+	first := quotaRequest(quotas, "k1")
+	second := quotaRequest(quotas, "k1")
+	third := quotaRequest(quotas, "k1")
+	other := quotaRequest(quotas, "k2")
+	clock.Advance(12 * time.Hour)
+	nextDay := quotaRequest(quotas, "k1")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "1", first.Header().Get("X-Quota-Remaining"))
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, "0", second.Header().Get("X-Quota-Remaining"))
+	assert.Equal(t, http.StatusTooManyRequests, third.Code)
+	assert.Equal(t, "43200", third.Header().Get("Retry-After"), "the quota resets at midnight")
+	assert.Contains(t, third.Body.String(), "2 requests per day")
+	assert.Equal(t, http.StatusOK, other.Code, "every API key has its own quota")
+	assert.Equal(t, http.StatusOK, nextDay.Code)
+	assert.Equal(t, "1", nextDay.Header().Get("X-Quota-Remaining"))
+}
+
+func TestQuotasPerMonth(t *testing.T) {
+	// Setup
+	clock := newFakeClock() // 1 May
+	quotas := NewQuotas(newMemoryQuotaStore(), 0, 1)
+	quotas.now = clock.Now
+
+	// Execute
+	first := quotaRequest(quotas, "k1")
+	clock.Advance(10 * 24 * time.Hour)
+	second := quotaRequest(quotas, "k1")
+	clock.Advance(21 * 24 * time.Hour) // 1 June
+	nextMonth := quotaRequest(quotas, "k1")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, http.StatusTooManyRequests, second.Code)
+	assert.Equal(t, http.StatusOK, nextMonth.Code)
+}
+
+func TestQuotasCheckAllPeriodsBeforeConsuming(t *testing.T) {
+	// Setup
+	clock := newFakeClock() // 1 May, 12:00 UTC
+	store := newMemoryQuotaStore()
+	quotas := NewQuotas(store, 5, 1)
+	quotas.now = clock.Now
+	dayStart, _ := quotaPeriod{name: "day"}.bounds(clock.Now())
+
+	// Execute
+	first := quotaRequest(quotas, "k1")
+	second := quotaRequest(quotas, "k1")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, http.StatusTooManyRequests, second.Code)
+	assert.Contains(t, second.Body.String(), "1 requests per month")
+	assert.Equal(t, int64(1), store.usage[memoryQuotaKey{"apikey:k1", "day", dayStart}], "the rejected request uses up no daily quota")
+}
+
+func TestQuotasCleanup(t *testing.T) {
+	// Setup
+	clock := newFakeClock() // 1 May, 12:00 UTC
+	store := newMemoryQuotaStore()
+	quotas := NewQuotas(store, 10, 100)
+	quotas.now = clock.Now
+	quotaRequest(quotas, "k1")
+	clock.Advance(24 * time.Hour)
+	quotaRequest(quotas, "k1")
+
+	// Execute
+	deleted, err := quotas.Cleanup(context.Background())
+
+	// Validate
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted, "only the count of the past day is deleted")
+	assert.Len(t, store.usage, 2)
+}
+
+func TestQuotasSkipRequestsWithoutAPIKey(t *testing.T) {
+	// Setup
+	quotas := NewQuotas(newMemoryQuotaStore(), 1, 0)
+
+	// Execute
+	first := quotaRequest(quotas, "")
+	second := quotaRequest(quotas, "")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Empty(t, first.Header().Get("X-Quota-Remaining"))
+}
+
+func TestQuotasFailOpen(t *testing.T) {
+	// Setup
+	quotas := NewQuotas(failingQuotaStore{}, 1, 0)
+
+	// Execute
+	rr := quotaRequest(quotas, "k1")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("X-Quota-Remaining"))
+}
+
+func TestSQLQuotaStoreConsume(t *testing.T) {
+	// Setup
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	store := newSQLQuotaStore(db)
+	day := time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)
+	month := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	windows := []quotaWindow{{period: "day", start: day, limit: 10}, {period: "month", start: month, limit: 100}}
+
+	// Mock DB response
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO quota_usage").
+		WithArgs("apikey:k1", "day", day).
+		WillReturnRows(sqlmock.NewRows([]string{"used"}).AddRow(4))
+	mock.ExpectQuery("INSERT INTO quota_usage").
+		WithArgs("apikey:k1", "month", month).
+		WillReturnRows(sqlmock.NewRows([]string{"used"}).AddRow(40))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO quota_usage").
+		WithArgs("apikey:k1", "day", day).
+		WillReturnRows(sqlmock.NewRows([]string{"used"}).AddRow(5))
+	mock.ExpectQuery("INSERT INTO quota_usage").
+		WithArgs("apikey:k1", "month", month).
+		WillReturnRows(sqlmock.NewRows([]string{"used"}).AddRow(101))
+	mock.ExpectRollback()
+	mock.ExpectExec("DELETE FROM quota_usage WHERE period = \\$1 AND period_start < \\$2").
+		WithArgs("day", day).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	// Execute
+	used, allowed, err := store.Consume(context.Background(), "apikey:k1", windows)
+	overUsed, overAllowed, overErr := store.Consume(context.Background(), "apikey:k1", windows)
+	deleted, deleteErr := store.DeleteExpired(context.Background(), "day", day)
+
+	// Validate
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{4, 40}, used)
+	assert.True(t, allowed)
+	assert.NoError(t, overErr)
+	assert.False(t, overAllowed, "the increments are rolled back once a quota is exceeded")
+	assert.Equal(t, []int64{4, 100}, overUsed)
+	assert.NoError(t, deleteErr)
+	assert.Equal(t, int64(3), deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// Limiter decides whether a client may make a request now. Each client is
+// limited on its own, so that one busy client cannot use up the capacity of
+// all others.
+type Limiter interface {
+	// Allow reports whether client may make a request and, if not, how
+	// long it should wait before trying again.
+	Allow(client string) (bool, time.Duration)
+}
+
+// clientStates keeps the state of a limiter per client. States of clients
+// idle for longer than idle are dropped, as they would allow the next
+// request anyway.
+type clientStates[S any] struct {
+	idle time.Duration
+
+	mu        sync.Mutex
+	states    map[string]*clientState[S]
+	lastPrune time.Time
+}
+
+type clientState[S any] struct {
+	state    S
+	lastSeen time.Time
+}
+
+func newClientStates[S any](idle time.Duration) clientStates[S] {
+	return clientStates[S]{idle: idle, states: make(map[string]*clientState[S])}
+}
+
+// do calls fn with the state of client, a zero S for new clients, holding
+// the lock of the table.
+func (c *clientStates[S]) do(client string, now time.Time, fn func(state *S)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastPrune) >= c.idle {
+		for id, s := range c.states {
+			if now.Sub(s.lastSeen) >= c.idle {
+				delete(c.states, id)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	s, found := c.states[client]
+	if !found {
+		s = &clientState[S]{}
+		c.states[client] = s
+	}
+	s.lastSeen = now
+	fn(&s.state)
+}
+
+// len returns the number of clients with state.
+func (c *clientStates[S]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.states)
+}
+
+// TokenBucketLimiter refills a bucket of burst tokens at limit per window;
+// every request takes a token. It allows short bursts at the cost of a
+// higher peak rate.
+type TokenBucketLimiter struct {
+	limit   rate.Limit
+	burst   int
+	now     func() time.Time
+	clients clientStates[*rate.Limiter]
+}
+
+// NewTokenBucketLimiter returns a token bucket limiter allowing limit
+// requests per window with bursts of up to burst requests.
+func NewTokenBucketLimiter(limit int, window time.Duration, burst int) *TokenBucketLimiter {
+	refill := window * time.Duration(burst) / time.Duration(limit)
+	return &TokenBucketLimiter{
+		limit:   rate.Limit(float64(limit) / window.Seconds()),
+		burst:   burst,
+		now:     time.Now,
+		clients: newClientStates[*rate.Limiter](max(2*window, refill)),
+	}
+}
+
+func (l *TokenBucketLimiter) Allow(client string) (allowed bool, retryAfter time.Duration) {
+	now := l.now()
+	l.clients.do(client, now, func(bucket **rate.Limiter) {
+		if *bucket == nil {
+			*bucket = rate.NewLimiter(l.limit, l.burst)
+		}
+		if allowed = (*bucket).AllowN(now, 1); !allowed {
+			missing := 1 - (*bucket).TokensAt(now)
+			retryAfter = time.Duration(missing / float64(l.limit) * float64(time.Second))
+		}
+	})
+	return allowed, retryAfter
+}
+
+// SlidingLogLimiter remembers the time of every request within the window
+// and allows a request if fewer than limit were made. It is exact, but its
+// memory grows with the limit.
+type SlidingLogLimiter struct {
+	limit   int
+	window  time.Duration
+	now     func() time.Time
+	clients clientStates[[]time.Time]
+}
+
+// NewSlidingLogLimiter returns a sliding log limiter allowing limit
+// requests in any window.
+func NewSlidingLogLimiter(limit int, window time.Duration) *SlidingLogLimiter {
+	return &SlidingLogLimiter{limit: limit, window: window, now: time.Now, clients: newClientStates[[]time.Time](window)}
+}
+
+func (l *SlidingLogLimiter) Allow(client string) (allowed bool, retryAfter time.Duration) {
+	now := l.now()
+	l.clients.do(client, now, func(log *[]time.Time) {
+		requests := *log
+		expired := 0
+		for expired < len(requests) && !requests[expired].After(now.Add(-l.window)) {
+			expired++
+		}
+		requests = requests[expired:]
+		if allowed = len(requests) < l.limit; allowed {
+			requests = append(requests, now)
+		} else {
+			retryAfter = requests[0].Add(l.window).Sub(now)
+		}
+		*log = requests
+	})
+	return allowed, retryAfter
+}
+
+// slidingWindow counts the requests of the current and the previous fixed
+// window.
+type slidingWindow struct {
+	start    time.Time
+	current  int
+	previous int
+}
+
+// SlidingWindowLimiter approximates a sliding log with two counters: the
+// requests of the previous fixed window are weighted by how much of it the
+// sliding window still covers. It needs constant memory per client.
+type SlidingWindowLimiter struct {
+	limit   int
+	window  time.Duration
+	now     func() time.Time
+	clients clientStates[slidingWindow]
+}
+
+// NewSlidingWindowLimiter returns a sliding window counter limiter
+// allowing about limit requests in any window.
+func NewSlidingWindowLimiter(limit int, window time.Duration) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{limit: limit, window: window, now: time.Now, clients: newClientStates[slidingWindow](2 * window)}
+}
+
+func (l *SlidingWindowLimiter) Allow(client string) (allowed bool, retryAfter time.Duration) {
+	now := l.now()
+	l.clients.do(client, now, func(w *slidingWindow) {
+		start := now.Truncate(l.window)
+		switch elapsed := start.Sub(w.start); {
+		case elapsed == l.window:
+			w.previous, w.current = w.current, 0
+		case elapsed > l.window:
+			w.previous, w.current = 0, 0
+		}
+		w.start = start
+
+		// The previous window counts with the part the sliding window
+		// still covers. Durations are whole nanoseconds, so the weights are
+		// exact.
+		elapsed := now.Sub(start)
+		weighted := float64(w.previous)*float64(l.window-elapsed) + float64(w.current+1)*float64(l.window)
+		if allowed = weighted <= float64(l.limit)*float64(l.window); allowed {
+			w.current++
+		} else if w.current < l.limit {
+			// Wait until the weight of the previous window has dropped
+			// enough to leave room for one request.
+			covered := time.Duration(l.limit-1-w.current) * l.window / time.Duration(w.previous)
+			retryAfter = start.Add(l.window - covered).Sub(now)
+		} else {
+			// Wait for the next window, where this one is the previous.
+			covered := time.Duration(l.limit-1) * l.window / time.Duration(w.current)
+			retryAfter = start.Add(2*l.window - covered).Sub(now)
+		}
+	})
+	return allowed, retryAfter
+}
+
+// GCRALimiter implements the generic cell rate algorithm: it tracks the
+// theoretical arrival time of the next request, which advances by the
+// emission interval window/limit with every request. Requests arriving
+// earlier than burst intervals before it are rejected. It behaves like a
+// token bucket with a single timestamp of state.
+type GCRALimiter struct {
+	interval  time.Duration
+	tolerance time.Duration
+	now       func() time.Time
+	clients   clientStates[time.Time]
+}
+
+// NewGCRALimiter returns a GCRA limiter allowing limit requests per window
+// with bursts of up to burst requests.
+func NewGCRALimiter(limit int, window time.Duration, burst int) *GCRALimiter {
+	interval := window / time.Duration(limit)
+	tolerance := interval * time.Duration(burst-1)
+	return &GCRALimiter{interval: interval, tolerance: tolerance, now: time.Now, clients: newClientStates[time.Time](max(2*window, tolerance+interval))}
+}
+
+func (l *GCRALimiter) Allow(client string) (allowed bool, retryAfter time.Duration) {
+	now := l.now()
+	l.clients.do(client, now, func(tat *time.Time) {
+		arrival := *tat
+		if arrival.Before(now) {
+			arrival = now
+		}
+		if earliest := arrival.Add(-l.tolerance); now.Before(earliest) {
+			retryAfter = earliest.Sub(now)
+			return
+		}
+		allowed = true
+		*tat = arrival.Add(l.interval)
+	})
+	return allowed, retryAfter
+}
+
+// newLimiter returns the limiter implementing algorithm.
+func newLimiter(algorithm string, limit int, window time.Duration, burst int) (Limiter, error) {
+	if limit <= 0 || window <= 0 {
+		return nil, fmt.Errorf("rate limits need a positive limit and window, got %d per %v", limit, window)
+	}
+	burst = max(burst, 1)
+	switch algorithm {
+	case "", "token-bucket":
+		return NewTokenBucketLimiter(limit, window, burst), nil
+	case "sliding-log":
+		return NewSlidingLogLimiter(limit, window), nil
+	case "sliding-window":
+		return NewSlidingWindowLimiter(limit, window), nil
+	case "gcra":
+		return NewGCRALimiter(limit, window, burst), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limiting algorithm %q", algorithm)
+	}
+}
+
+// RateLimits applies a Limiter per route, falling back to a default one for
+// routes without a limiter of their own.
+type RateLimits struct {
+	fallback Limiter
+
+	mu     sync.RWMutex
+	routes map[*mux.Route]Limiter
+}
+
+// NewRateLimits returns rate limits applying fallback to all routes.
+func NewRateLimits(fallback Limiter) *RateLimits {
+	return &RateLimits{fallback: fallback, routes: make(map[*mux.Route]Limiter)}
+}
+
+// Fallback returns the limiter of routes without one of their own.
+func (l *RateLimits) Fallback() Limiter {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.fallback
+}
+
+// SetFallback replaces the limiter of routes without one of their own and
+// returns the previous one. Clients start over with the new limiter.
+func (l *RateLimits) SetFallback(limiter Limiter) (previous Limiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	previous, l.fallback = l.fallback, limiter
+	return previous
+}
+
+// Limit sets the limiter of route and returns the route. Clients are
+// counted separately for every route with a limiter of its own.
+func (l *RateLimits) Limit(route *mux.Route, limiter Limiter) *mux.Route {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.routes[route] = limiter
+	return route
+}
+
+// Middleware answers 429 Too Many Requests with a Retry-After header to
+// clients exceeding the limit of the matched route.
+func (l *RateLimits) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.mu.RLock()
+		limiter, found := l.routes[mux.CurrentRoute(r)]
+		if !found {
+			limiter = l.fallback
+		}
+		l.mu.RUnlock()
+
+		client := clientIdentity(r)
+		if allowed, retryAfter := limiter.Allow(client); !allowed {
+			slog.Debug("Rate limited request", "client", client, "path", r.URL.Path, "retry_after", retryAfter)
+			writeTooManyRequests(w, retryAfter, "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeTooManyRequests answers 429 with the wait rounded up to seconds.
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// clientIdentity names the client of r for rate limiting: its API key or
+// token subject if it authenticated, its address otherwise.
+func clientIdentity(r *http.Request) string {
+	if p := principalFrom(r.Context()); p != nil {
+		if p.APIKey != "" {
+			return "apikey:" + p.APIKey
+		}
+		return "subject:" + p.Tenant + "/" + p.Subject
+	}
+	return "ip:" + remoteIP(r)
+}
+
+// remoteIP returns the address of the client of r without its port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
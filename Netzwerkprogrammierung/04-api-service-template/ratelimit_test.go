@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a clock for limiters that only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestLimitersAllowLimitPerWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		limiter    func(clock *fakeClock) Limiter
+		allowed    int           // requests allowed at once
+		retryAfter time.Duration // wait announced for the next one
+		refill     time.Duration // wait after which one more is allowed
+	}{
+		{
+			name: "token bucket",
+			limiter: func(clock *fakeClock) Limiter {
+				l := NewTokenBucketLimiter(2, time.Second, 4)
+				l.now = clock.Now
+				return l
+			},
+			allowed:    4,
+			retryAfter: 500 * time.Millisecond,
+			refill:     500 * time.Millisecond,
+		},
+		{
+			name: "sliding log",
+			limiter: func(clock *fakeClock) Limiter {
+				l := NewSlidingLogLimiter(3, time.Minute)
+				l.now = clock.Now
+				return l
+			},
+			allowed:    3,
+			retryAfter: time.Minute,
+			refill:     time.Minute,
+		},
+		{
+			name: "sliding window",
+			limiter: func(clock *fakeClock) Limiter {
+				l := NewSlidingWindowLimiter(3, time.Minute)
+				l.now = clock.Now
+				return l
+			},
+			allowed: 3,
+			// The requests weigh on the next window until two thirds of
+			// them have left it.
+			retryAfter: 80 * time.Second,
+			refill:     80 * time.Second,
+		},
+		{
+			name: "gcra",
+			limiter: func(clock *fakeClock) Limiter {
+				l := NewGCRALimiter(2, time.Second, 4)
+				l.now = clock.Now
+				return l
+			},
+			allowed:    4,
+			retryAfter: 500 * time.Millisecond,
+			refill:     500 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Setup
+			clock := newFakeClock()
+			limiter := tt.limiter(clock)
+
+			// Execute and validate
+			for i := 0; i < tt.allowed; i++ {
+				allowed, _ := limiter.Allow("a")
+				assert.True(t, allowed, "request %d is within the limit", i+1)
+			}
+			allowed, retryAfter := limiter.Allow("a")
+			assert.False(t, allowed, "the limit of a is used up")
+			assert.Equal(t, tt.retryAfter, retryAfter)
+
+			allowed, _ = limiter.Allow("b")
+			assert.True(t, allowed, "b is limited on its own")
+
+			clock.Advance(tt.refill - time.Millisecond)
+			allowed, _ = limiter.Allow("a")
+			assert.False(t, allowed, "a has to wait the announced time")
+			clock.Advance(time.Millisecond)
+			allowed, _ = limiter.Allow("a")
+			assert.True(t, allowed, "a may make a request after waiting")
+		})
+	}
+}
+
+func TestSlidingLogLimiterSlides(t *testing.T) {
+	// Setup
+	clock := newFakeClock()
+	limiter := NewSlidingLogLimiter(2, time.Minute)
+	limiter.now = clock.Now
+
+	// Execute
+	first, _ := limiter.Allow("a")
+	clock.Advance(40 * time.Second)
+	second, _ := limiter.Allow("a")
+	third, retryAfter := limiter.Allow("a")
+	clock.Advance(20 * time.Second)
+	fourth, _ := limiter.Allow("a")
+
+	// Validate
+	assert.True(t, first)
+	assert.True(t, second)
+	assert.False(t, third)
+	assert.Equal(t, 20*time.Second, retryAfter, "the first request leaves the window after a minute")
+	assert.True(t, fourth)
+}
+
+func TestSlidingWindowLimiterWeightsPreviousWindow(t *testing.T) {
+	// Setup
+	clock := newFakeClock()
+	limiter := NewSlidingWindowLimiter(4, time.Minute)
+	limiter.now = clock.Now
+	for i := 0; i < 4; i++ {
+		limiter.Allow("a")
+	}
+
+	// Execute: a quarter into the next window, the previous one still
+	// weighs 3 of its 4 requests.
+	clock.Advance(75 * time.Second)
+	first, _ := limiter.Allow("a")
+	second, retryAfter := limiter.Allow("a")
+	clock.Advance(retryAfter)
+	third, _ := limiter.Allow("a")
+
+	// Validate
+	assert.True(t, first)
+	assert.False(t, second)
+	assert.Equal(t, 15*time.Second, retryAfter, "half of the previous window has to pass")
+	assert.True(t, third)
+}
+
+func TestLimitersPruneIdleClients(t *testing.T) {
+	// Setup
+	clock := newFakeClock()
+	limiter := NewGCRALimiter(1, time.Second, 1)
+	limiter.now = clock.Now
+
+	// Execute
+	limiter.Allow("a")
+	limiter.Allow("b")
+	clock.Advance(time.Minute)
+	limiter.Allow("c")
+
+	// Validate
+	assert.Equal(t, 1, limiter.clients.len())
+}
+
+func TestNewLimiter(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		want      Limiter
+	}{
+		{"", &TokenBucketLimiter{}},
+		{"token-bucket", &TokenBucketLimiter{}},
+		{"sliding-log", &SlidingLogLimiter{}},
+		{"sliding-window", &SlidingWindowLimiter{}},
+		{"gcra", &GCRALimiter{}},
+	}
+	for _, tt := range tests {
+		limiter, err := newLimiter(tt.algorithm, 10, time.Second, 0)
+		assert.NoError(t, err, tt.algorithm)
+		assert.IsType(t, tt.want, limiter, tt.algorithm)
+	}
+
+	_, err := newLimiter("leaky-bucket", 10, time.Second, 1)
+	assert.ErrorContains(t, err, "unknown rate limiting algorithm")
+	_, err = newLimiter("gcra", 0, time.Second, 1)
+	assert.ErrorContains(t, err, "positive limit")
+}
+
+func TestRateLimitsPerRoute(t *testing.T) {
+	// Setup
+	clock := newFakeClock()
+	fallback := NewTokenBucketLimiter(1, time.Second, 1)
+	fallback.now = clock.Now
+	strict := NewSlidingLogLimiter(1, time.Minute)
+	strict.now = clock.Now
+	limits := NewRateLimits(fallback)
+
+	r := mux.NewRouter()
+	r.Use(limits.Middleware)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r.HandleFunc("/users", ok)
+	limits.Limit(r.HandleFunc("/users/export", ok), strict)
+	request := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.0.2.1:4321"
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Execute
+	export := request("/users/export")
+	users := request("/users")
+	clock.Advance(time.Second)
+	usersAgain := request("/users")
+	exportAgain := request("/users/export")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, export.Code)
+	assert.Equal(t, http.StatusOK, users.Code, "the routes are counted separately")
+	assert.Equal(t, http.StatusOK, usersAgain.Code)
+	assert.Equal(t, http.StatusTooManyRequests, exportAgain.Code)
+	assert.Equal(t, "59", exportAgain.Header().Get("Retry-After"))
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Permissions checked by the access policy.
+const (
+	permUsersRead  = "users:read"
+	permUsersWrite = "users:write"
+	permUsersAdmin = "users:admin"
+)
+
+// rolePermissions lists the permissions granted by each role.
+var rolePermissions = map[string][]string{
+	"viewer": {permUsersRead},
+	"editor": {permUsersRead, permUsersWrite},
+	"admin":  {permUsersRead, permUsersWrite, permUsersAdmin},
+}
+
+// ErrForbidden is returned when the caller lacks a permission.
+var ErrForbidden = errors.New("permission denied")
+
+// ErrRoleNotAssigned is returned when revoking a role the principal does
+// not have.
+var ErrRoleNotAssigned = errors.New("role not assigned")
+
+// PermissionError reports the permission the caller is missing. It wraps
+// ErrForbidden.
+type PermissionError struct {
+	Permission string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("missing permission %s", e.Permission)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return ErrForbidden
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject string
+	Tenant  string
+	APIKey  string // id of the API key the caller authenticated with
+	Session string // id of the login session of the access token
+	// permissions is set by the access policy once the roles of the
+	// principal are loaded, or to the scopes of its API key.
+	permissions map[string]bool
+}
+
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx carrying p.
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the caller of the request ctx belongs to, or nil if
+// the request is not authenticated.
+func principalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// authorize returns a PermissionError unless the caller has permission.
+// Without access control there are no evaluated permissions in ctx and
+// everything is allowed. The business layer calls it for every operation,
+// so that single-endpoint APIs like JSON-RPC and GraphQL obey the same
+// rules as the v1 routes.
+func authorize(ctx context.Context, permission string) error {
+	p := principalFrom(ctx)
+	if p == nil || p.permissions == nil || p.permissions[permission] {
+		return nil
+	}
+	return &PermissionError{Permission: permission}
+}
+
+// Authenticator requires a valid HS256 bearer token on every request and
+// makes its subject the principal of the request. Requests already
+// authenticated with an API key pass. With sessions set, tokens issued for
+// a login session are refused once the session has been terminated.
+type Authenticator struct {
+	secret   []byte
+	now      func() time.Time
+	sessions SessionStore
+}
+
+// NewAuthenticator returns an Authenticator verifying tokens with secret.
+func NewAuthenticator(secret []byte) *Authenticator {
+	return &Authenticator{secret: secret, now: time.Now}
+}
+
+// Middleware rejects requests without a valid token with 401.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principalFrom(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeProblem(w, problem{Type: problemBaseURI + "unauthenticated", Title: "Authentication required", Status: http.StatusUnauthorized,
+				Detail: "Send a bearer token in the Authorization header.", Instance: r.URL.Path})
+			return
+		}
+		claims, err := verifyJWT(token, a.secret, a.now())
+		if err != nil || claims.Subject == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeProblem(w, problem{Type: problemBaseURI + "invalid-token", Title: "Invalid token", Status: http.StatusUnauthorized,
+				Detail: "The bearer token is malformed, expired or not signed by this service.", Instance: r.URL.Path})
+			return
+		}
+		if claims.SessionID != "" && a.sessions != nil {
+			ctx := r.Context()
+			if claims.Tenant != "" {
+				ctx = withTenant(ctx, claims.Tenant)
+			}
+			if _, err := a.sessions.LookupSession(ctx, claims.SessionID); errors.Is(err, ErrSessionNotFound) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeProblem(w, problem{Type: problemBaseURI + "invalid-token", Title: "Invalid token", Status: http.StatusUnauthorized,
+					Detail: "The session of the bearer token has ended.", Instance: r.URL.Path})
+				return
+			} else if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+		}
+		p := &Principal{Subject: claims.Subject, Tenant: claims.Tenant, Session: claims.SessionID}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+// Policy holds the permissions required by each route and enforces them
+// with the roles of the caller. Routes without a declaration are denied,
+// so a route added without thinking about access is not left open.
+type Policy struct {
+	roles  RoleStore
+	admins map[string]bool // tenant/subject pairs holding the admin role regardless of roles
+
+	mu     sync.RWMutex
+	routes map[*mux.Route][]string
+}
+
+// NewPolicy returns a policy looking up roles in roles. The admins, given
+// as tenant/subject, always hold the admin role in their tenant, so that
+// roles can be assigned on a fresh deployment. An admin without a tenant
+// belongs to the default tenant; admins are never granted across tenants.
+func NewPolicy(roles RoleStore, admins []string) *Policy {
+	p := &Policy{roles: roles, admins: make(map[string]bool), routes: make(map[*mux.Route][]string)}
+	for _, admin := range admins {
+		if admin = strings.TrimSpace(admin); admin == "" {
+			continue
+		}
+		if !strings.Contains(admin, "/") {
+			admin = defaultTenant + "/" + admin
+		}
+		p.admins[admin] = true
+	}
+	return p
+}
+
+// Require declares the permissions needed to call route and returns it. A
+// route declared without permissions only requires authentication. On a
+// nil Policy it does nothing, so routes can be declared whether or not
+// access control is enabled.
+func (p *Policy) Require(route *mux.Route, permissions ...string) *mux.Route {
+	if p == nil {
+		return route
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.routes[route] = permissions
+	return route
+}
+
+// permissions returns the permissions granted to the caller.
+func (p *Policy) permissions(ctx context.Context, subject string) (map[string]bool, error) {
+	roles, err := p.roles.Roles(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	if p.admins[tenantOrDefault(ctx)+"/"+subject] {
+		roles = append(roles, "admin")
+	}
+	granted := make(map[string]bool)
+	for _, role := range roles {
+		for _, permission := range rolePermissions[role] {
+			granted[permission] = true
+		}
+	}
+	return granted, nil
+}
+
+// Middleware evaluates the permissions of the matched route against the
+// roles of the principal and answers 403 with the missing permission.
+// It must run after the Authenticator.
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := principalFrom(r.Context())
+		if principal == nil {
+			writeProblem(w, problem{Type: problemBaseURI + "unauthenticated", Title: "Authentication required", Status: http.StatusUnauthorized, Instance: r.URL.Path})
+			return
+		}
+
+		p.mu.RLock()
+		required, declared := p.routes[mux.CurrentRoute(r)]
+		p.mu.RUnlock()
+		if !declared {
+			writeProblem(w, problem{Type: problemBaseURI + "forbidden", Title: "Forbidden", Status: http.StatusForbidden,
+				Detail: "No access policy is declared for this route.", Instance: r.URL.Path})
+			return
+		}
+
+		granted := principal.permissions
+		if granted == nil {
+			var err error
+			if granted, err = p.permissions(r.Context(), principal.Subject); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+		}
+		for _, permission := range required {
+			if !granted[permission] {
+				writeProblem(w, problem{Type: problemBaseURI + "forbidden", Title: "Forbidden", Status: http.StatusForbidden,
+					Detail:   fmt.Sprintf("%s %s requires the %s permission, which none of the roles of %s grant.", r.Method, r.URL.Path, permission, principal.Subject),
+					Instance: r.URL.Path, MissingPermission: permission})
+				return
+			}
+		}
+
+		authorized := *principal
+		authorized.permissions = granted
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), &authorized)))
+	})
+}
+
+// RoleStore persists the roles assigned to principals, per tenant.
+type RoleStore interface {
+	// Roles returns the roles of principal in ascending order.
+	Roles(ctx context.Context, principal string) ([]string, error)
+	// GrantRole assigns role to principal and reports whether it was new.
+	GrantRole(ctx context.Context, principal, role string) (bool, error)
+	// RevokeRole removes role from principal or returns ErrRoleNotAssigned.
+	RevokeRole(ctx context.Context, principal, role string) error
+}
+
+// sqlRoleStore is a RoleStore backed by the principal_roles table.
+type sqlRoleStore struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+}
+
+// newSQLRoleStore returns a RoleStore using the given database handle.
+func newSQLRoleStore(db *sql.DB) *sqlRoleStore {
+	return &sqlRoleStore{db: db, queryTimeout: 5 * time.Second}
+}
+
+func (s *sqlRoleStore) Roles(ctx context.Context, principal string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT role FROM principal_roles WHERE tenant_id = $1 AND principal = $2 ORDER BY role", tenantOrDefault(ctx), principal)
+	if err != nil {
+		return nil, classify(ctx, err)
+	}
+	defer rows.Close()
+
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, classify(ctx, err)
+		}
+		roles = append(roles, role)
+	}
+	return roles, classify(ctx, rows.Err())
+}
+
+func (s *sqlRoleStore) GrantRole(ctx context.Context, principal, role string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, "INSERT INTO principal_roles (tenant_id, principal, role) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		tenantOrDefault(ctx), principal, role)
+	if err != nil {
+		return false, classify(ctx, err)
+	}
+	return requireAffected(result) == nil, nil
+}
+
+func (s *sqlRoleStore) RevokeRole(ctx context.Context, principal, role string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, "DELETE FROM principal_roles WHERE tenant_id = $1 AND principal = $2 AND role = $3",
+		tenantOrDefault(ctx), principal, role)
+	if err != nil {
+		return classify(ctx, err)
+	}
+	if requireAffected(result) != nil {
+		return ErrRoleNotAssigned
+	}
+	return nil
+}
+
+// memoryRoleStore is a RoleStore kept in process memory.
+type memoryRoleStore struct {
+	mu    sync.RWMutex
+	roles map[string]map[string]map[string]bool // tenant, principal, role
+}
+
+// newMemoryRoleStore returns an empty in-memory RoleStore.
+func newMemoryRoleStore() *memoryRoleStore {
+	return &memoryRoleStore{roles: make(map[string]map[string]map[string]bool)}
+}
+
+func (s *memoryRoleStore) Roles(ctx context.Context, principal string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var roles []string
+	for role := range s.roles[tenantOrDefault(ctx)][principal] {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles, nil
+}
+
+func (s *memoryRoleStore) GrantRole(ctx context.Context, principal, role string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := tenantOrDefault(ctx)
+	if s.roles[tenant] == nil {
+		s.roles[tenant] = make(map[string]map[string]bool)
+	}
+	if s.roles[tenant][principal] == nil {
+		s.roles[tenant][principal] = make(map[string]bool)
+	}
+	if s.roles[tenant][principal][role] {
+		return false, nil
+	}
+	s.roles[tenant][principal][role] = true
+	return true, nil
+}
+
+func (s *memoryRoleStore) RevokeRole(ctx context.Context, principal, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	assigned := s.roles[tenantOrDefault(ctx)][principal]
+	if !assigned[role] {
+		return ErrRoleNotAssigned
+	}
+	delete(assigned, role)
+	return nil
+}
+
+// principalRoles is the response of the role assignment endpoints.
+type principalRoles struct {
+	Principal   string   `json:"principal"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// listRoles handles the GET /v1/admin/roles endpoint.
+func listRoles(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, rolePermissions)
+}
+
+// getPrincipalRoles handles the GET /v1/admin/principals/{principal}/roles
+// endpoint.
+func (s *Server) getPrincipalRoles(w http.ResponseWriter, r *http.Request) {
+	principal := mux.Vars(r)["principal"]
+	assigned, err := s.roles.Roles(r.Context(), principal)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	response := principalRoles{Principal: principal, Roles: []string{}, Permissions: []string{}}
+	granted := make(map[string]bool)
+	for _, role := range assigned {
+		response.Roles = append(response.Roles, role)
+		for _, permission := range rolePermissions[role] {
+			if !granted[permission] {
+				granted[permission] = true
+				response.Permissions = append(response.Permissions, permission)
+			}
+		}
+	}
+	sort.Strings(response.Permissions)
+	writeJSON(w, http.StatusOK, response)
+}
+
+// grantRole handles the PUT /v1/admin/principals/{principal}/roles/{role}
+// endpoint: 201 if the role was assigned, 204 if the principal already had
+// it.
+func (s *Server) grantRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if _, known := rolePermissions[vars["role"]]; !known {
+		http.Error(w, fmt.Sprintf("unknown role %q", vars["role"]), http.StatusBadRequest)
+		return
+	}
+
+	created, err := s.roles.GrantRole(r.Context(), vars["principal"], vars["role"])
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeRole handles the DELETE /v1/admin/principals/{principal}/roles/{role}
+// endpoint.
+func (s *Server) revokeRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := s.roles.RevokeRole(r.Context(), vars["principal"], vars["role"])
+	if errors.Is(err, ErrRoleNotAssigned) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
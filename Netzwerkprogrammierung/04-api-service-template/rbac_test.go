@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyEnforcesRoutePermissions(t *testing.T) {
+	// Setup
+	router := NewServer(WithAccessControl(testJWTSecret, []string{"root"}))
+	token := func(subject string) string {
+		return testToken(t, map[string]any{"sub": subject, "exp": time.Now().Add(time.Hour).Unix()})
+	}
+	serve := func(method, path, subject, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if subject != "" {
+			req.Header.Set("Authorization", "Bearer "+token(subject))
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Execute
+	anonymous := serve("GET", "/v1/users/1", "", "")
+	stranger := serve("GET", "/v1/users/1", "alice", "")
+	grantViewer := serve("PUT", "/v1/admin/principals/alice/roles/viewer", "root", "")
+	grantAgain := serve("PUT", "/v1/admin/principals/alice/roles/viewer", "root", "")
+	grantUnknown := serve("PUT", "/v1/admin/principals/alice/roles/owner", "root", "")
+	created := serve("POST", "/v1/users", "root", `{"name":"Bob"}`)
+	viewerRead := serve("GET", "/v1/users/1", "alice", "")
+	viewerDelete := serve("DELETE", "/v1/users/1", "alice", "")
+	viewerAdmin := serve("GET", "/v1/admin/principals/alice/roles", "alice", "")
+	grantEditor := serve("PUT", "/v1/admin/principals/alice/roles/editor", "root", "")
+	listed := serve("GET", "/v1/admin/principals/alice/roles", "root", "")
+	editorDelete := serve("DELETE", "/v1/users/1", "alice", "")
+	revoked := serve("DELETE", "/v1/admin/principals/alice/roles/editor", "root", "")
+	revokedAgain := serve("DELETE", "/v1/admin/principals/alice/roles/editor", "root", "")
+
+	// Validate
+	assert.Equal(t, http.StatusUnauthorized, anonymous.Code)
+	assert.Equal(t, "application/problem+json", anonymous.Header().Get("Content-Type"))
+	assert.Equal(t, http.StatusForbidden, stranger.Code)
+	assert.Equal(t, http.StatusCreated, grantViewer.Code)
+	assert.Equal(t, http.StatusNoContent, grantAgain.Code)
+	assert.Equal(t, http.StatusBadRequest, grantUnknown.Code)
+	assert.Equal(t, http.StatusOK, created.Code)
+	assert.Equal(t, http.StatusOK, viewerRead.Code)
+
+	assert.Equal(t, http.StatusForbidden, viewerDelete.Code)
+	assert.Equal(t, "application/problem+json", viewerDelete.Header().Get("Content-Type"))
+	var denied problem
+	assert.NoError(t, json.Unmarshal(viewerDelete.Body.Bytes(), &denied))
+	assert.Equal(t, problemBaseURI+"forbidden", denied.Type)
+	assert.Equal(t, http.StatusForbidden, denied.Status)
+	assert.Equal(t, permUsersWrite, denied.MissingPermission)
+	assert.Contains(t, denied.Detail, "DELETE /v1/users/1 requires the users:write permission")
+
+	assert.Equal(t, http.StatusForbidden, viewerAdmin.Code)
+	assert.Equal(t, http.StatusCreated, grantEditor.Code)
+	assert.JSONEq(t, `{"principal":"alice","roles":["editor","viewer"],"permissions":["users:read","users:write"]}`, listed.Body.String())
+	assert.Equal(t, http.StatusNoContent, editorDelete.Code)
+	assert.Equal(t, http.StatusNoContent, revoked.Code)
+	assert.Equal(t, http.StatusNotFound, revokedAgain.Code)
+}
+
+func TestPolicyScopesAdminsToTheirTenant(t *testing.T) {
+	// Setup
+	router := NewServer(WithTenancy(NewTenantResolver(testJWTSecret, "")),
+		WithAccessControl(testJWTSecret, []string{"root", "acme/ops"}))
+	serve := func(subject, tenant string) int {
+		req := httptest.NewRequest("GET", "/v1/admin/principals/alice/roles", nil)
+		req.Header.Set("Authorization", "Bearer "+testToken(t, map[string]any{"sub": subject, "tenant": tenant, "exp": time.Now().Add(time.Hour).Unix()}))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Execute
+	rootDefault := serve("root", defaultTenant)
+	rootAcme := serve("root", "acme")
+	opsAcme := serve("ops", "acme")
+	opsOther := serve("ops", "globex")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, rootDefault, "an admin without a tenant belongs to the default tenant")
+	assert.Equal(t, http.StatusForbidden, rootAcme, "admins are not granted across tenants")
+	assert.Equal(t, http.StatusOK, opsAcme)
+	assert.Equal(t, http.StatusForbidden, opsOther)
+}
+
+func TestPolicyDeniesUndeclaredRoutes(t *testing.T) {
+	// Setup
+	policy := NewPolicy(newMemoryRoleStore(), []string{"root"})
+	r := mux.NewRouter()
+	r.HandleFunc("/undeclared", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(NewAuthenticator(testJWTSecret).Middleware, policy.Middleware)
+	req := httptest.NewRequest("GET", "/undeclared", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, map[string]any{"sub": "root", "exp": time.Now().Add(time.Hour).Unix()}))
+	rr := httptest.NewRecorder()
+
+	// Execute
+	r.ServeHTTP(rr, req)
+
+	// Validate
+	assert.Equal(t, http.StatusForbidden, rr.Code, "routes without a policy are denied")
+}
+
+func TestPermissionsApplyToJSONRPC(t *testing.T) {
+	// Setup
+	router := NewServer(WithAccessControl(testJWTSecret, nil))
+	_, err := router.roles.GrantRole(context.Background(), "alice", "viewer")
+	assert.NoError(t, err)
+	req := httptest.NewRequest("POST", "/rpc", strings.NewReader(`[
+		{"jsonrpc":"2.0","method":"users.list","id":1},
+		{"jsonrpc":"2.0","method":"users.create","params":{"name":"Mallory"},"id":2}
+	]`))
+	req.Header.Set("Authorization", "Bearer "+testToken(t, map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}))
+	rr := httptest.NewRecorder()
+
+	// Execute
+	router.ServeHTTP(rr, req)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[
+		{"jsonrpc":"2.0","result":[],"id":1},
+		{"jsonrpc":"2.0","error":{"code":-32001,"message":"Permission denied","data":{"missing_permission":"users:write"}},"id":2}
+	]`, rr.Body.String())
+}
+
+func TestAuthorizeWithoutAccessControl(t *testing.T) {
+	// Setup
+	unevaluated := withPrincipal(context.Background(), &Principal{Subject: "alice"})
+	viewer := withPrincipal(context.Background(), &Principal{Subject: "alice", permissions: map[string]bool{permUsersRead: true}})
+
+	// Execute and validate
+	assert.NoError(t, authorize(context.Background(), permUsersAdmin))
+	assert.NoError(t, authorize(unevaluated, permUsersAdmin))
+	assert.NoError(t, authorize(viewer, permUsersRead))
+	err := authorize(viewer, permUsersWrite)
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.EqualError(t, err, "missing permission users:write")
+}
+
+func TestSQLRoleStore(t *testing.T) {
+	// Setup
+	storeDB, storeMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer storeDB.Close()
+	s := newSQLRoleStore(storeDB)
+	ctx := withTenant(context.Background(), "acme")
+
+	// Mock DB response
+	storeMock.ExpectQuery("SELECT role FROM principal_roles WHERE tenant_id = \\$1 AND principal = \\$2 ORDER BY role").
+		WithArgs("acme", "alice").WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("editor").AddRow("viewer"))
+	storeMock.ExpectExec("INSERT INTO principal_roles \\(tenant_id, principal, role\\) VALUES \\(\\$1, \\$2, \\$3\\) ON CONFLICT DO NOTHING").
+		WithArgs("default", "bob", "admin").WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectExec("DELETE FROM principal_roles WHERE tenant_id = \\$1 AND principal = \\$2 AND role = \\$3").
+		WithArgs("acme", "alice", "admin").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Execute
+	assigned, rolesErr := s.Roles(ctx, "alice")
+	created, grantErr := s.GrantRole(context.Background(), "bob", "admin")
+	revokeErr := s.RevokeRole(ctx, "alice", "admin")
+
+	// Validate
+	assert.NoError(t, rolesErr)
+	assert.Equal(t, []string{"editor", "viewer"}, assigned)
+	assert.NoError(t, grantErr)
+	assert.True(t, created)
+	assert.ErrorIs(t, revokeErr, ErrRoleNotAssigned)
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
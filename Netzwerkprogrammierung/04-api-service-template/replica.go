@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// consistencyHeader lets a client demand that its reads see the primary,
+// for example right after it wrote through another instance.
+const consistencyHeader = "X-Consistency"
+
+// sessionHeader identifies a client session for read-your-writes. Without
+// it the client address is used.
+const sessionHeader = "X-Session-ID"
+
+// replicaLagQuery reports whether a replica streams WAL from the primary
+// and how far it is behind in seconds. A streaming replica that replayed
+// everything it received counts as current, since the replay timestamp does
+// not move while the primary is idle. Reading the receiver status needs the
+// pg_read_all_stats role; without it the replica never counts as streaming.
+const replicaLagQuery = `SELECT EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE status = 'streaming'),
+	CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`
+
+// errReplicaNotStreaming means the replica lost its connection to the
+// primary, so its data may be arbitrarily old.
+var errReplicaNotStreaming = errors.New("WAL receiver is not streaming from the primary")
+
+// replica is a read-only database and its last known state.
+type replica struct {
+	name    string // host of the replica, for logs and metrics
+	db      *sql.DB
+	healthy atomic.Bool
+	lag     atomic.Int64 // nanoseconds
+}
+
+// ReplicaRouter spreads reads over healthy read replicas. Replicas are
+// checked every interval and skipped while they cannot be reached or lag
+// more than maxLag. Reads of a client that wrote within the last window go
+// to the primary so that it sees its own writes.
+type ReplicaRouter struct {
+	replicas []*replica
+	maxLag   time.Duration
+	interval time.Duration
+	window   time.Duration
+	next     atomic.Uint64
+	now      func() time.Time
+	logger   *slog.Logger
+
+	mu     sync.Mutex
+	writes map[string]time.Time // last write per session
+}
+
+// NewReplicaRouter returns a router over the given replica handles, keyed
+// by a name used in logs and metrics.
+func NewReplicaRouter(replicas map[string]*sql.DB, maxLag, interval, window time.Duration) *ReplicaRouter {
+	router := &ReplicaRouter{
+		maxLag:   maxLag,
+		interval: interval,
+		window:   window,
+		now:      time.Now,
+		logger:   slog.Default(),
+		writes:   make(map[string]time.Time),
+	}
+	for name, db := range replicas {
+		router.replicas = append(router.replicas, &replica{name: name, db: db})
+	}
+	sort.Slice(router.replicas, func(i, j int) bool { return router.replicas[i].name < router.replicas[j].name })
+	return router
+}
+
+// openReplicas opens the comma separated replica URLs of
+// DATABASE_REPLICA_URLS. Unreachable replicas are opened anyway and join
+// once their health check passes.
+func openReplicas(urls string, pool poolConfig) (map[string]*sql.DB, error) {
+	replicas := make(map[string]*sql.DB)
+	for _, dsn := range strings.Split(urls, ",") {
+		dsn = strings.TrimSpace(dsn)
+		if dsn == "" {
+			continue
+		}
+		name := dsn
+		if u, err := url.Parse(dsn); err == nil && u.Host != "" {
+			name = u.Host // without credentials
+		}
+		db, err := sql.Open("pgx", dsn)
+		if err != nil {
+			for _, opened := range replicas {
+				opened.Close()
+			}
+			return nil, err
+		}
+		pool.apply(db)
+		replicas[name] = db
+	}
+	return replicas, nil
+}
+
+// Run checks the replicas every interval until ctx is cancelled.
+func (r *ReplicaRouter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check measures the lag of every replica and updates its health.
+func (r *ReplicaRouter) check(ctx context.Context) {
+	for _, replica := range r.replicas {
+		checkCtx, cancel := context.WithTimeout(ctx, r.interval)
+		var streaming bool
+		var seconds float64
+		err := replica.db.QueryRowContext(checkCtx, replicaLagQuery).Scan(&streaming, &seconds)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && !streaming {
+			err = errReplicaNotStreaming
+		}
+
+		lag := time.Duration(seconds * float64(time.Second))
+		replica.lag.Store(int64(lag))
+		healthy := err == nil && lag <= r.maxLag
+		if was := replica.healthy.Swap(healthy); was != healthy {
+			switch {
+			case healthy:
+				r.logger.Info("Replica is healthy", "replica", replica.name, "lag", lag)
+			case err != nil:
+				r.logger.Warn("Replica is unhealthy", "replica", replica.name, "error", err)
+			default:
+				r.logger.Warn("Replica lags behind the primary, reading from the primary", "replica", replica.name, "lag", lag)
+			}
+		}
+	}
+}
+
+// markDown takes replica out of rotation until the next health check finds
+// it healthy again.
+func (r *ReplicaRouter) markDown(replica *replica, err error) {
+	if replica.healthy.Swap(false) {
+		r.logger.Warn("Replica failed, reading from the primary", "replica", replica.name, "error", err)
+	}
+}
+
+// pick returns the next healthy replica in round-robin order, or nil if the
+// read must go to the primary.
+func (r *ReplicaRouter) pick(ctx context.Context) *replica {
+	if r == nil || len(r.replicas) == 0 {
+		return nil
+	}
+	if c := consistencyFrom(ctx); c != nil && (c.primary || c.wrote.Load()) {
+		return nil
+	}
+
+	start := r.next.Add(1)
+	for i := range r.replicas {
+		replica := r.replicas[(int(start)+i)%len(r.replicas)]
+		if replica.healthy.Load() {
+			return replica
+		}
+	}
+	return nil
+}
+
+// recordWrite starts the read-your-writes window of a session.
+func (r *ReplicaRouter) recordWrite(session string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if len(r.writes) >= 1024 {
+		for key, at := range r.writes {
+			if now.Sub(at) >= r.window {
+				delete(r.writes, key)
+			}
+		}
+	}
+	r.writes[session] = now
+}
+
+// wroteRecently reports whether the session is in its read-your-writes
+// window.
+func (r *ReplicaRouter) wroteRecently(session string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	at, found := r.writes[session]
+	return found && r.now().Sub(at) < r.window
+}
+
+// Middleware sends the reads of a request to the primary if the client asks
+// for it with the consistency header or wrote within the window.
+func (r *ReplicaRouter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		session := req.Header.Get(sessionHeader)
+		if session == "" {
+			session, _, _ = net.SplitHostPort(req.RemoteAddr)
+		}
+
+		c := &consistency{
+			router:  r,
+			session: session,
+			primary: strings.EqualFold(req.Header.Get(consistencyHeader), "primary") || r.wroteRecently(session),
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), consistencyKey{}, c)))
+	})
+}
+
+// replicaStats is the state of a replica for metrics.
+type replicaStats struct {
+	Name    string
+	Healthy bool
+	Lag     time.Duration
+}
+
+// Stats returns the state of every replica.
+func (r *ReplicaRouter) Stats() []replicaStats {
+	stats := make([]replicaStats, len(r.replicas))
+	for i, replica := range r.replicas {
+		stats[i] = replicaStats{Name: replica.name, Healthy: replica.healthy.Load(), Lag: time.Duration(replica.lag.Load())}
+	}
+	return stats
+}
+
+// Close closes the replica handles.
+func (r *ReplicaRouter) Close() error {
+	var errs []error
+	for _, replica := range r.replicas {
+		errs = append(errs, replica.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// consistency carries the read routing of a request.
+type consistency struct {
+	router  *ReplicaRouter
+	session string
+	primary bool
+	wrote   atomic.Bool
+}
+
+// markWrite sends the remaining reads of the request and those of the
+// session within the window to the primary. The window starts before the
+// response is sent, so that the client cannot outrun it.
+func (c *consistency) markWrite() {
+	c.wrote.Store(true)
+	c.router.recordWrite(c.session)
+}
+
+type consistencyKey struct{}
+
+// consistencyFrom returns the consistency of the request ctx belongs to, or
+// nil outside of requests.
+func consistencyFrom(ctx context.Context) *consistency {
+	c, _ := ctx.Value(consistencyKey{}).(*consistency)
+	return c
+}
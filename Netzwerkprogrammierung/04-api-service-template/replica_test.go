@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// newReplicaTestStore returns a sqlStore with one replica and the mocks of
+// both databases.
+func newReplicaTestStore(t *testing.T) (*sqlStore, *ReplicaRouter, sqlmock.Sqlmock, sqlmock.Sqlmock) {
+	primaryDB, primaryMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	replicaDB, replicaMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		primaryDB.Close()
+		replicaDB.Close()
+	})
+
+	router := NewReplicaRouter(map[string]*sql.DB{"replica:5432": replicaDB}, 5*time.Second, time.Second, 5*time.Second)
+	s := newSQLStore(primaryDB)
+	s.replicas = router
+	return s, router, primaryMock, replicaMock
+}
+
+func TestReplicaHealthCheck(t *testing.T) {
+	// Setup
+	_, router, _, replicaMock := newReplicaTestStore(t)
+
+	// Mock DB response
+	lagQuery := "SELECT EXISTS \\(SELECT 1 FROM pg_stat_wal_receiver WHERE status = 'streaming'\\)"
+	replicaMock.ExpectQuery(lagQuery).WillReturnRows(sqlmock.NewRows([]string{"streaming", "lag"}).AddRow(true, 1.5))
+	replicaMock.ExpectQuery(lagQuery).WillReturnRows(sqlmock.NewRows([]string{"streaming", "lag"}).AddRow(true, 30.0))
+	replicaMock.ExpectQuery(lagQuery).WillReturnRows(sqlmock.NewRows([]string{"streaming", "lag"}).AddRow(true, 0.0))
+	replicaMock.ExpectQuery(lagQuery).WillReturnRows(sqlmock.NewRows([]string{"streaming", "lag"}).AddRow(false, 0.0))
+	replicaMock.ExpectQuery(lagQuery).WillReturnError(errors.New("connection refused"))
+
+	// Execute and validate
+	router.check(context.Background())
+	assert.Equal(t, []replicaStats{{Name: "replica:5432", Healthy: true, Lag: 1500 * time.Millisecond}}, router.Stats())
+	router.check(context.Background())
+	assert.False(t, router.Stats()[0].Healthy, "lagging replicas leave the rotation")
+	router.check(context.Background())
+	assert.True(t, router.Stats()[0].Healthy)
+	router.check(context.Background())
+	assert.False(t, router.Stats()[0].Healthy, "a replica cut off from the primary is not current")
+	router.check(context.Background())
+	assert.False(t, router.Stats()[0].Healthy)
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+}
+
+func TestReadsUseHealthyReplica(t *testing.T) {
+	// Setup
+	s, router, primaryMock, replicaMock := newReplicaTestStore(t)
+	router.replicas[0].healthy.Store(true)
+
+	// Mock DB response
+	replicaMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "Alice"))
+	primaryMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(2, "Bob"))
+
+	// Execute
+	fromReplica, err1 := s.GetUser(context.Background(), 1)
+	router.replicas[0].healthy.Store(false)
+	fromPrimary, err2 := s.GetUser(context.Background(), 2)
+
+	// Validate
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.Equal(t, "Alice", fromReplica.Name)
+	assert.Equal(t, "Bob", fromPrimary.Name)
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+}
+
+func TestReadFallsBackToPrimaryWhenReplicaFails(t *testing.T) {
+	// Setup
+	s, router, primaryMock, replicaMock := newReplicaTestStore(t)
+	router.replicas[0].healthy.Store(true)
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	// Mock DB response
+	replicaMock.ExpectQuery("SELECT id, name FROM users WHERE id = ANY").WillReturnError(refused)
+	primaryMock.ExpectQuery("SELECT id, name FROM users WHERE id = ANY").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "Alice"))
+
+	// Execute
+	users, err := s.GetUsers(context.Background(), []int{1})
+
+	// Validate
+	assert.NoError(t, err)
+	assert.Equal(t, []User{{ID: 1, Name: "Alice"}}, users)
+	assert.False(t, router.replicas[0].healthy.Load(), "a failed replica leaves the rotation")
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+}
+
+func TestReadFallsBackToPrimaryWhenReplicaTimesOut(t *testing.T) {
+	// Setup
+	s, router, primaryMock, replicaMock := newReplicaTestStore(t)
+	s.queryTimeout = 50 * time.Millisecond
+	router.replicas[0].healthy.Store(true)
+
+	// Mock DB response
+	replicaMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WithArgs(1).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "Alice"))
+	primaryMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "Alice"))
+
+	// Execute
+	user, err := s.GetUser(context.Background(), 1)
+
+	// Validate
+	assert.NoError(t, err, "the primary gets a timeout of its own")
+	assert.Equal(t, "Alice", user.Name)
+	assert.False(t, router.replicas[0].healthy.Load(), "a replica timing out leaves the rotation")
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+}
+
+func TestReadDoesNotRetryPastTheDeadlineOfTheCaller(t *testing.T) {
+	// Setup
+	s, router, primaryMock, replicaMock := newReplicaTestStore(t)
+	router.replicas[0].healthy.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Mock DB response
+	replicaMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WithArgs(1).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "Alice"))
+
+	// Execute
+	_, err := s.GetUser(ctx, 1)
+
+	// Validate
+	assert.ErrorIs(t, err, ErrStoreTimeout)
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+	assert.NoError(t, primaryMock.ExpectationsWereMet(), "the primary is not asked once the caller gave up")
+}
+
+func TestEachUserDoesNotRepeatRowsOnFallback(t *testing.T) {
+	// Setup
+	s, router, primaryMock, replicaMock := newReplicaTestStore(t)
+	router.replicas[0].healthy.Store(true)
+	refused := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}
+
+	// Mock DB response
+	replicaMock.ExpectQuery("SELECT id, name FROM users ORDER BY id").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "Alice").AddRow(2, "Bob").RowError(1, refused))
+
+	// Execute
+	var names []string
+	err := s.EachUser(context.Background(), func(user User) error {
+		names = append(names, user.Name)
+		return nil
+	})
+
+	// Validate
+	assert.ErrorIs(t, err, ErrStoreUnavailable)
+	assert.Equal(t, []string{"Alice"}, names)
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+}
+
+func TestCallerErrorsDoNotMarkReplicaDown(t *testing.T) {
+	// Setup
+	s, router, primaryMock, replicaMock := newReplicaTestStore(t)
+	router.replicas[0].healthy.Store(true)
+	brokenPipe := &net.OpError{Op: "write", Net: "tcp", Err: errors.New("broken pipe")}
+
+	// Mock DB response
+	replicaMock.ExpectQuery("SELECT id, name FROM users ORDER BY id").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "Alice").AddRow(2, "Bob"))
+
+	// Execute
+	err := s.EachUser(context.Background(), func(user User) error { return brokenPipe })
+
+	// Validate
+	assert.Equal(t, brokenPipe, err, "errors of the callback are passed on unchanged")
+	assert.True(t, router.replicas[0].healthy.Load(), "a client going away says nothing about the replica")
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+}
+
+func TestReadYourWrites(t *testing.T) {
+	// Setup
+	s, router, primaryMock, replicaMock := newReplicaTestStore(t)
+	router.replicas[0].healthy.Store(true)
+	now := time.Unix(0, 0)
+	router.now = func() time.Time { return now }
+	handler := router.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			_, err := s.CreateUser(r.Context(), User{Name: "Alice"})
+			assert.NoError(t, err)
+		}
+		_, err := s.GetUser(r.Context(), 1)
+		assert.NoError(t, err)
+	}))
+	serve := func(method, session string, header ...string) {
+		req := httptest.NewRequest(method, "/v1/users/1", strings.NewReader(""))
+		req.Header.Set(sessionHeader, session)
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	userRow := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "Alice") }
+
+	// Mock DB response
+	primaryMock.ExpectQuery("INSERT INTO users").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	primaryMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WillReturnRows(userRow()) // same request
+	primaryMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WillReturnRows(userRow()) // within the window
+	replicaMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WillReturnRows(userRow()) // other session
+	replicaMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WillReturnRows(userRow()) // window passed
+	primaryMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WillReturnRows(userRow()) // header
+
+	// Execute
+	serve("POST", "a")
+	now = now.Add(4 * time.Second)
+	serve("GET", "a")
+	serve("GET", "b")
+	now = now.Add(time.Second)
+	serve("GET", "a")
+	serve("GET", "b", consistencyHeader, "primary")
+
+	// Validate
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+}
+
+func TestMetricsReportReplicas(t *testing.T) {
+	// Setup
+	_, replicas, _, _ := newReplicaTestStore(t)
+	replicas.replicas[0].healthy.Store(true)
+	replicas.replicas[0].lag.Store(int64(250 * time.Millisecond))
+	server, _ := newTestServer(t, WithReplicas(replicas))
+	rr := httptest.NewRecorder()
+
+	// Execute
+	server.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	// Validate
+	assert.Contains(t, rr.Body.String(), `db_replica_healthy{replica="replica:5432"} 1`+"\n")
+	assert.Contains(t, rr.Body.String(), `db_replica_lag_seconds{replica="replica:5432"} 0.25`+"\n")
+}
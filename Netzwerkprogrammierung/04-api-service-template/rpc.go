@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// Error codes defined by the JSON-RPC 2.0 specification, plus the
+// implementation-defined server errors used by this service.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcForbidden      = -32001
+	rpcUnavailable    = -32003
+	rpcNotFound       = -32004
+	rpcTimeout        = -32005
+)
+
+// maxRPCBodySize bounds the size of a JSON-RPC request or batch.
+const maxRPCBodySize = 1 << 20
+
+// RPCError is a JSON-RPC error object. Method handlers return it to control
+// the code sent to the client; any other error becomes an internal error.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("JSON-RPC error %d: %s", e.Code, e.Message)
+}
+
+// RPCHandler implements one JSON-RPC method. params is the raw params member
+// of the request and is empty if it was omitted.
+type RPCHandler func(ctx context.Context, params json.RawMessage) (any, error)
+
+// rpcRequest is a single JSON-RPC request. ID is nil for notifications.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcResponse is a single JSON-RPC response.
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// RPCServer is a JSON-RPC 2.0 endpoint dispatching to registered methods.
+// Resources register their methods with Register, typically through
+// rpcMethod for typed parameters.
+type RPCServer struct {
+	logger *slog.Logger
+
+	mu      sync.RWMutex
+	methods map[string]RPCHandler
+}
+
+// NewRPCServer returns a server without methods, logging failed methods to
+// logger.
+func NewRPCServer(logger *slog.Logger) *RPCServer {
+	return &RPCServer{logger: logger, methods: make(map[string]RPCHandler)}
+}
+
+// Register adds a method. Registering a name twice panics.
+func (s *RPCServer) Register(name string, handler RPCHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.methods[name]; found {
+		panic(fmt.Sprintf("JSON-RPC method %q registered twice", name))
+	}
+	s.methods[name] = handler
+}
+
+// rpcMethod adapts a function with typed parameters to an RPCHandler.
+// Parameters are accepted by name, as a JSON object decoded into P; unknown
+// members are rejected.
+func rpcMethod[P any, R any](fn func(ctx context.Context, params P) (R, error)) RPCHandler {
+	return func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var params P
+		if len(raw) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&params); err != nil {
+				return nil, &RPCError{Code: rpcInvalidParams, Message: "Invalid params", Data: err.Error()}
+			}
+		}
+		return fn(ctx, params)
+	}
+}
+
+// ServeHTTP handles a POST of a single request or a batch.
+func (s *RPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRPCBodySize+1))
+	if err != nil || len(body) > maxRPCBodySize {
+		writeRPC(w, rpcResponse{JSONRPC: "2.0", Error: &RPCError{Code: rpcInvalidRequest, Message: "Invalid Request"}, ID: json.RawMessage("null")})
+		return
+	}
+	body = bytes.TrimSpace(body)
+
+	if len(body) == 0 || body[0] != '[' {
+		response, ok := s.handle(r.Context(), body)
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeRPC(w, response)
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		writeRPC(w, rpcResponse{JSONRPC: "2.0", Error: &RPCError{Code: rpcParseError, Message: "Parse error"}, ID: json.RawMessage("null")})
+		return
+	}
+	if len(batch) == 0 {
+		writeRPC(w, rpcResponse{JSONRPC: "2.0", Error: &RPCError{Code: rpcInvalidRequest, Message: "Invalid Request"}, ID: json.RawMessage("null")})
+		return
+	}
+
+	responses := make([]rpcResponse, 0, len(batch))
+	for _, raw := range batch {
+		if response, ok := s.handle(r.Context(), raw); ok {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		// A batch of notifications gets no response at all.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeRPC(w, responses)
+}
+
+// handle runs a single request. ok is false for notifications, which get no
+// response.
+func (s *RPCServer) handle(ctx context.Context, raw json.RawMessage) (response rpcResponse, ok bool) {
+	response = rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null")}
+
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) || !json.Valid(raw) {
+			response.Error = &RPCError{Code: rpcParseError, Message: "Parse error"}
+		} else {
+			response.Error = &RPCError{Code: rpcInvalidRequest, Message: "Invalid Request"}
+		}
+		return response, true
+	}
+	if req.ID != nil {
+		response.ID = req.ID
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" || !validRPCID(req.ID) {
+		response.Error = &RPCError{Code: rpcInvalidRequest, Message: "Invalid Request"}
+		return response, true
+	}
+
+	s.mu.RLock()
+	handler, found := s.methods[req.Method]
+	s.mu.RUnlock()
+	notification := req.ID == nil
+	if !found {
+		response.Error = &RPCError{Code: rpcMethodNotFound, Message: "Method not found", Data: req.Method}
+		return response, !notification
+	}
+
+	result, err := s.call(ctx, handler, req.Params)
+	if err != nil {
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) {
+			s.logger.Error("JSON-RPC method failed", "method", req.Method, "error", err)
+			rpcErr = &RPCError{Code: rpcInternalError, Message: "Internal error"}
+		}
+		response.Error = rpcErr
+		return response, !notification
+	}
+
+	response.Result, err = json.Marshal(result)
+	if err != nil {
+		response.Result = nil
+		response.Error = &RPCError{Code: rpcInternalError, Message: "Internal error"}
+	}
+	return response, !notification
+}
+
+// call invokes handler, turning a panic into an internal error.
+func (s *RPCServer) call(ctx context.Context, handler RPCHandler, params json.RawMessage) (result any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return handler(ctx, params)
+}
+
+// validRPCID reports whether id is absent, a string, a number or null.
+func validRPCID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	default:
+		return false
+	}
+}
+
+// writeRPC writes a response or batch of responses.
+func writeRPC(w http.ResponseWriter, v any) {
+	response, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// rpcUserError maps business layer errors to JSON-RPC errors.
+func rpcUserError(err error) error {
+	var validationErr *ValidationError
+	var permissionErr *PermissionError
+	switch {
+	case errors.As(err, &validationErr):
+		return &RPCError{Code: rpcInvalidParams, Message: "Invalid params", Data: validationErr}
+	case errors.As(err, &permissionErr):
+		return &RPCError{Code: rpcForbidden, Message: "Permission denied", Data: map[string]string{"missing_permission": permissionErr.Permission}}
+	case errors.Is(err, ErrUserNotFound):
+		return &RPCError{Code: rpcNotFound, Message: "User not found"}
+	case errors.Is(err, ErrStoreTimeout):
+		return &RPCError{Code: rpcTimeout, Message: "Database operation timed out"}
+	case errors.Is(err, ErrStoreUnavailable):
+		return &RPCError{Code: rpcUnavailable, Message: "Database unavailable"}
+	default:
+		return err
+	}
+}
+
+// userIDParams are the params of users.get and users.delete.
+type userIDParams struct {
+	ID int `json:"id"`
+}
+
+// registerUserMethods exposes the users business layer as users.* methods.
+func registerUserMethods(s *RPCServer, users *userService) {
+	s.Register("users.list", rpcMethod(func(ctx context.Context, _ struct{}) ([]User, error) {
+		list := []User{}
+		err := users.listUsers(ctx, func(user User) error {
+			list = append(list, user)
+			return nil
+		})
+		return list, rpcUserError(err)
+	}))
+	s.Register("users.get", rpcMethod(func(ctx context.Context, params userIDParams) (User, error) {
+		user, err := users.findUser(ctx, params.ID)
+		return user, rpcUserError(err)
+	}))
+	s.Register("users.create", rpcMethod(func(ctx context.Context, params User) (User, error) {
+		user, err := users.addUser(ctx, params)
+		return user, rpcUserError(err)
+	}))
+	s.Register("users.update", rpcMethod(func(ctx context.Context, params User) (User, error) {
+		return params, rpcUserError(users.saveUser(ctx, params))
+	}))
+	s.Register("users.delete", rpcMethod(func(ctx context.Context, params userIDParams) (any, error) {
+		return nil, rpcUserError(users.removeUser(ctx, params.ID))
+	}))
+}
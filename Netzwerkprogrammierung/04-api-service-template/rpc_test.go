@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postRPC(t *testing.T, handler http.Handler, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/rpc", bytes.NewBufferString(body))
+	assert.NoError(t, err)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRPCUserMethods(t *testing.T) {
+	// Setup
+	server := NewServer()
+
+	// Execute
+	created := postRPC(t, server, `{"jsonrpc":"2.0","method":"users.create","params":{"name":"John Doe"},"id":1}`)
+	updated := postRPC(t, server, `{"jsonrpc":"2.0","method":"users.update","params":{"id":1,"name":"Jane Doe"},"id":"two"}`)
+	fetched := postRPC(t, server, `{"jsonrpc":"2.0","method":"users.get","params":{"id":1},"id":3}`)
+	deleted := postRPC(t, server, `{"jsonrpc":"2.0","method":"users.delete","params":{"id":1},"id":4}`)
+	missing := postRPC(t, server, `{"jsonrpc":"2.0","method":"users.get","params":{"id":1},"id":5}`)
+
+	// Validate
+	assert.JSONEq(t, `{"jsonrpc":"2.0","result":{"id":1,"name":"John Doe"},"id":1}`, created.Body.String())
+	assert.JSONEq(t, `{"jsonrpc":"2.0","result":{"id":1,"name":"Jane Doe"},"id":"two"}`, updated.Body.String())
+	assert.JSONEq(t, `{"jsonrpc":"2.0","result":{"id":1,"name":"Jane Doe"},"id":3}`, fetched.Body.String())
+	assert.JSONEq(t, `{"jsonrpc":"2.0","result":null,"id":4}`, deleted.Body.String())
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32004,"message":"User not found"},"id":5}`, missing.Body.String())
+}
+
+func TestRPCBatch(t *testing.T) {
+	// Setup
+	server := NewServer()
+	body := `[
+		{"jsonrpc":"2.0","method":"users.create","params":{"name":"John Doe"}},
+		{"jsonrpc":"2.0","method":"users.list","id":1},
+		{"jsonrpc":"2.0","method":"users.create","params":{"name":""},"id":2},
+		{"jsonrpc":"2.0","method":"users.get","params":{"id":"1"},"id":3},
+		{"jsonrpc":"2.0","method":"users.rename","id":4},
+		{"jsonrpc":"1.0","method":"users.list","id":5},
+		42
+	]`
+
+	// Execute
+	rr := postRPC(t, server, body)
+	var responses []rpcResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &responses)
+
+	// Validate
+	assert.NoError(t, err)
+	if assert.Len(t, responses, 6) {
+		assert.JSONEq(t, `[{"id":1,"name":"John Doe"}]`, string(responses[0].Result))
+		assert.Equal(t, rpcInvalidParams, responses[1].Error.Code)
+		assert.Equal(t, map[string]any{"field": "name", "message": "name is required"}, responses[1].Error.Data)
+		assert.Equal(t, rpcInvalidParams, responses[2].Error.Code)
+		assert.Equal(t, rpcMethodNotFound, responses[3].Error.Code)
+		assert.Equal(t, rpcInvalidRequest, responses[4].Error.Code)
+		assert.Equal(t, rpcInvalidRequest, responses[5].Error.Code)
+		assert.Equal(t, "null", string(responses[5].ID))
+	}
+}
+
+func TestRPCNotificationsAndMalformedRequests(t *testing.T) {
+	// Setup
+	server := NewServer()
+
+	// Execute
+	notification := postRPC(t, server, `{"jsonrpc":"2.0","method":"users.create","params":{"name":"John Doe"}}`)
+	notifications := postRPC(t, server, `[{"jsonrpc":"2.0","method":"users.list"},{"jsonrpc":"2.0","method":"unknown"}]`)
+	malformed := postRPC(t, server, `{"jsonrpc":"2.0","method":`)
+	empty := postRPC(t, server, `[]`)
+
+	// Validate
+	assert.Equal(t, http.StatusNoContent, notification.Code)
+	assert.Equal(t, http.StatusNoContent, notifications.Code)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`, malformed.Body.String())
+	assert.JSONEq(t, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`, empty.Body.String())
+	exists, _ := server.store.UserExists(context.Background(), 1)
+	assert.True(t, exists)
+}
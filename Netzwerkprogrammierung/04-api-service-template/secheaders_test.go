@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	// Setup
+	headers := NewSecurityHeaders("", "", 365*24*time.Hour)
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	r := mux.NewRouter()
+	r.HandleFunc("/plain", ok)
+	headers.Override(r.HandleFunc("/docs", ok), http.Header{
+		"Content-Security-Policy": {"default-src 'self'"},
+		"X-Frame-Options":         {""},
+	})
+	r.Use(headers.Middleware)
+	serve := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	// Execute
+	plain := serve("/plain")
+	docs := serve("/docs")
+
+	// Validate
+	assert.Equal(t, defaultContentSecurityPolicy, plain.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "nosniff", plain.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "no-referrer", plain.Header().Get("Referrer-Policy"))
+	assert.Equal(t, "DENY", plain.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "max-age=31536000; includeSubDomains", plain.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "default-src 'self'", docs.Header().Get("Content-Security-Policy"))
+	assert.Empty(t, docs.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "nosniff", docs.Header().Get("X-Content-Type-Options"), "other defaults still apply")
+}
+
+func TestSecurityHeadersWithoutHSTS(t *testing.T) {
+	// Setup
+	headers := NewSecurityHeaders("default-src 'self'", "same-origin", 0)
+	rr := httptest.NewRecorder()
+
+	// Execute
+	headers.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	// Validate
+	assert.Empty(t, rr.Header().Get("Strict-Transport-Security"))
+	assert.Equal(t, "default-src 'self'", rr.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "same-origin", rr.Header().Get("Referrer-Policy"))
+}
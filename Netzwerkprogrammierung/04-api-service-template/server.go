@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Server is one instance of the API service. It owns its router and all of
+// its state, so that several isolated instances can run in one process and
+// the service can be embedded into other binaries. Requests are served
+// through ServeHTTP; Run does the background work.
+type Server struct {
+	db            *sql.DB // nil without PostgreSQL
+	store         UserStore
+	users         *userService
+	queryTimeout  time.Duration
+	streamTimeout time.Duration
+	breaker       *CircuitBreaker // nil without PostgreSQL
+	replicas      *ReplicaRouter  // nil without read replicas
+	listen        bool            // whether the users table trigger announces changes
+	outbox        bool
+	outboxPoll    time.Duration
+	outboxRetain  time.Duration
+	relay         *OutboxRelay // nil unless events are relayed from the outbox
+
+	cache            *ResponseCache
+	invalidator      *CacheInvalidator
+	cacheEnabled     atomic.Bool // switched at runtime through the admin API
+	rateLimits       *RateLimits
+	bulkLimiter      Limiter
+	bulkRoutes       []*mux.Route
+	rateLimitEnabled atomic.Bool
+	dailyQuota       int64
+	monthlyQuota     int64
+	quotas           *Quotas // nil without quotas
+	idempotency      *IdempotencyStore
+
+	webhooks      *WebhookDispatcher
+	changes       *ChangeBroker
+	sseHeartbeat  time.Duration
+	graphQLDepth  int
+	graphQLCost   int
+	tenancy       *TenantResolver // nil unless tenancy is enabled
+	jwtSecret     []byte          // enables access control if set
+	rbacAdmins    []string
+	authenticator *Authenticator // nil without access control
+	policy        *Policy        // nil without access control; Require is a no-op then
+	roles         RoleStore
+	apiKeys       APIKeyStore
+	loginEnabled  bool
+	accessTTL     time.Duration
+	refreshTTL    time.Duration
+	passwordCost  int
+	// dummyPasswordHash is checked for unknown emails, so that they take
+	// as long to reject as wrong passwords.
+	dummyPasswordHash  []byte
+	credentials        CredentialStore // nil unless users can log in
+	sessions           SessionStore    // nil unless users can log in
+	loginGuardSettings LoginGuardSettings
+	loginGuard         *LoginGuard // nil unless users can log in
+
+	securityHeaders *SecurityHeaders
+	cors            *CORS // nil unless cross-origin requests are allowed
+	adminToken      string
+	audit           *slog.Logger
+	admin           *AdminAPI // nil without an admin token
+
+	logger   *slog.Logger
+	logLevel *slog.LevelVar // nil if the level cannot be changed at runtime
+	now      func() time.Time
+	handler  http.Handler
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithDatabase keeps users, roles, API keys, quotas, webhooks and failed
+// logins in PostgreSQL and shares user changes and cache invalidations with
+// the other instances through it.
+func WithDatabase(db *sql.DB) Option {
+	return func(s *Server) { s.db = db }
+}
+
+// WithStore keeps users in store instead of PostgreSQL or process memory.
+// The server publishes its changes.
+func WithStore(store UserStore) Option {
+	return func(s *Server) { s.store = store }
+}
+
+// WithQueryTimeouts bounds single database operations and streamed reads.
+func WithQueryTimeouts(query, stream time.Duration) Option {
+	return func(s *Server) { s.queryTimeout, s.streamTimeout = query, stream }
+}
+
+// WithReplicas sends reads to replicas where the consistency of the request
+// allows. The caller closes the router.
+func WithReplicas(replicas *ReplicaRouter) Option {
+	return func(s *Server) { s.replicas = replicas }
+}
+
+// WithCircuitBreaker fails database operations fast through breaker while
+// the database is down.
+func WithCircuitBreaker(breaker *CircuitBreaker) Option {
+	return func(s *Server) { s.breaker = breaker }
+}
+
+// WithOutbox writes user events with every change and relays them to the
+// webhooks, polling every poll and keeping relayed events for retain.
+func WithOutbox(poll, retain time.Duration) Option {
+	return func(s *Server) { s.outbox, s.outboxPoll, s.outboxRetain = true, poll, retain }
+}
+
+// WithCache answers v1 reads from cache. enabled tells whether it is used
+// from the start; the admin API switches it at runtime.
+func WithCache(cache *ResponseCache, enabled bool) Option {
+	return func(s *Server) {
+		s.cache = cache
+		s.cacheEnabled.Store(enabled)
+	}
+}
+
+// WithLimiter limits the rate of requests of every client with limiter.
+// enabled tells whether it is applied from the start; the admin API
+// switches it at runtime.
+func WithLimiter(limiter Limiter, enabled bool) Option {
+	return func(s *Server) {
+		s.rateLimits = NewRateLimits(limiter)
+		s.rateLimitEnabled.Store(enabled)
+	}
+}
+
+// WithBulkLimiter limits user exports and imports with limiter instead of
+// the limiter of the other routes.
+func WithBulkLimiter(limiter Limiter) Option {
+	return func(s *Server) { s.bulkLimiter = limiter }
+}
+
+// WithQuotas limits the requests of every API key per day and per month. A
+// limit of zero disables the period.
+func WithQuotas(daily, monthly int64) Option {
+	return func(s *Server) { s.dailyQuota, s.monthlyQuota = daily, monthly }
+}
+
+// WithIdempotency keeps the responses of requests with an Idempotency-Key
+// for ttl and lets duplicates wait up to wait for the first request.
+func WithIdempotency(ttl, wait time.Duration) Option {
+	return func(s *Server) { s.idempotency = NewIdempotencyStore(ttl, wait) }
+}
+
+// WithEventStream sends a heartbeat to event stream clients every interval.
+// An interval that is not positive sends none.
+func WithEventStream(heartbeat time.Duration) Option {
+	return func(s *Server) { s.sseHeartbeat = heartbeat }
+}
+
+// WithGraphQLLimits rejects GraphQL queries deeper than maxDepth or
+// resolving more than maxComplexity users and mutations.
+func WithGraphQLLimits(maxDepth, maxComplexity int) Option {
+	return func(s *Server) { s.graphQLDepth, s.graphQLCost = maxDepth, maxComplexity }
+}
+
+// WithTenancy scopes every request to the tenant resolver determines.
+func WithTenancy(resolver *TenantResolver) Option {
+	return func(s *Server) { s.tenancy = resolver }
+}
+
+// WithAccessControl requires bearer tokens signed with secret or API keys
+// and enforces the roles of their principals. The admins, given as
+// tenant/subject or as a subject of the default tenant, always hold the
+// admin role in their tenant.
+func WithAccessControl(secret []byte, admins []string) Option {
+	return func(s *Server) { s.jwtSecret, s.rbacAdmins = secret, admins }
+}
+
+// WithLogin lets users log in with their email and password. Access tokens
+// are valid for accessTTL, refresh tokens for refreshTTL after their last
+// use; passwords are hashed with the bcrypt cost passwordCost. The tokens
+// are signed with the secret of WithAccessControl, without which users
+// cannot log in.
+func WithLogin(accessTTL, refreshTTL time.Duration, passwordCost int) Option {
+	return func(s *Server) {
+		s.loginEnabled, s.accessTTL, s.refreshTTL, s.passwordCost = true, accessTTL, refreshTTL, passwordCost
+	}
+}
+
+// WithLoginGuard protects the login against guessing passwords with
+// settings instead of the defaults.
+func WithLoginGuard(settings LoginGuardSettings) Option {
+	return func(s *Server) { s.loginGuardSettings = settings }
+}
+
+// WithSecurityHeaders sends headers with every response.
+func WithSecurityHeaders(headers *SecurityHeaders) Option {
+	return func(s *Server) { s.securityHeaders = headers }
+}
+
+// WithCORS allows the cross-origin requests cors permits.
+func WithCORS(cors *CORS) Option {
+	return func(s *Server) { s.cors = cors }
+}
+
+// WithAdmin serves the admin API to operators presenting token and writes
+// their actions to audit, or to the logger of the server if audit is nil.
+func WithAdmin(token string, audit *slog.Logger) Option {
+	return func(s *Server) { s.adminToken, s.audit = token, audit }
+}
+
+// WithLogger logs to logger. If level is not nil it is the level of logger,
+// which the admin API then adjusts.
+func WithLogger(logger *slog.Logger, level *slog.LevelVar) Option {
+	return func(s *Server) { s.logger, s.logLevel = logger, level }
+}
+
+// WithClock reads the time from now, for the server and the components it
+// builds.
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) { s.now = now }
+}
+
+// NewServer returns a server configured by options. Without options it
+// keeps everything in process memory, with caching and rate limiting
+// switched off.
+func NewServer(options ...Option) *Server {
+	s := &Server{
+		queryTimeout:       5 * time.Second,
+		streamTimeout:      5 * time.Minute,
+		cache:              NewResponseCache(10*time.Second, 2*time.Second, 1<<20, 64),
+		rateLimits:         NewRateLimits(NewTokenBucketLimiter(1, time.Second, 3)), // 1 request per second and client, burst size of 3
+		bulkLimiter:        NewSlidingLogLimiter(5, time.Minute),
+		idempotency:        NewIdempotencyStore(24*time.Hour, 2*time.Second),
+		webhooks:           NewWebhookDispatcher(newWebhookClient(10*time.Second), 8, 20, 5*time.Second, time.Hour),
+		changes:            NewChangeBroker(1024, 64), // remembers 1024 events, buffers 64 per client
+		sseHeartbeat:       15 * time.Second,
+		graphQLDepth:       15,
+		graphQLCost:        1000,
+		roles:              newMemoryRoleStore(),
+		apiKeys:            newMemoryAPIKeyStore(),
+		securityHeaders:    NewSecurityHeaders("", "", 365*24*time.Hour),
+		loginGuardSettings: defaultLoginGuardSettings,
+		logger:             slog.Default(),
+		now:                time.Now,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	s.idempotency.now, s.idempotency.logger = s.now, s.logger
+
+	s.webhooks.logger, s.webhooks.now = s.logger, s.now
+	if s.replicas != nil {
+		s.replicas.logger = s.logger
+	}
+	if s.db != nil {
+		// All tables share the breaker, as they share the database.
+		if s.breaker == nil {
+			s.breaker = NewCircuitBreaker(5, 10*time.Second)
+		}
+		s.breaker.logger = s.logger
+		s.apiKeys = &breakerAPIKeyStore{next: newSQLAPIKeyStore(s.db), breaker: s.breaker}
+		s.webhooks.store = &breakerWebhookStore{next: newSQLWebhookStore(s.db), breaker: s.breaker}
+	}
+	if s.store == nil {
+		s.store = s.newUserStore()
+	} else {
+		s.store = newEventingStore(s.store, s.publishEvent)
+	}
+
+	// Writes on any instance invalidate the caches of all instances.
+	var bus InvalidationBus = newMemoryInvalidationBus()
+	if s.db != nil {
+		bus = &breakerInvalidationBus{next: newPGInvalidationBus(s.db, s.logger), breaker: s.breaker}
+	}
+	s.invalidator = NewCacheInvalidator(s.cache, bus, s.logger)
+	s.users = &userService{store: s.store, invalidator: s.invalidator}
+
+	if s.dailyQuota > 0 || s.monthlyQuota > 0 {
+		var quotaStore QuotaStore = newMemoryQuotaStore()
+		if s.db != nil {
+			quotaStore = &breakerQuotaStore{next: newSQLQuotaStore(s.db), breaker: s.breaker}
+		}
+		s.quotas = NewQuotas(quotaStore, s.dailyQuota, s.monthlyQuota)
+		s.quotas.now, s.quotas.logger = s.now, s.logger
+	}
+	if len(s.jwtSecret) > 0 {
+		if s.db != nil {
+			s.roles = &breakerRoleStore{next: newSQLRoleStore(s.db), breaker: s.breaker}
+		}
+		s.authenticator = NewAuthenticator(s.jwtSecret)
+		s.authenticator.now = s.now
+		s.policy = NewPolicy(s.roles, s.rbacAdmins)
+		if s.loginEnabled {
+			s.credentials, s.sessions = newMemoryCredentialStore(s.store), newMemorySessionStore(s.store)
+			if s.db != nil {
+				credentials := newSQLCredentialStore(s.db)
+				credentials.users.queryTimeout = s.queryTimeout
+				s.credentials = &breakerCredentialStore{next: credentials, breaker: s.breaker}
+				s.sessions = &breakerSessionStore{next: newSQLSessionStore(s.db), breaker: s.breaker}
+			}
+			s.authenticator.sessions = s.sessions
+			s.dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("no password"), s.passwordCost)
+			var guardStore LoginGuardStore = newMemoryLoginGuardStore()
+			if s.db != nil {
+				guardStore = &breakerLoginGuardStore{next: newSQLLoginGuardStore(s.db), breaker: s.breaker}
+			}
+			s.loginGuard = NewLoginGuard(s.loginGuardSettings, s.jwtSecret, guardStore)
+			s.loginGuard.now = s.now
+		}
+	}
+	if s.adminToken != "" {
+		if s.audit == nil {
+			s.audit = s.logger
+		}
+		s.admin = NewAdminAPI(s, s.adminToken, s.audit)
+	}
+	s.handler = s.routes()
+	return s
+}
+
+// newUserStore returns the store of users: PostgreSQL if the server has a
+// database, process memory otherwise.
+func (s *Server) newUserStore() UserStore {
+	if s.db == nil {
+		// Without PostgreSQL there is no trigger announcing changes, so
+		// the store publishes them to the event stream itself.
+		var memory UserStore = newMemoryStore()
+		if s.tenancy != nil {
+			memory = newTenantMemoryStore()
+		}
+		return newEventingStore(memory, s.publishEvent)
+	}
+
+	sqlStore := newSQLStore(s.db)
+	sqlStore.queryTimeout = s.queryTimeout
+	sqlStore.streamTimeout = s.streamTimeout
+	sqlStore.replicas = s.replicas
+	guarded := newBreakerStore(sqlStore, s.breaker)
+	s.listen = true
+	if s.outbox {
+		// Events are written with the mutation and relayed from the
+		// outbox instead of being emitted next to the SQL write.
+		sqlStore.outbox = true
+		s.relay = NewOutboxRelay(s.db, PublisherFunc(s.webhooks.Deliver), s.outboxPoll, s.outboxRetain)
+		s.relay.logger = s.logger
+		return guarded
+	}
+	return newEventingStore(guarded, s.webhooks.Publish)
+}
+
+// publishEvent sends a user event to the webhooks and the event stream.
+func (s *Server) publishEvent(event UserEvent) {
+	s.webhooks.Publish(event)
+	s.changes.Publish(event)
+}
+
+// routes returns the handler of all endpoints.
+func (s *Server) routes() http.Handler {
+	policy := s.policy
+	r := mux.NewRouter()
+	r.Use(s.securityHeaders.Middleware)
+	r.HandleFunc("/healthz", liveness).Methods("GET")
+	r.HandleFunc("/readyz", s.readiness).Methods("GET")
+	r.HandleFunc("/metrics", s.metrics).Methods("GET")
+	if s.replicas != nil {
+		r.Use(s.replicas.Middleware)
+	}
+
+	// Logging in and refreshing happen before the client has an access
+	// token, so these routes are registered ahead of the authenticated v1
+	// routes. Their responses carry tokens and are never cached.
+	if s.sessions != nil {
+		public := r.NewRoute().Subrouter()
+		public.HandleFunc("/v1/auth/login", s.login).Methods("POST")
+		public.HandleFunc("/v1/auth/refresh", s.refreshSession).Methods("POST")
+		public.HandleFunc("/v1/auth/logout", s.logout).Methods("POST")
+		if s.tenancy != nil {
+			public.Use(s.tenancy.Middleware)
+		}
+		public.Use(toggled(&s.rateLimitEnabled, s.rateLimits.Middleware))
+	}
+
+	v1 := r.PathPrefix("/v1").Subrouter()
+	policy.Require(v1.HandleFunc("/users", s.getUsersV1).Methods("GET"), permUsersRead)
+	policy.Require(v1.HandleFunc("/users", s.createUser).Methods("POST"), permUsersWrite)
+	// Bulk transfers are costly, so they are limited more strictly. Exports
+	// exceed any cacheable size and are streamed past the cache.
+	s.bulkRoutes = []*mux.Route{
+		s.cache.Bypass(policy.Require(v1.HandleFunc("/users/export", s.exportUsers).Methods("GET"), permUsersRead)),
+		policy.Require(v1.HandleFunc("/users/import", s.importUsers).Methods("POST"), permUsersWrite),
+	}
+	for _, route := range s.bulkRoutes {
+		s.rateLimits.Limit(route, s.bulkLimiter)
+	}
+	s.cache.Bypass(policy.Require(v1.HandleFunc("/users/events", s.streamUserEvents).Methods("GET"), permUsersRead))
+	policy.Require(v1.HandleFunc("/users/{id}", s.getUser).Methods("GET"), permUsersRead)
+	policy.Require(v1.HandleFunc("/users/{id}", s.updateUser).Methods("PUT"), permUsersWrite)
+	policy.Require(v1.HandleFunc("/users/{id}", s.deleteUser).Methods("DELETE"), permUsersWrite)
+	// Administrative responses carry webhook settings, key metadata and
+	// secrets; neither the response cache nor browsers may keep them.
+	noStore := http.Header{"Cache-Control": {"no-store"}}
+	admin := func(route *mux.Route) {
+		s.securityHeaders.Override(policy.Require(route, permUsersAdmin), noStore)
+	}
+	admin(v1.HandleFunc("/webhooks", s.listWebhooks).Methods("GET"))
+	admin(v1.HandleFunc("/webhooks", s.createWebhook).Methods("POST"))
+	admin(v1.HandleFunc("/webhooks/{id}", s.getWebhook).Methods("GET"))
+	admin(v1.HandleFunc("/webhooks/{id}", s.updateWebhook).Methods("PUT"))
+	admin(v1.HandleFunc("/webhooks/{id}", s.deleteWebhook).Methods("DELETE"))
+	admin(v1.HandleFunc("/webhooks/{id}/deliveries", s.listWebhookDeliveries).Methods("GET"))
+	admin(v1.HandleFunc("/webhooks/{id}/deliveries/{deliveryID}/redeliver", s.redeliverWebhook).Methods("POST"))
+	admin(v1.HandleFunc("/api-keys", s.listAPIKeys).Methods("GET"))
+	admin(v1.HandleFunc("/api-keys", s.createAPIKey).Methods("POST"))
+	admin(v1.HandleFunc("/api-keys/{id}", s.getAPIKey).Methods("GET"))
+	admin(v1.HandleFunc("/api-keys/{id}", s.revokeAPIKey).Methods("DELETE"))
+	admin(v1.HandleFunc("/api-keys/{id}/rotate", s.rotateAPIKey).Methods("POST"))
+	admin(v1.HandleFunc("/admin/roles", listRoles).Methods("GET"))
+	admin(v1.HandleFunc("/admin/principals/{principal}/roles", s.getPrincipalRoles).Methods("GET"))
+	admin(v1.HandleFunc("/admin/principals/{principal}/roles/{role}", s.grantRole).Methods("PUT"))
+	admin(v1.HandleFunc("/admin/principals/{principal}/roles/{role}", s.revokeRole).Methods("DELETE"))
+	if s.sessions != nil {
+		// Sessions are listed per user, so they must not be cached per
+		// tenant either.
+		s.securityHeaders.Override(policy.Require(v1.HandleFunc("/auth/sessions", s.listOwnSessions).Methods("GET")), noStore)
+		s.securityHeaders.Override(policy.Require(v1.HandleFunc("/auth/sessions/{id}", s.terminateOwnSession).Methods("DELETE")), noStore)
+		admin(v1.HandleFunc("/users/{id}/credentials", s.setCredentials).Methods("PUT"))
+		admin(v1.HandleFunc("/users/{id}/sessions", s.listUserSessions).Methods("GET"))
+		admin(v1.HandleFunc("/users/{id}/sessions", s.terminateUserSessions).Methods("DELETE"))
+		admin(v1.HandleFunc("/users/{id}/sessions/{sessionID}", s.terminateUserSession).Methods("DELETE"))
+	}
+
+	// The caller and tenant must be known and authorized before the cache
+	// and the idempotency store look up responses, as both are scoped to
+	// the tenant and would otherwise answer requests the policy denies.
+	// API keys are checked first; the authenticator accepts their principal.
+	v1.Use(s.apiKeyMiddleware)
+	if s.authenticator != nil {
+		v1.Use(s.authenticator.Middleware)
+	}
+	if s.tenancy != nil {
+		v1.Use(s.tenancy.Middleware)
+	}
+	if policy != nil {
+		v1.Use(policy.Middleware)
+	}
+	// The cache and the rate limits can be switched on and off at runtime.
+	// Invalidations are applied while the cache is off, so that it holds
+	// no outdated responses when it is switched back on.
+	v1.Use(toggled(&s.cacheEnabled, s.cache.Middleware))
+	v1.Use(toggled(&s.rateLimitEnabled, s.rateLimits.Middleware))
+	if s.quotas != nil {
+		v1.Use(s.quotas.Middleware)
+	}
+	v1.Use(s.idempotency.Middleware)
+
+	// JSON-RPC and GraphQL serve everything from a single endpoint each, so
+	// the response cache of v1 does not apply to them.
+	rpcServer := NewRPCServer(s.logger)
+	registerUserMethods(rpcServer, s.users)
+	graphQL := NewGraphQLServer(s.users, s.logger, s.graphQLDepth, s.graphQLCost)
+	// Their operations are authorized one by one in the business layer.
+	rpc := r.NewRoute().Subrouter()
+	policy.Require(rpc.Handle("/rpc", rpcServer).Methods("POST"))
+	policy.Require(rpc.Handle("/graphql", graphQL).Methods("GET", "POST"))
+	rpc.Use(s.apiKeyMiddleware)
+	if s.authenticator != nil {
+		rpc.Use(s.authenticator.Middleware)
+	}
+	if s.tenancy != nil {
+		rpc.Use(s.tenancy.Middleware)
+	}
+	if policy != nil {
+		rpc.Use(policy.Middleware)
+	}
+	rpc.Use(toggled(&s.rateLimitEnabled, s.rateLimits.Middleware))
+	if s.quotas != nil {
+		rpc.Use(s.quotas.Middleware)
+	}
+
+	if s.admin != nil {
+		s.admin.Register(r)
+	}
+
+	// Preflight requests are answered before routing, as no route accepts
+	// OPTIONS.
+	if s.cors != nil {
+		return s.cors.Handler(r)
+	}
+	return r
+}
+
+// ServeHTTP serves a request with the routes of the server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Run does the background work of the server until ctx is cancelled:
+// delivering webhooks, exchanging cache invalidations, checking replicas,
+// relaying the outbox, deleting expired sessions and quota counts and
+// listening for user changes.
+func (s *Server) Run(ctx context.Context) {
+	s.webhooks.Start(4)
+	defer s.webhooks.Stop()
+
+	go s.invalidator.Run(ctx)
+	if s.replicas != nil {
+		go s.replicas.Run(ctx)
+	}
+	if s.relay != nil {
+		go s.relay.Run(ctx)
+	}
+	if s.sessions != nil {
+		go s.expireSessions(ctx)
+	}
+	if s.loginGuard != nil {
+		go s.cleanLoginGuard(ctx)
+	}
+	if s.quotas != nil {
+		go s.cleanQuotas(ctx)
+	}
+	if s.listen {
+		go listenLoop(ctx, s.db, s.logger, userChangesChannel, s.publishUserChange, nil)
+	}
+	<-ctx.Done()
+}
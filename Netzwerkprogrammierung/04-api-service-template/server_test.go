@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer returns a server keeping its data in a mocked database,
+// together with the mock.
+func newTestServer(t *testing.T, options ...Option) (*Server, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewServer(append([]Option{WithDatabase(db)}, options...)...), mock
+}
+
+// serve sends a request to handler and returns the response.
+func serve(handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rr
+}
+
+func TestServersAreIsolated(t *testing.T) {
+	// Setup
+	first, second := NewServer(), NewServer()
+
+	// Execute
+	created := serve(first, "POST", "/v1/users", `{"name":"John Doe"}`)
+	inFirst := serve(first, "GET", "/v1/users/1", "")
+	inSecond := serve(second, "GET", "/v1/users/1", "")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, created.Code)
+	assert.Equal(t, http.StatusOK, inFirst.Code)
+	assert.Equal(t, http.StatusNotFound, inSecond.Code)
+}
+
+func TestServerOptions(t *testing.T) {
+	// Setup
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	server := NewServer(
+		WithClock(func() time.Time { return now }),
+		WithLimiter(NewTokenBucketLimiter(1, time.Minute, 1), true),
+		WithAdmin("secret", nil),
+	)
+	settings := httptest.NewRequest("GET", "/admin/settings", nil)
+	settings.Header.Set("Authorization", "Bearer secret")
+
+	// Execute
+	first := serve(server, "GET", "/v1/users", "")
+	second := serve(server, "GET", "/v1/users", "")
+	admin := httptest.NewRecorder()
+	server.ServeHTTP(admin, settings)
+
+	// Validate
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, http.StatusTooManyRequests, second.Code)
+	assert.Equal(t, http.StatusOK, admin.Code)
+	var body adminSettings
+	assert.NoError(t, json.Unmarshal(admin.Body.Bytes(), &body))
+	assert.True(t, *body.RateLimitEnabled)
+	assert.Nil(t, body.RateLimit, "the limiter was not built from settings")
+	assert.Nil(t, body.LogLevel, "the server has no adjustable log level")
+}
+
+func TestServerRunStopsWithContext(t *testing.T) {
+	// Setup
+	server := NewServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	// Execute
+	go func() {
+		server.Run(ctx)
+		close(done)
+	}()
+	cancel()
+
+	// Validate
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+}
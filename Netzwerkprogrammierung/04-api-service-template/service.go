@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// maxNameLength matches the size of the users.name column.
+const maxNameLength = 100
+
+// ValidationError reports input breaking a business rule for users.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// validateUser checks a user before it is written.
+func validateUser(user User) error {
+	if user.ID < 0 {
+		return &ValidationError{Field: "id", Message: "id must be positive"}
+	}
+	if strings.TrimSpace(user.Name) == "" {
+		return &ValidationError{Field: "name", Message: "name is required"}
+	}
+	if len([]rune(user.Name)) > maxNameLength {
+		return &ValidationError{Field: "name", Message: fmt.Sprintf("name exceeds %d characters", maxNameLength)}
+	}
+	return nil
+}
+
+// userService is the business layer for users. The REST, bulk, JSON-RPC and
+// GraphQL handlers go through it rather than using the store directly, so
+// that every API applies the same rules and permissions. Only the v1 REST
+// API writes users without validating them, as it always did.
+type userService struct {
+	store       UserStore
+	invalidator *CacheInvalidator // nil without a response cache
+}
+
+// usersChanged drops the cached user responses of the tenant of ctx on all
+// instances after a successful write.
+func (u *userService) usersChanged(ctx context.Context, err error) {
+	if err == nil {
+		u.invalidator.Invalidate(cachePrefix(ctx, "/v1/users"))
+	}
+}
+
+// listUsers calls fn for every user in ascending id order.
+func (u *userService) listUsers(ctx context.Context, fn func(User) error) error {
+	if err := authorize(ctx, permUsersRead); err != nil {
+		return err
+	}
+	return u.store.EachUser(ctx, fn)
+}
+
+// findUser returns the user with the given id or ErrUserNotFound.
+func (u *userService) findUser(ctx context.Context, id int) (User, error) {
+	if err := authorize(ctx, permUsersRead); err != nil {
+		return User{}, err
+	}
+	return u.store.GetUser(ctx, id)
+}
+
+// findUsers returns the users with the given ids in ascending id order,
+// skipping ids without a user.
+func (u *userService) findUsers(ctx context.Context, ids []int) ([]User, error) {
+	if err := authorize(ctx, permUsersRead); err != nil {
+		return nil, err
+	}
+	return u.store.GetUsers(ctx, ids)
+}
+
+// pageUsers returns at most limit users following afterID.
+func (u *userService) pageUsers(ctx context.Context, afterID, limit int) ([]User, error) {
+	if err := authorize(ctx, permUsersRead); err != nil {
+		return nil, err
+	}
+	return u.store.PageUsers(ctx, afterID, limit)
+}
+
+// addUser validates and creates a user.
+func (u *userService) addUser(ctx context.Context, user User) (User, error) {
+	if err := authorize(ctx, permUsersWrite); err != nil {
+		return User{}, err
+	}
+	user.ID = 0
+	if err := validateUser(user); err != nil {
+		return User{}, err
+	}
+	return u.addUserV1(ctx, user)
+}
+
+// addUserV1 creates a user like addUser, but without validating it. The v1
+// REST API accepted any name before the rules moved into this layer, and
+// its clients keep that contract.
+func (u *userService) addUserV1(ctx context.Context, user User) (User, error) {
+	if err := authorize(ctx, permUsersWrite); err != nil {
+		return User{}, err
+	}
+	user.ID = 0
+	created, err := u.store.CreateUser(ctx, user)
+	u.usersChanged(ctx, err)
+	return created, err
+}
+
+// saveUser validates and updates an existing user.
+func (u *userService) saveUser(ctx context.Context, user User) error {
+	if err := authorize(ctx, permUsersWrite); err != nil {
+		return err
+	}
+	if err := validateUser(user); err != nil {
+		return err
+	}
+	return u.saveUserV1(ctx, user)
+}
+
+// saveUserV1 updates an existing user like saveUser, but without validating
+// it, for the v1 REST API like addUserV1.
+func (u *userService) saveUserV1(ctx context.Context, user User) error {
+	if err := authorize(ctx, permUsersWrite); err != nil {
+		return err
+	}
+	err := u.store.UpdateUser(ctx, user)
+	u.usersChanged(ctx, err)
+	return err
+}
+
+// removeUser deletes a user.
+func (u *userService) removeUser(ctx context.Context, id int) error {
+	if err := authorize(ctx, permUsersWrite); err != nil {
+		return err
+	}
+	err := u.store.DeleteUser(ctx, id)
+	u.usersChanged(ctx, err)
+	return err
+}
+
+// importUser validates and upserts an imported user and reports whether it
+// was created. Users without an id are always created. With dryRun nothing is
+// written and the result tells what would have happened. The cached
+// responses are left to importFinished, so that an import invalidates them
+// once rather than for every row.
+func (u *userService) importUser(ctx context.Context, user User, dryRun bool) (bool, error) {
+	if err := authorize(ctx, permUsersWrite); err != nil {
+		return false, err
+	}
+	if err := validateUser(user); err != nil {
+		return false, err
+	}
+	if user.ID == 0 {
+		if dryRun {
+			return true, nil
+		}
+		_, err := u.store.CreateUser(ctx, user)
+		return err == nil, err
+	}
+	if dryRun {
+		exists, err := u.store.UserExists(ctx, user.ID)
+		return !exists, err
+	}
+	return u.store.UpsertUser(ctx, user)
+}
+
+// importFinished drops the cached user responses after an import that
+// wrote users, also if it was aborted.
+func (u *userService) importFinished(ctx context.Context, written bool) {
+	if written {
+		u.usersChanged(ctx, nil)
+	}
+}
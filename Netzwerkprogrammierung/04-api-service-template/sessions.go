@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Refresh tokens have the form rt_<session id>_<secret>. Like API keys only
+// a salted hash of the secret is stored.
+const (
+	refreshTokenPrefix = "rt_"
+	sessionIDLength    = 16 // hex characters
+	maxUserAgentLength = 255
+)
+
+// sessionCleanupInterval is how often expired sessions are deleted.
+const sessionCleanupInterval = time.Hour
+
+// ErrSessionNotFound is returned by a SessionStore when no session has the
+// requested id.
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a login of a user. It lasts as long as its refresh token is
+// used within the refresh token lifetime.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	ClientIP   string    `json:"client_ip,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current,omitempty"` // the session of the caller
+	Tenant     string    `json:"-"`
+	Salt       []byte    `json:"-"`
+	Hash       []byte    `json:"-"`
+	// PreviousSalt and PreviousHash belong to the refresh token the current
+	// one replaced, so that presenting it again can be told apart from a
+	// made-up token. Both are nil before the first refresh.
+	PreviousSalt []byte `json:"-"`
+	PreviousHash []byte `json:"-"`
+}
+
+// expired reports whether the session has ended at now.
+func (s Session) expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// formatRefreshToken returns the refresh token handed to the client.
+func formatRefreshToken(id, secret string) string {
+	return refreshTokenPrefix + id + "_" + secret
+}
+
+// parseRefreshToken splits a refresh token into its session id and secret.
+func parseRefreshToken(token string) (id, secret string, ok bool) {
+	rest, found := strings.CutPrefix(token, refreshTokenPrefix)
+	if !found || len(rest) < sessionIDLength+2 || rest[sessionIDLength] != '_' {
+		return "", "", false
+	}
+	return rest[:sessionIDLength], rest[sessionIDLength+1:], true
+}
+
+// truncate shortens s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// SessionStore persists login sessions, limited to the tenant of ctx.
+// Sessions go away with their user.
+type SessionStore interface {
+	// LookupSession returns the session with the given id.
+	LookupSession(ctx context.Context, id string) (Session, error)
+	// ListSessions returns the sessions of a user, newest first.
+	ListSessions(ctx context.Context, userID int) ([]Session, error)
+	// CreateSession stores a new session.
+	CreateSession(ctx context.Context, session Session) error
+	// RotateSession replaces the salt and hash of the refresh token of a
+	// session and extends it, unless the hash is no longer previous. The
+	// replaced salt and hash become the previous ones of the session.
+	RotateSession(ctx context.Context, id string, previous, salt, hash []byte, usedAt, expiresAt time.Time) error
+	// DeleteSession terminates a session.
+	DeleteSession(ctx context.Context, id string) error
+	// DeleteUserSessions terminates all sessions of a user.
+	DeleteUserSessions(ctx context.Context, userID int) error
+	// DeleteExpiredSessions removes the sessions of all tenants that ended
+	// before now and returns their number.
+	DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error)
+}
+
+// expireSessions deletes expired sessions every sessionCleanupInterval until
+// ctx is cancelled.
+func (s *Server) expireSessions(ctx context.Context) {
+	ticker := time.NewTicker(sessionCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := s.sessions.DeleteExpiredSessions(ctx, s.now())
+			if err != nil {
+				s.logger.Warn("Failed to delete expired sessions", "error", err)
+			} else if deleted > 0 {
+				s.logger.Info("Deleted expired sessions", "count", deleted)
+			}
+		}
+	}
+}
+
+// activeSessions returns the sessions of a user that have not expired.
+func (s *Server) activeSessions(ctx context.Context, userID int) ([]Session, error) {
+	sessions, err := s.sessions.ListSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	active := []Session{}
+	for _, session := range sessions {
+		if !session.expired(now) {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
+
+// terminateSession deletes the session with the given id if it belongs to
+// the user.
+func (s *Server) terminateSession(ctx context.Context, userID int, id string) error {
+	session, err := s.sessions.LookupSession(ctx, id)
+	if err == nil && session.UserID != userID {
+		return ErrSessionNotFound
+	} else if err != nil {
+		return err
+	}
+	return s.sessions.DeleteSession(ctx, id)
+}
+
+// writeNotLoggedIn answers a session request from a caller that did not log
+// in with a password, such as an API key or a token of another issuer.
+func writeNotLoggedIn(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, problem{Type: problemBaseURI + "no-session", Title: "No session", Status: http.StatusForbidden,
+		Detail: "Only users who logged in with their password have sessions.", Instance: r.URL.Path})
+}
+
+// listOwnSessions handles the GET /v1/auth/sessions endpoint.
+func (s *Server) listOwnSessions(w http.ResponseWriter, r *http.Request) {
+	p := principalFrom(r.Context())
+	userID, ok := loginUser(p)
+	if !ok {
+		writeNotLoggedIn(w, r)
+		return
+	}
+	sessions, err := s.activeSessions(r.Context(), userID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == p.Session
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// terminateOwnSession handles the DELETE /v1/auth/sessions/{id} endpoint.
+func (s *Server) terminateOwnSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := loginUser(principalFrom(r.Context()))
+	if !ok {
+		writeNotLoggedIn(w, r)
+		return
+	}
+	err := s.terminateSession(r.Context(), userID, mux.Vars(r)["id"])
+	if errors.Is(err, ErrSessionNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionsUser returns the id of the user of the route if the user exists.
+func (s *Server) sessionsUser(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, &ValidationError{Field: "id", Message: "Invalid user ID"}
+	}
+	exists, err := s.store.UserExists(r.Context(), id)
+	if err == nil && !exists {
+		err = ErrUserNotFound
+	}
+	return id, err
+}
+
+// writeSessionError answers a failed session request of an admin.
+func writeSessionError(w http.ResponseWriter, r *http.Request, err error) {
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrSessionNotFound):
+		http.NotFound(w, r)
+	default:
+		writeStoreError(w, err)
+	}
+}
+
+// listUserSessions handles the GET /v1/users/{id}/sessions endpoint.
+func (s *Server) listUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.sessionsUser(r)
+	var sessions []Session
+	if err == nil {
+		sessions, err = s.activeSessions(r.Context(), userID)
+	}
+	if err != nil {
+		writeSessionError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// terminateUserSessions handles the DELETE /v1/users/{id}/sessions endpoint.
+func (s *Server) terminateUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.sessionsUser(r)
+	if err == nil {
+		err = s.sessions.DeleteUserSessions(r.Context(), userID)
+	}
+	if err != nil {
+		writeSessionError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// terminateUserSession handles the DELETE /v1/users/{id}/sessions/{sessionID}
+// endpoint.
+func (s *Server) terminateUserSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.sessionsUser(r)
+	if err == nil {
+		err = s.terminateSession(r.Context(), userID, mux.Vars(r)["sessionID"])
+	}
+	if err != nil {
+		writeSessionError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sqlSessionStore is a SessionStore backed by the sessions table.
+type sqlSessionStore struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+}
+
+// newSQLSessionStore returns a SessionStore using the given database handle.
+func newSQLSessionStore(db *sql.DB) *sqlSessionStore {
+	return &sqlSessionStore{db: db, queryTimeout: 5 * time.Second}
+}
+
+const sessionColumns = "id, tenant_id, user_id, salt, hash, previous_salt, previous_hash, COALESCE(user_agent, ''), COALESCE(client_ip, ''), created_at, last_used_at, expires_at"
+
+// scanSession reads a row selected with sessionColumns.
+func scanSession(scan func(dest ...any) error) (Session, error) {
+	var session Session
+	err := scan(&session.ID, &session.Tenant, &session.UserID, &session.Salt, &session.Hash, &session.PreviousSalt, &session.PreviousHash,
+		&session.UserAgent, &session.ClientIP, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+	return session, err
+}
+
+func (s *sqlSessionStore) LookupSession(ctx context.Context, id string) (Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	session, err := scanSession(s.db.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE id = $1 AND tenant_id = $2", id, tenantOrDefault(ctx)).Scan)
+	if err == sql.ErrNoRows {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, classify(ctx, err)
+}
+
+func (s *sqlSessionStore) ListSessions(ctx context.Context, userID int) ([]Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE tenant_id = $1 AND user_id = $2 ORDER BY created_at DESC, id",
+		tenantOrDefault(ctx), userID)
+	if err != nil {
+		return nil, classify(ctx, err)
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		session, err := scanSession(rows.Scan)
+		if err != nil {
+			return nil, classify(ctx, err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, classify(ctx, rows.Err())
+}
+
+func (s *sqlSessionStore) CreateSession(ctx context.Context, session Session) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO sessions (id, tenant_id, user_id, salt, hash, user_agent, client_ip, created_at, last_used_at, expires_at) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, $9, $10)",
+		session.ID, session.Tenant, session.UserID, session.Salt, session.Hash, session.UserAgent, session.ClientIP,
+		session.CreatedAt, session.LastUsedAt, session.ExpiresAt)
+	return classify(ctx, err)
+}
+
+func (s *sqlSessionStore) RotateSession(ctx context.Context, id string, previous, salt, hash []byte, usedAt, expiresAt time.Time) error {
+	return s.exec(ctx, "UPDATE sessions SET previous_salt = salt, previous_hash = hash, salt = $1, hash = $2, last_used_at = $3, expires_at = $4 WHERE id = $5 AND tenant_id = $6 AND hash = $7",
+		salt, hash, usedAt, expiresAt, id, tenantOrDefault(ctx), previous)
+}
+
+func (s *sqlSessionStore) DeleteSession(ctx context.Context, id string) error {
+	return s.exec(ctx, "DELETE FROM sessions WHERE id = $1 AND tenant_id = $2", id, tenantOrDefault(ctx))
+}
+
+func (s *sqlSessionStore) DeleteUserSessions(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE tenant_id = $1 AND user_id = $2", tenantOrDefault(ctx), userID)
+	return classify(ctx, err)
+}
+
+func (s *sqlSessionStore) DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, classify(ctx, err)
+	}
+	return result.RowsAffected()
+}
+
+// exec runs a statement changing a single session.
+func (s *sqlSessionStore) exec(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return classify(ctx, err)
+	}
+	if requireAffected(result) != nil {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// memorySessionStore is a SessionStore kept in process memory next to a
+// memory UserStore, which it asks whether users still exist.
+type memorySessionStore struct {
+	users UserStore
+
+	mu       sync.RWMutex
+	sessions map[string]Session
+}
+
+// newMemorySessionStore returns an empty in-memory SessionStore for the
+// users in users.
+func newMemorySessionStore(users UserStore) *memorySessionStore {
+	return &memorySessionStore{users: users, sessions: make(map[string]Session)}
+}
+
+func (s *memorySessionStore) LookupSession(ctx context.Context, id string) (Session, error) {
+	s.mu.RLock()
+	session, found := s.sessions[id]
+	s.mu.RUnlock()
+	if !found || session.Tenant != tenantOrDefault(ctx) {
+		return Session{}, ErrSessionNotFound
+	}
+	exists, err := s.users.UserExists(ctx, session.UserID)
+	if err != nil {
+		return Session{}, err
+	} else if !exists {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (s *memorySessionStore) ListSessions(ctx context.Context, userID int) ([]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenant := tenantOrDefault(ctx)
+	var sessions []Session
+	for _, session := range s.sessions {
+		if session.Tenant == tenant && session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].CreatedAt.Equal(sessions[j].CreatedAt) {
+			return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+func (s *memorySessionStore) CreateSession(ctx context.Context, session Session) error {
+	exists, err := s.users.UserExists(ctx, session.UserID)
+	if err != nil {
+		return err
+	} else if !exists {
+		return ErrUserNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *memorySessionStore) RotateSession(ctx context.Context, id string, previous, salt, hash []byte, usedAt, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, found := s.sessions[id]
+	if !found || session.Tenant != tenantOrDefault(ctx) || string(session.Hash) != string(previous) {
+		return ErrSessionNotFound
+	}
+	session.PreviousSalt, session.PreviousHash = session.Salt, session.Hash
+	session.Salt, session.Hash, session.LastUsedAt, session.ExpiresAt = salt, hash, usedAt, expiresAt
+	s.sessions[id] = session
+	return nil
+}
+
+func (s *memorySessionStore) DeleteSession(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, found := s.sessions[id]; !found || session.Tenant != tenantOrDefault(ctx) {
+		return ErrSessionNotFound
+	}
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memorySessionStore) DeleteUserSessions(ctx context.Context, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := tenantOrDefault(ctx)
+	for id, session := range s.sessions {
+		if session.Tenant == tenant && session.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *memorySessionStore) DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for id, session := range s.sessions {
+		if session.expired(now) {
+			delete(s.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
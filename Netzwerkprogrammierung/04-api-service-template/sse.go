@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// userChangesChannel is the PostgreSQL notification channel the users table
+// trigger in init.sql publishes to.
+const userChangesChannel = "user_changes"
+
+// sseRetry is the reconnection delay suggested to event stream clients.
+const sseRetry = 3 * time.Second
+
+// sequencedEvent is a UserEvent with its SSE event id. Changes announced by
+// the database carry the number the users table trigger gave them, so that
+// every instance sends the same id for the same event.
+type sequencedEvent struct {
+	seq   uint64
+	event UserEvent
+}
+
+// changeSubscription is one client of a ChangeBroker. events is closed when
+// the client could not keep up and was dropped. Clients with a tenant only
+// receive the events of that tenant.
+type changeSubscription struct {
+	tenant string
+	events chan sequencedEvent
+}
+
+// wants reports whether the client receives e.
+func (sub *changeSubscription) wants(e sequencedEvent) bool {
+	return sub.tenant == "" || e.event.Tenant == sub.tenant
+}
+
+// ChangeBroker fans user change events out to the connected event stream
+// clients. It keeps the most recent events so that reconnecting clients can
+// resume from their Last-Event-ID, also on another instance.
+type ChangeBroker struct {
+	mu          sync.Mutex
+	seq         uint64           // id of the latest event
+	history     []sequencedEvent // ring buffer of the last historySize events
+	oldest      int              // index of the oldest event in history
+	historySize int
+	bufferSize  int
+	subscribers map[*changeSubscription]struct{}
+}
+
+// NewChangeBroker returns a broker remembering historySize events for
+// resumption and buffering up to bufferSize events per client.
+func NewChangeBroker(historySize, bufferSize int) *ChangeBroker {
+	return &ChangeBroker{
+		history:     make([]sequencedEvent, 0, historySize),
+		historySize: historySize,
+		bufferSize:  bufferSize,
+		subscribers: make(map[*changeSubscription]struct{}),
+	}
+}
+
+// Publish numbers event after the latest one and sends it to every client.
+func (b *ChangeBroker) Publish(event UserEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publishLocked(b.seq+1, event)
+}
+
+// PublishAs sends event to every client with the id seq.
+func (b *ChangeBroker) PublishAs(seq uint64, event UserEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publishLocked(seq, event)
+}
+
+// publishLocked remembers and sends an event. Clients whose buffer is full
+// are disconnected instead of slowing down everybody else. The caller must
+// hold b.mu.
+func (b *ChangeBroker) publishLocked(seq uint64, event UserEvent) {
+	b.seq = seq
+	e := sequencedEvent{seq: seq, event: event}
+	if len(b.history) < b.historySize {
+		b.history = append(b.history, e)
+	} else if b.historySize > 0 {
+		b.history[b.oldest] = e
+		b.oldest = (b.oldest + 1) % b.historySize
+	}
+
+	for sub := range b.subscribers {
+		if !sub.wants(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// Subscribe registers a client of tenant, or of all tenants if tenant is
+// empty. If lastEventID is not empty, the remembered events after it that
+// the client receives are returned for replay; complete is false if the event
+// with lastEventID was already evicted or is unknown. The ids of database
+// changes increase, but not without gaps and not always in the order the
+// changes are announced, so events are replayed in the order they were
+// published after the one with lastEventID.
+func (b *ChangeBroker) Subscribe(tenant, lastEventID string) (sub *changeSubscription, replay []sequencedEvent, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub = &changeSubscription{tenant: tenant, events: make(chan sequencedEvent, b.bufferSize)}
+	b.subscribers[sub] = struct{}{}
+	if lastEventID == "" {
+		return sub, nil, true
+	}
+
+	last, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		return sub, nil, false
+	}
+	for i := len(b.history) - 1; i >= 0; i-- {
+		if b.history[(b.oldest+i)%len(b.history)].seq != last {
+			continue
+		}
+		for j := i + 1; j < len(b.history); j++ {
+			if e := b.history[(b.oldest+j)%len(b.history)]; sub.wants(e) {
+				replay = append(replay, e)
+			}
+		}
+		return sub, replay, true
+	}
+	return sub, nil, false
+}
+
+// Unsubscribe removes a client.
+func (b *ChangeBroker) Unsubscribe(sub *changeSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, found := b.subscribers[sub]; found {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// userChange is the payload of a notification on userChangesChannel. Seq
+// numbers the changes of all instances.
+type userChange struct {
+	Seq    uint64 `json:"seq"`
+	Op     string `json:"op"`
+	Tenant string `json:"tenant"`
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+}
+
+// parseUserChange converts a users table notification into a UserEvent and
+// returns its number, which is zero if the trigger does not number changes.
+func parseUserChange(payload string) (UserEvent, uint64, error) {
+	var change userChange
+	if err := json.Unmarshal([]byte(payload), &change); err != nil {
+		return UserEvent{}, 0, err
+	}
+
+	var event UserEvent
+	switch change.Op {
+	case "INSERT":
+		event = newUserEvent(EventUserCreated, User{ID: change.ID, Name: change.Name})
+	case "UPDATE":
+		event = newUserEvent(EventUserUpdated, User{ID: change.ID, Name: change.Name})
+	case "DELETE":
+		event = newUserEvent(EventUserDeleted, User{ID: change.ID})
+	default:
+		return UserEvent{}, 0, fmt.Errorf("unknown operation %q", change.Op)
+	}
+	event.Tenant = change.Tenant
+	return event, change.Seq, nil
+}
+
+// publishUserChange is the listenLoop handler feeding users table
+// notifications into the change broker.
+func (s *Server) publishUserChange(payload string) {
+	event, seq, err := parseUserChange(payload)
+	if err != nil {
+		s.logger.Warn("Ignoring user change notification", "payload", payload, "error", err)
+		return
+	}
+	if seq == 0 {
+		// The trigger of an older schema does not number the changes.
+		s.changes.Publish(event)
+		return
+	}
+	s.changes.PublishAs(seq, event)
+}
+
+// writeSSE writes one event in text/event-stream format.
+func writeSSE(w http.ResponseWriter, e sequencedEvent) error {
+	data, err := json.Marshal(e.event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.seq, e.event.Type, data)
+	return err
+}
+
+// streamUserEvents handles the GET /v1/users/events endpoint, a Server-Sent
+// Events stream of user changes. Clients resume with the Last-Event-ID header
+// (or the lastEventId query parameter); if that is no longer possible a
+// "reset" event tells them to reload their state. With tenancy enabled
+// clients only see the changes of their tenant.
+func (s *Server) streamUserEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	sub, replay, complete := s.changes.Subscribe(tenantFrom(r.Context()), lastEventID)
+	defer s.changes.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, e := range replay {
+		if err := writeSSE(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	// Without a heartbeat interval the nil channel never fires.
+	var heartbeat <-chan time.Time
+	if s.sseHeartbeat > 0 {
+		ticker := time.NewTicker(s.sseHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.events:
+			if !ok {
+				s.logger.Warn("Disconnecting slow event stream client", "remote", r.RemoteAddr)
+				return
+			}
+			if err := writeSSE(w, e); err != nil {
+				return
+			}
+		case <-heartbeat:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
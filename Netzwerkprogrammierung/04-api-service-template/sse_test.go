@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeBrokerResumesFromLastEventID(t *testing.T) {
+	// Setup
+	b := NewChangeBroker(3, 8)
+	for i := 1; i <= 5; i++ {
+		b.Publish(newUserEvent(EventUserCreated, User{ID: i}))
+	}
+
+	// Execute
+	_, replay, complete := b.Subscribe("", "3")
+	_, _, tooOld := b.Subscribe("", "1")
+	_, _, unknown := b.Subscribe("", "9")
+	_, latest, upToDate := b.Subscribe("", "5")
+
+	// Validate
+	assert.True(t, complete)
+	assert.Len(t, replay, 2)
+	assert.Equal(t, uint64(4), replay[0].seq)
+	assert.Equal(t, 5, replay[1].event.Data.ID)
+	assert.False(t, tooOld)
+	assert.False(t, unknown)
+	assert.True(t, upToDate)
+	assert.Empty(t, latest)
+}
+
+func TestChangeBrokerResumesFromSharedIDs(t *testing.T) {
+	// Setup
+	b := NewChangeBroker(3, 8)
+	for _, seq := range []uint64{10, 12, 11, 14} {
+		b.PublishAs(seq, newUserEvent(EventUserCreated, User{ID: int(seq)}))
+	}
+
+	// Execute
+	_, replay, complete := b.Subscribe("", "12")
+	_, _, evicted := b.Subscribe("", "10")
+	b.Publish(newUserEvent(EventUserDeleted, User{ID: 14}))
+	_, latest, _ := b.Subscribe("", "14")
+
+	// Validate
+	assert.True(t, complete)
+	if assert.Len(t, replay, 2) {
+		assert.Equal(t, uint64(11), replay[0].seq, "events are replayed in the order they were published")
+		assert.Equal(t, uint64(14), replay[1].seq)
+	}
+	assert.False(t, evicted)
+	if assert.Len(t, latest, 1) {
+		assert.Equal(t, uint64(15), latest[0].seq)
+	}
+}
+
+func TestChangeBrokerDropsSlowConsumers(t *testing.T) {
+	// Setup
+	b := NewChangeBroker(10, 2)
+	slow, _, _ := b.Subscribe("", "")
+	fast, _, _ := b.Subscribe("", "")
+
+	// Execute
+	for i := 1; i <= 3; i++ {
+		b.Publish(newUserEvent(EventUserCreated, User{ID: i}))
+		<-fast.events
+	}
+
+	// Validate
+	received := 0
+	for range slow.events {
+		received++
+	}
+	assert.Equal(t, 2, received)
+	b.Publish(newUserEvent(EventUserCreated, User{ID: 4}))
+	assert.Equal(t, 4, (<-fast.events).event.Data.ID)
+	b.Unsubscribe(slow)
+	b.Unsubscribe(fast)
+}
+
+func TestChangeBrokerQueuesOnlyTheEventsOfTheTenant(t *testing.T) {
+	// Setup
+	b := NewChangeBroker(10, 2)
+	acme, _, _ := b.Subscribe("acme", "")
+	other := func(id int) UserEvent {
+		event := newUserEvent(EventUserCreated, User{ID: id})
+		event.Tenant = "other"
+		return event
+	}
+	b.Publish(other(1))
+
+	// Execute
+	for i := 2; i <= 5; i++ {
+		b.Publish(other(i))
+	}
+	event := newUserEvent(EventUserCreated, User{ID: 6})
+	event.Tenant = "acme"
+	b.Publish(event)
+	_, replay, complete := b.Subscribe("acme", "1")
+
+	// Validate
+	received, ok := <-acme.events
+	assert.True(t, ok, "the events of other tenants do not fill the buffer of the client")
+	assert.Equal(t, 6, received.event.Data.ID)
+	assert.True(t, complete)
+	if assert.Len(t, replay, 1) {
+		assert.Equal(t, uint64(6), replay[0].seq)
+	}
+	b.Unsubscribe(acme)
+}
+
+func TestParseUserChange(t *testing.T) {
+	// Execute
+	created, seq, err := parseUserChange(`{"seq":7,"op":"INSERT","id":1,"name":"John Doe"}`)
+	assert.NoError(t, err)
+	deleted, unnumbered, err := parseUserChange(`{"op":"DELETE","id":2}`)
+	assert.NoError(t, err)
+	_, _, err = parseUserChange(`{"op":"TRUNCATE"}`)
+
+	// Validate
+	assert.Error(t, err)
+	assert.Equal(t, uint64(7), seq)
+	assert.Zero(t, unnumbered)
+	assert.Equal(t, EventUserCreated, created.Type)
+	assert.Equal(t, User{ID: 1, Name: "John Doe"}, created.Data)
+	assert.Equal(t, EventUserDeleted, deleted.Type)
+	assert.Equal(t, 2, deleted.Data.ID)
+}
+
+func TestStreamUserEvents(t *testing.T) {
+	// Setup
+	service := NewServer(WithEventStream(10 * time.Millisecond))
+	service.changes.Publish(newUserEvent(EventUserCreated, User{ID: 1, Name: "John Doe"}))
+	service.changes.Publish(newUserEvent(EventUserUpdated, User{ID: 1, Name: "John Smith"}))
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/v1/users/events", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "1")
+
+	// Execute
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	readUntil := func(prefix string) string {
+		for lines.Scan() {
+			if strings.HasPrefix(lines.Text(), prefix) {
+				return lines.Text()
+			}
+		}
+		return ""
+	}
+
+	// Validate
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "retry: 3000", readUntil("retry:"))
+	assert.Equal(t, "id: 2", readUntil("id:"))
+	assert.Equal(t, "event: user.updated", readUntil("event:"))
+	assert.Contains(t, readUntil("data:"), `"name":"John Smith"`)
+	assert.Equal(t, ": heartbeat", readUntil(":"))
+	service.changes.Publish(newUserEvent(EventUserDeleted, User{ID: 1}))
+	assert.Equal(t, "id: 3", readUntil("id:"))
+	assert.Equal(t, "event: user.deleted", readUntil("event:"))
+}
+
+func TestStreamUserEventsBypassesTheCache(t *testing.T) {
+	// Setup
+	service := NewServer(WithEventStream(time.Minute), WithCache(NewResponseCache(time.Minute, time.Minute, 1<<20, 4), true))
+	server := httptest.NewServer(service)
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	connect := func() (*http.Response, string) {
+		req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/v1/users/events", nil)
+		assert.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		lines := bufio.NewScanner(resp.Body)
+		lines.Scan()
+		return resp, lines.Text()
+	}
+
+	// Execute
+	first, firstLine := connect()
+	second, secondLine := connect()
+
+	// Validate
+	assert.Equal(t, "retry: 3000", firstLine)
+	assert.Equal(t, "retry: 3000", secondLine, "the second client does not wait for the first")
+	for _, resp := range []*http.Response{first, second} {
+		if resp != nil {
+			assert.Empty(t, resp.Header.Get(cacheStatusHeader))
+			resp.Body.Close()
+		}
+	}
+}
+
+func TestStreamUserEventsWithoutHeartbeat(t *testing.T) {
+	// Setup
+	service := NewServer(WithEventStream(0))
+	server := httptest.NewServer(service)
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/v1/users/events", nil)
+	assert.NoError(t, err)
+
+	// Execute
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	lines.Scan()
+	service.changes.Publish(newUserEvent(EventUserCreated, User{ID: 1, Name: "John Doe"}))
+	lines.Scan()
+	lines.Scan()
+
+	// Validate
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "id: 1", lines.Text())
+}
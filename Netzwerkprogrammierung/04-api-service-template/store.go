@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUserNotFound is returned by a UserStore when no user has the requested id.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrStoreTimeout is returned by a UserStore when an operation exceeded
+	// its timeout.
+	ErrStoreTimeout = errors.New("database operation timed out")
+	// ErrStoreUnavailable is returned by a UserStore when the database
+	// cannot be reached.
+	ErrStoreUnavailable = errors.New("database unavailable")
+)
+
+// UserStore persists users. Every method honours the cancellation of ctx.
+type UserStore interface {
+	// EachUser calls fn for every user in ascending id order. Iteration stops
+	// at the first error returned by fn, which EachUser then returns.
+	EachUser(ctx context.Context, fn func(User) error) error
+	// GetUser returns the user with the given id or ErrUserNotFound.
+	GetUser(ctx context.Context, id int) (User, error)
+	// GetUsers returns the users with the given ids in ascending id order.
+	// Ids without a user are skipped.
+	GetUsers(ctx context.Context, ids []int) ([]User, error)
+	// PageUsers returns at most limit users with an id above afterID in
+	// ascending id order.
+	PageUsers(ctx context.Context, afterID, limit int) ([]User, error)
+	// UserExists reports whether a user with the given id exists.
+	UserExists(ctx context.Context, id int) (bool, error)
+	// CreateUser inserts a new user and returns it with its assigned id.
+	CreateUser(ctx context.Context, user User) (User, error)
+	// UpsertUser inserts or replaces the user with user.ID and reports
+	// whether it was created.
+	UpsertUser(ctx context.Context, user User) (bool, error)
+	// UpdateUser replaces the user with user.ID or returns ErrUserNotFound.
+	UpdateUser(ctx context.Context, user User) error
+	// DeleteUser removes the user with the given id or returns ErrUserNotFound.
+	DeleteUser(ctx context.Context, id int) error
+}
+
+// dbtx is the subset of *sql.DB and *sql.Tx used by sqlStore, so that
+// statements can run inside or outside a transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqlStore is a UserStore backed by the PostgreSQL users table. With outbox
+// set, every mutation records its events in the outbox table in the same
+// transaction, to be published by an OutboxRelay.
+//
+// Every operation runs with a deadline: queryTimeout for lookups and writes,
+// streamTimeout for EachUser, which may stream the whole table. When it
+// passes, pgx cancels the statement on the server.
+//
+// With replicas set, reads go to a healthy read replica unless the request
+// needs to see its own writes, and fall back to db when the replica fails.
+//
+// When ctx is scoped to a tenant every statement runs in a transaction with
+// app.tenant_id set to it, which the row-level security policies of the
+// users table in init.sql filter on. Rows of other tenants are invisible,
+// so accessing them fails with ErrUserNotFound.
+type sqlStore struct {
+	db            *sql.DB
+	replicas      *ReplicaRouter
+	outbox        bool
+	queryTimeout  time.Duration
+	streamTimeout time.Duration
+}
+
+// newSQLStore returns a UserStore using the given database handle.
+func newSQLStore(db *sql.DB) *sqlStore {
+	return &sqlStore{db: db, queryTimeout: 5 * time.Second, streamTimeout: 5 * time.Minute}
+}
+
+// classify wraps errors caused by the database rather than the request in
+// ErrStoreTimeout or ErrStoreUnavailable. ctx is the context the operation
+// ran with.
+func classify(ctx context.Context, err error) error {
+	var netErr net.Error
+	switch {
+	case err == nil || errors.Is(err, ErrUserNotFound):
+		return err
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrStoreTimeout, err)
+	case errors.Is(err, context.Canceled):
+		// The client went away; there is nobody to report to.
+		return err
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.As(err, &netErr):
+		return fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+	return err
+}
+
+// write runs the mutation fn. With the outbox enabled fn runs in a
+// transaction together with the insertion of the events it returns.
+func (s *sqlStore) write(ctx context.Context, fn func(q dbtx) ([]UserEvent, error)) error {
+	if c := consistencyFrom(ctx); c != nil {
+		// Even a failed write may have committed, so read from the primary.
+		c.markWrite()
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	return classify(ctx, s.runWrite(ctx, fn))
+}
+
+func (s *sqlStore) runWrite(ctx context.Context, fn func(q dbtx) ([]UserEvent, error)) error {
+	tenant := tenantFrom(ctx)
+	if !s.outbox && tenant == "" {
+		_, err := fn(s.db)
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if tenant != "" {
+		if err := setTenant(ctx, tx, tenant); err != nil {
+			return err
+		}
+	}
+	events, err := fn(tx)
+	if err != nil {
+		return err
+	}
+	if !s.outbox {
+		return tx.Commit()
+	}
+	for _, event := range events {
+		event.Tenant = tenant
+		if err := insertOutboxEvent(ctx, tx, event); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// read runs the query fn on a healthy replica if there is one and on the
+// primary otherwise, each attempt limited to timeout. When the replica turns
+// out to be unavailable or too slow it is taken out of rotation and fn runs
+// again on the primary, unless retry reports that fn already handed out
+// results.
+func (s *sqlStore) read(ctx context.Context, timeout time.Duration, fn func(ctx context.Context, q dbtx) error, retry func() bool) error {
+	if replica := s.replicas.pick(ctx); replica != nil {
+		err := s.attempt(ctx, replica.db, timeout, fn)
+		if !errors.Is(err, ErrStoreUnavailable) && !errors.Is(err, ErrStoreTimeout) {
+			return err
+		}
+		s.replicas.markDown(replica, err)
+		// A deadline of the caller would stop the primary just the same.
+		if ctx.Err() != nil || !retry() {
+			return err
+		}
+	}
+	return s.attempt(ctx, s.db, timeout, fn)
+}
+
+// attempt runs the query fn on db within timeout and classifies its error.
+func (s *sqlStore) attempt(ctx context.Context, db *sql.DB, timeout time.Duration, fn func(ctx context.Context, q dbtx) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := s.scoped(ctx, db, func(q dbtx) error { return fn(ctx, q) })
+	var callerErr *callerError
+	if errors.As(err, &callerErr) {
+		return callerErr.err
+	}
+	return classify(ctx, err)
+}
+
+// callerError wraps an error returned to a read by the caller's own
+// callback, such as a failed write to a client. It says nothing about the
+// database, so read passes it on without classifying it.
+type callerError struct{ err error }
+
+func (e *callerError) Error() string { return e.err.Error() }
+func (e *callerError) Unwrap() error { return e.err }
+
+// scoped runs the query fn on db, in a read-only transaction limited to the
+// tenant of ctx if there is one.
+func (s *sqlStore) scoped(ctx context.Context, db *sql.DB, fn func(q dbtx) error) error {
+	tenant := tenantFrom(ctx)
+	if tenant == "" {
+		return fn(db)
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setTenant(ctx, tx, tenant); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setTenant limits the rest of the transaction tx to the rows of tenant.
+func setTenant(ctx context.Context, tx *sql.Tx, tenant string) error {
+	_, err := tx.ExecContext(ctx, "SELECT set_config('app.tenant_id', $1, true)", tenant)
+	return err
+}
+
+// always is the retry of reads that collect their results before returning.
+func always() bool { return true }
+
+func (s *sqlStore) EachUser(ctx context.Context, fn func(User) error) error {
+	delivered := false
+	return s.read(ctx, s.streamTimeout, func(ctx context.Context, q dbtx) error {
+		rows, err := q.QueryContext(ctx, "SELECT id, name FROM users ORDER BY id")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var user User
+			if err := rows.Scan(&user.ID, &user.Name); err != nil {
+				return err
+			}
+			delivered = true
+			if err := fn(user); err != nil {
+				return &callerError{err}
+			}
+		}
+		return rows.Err()
+	}, func() bool { return !delivered })
+}
+
+func (s *sqlStore) GetUser(ctx context.Context, id int) (User, error) {
+	var user User
+	err := s.read(ctx, s.queryTimeout, func(ctx context.Context, q dbtx) error {
+		return q.QueryRowContext(ctx, "SELECT id, name FROM users WHERE id = $1", id).Scan(&user.ID, &user.Name)
+	}, always)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func (s *sqlStore) GetUsers(ctx context.Context, ids []int) ([]User, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return s.queryUsers(ctx, "SELECT id, name FROM users WHERE id = ANY($1::int[]) ORDER BY id", intArray(ids))
+}
+
+func (s *sqlStore) PageUsers(ctx context.Context, afterID, limit int) ([]User, error) {
+	return s.queryUsers(ctx, "SELECT id, name FROM users WHERE id > $1 ORDER BY id LIMIT $2", afterID, limit)
+}
+
+// queryUsers runs a query selecting id and name and collects the users.
+func (s *sqlStore) queryUsers(ctx context.Context, query string, args ...any) ([]User, error) {
+	var users []User
+	err := s.read(ctx, s.queryTimeout, func(ctx context.Context, q dbtx) error {
+		rows, err := q.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		users = nil
+		for rows.Next() {
+			var user User
+			if err := rows.Scan(&user.ID, &user.Name); err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+		return rows.Err()
+	}, always)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// intArray formats ids as a PostgreSQL array literal, which every driver can
+// pass as a plain string parameter.
+func intArray(ids []int) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, id := range ids {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Itoa(id))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (s *sqlStore) UserExists(ctx context.Context, id int) (bool, error) {
+	var exists bool
+	err := s.read(ctx, s.queryTimeout, func(ctx context.Context, q dbtx) error {
+		return q.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists)
+	}, always)
+	return exists, err
+}
+
+func (s *sqlStore) CreateUser(ctx context.Context, user User) (User, error) {
+	err := s.write(ctx, func(q dbtx) ([]UserEvent, error) {
+		err := q.QueryRowContext(ctx, "INSERT INTO users (name) VALUES ($1) RETURNING id", user.Name).Scan(&user.ID)
+		if err != nil {
+			return nil, err
+		}
+		return []UserEvent{newUserEvent(EventUserCreated, user)}, nil
+	})
+	return user, err
+}
+
+func (s *sqlStore) UpsertUser(ctx context.Context, user User) (bool, error) {
+	var inserted bool
+	err := s.write(ctx, func(q dbtx) ([]UserEvent, error) {
+		err := q.QueryRowContext(ctx,
+			"INSERT INTO users (id, name) VALUES ($1, $2) ON CONFLICT (tenant_id, id) DO UPDATE SET name = EXCLUDED.name RETURNING (xmax = 0)",
+			user.ID, user.Name).Scan(&inserted)
+		if err != nil {
+			return nil, err
+		}
+		if !inserted {
+			return []UserEvent{newUserEvent(EventUserUpdated, user)}, nil
+		}
+
+		// Rows inserted with an explicit id bypass the serial sequence, so
+		// move it past the id to keep later inserts from colliding. The
+		// sequence is shared by all tenants and must never move back.
+		_, err = q.ExecContext(ctx, "SELECT setval('users_id_seq', GREATEST($1, last_value)) FROM users_id_seq", user.ID)
+		return []UserEvent{newUserEvent(EventUserCreated, user)}, err
+	})
+	return inserted, err
+}
+
+func (s *sqlStore) UpdateUser(ctx context.Context, user User) error {
+	return s.write(ctx, func(q dbtx) ([]UserEvent, error) {
+		result, err := q.ExecContext(ctx, "UPDATE users SET name = $1 WHERE id = $2", user.Name, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireAffected(result); err != nil {
+			return nil, err
+		}
+		return []UserEvent{newUserEvent(EventUserUpdated, user)}, nil
+	})
+}
+
+func (s *sqlStore) DeleteUser(ctx context.Context, id int) error {
+	return s.write(ctx, func(q dbtx) ([]UserEvent, error) {
+		result, err := q.ExecContext(ctx, "DELETE FROM users WHERE id = $1", id)
+		if err != nil {
+			return nil, err
+		}
+		if err := requireAffected(result); err != nil {
+			return nil, err
+		}
+		return []UserEvent{newUserEvent(EventUserDeleted, User{ID: id})}, nil
+	})
+}
+
+// requireAffected maps a statement that touched no rows to ErrUserNotFound.
+func requireAffected(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// memoryPageSize is the number of users EachUser copies per lock acquisition
+// on a memoryStore.
+const memoryPageSize = 256
+
+// memoryStore is a UserStore kept in process memory. It is used by tests and
+// benchmarks and for running the service without PostgreSQL.
+type memoryStore struct {
+	mu     sync.RWMutex
+	users  []User // sorted by ID
+	nextID int
+}
+
+// newMemoryStore returns an empty in-memory UserStore.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{nextID: 1}
+}
+
+// find returns the index of id in s.users, or the index it would be inserted
+// at, and whether it was found. The caller must hold s.mu.
+func (s *memoryStore) find(id int) (int, bool) {
+	i := sort.Search(len(s.users), func(i int) bool { return s.users[i].ID >= id })
+	return i, i < len(s.users) && s.users[i].ID == id
+}
+
+func (s *memoryStore) EachUser(ctx context.Context, fn func(User) error) error {
+	page := make([]User, 0, memoryPageSize)
+	after := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Copy one page at a time so slow consumers do not block writers.
+		s.mu.RLock()
+		i, _ := s.find(after + 1)
+		page = append(page[:0], s.users[i:min(i+memoryPageSize, len(s.users))]...)
+		s.mu.RUnlock()
+
+		if len(page) == 0 {
+			return nil
+		}
+		for _, user := range page {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+func (s *memoryStore) GetUser(ctx context.Context, id int) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, found := s.find(id)
+	if !found {
+		return User{}, ErrUserNotFound
+	}
+	return s.users[i], nil
+}
+
+func (s *memoryStore) GetUsers(ctx context.Context, ids []int) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []User
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if i, found := s.find(id); found && !seen[id] {
+			seen[id] = true
+			users = append(users, s.users[i])
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s *memoryStore) PageUsers(ctx context.Context, afterID, limit int) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, _ := s.find(afterID + 1)
+	return append([]User(nil), s.users[i:min(i+limit, len(s.users))]...), nil
+}
+
+func (s *memoryStore) UserExists(ctx context.Context, id int) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, found := s.find(id)
+	return found, nil
+}
+
+func (s *memoryStore) CreateUser(ctx context.Context, user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user.ID = s.nextID
+	s.nextID++
+	s.users = append(s.users, user)
+	return user, nil
+}
+
+func (s *memoryStore) UpsertUser(ctx context.Context, user User) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, found := s.find(user.ID)
+	if found {
+		s.users[i] = user
+		return false, nil
+	}
+	s.users = append(s.users, User{})
+	copy(s.users[i+1:], s.users[i:])
+	s.users[i] = user
+	if user.ID >= s.nextID {
+		s.nextID = user.ID + 1
+	}
+	return true, nil
+}
+
+func (s *memoryStore) UpdateUser(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, found := s.find(user.ID)
+	if !found {
+		return ErrUserNotFound
+	}
+	s.users[i] = user
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, found := s.find(id)
+	if !found {
+		return ErrUserNotFound
+	}
+	s.users = append(s.users[:i], s.users[i+1:]...)
+	return nil
+}
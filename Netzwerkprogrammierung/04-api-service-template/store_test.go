@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStoreCRUD(t *testing.T) {
+	// Setup
+	s := newMemoryStore()
+	ctx := context.Background()
+
+	// Execute
+	john, err := s.CreateUser(ctx, User{Name: "John Doe"})
+	assert.NoError(t, err)
+	jane, err := s.CreateUser(ctx, User{Name: "Jane Doe"})
+	assert.NoError(t, err)
+	err = s.UpdateUser(ctx, User{ID: jane.ID, Name: "Jane Smith"})
+	assert.NoError(t, err)
+	err = s.DeleteUser(ctx, john.ID)
+	assert.NoError(t, err)
+
+	// Validate
+	assert.Equal(t, 1, john.ID)
+	assert.Equal(t, 2, jane.ID)
+	_, err = s.GetUser(ctx, john.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	user, err := s.GetUser(ctx, jane.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Smith", user.Name)
+	assert.ErrorIs(t, s.UpdateUser(ctx, User{ID: 42}), ErrUserNotFound)
+	assert.ErrorIs(t, s.DeleteUser(ctx, 42), ErrUserNotFound)
+}
+
+func TestMemoryStoreUpsertKeepsOrder(t *testing.T) {
+	// Setup
+	s := newMemoryStore()
+	ctx := context.Background()
+
+	// Execute
+	created, err := s.UpsertUser(ctx, User{ID: 5, Name: "Five"})
+	assert.NoError(t, err)
+	assert.True(t, created)
+	created, err = s.UpsertUser(ctx, User{ID: 2, Name: "Two"})
+	assert.NoError(t, err)
+	assert.True(t, created)
+	created, err = s.UpsertUser(ctx, User{ID: 5, Name: "Fünf"})
+	assert.NoError(t, err)
+	assert.False(t, created)
+	next, err := s.CreateUser(ctx, User{Name: "Six"})
+	assert.NoError(t, err)
+
+	// Validate
+	assert.Equal(t, 6, next.ID)
+	var names []string
+	err = s.EachUser(ctx, func(user User) error {
+		names = append(names, user.Name)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Two", "Fünf", "Six"}, names)
+}
+
+func TestMemoryStoreEachUserPagesAndCancels(t *testing.T) {
+	// Setup
+	s := newMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 3*memoryPageSize; i++ {
+		s.CreateUser(ctx, User{Name: "user"})
+	}
+
+	// Execute
+	seen := 0
+	err := s.EachUser(ctx, func(user User) error {
+		seen++
+		if seen == memoryPageSize+1 {
+			cancel()
+		}
+		return nil
+	})
+
+	// Validate
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 2*memoryPageSize, seen)
+}
+
+func TestSQLStoreBatchAndPageQueries(t *testing.T) {
+	// Setup
+	storeDB, storeMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer storeDB.Close()
+	s := newSQLStore(storeDB)
+
+	// Mock DB response
+	storeMock.ExpectQuery("SELECT id, name FROM users WHERE id = ANY\\(\\$1::int\\[\\]\\) ORDER BY id").
+		WithArgs("{3,1}").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "John Doe").AddRow(3, "Jim Doe"))
+	storeMock.ExpectQuery("SELECT id, name FROM users WHERE id > \\$1 ORDER BY id LIMIT \\$2").
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(3, "Jim Doe"))
+
+	// Execute
+	batch, batchErr := s.GetUsers(context.Background(), []int{3, 1})
+	page, pageErr := s.PageUsers(context.Background(), 1, 2)
+
+	// Validate
+	assert.NoError(t, batchErr)
+	assert.NoError(t, pageErr)
+	assert.Equal(t, []User{{ID: 1, Name: "John Doe"}, {ID: 3, Name: "Jim Doe"}}, batch)
+	assert.Equal(t, []User{{ID: 3, Name: "Jim Doe"}}, page)
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
+
+func TestSQLStoreClassifiesErrors(t *testing.T) {
+	// Setup
+	storeDB, storeMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer storeDB.Close()
+	s := newSQLStore(storeDB)
+	s.queryTimeout = 20 * time.Millisecond
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	// Mock DB response
+	storeMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").
+		WithArgs(1).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "John Doe"))
+	storeMock.ExpectExec("DELETE FROM users WHERE id = \\$1").
+		WithArgs(1).
+		WillReturnError(refused)
+	storeMock.ExpectQuery("SELECT EXISTS").
+		WithArgs(1).
+		WillReturnError(errors.New("syntax error"))
+
+	// Execute
+	start := time.Now()
+	_, getErr := s.GetUser(context.Background(), 1)
+	elapsed := time.Since(start)
+	deleteErr := s.DeleteUser(context.Background(), 1)
+	_, existsErr := s.UserExists(context.Background(), 1)
+
+	// Validate
+	assert.ErrorIs(t, getErr, ErrStoreTimeout)
+	assert.Less(t, elapsed, 500*time.Millisecond)
+	assert.ErrorIs(t, deleteErr, ErrStoreUnavailable)
+	assert.ErrorIs(t, deleteErr, refused)
+	assert.Error(t, existsErr)
+	assert.NotErrorIs(t, existsErr, ErrStoreTimeout)
+	assert.NotErrorIs(t, existsErr, ErrStoreUnavailable)
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
+
+func TestHandlersMapStoreErrors(t *testing.T) {
+	// Setup
+	router, storeMock := newTestServer(t, WithQueryTimeouts(20*time.Millisecond, time.Minute))
+
+	// Mock DB response
+	storeMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").
+		WithArgs(1).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	storeMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").
+		WithArgs(2).
+		WillReturnError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+
+	// Execute
+	slow := httptest.NewRecorder()
+	router.ServeHTTP(slow, httptest.NewRequest("GET", "/v1/users/1", nil))
+	down := httptest.NewRecorder()
+	router.ServeHTTP(down, httptest.NewRequest("GET", "/v1/users/2", nil))
+
+	// Validate
+	assert.Equal(t, http.StatusGatewayTimeout, slow.Code)
+	assert.Equal(t, "application/problem+json", slow.Header().Get("Content-Type"))
+	assert.Contains(t, slow.Body.String(), problemBaseURI+"database-timeout")
+	assert.Equal(t, http.StatusServiceUnavailable, down.Code)
+	assert.Equal(t, "application/problem+json", down.Header().Get("Content-Type"))
+	assert.Contains(t, down.Body.String(), problemBaseURI+"database-unavailable")
+	assert.Equal(t, "5", down.Header().Get("Retry-After"))
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
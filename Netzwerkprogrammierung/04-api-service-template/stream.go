@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// streamFlushInterval is the number of elements written between two flushes
+// of a streamed response.
+const streamFlushInterval = 256
+
+// jsonArrayWriter encodes values as the elements of a JSON array while they
+// are produced, so the array is never held in memory as a whole. Output is
+// flushed to the client every streamFlushInterval elements.
+type jsonArrayWriter struct {
+	out     *sentWriter
+	w       *bufio.Writer
+	flusher http.Flusher
+	buf     bytes.Buffer
+	enc     *json.Encoder
+	count   int
+}
+
+// newJSONArrayWriter returns a jsonArrayWriter writing to w. If flusher is
+// not nil it is flushed along with the internal buffer.
+func newJSONArrayWriter(w io.Writer, flusher http.Flusher) *jsonArrayWriter {
+	a := &jsonArrayWriter{out: &sentWriter{w: w}, flusher: flusher}
+	a.w = bufio.NewWriterSize(a.out, 32*1024)
+	a.enc = json.NewEncoder(&a.buf)
+	return a
+}
+
+// Len returns the number of elements written so far.
+func (a *jsonArrayWriter) Len() int {
+	return a.count
+}
+
+// Sent reports whether any output reached the client. Until then the
+// response can still be replaced by an error.
+func (a *jsonArrayWriter) Sent() bool {
+	return a.out.sent
+}
+
+// Write appends v to the array.
+func (a *jsonArrayWriter) Write(v any) error {
+	a.buf.Reset()
+	if err := a.enc.Encode(v); err != nil {
+		return err
+	}
+
+	separator := byte(',')
+	if a.count == 0 {
+		separator = '['
+	}
+	if err := a.w.WriteByte(separator); err != nil {
+		return err
+	}
+	// Drop the newline appended by json.Encoder.
+	if _, err := a.w.Write(a.buf.Bytes()[:a.buf.Len()-1]); err != nil {
+		return err
+	}
+
+	a.count++
+	if a.count%streamFlushInterval == 0 {
+		return a.Flush()
+	}
+	return nil
+}
+
+// Flush sends everything written so far to the client.
+func (a *jsonArrayWriter) Flush() error {
+	if err := a.w.Flush(); err != nil {
+		return err
+	}
+	if a.flusher != nil {
+		a.flusher.Flush()
+	}
+	return nil
+}
+
+// Close terminates the array and flushes it.
+func (a *jsonArrayWriter) Close() error {
+	if a.count == 0 {
+		if err := a.w.WriteByte('['); err != nil {
+			return err
+		}
+	}
+	if err := a.w.WriteByte(']'); err != nil {
+		return err
+	}
+	return a.Flush()
+}
+
+// sentWriter records whether anything was written to w.
+type sentWriter struct {
+	w    io.Writer
+	sent bool
+}
+
+func (s *sentWriter) Write(p []byte) (int, error) {
+	s.sent = s.sent || len(p) > 0
+	return s.w.Write(p)
+}
+
+// abortStream ends a streamed response that failed with err. If nothing
+// reached the client yet the error is reported instead. Otherwise the
+// connection is torn down, so that the client sees a truncated response
+// instead of one that looks complete.
+func (s *Server) abortStream(w http.ResponseWriter, sent bool, err error, msg string, rows int) {
+	if !sent {
+		writeStoreError(w, err)
+		return
+	}
+	s.logger.Warn(msg, "rows", rows, "error", err)
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// benchmarkUserCount is the table size used by the list benchmarks.
+const benchmarkUserCount = 1_000_000
+
+var benchmarkStore = sync.OnceValue(func() *memoryStore {
+	s := newMemoryStore()
+	for i := 0; i < benchmarkUserCount; i++ {
+		s.CreateUser(context.Background(), User{Name: "Benchmark User"})
+	}
+	return s
+})
+
+// getUsersBuffered is the list handler as it was before streaming: every row
+// is collected into a slice and marshalled in one piece.
+func (s *Server) getUsersBuffered(w http.ResponseWriter, r *http.Request) {
+	var users []User
+	err := s.store.EachUser(r.Context(), func(user User) error {
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response, _ := json.Marshal(users)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// ttfbWriter is a ResponseWriter discarding the body and recording when the
+// first byte was written.
+type ttfbWriter struct {
+	header    http.Header
+	start     time.Time
+	firstByte time.Duration
+	written   int64
+}
+
+func (t *ttfbWriter) Header() http.Header { return t.header }
+func (t *ttfbWriter) WriteHeader(int)     {}
+func (t *ttfbWriter) Flush()              {}
+
+func (t *ttfbWriter) Write(p []byte) (int, error) {
+	if t.written == 0 {
+		t.firstByte = time.Since(t.start)
+	}
+	t.written += int64(len(p))
+	return len(p), nil
+}
+
+func benchmarkListUsers(b *testing.B, handler func(*Server, http.ResponseWriter, *http.Request)) {
+	server := NewServer(WithStore(benchmarkStore()))
+	req := httptest.NewRequest("GET", "/v1/users", nil)
+
+	var firstByte time.Duration
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := &ttfbWriter{header: http.Header{}, start: time.Now()}
+		handler(server, w, req)
+		firstByte += w.firstByte
+		b.SetBytes(w.written)
+	}
+	b.ReportMetric(float64(firstByte.Nanoseconds())/float64(b.N), "ttfb-ns/op")
+}
+
+func BenchmarkListUsersBuffered(b *testing.B) {
+	benchmarkListUsers(b, (*Server).getUsersBuffered)
+}
+
+func BenchmarkListUsersStreaming(b *testing.B) {
+	benchmarkListUsers(b, (*Server).getUsersV1)
+}
+
+func TestJSONArrayWriter(t *testing.T) {
+	// Setup
+	var buf bytes.Buffer
+	empty := newJSONArrayWriter(&buf, nil)
+
+	// Execute
+	err := empty.Close()
+
+	// Validate
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", buf.String())
+
+	// Setup
+	buf.Reset()
+	users := newJSONArrayWriter(&buf, nil)
+
+	// Execute
+	for i := 1; i <= streamFlushInterval+1; i++ {
+		assert.NoError(t, users.Write(User{ID: i, Name: "<b>"}))
+	}
+	err = users.Close()
+
+	// Validate
+	assert.NoError(t, err)
+	var decoded []User
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Len(t, decoded, streamFlushInterval+1)
+	expected, _ := json.Marshal(decoded)
+	assert.Equal(t, string(expected), buf.String())
+}
+
+func TestGetUsersStopsWhenClientDisconnects(t *testing.T) {
+	// Setup
+	memory := newMemoryStore()
+	for i := 0; i < 4*streamFlushInterval; i++ {
+		memory.CreateUser(context.Background(), User{Name: "John Doe"})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/v1/users", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	router := NewServer(WithStore(memory))
+
+	// Execute
+	cancelAfterFirstFlush := &cancelingRecorder{ResponseRecorder: rr, cancel: cancel}
+
+	// Validate
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() { router.ServeHTTP(cancelAfterFirstFlush, req) })
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, strings.HasPrefix(rr.Body.String(), "[{"))
+	assert.False(t, strings.HasSuffix(rr.Body.String(), "]"))
+}
+
+// failingStore fails listing users after the given number of rows.
+type failingStore struct {
+	UserStore
+	after int
+}
+
+func (s *failingStore) EachUser(ctx context.Context, fn func(User) error) error {
+	rows := 0
+	return s.UserStore.EachUser(ctx, func(user User) error {
+		if rows == s.after {
+			return ErrStoreUnavailable
+		}
+		rows++
+		return fn(user)
+	})
+}
+
+// newFailingStore returns a store with users rows that fails listing them
+// after the given number of rows.
+func newFailingStore(users, after int) *failingStore {
+	memory := newMemoryStore()
+	for i := 0; i < users; i++ {
+		memory.CreateUser(context.Background(), User{Name: "John Doe"})
+	}
+	return &failingStore{UserStore: memory, after: after}
+}
+
+func TestGetUsersReportsStoreErrors(t *testing.T) {
+	// Setup
+	router := NewServer(WithStore(newFailingStore(10, 3)))
+	req := httptest.NewRequest("GET", "/v1/users", nil)
+	rr := httptest.NewRecorder()
+
+	// Execute
+	router.ServeHTTP(rr, req)
+
+	// Validate
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code, "nothing was sent yet, so the error can still be reported")
+	assert.NotContains(t, rr.Body.String(), "John Doe")
+}
+
+func TestGetUsersAbortsAfterSendingRows(t *testing.T) {
+	// Setup
+	router := NewServer(WithStore(newFailingStore(4*streamFlushInterval, 2*streamFlushInterval+3)))
+	req := httptest.NewRequest("GET", "/v1/users", nil)
+	rr := httptest.NewRecorder()
+
+	// Execute and validate
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() { router.ServeHTTP(rr, req) })
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, strings.HasPrefix(rr.Body.String(), "[{"))
+	assert.False(t, strings.HasSuffix(rr.Body.String(), "]"), "the client must not see a complete array")
+}
+
+// cancelingRecorder cancels the request context on the first flush, as if
+// the client went away after receiving the first chunk.
+type cancelingRecorder struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (c *cancelingRecorder) Flush() {
+	c.ResponseRecorder.Flush()
+	c.cancel()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tenantHeader names the tenant of a request when it carries no token.
+const tenantHeader = "X-Tenant-ID"
+
+// defaultTenant owns the rows that existed before tenancy was enabled and
+// every row written while it is disabled.
+const defaultTenant = "default"
+
+// tenantPattern restricts tenant ids to what is safe in hostnames, cache
+// keys and logs.
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+type tenantKey struct{}
+
+// withTenant returns a copy of ctx scoped to tenant.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns the tenant ctx is scoped to, or "" if tenancy is
+// disabled.
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantOrDefault returns the tenant of ctx, or the default tenant if tenancy
+// is disabled.
+func tenantOrDefault(ctx context.Context) string {
+	if tenant := tenantFrom(ctx); tenant != "" {
+		return tenant
+	}
+	return defaultTenant
+}
+
+// TenantResolver determines the tenant of a request. A bearer token is
+// verified with secret and its tenant claim is authoritative; without one
+// the X-Tenant-ID header is used, and then the first label of the host
+// below baseDomain. Header and subdomain are meant for deployments behind a
+// gateway that authenticates the client.
+type TenantResolver struct {
+	secret     []byte
+	baseDomain string
+	now        func() time.Time
+}
+
+// NewTenantResolver returns a resolver. An empty secret disables tokens,
+// an empty baseDomain disables subdomains.
+func NewTenantResolver(secret []byte, baseDomain string) *TenantResolver {
+	return &TenantResolver{secret: secret, baseDomain: strings.ToLower(strings.TrimPrefix(baseDomain, ".")), now: time.Now}
+}
+
+// Errors of Resolve besides ErrInvalidToken.
+var (
+	errTenantRequired = errors.New("tenant required")
+	errInvalidTenant  = errors.New("invalid tenant")
+	errTenantMismatch = errors.New("tenant header does not match the token")
+)
+
+// Resolve returns the tenant of r.
+func (t *TenantResolver) Resolve(r *http.Request) (string, error) {
+	header := r.Header.Get(tenantHeader)
+
+	claimed, found, err := t.claimedTenant(r)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		if !tenantPattern.MatchString(claimed) {
+			return "", ErrInvalidToken
+		}
+		if header != "" && header != claimed {
+			return "", errTenantMismatch
+		}
+		return claimed, nil
+	}
+
+	if header != "" {
+		if !tenantPattern.MatchString(header) {
+			return "", errInvalidTenant
+		}
+		return header, nil
+	}
+
+	if t.baseDomain != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if sub, found := strings.CutSuffix(strings.ToLower(host), "."+t.baseDomain); found && tenantPattern.MatchString(sub) {
+			return sub, nil
+		}
+	}
+	return "", errTenantRequired
+}
+
+// claimedTenant returns the tenant claim of the token of r. found is false
+// if the request carries no token.
+func (t *TenantResolver) claimedTenant(r *http.Request) (tenant string, found bool, err error) {
+	if p := principalFrom(r.Context()); p != nil {
+		// The Authenticator already verified the token.
+		return p.Tenant, true, nil
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || len(t.secret) == 0 {
+		return "", false, nil
+	}
+	claims, err := verifyJWT(token, t.secret, t.now())
+	return claims.Tenant, true, err
+}
+
+// Middleware scopes the request context to the tenant of the request and
+// rejects requests without a valid one.
+func (t *TenantResolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := t.Resolve(r)
+		switch {
+		case errors.Is(err, ErrInvalidToken):
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case errors.Is(err, errTenantMismatch):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), tenant)))
+	})
+}
+
+// cacheKey returns the response cache key of r, scoped to its tenant. The
+// query parameters are sorted by name, so that their order does not split
+// the cache.
+func cacheKey(r *http.Request) string {
+	key := r.URL.EscapedPath()
+	if query := r.URL.Query(); len(query) > 0 {
+		key += "?" + query.Encode()
+	}
+	return cachePrefix(r.Context(), key)
+}
+
+// cachePrefix returns the prefix of the cache keys of the tenant of ctx
+// starting with path.
+func cachePrefix(ctx context.Context, path string) string {
+	if tenant := tenantFrom(ctx); tenant != "" {
+		return tenant + " " + path
+	}
+	return path
+}
+
+// tenantMemoryStore keeps the users of every tenant in a memoryStore of its
+// own, mirroring the row-level security of the PostgreSQL store.
+type tenantMemoryStore struct {
+	mu      sync.Mutex
+	tenants map[string]*memoryStore
+}
+
+// newTenantMemoryStore returns an empty tenant-partitioned UserStore.
+func newTenantMemoryStore() *tenantMemoryStore {
+	return &tenantMemoryStore{tenants: make(map[string]*memoryStore)}
+}
+
+// of returns the store of the tenant of ctx.
+func (s *tenantMemoryStore) of(ctx context.Context) *memoryStore {
+	tenant := tenantOrDefault(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	store, found := s.tenants[tenant]
+	if !found {
+		store = newMemoryStore()
+		s.tenants[tenant] = store
+	}
+	return store
+}
+
+func (s *tenantMemoryStore) EachUser(ctx context.Context, fn func(User) error) error {
+	return s.of(ctx).EachUser(ctx, fn)
+}
+
+func (s *tenantMemoryStore) GetUser(ctx context.Context, id int) (User, error) {
+	return s.of(ctx).GetUser(ctx, id)
+}
+
+func (s *tenantMemoryStore) GetUsers(ctx context.Context, ids []int) ([]User, error) {
+	return s.of(ctx).GetUsers(ctx, ids)
+}
+
+func (s *tenantMemoryStore) PageUsers(ctx context.Context, afterID, limit int) ([]User, error) {
+	return s.of(ctx).PageUsers(ctx, afterID, limit)
+}
+
+func (s *tenantMemoryStore) UserExists(ctx context.Context, id int) (bool, error) {
+	return s.of(ctx).UserExists(ctx, id)
+}
+
+func (s *tenantMemoryStore) CreateUser(ctx context.Context, user User) (User, error) {
+	return s.of(ctx).CreateUser(ctx, user)
+}
+
+func (s *tenantMemoryStore) UpsertUser(ctx context.Context, user User) (bool, error) {
+	return s.of(ctx).UpsertUser(ctx, user)
+}
+
+func (s *tenantMemoryStore) UpdateUser(ctx context.Context, user User) error {
+	return s.of(ctx).UpdateUser(ctx, user)
+}
+
+func (s *tenantMemoryStore) DeleteUser(ctx context.Context, id int) error {
+	return s.of(ctx).DeleteUser(ctx, id)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+var testJWTSecret = []byte("test-secret")
+
+func testToken(t *testing.T, claims map[string]any) string {
+	token, err := signJWT(claims, testJWTSecret)
+	assert.NoError(t, err)
+	return token
+}
+
+func TestVerifyJWT(t *testing.T) {
+	// Setup
+	now := time.Unix(1_700_000_000, 0)
+	valid := testToken(t, map[string]any{"sub": "alice", "tenant": "acme", "exp": now.Add(time.Hour).Unix()})
+	expired := testToken(t, map[string]any{"tenant": "acme", "exp": now.Add(-time.Hour).Unix()})
+	noExpiry := testToken(t, map[string]any{"tenant": "acme"})
+	parts := strings.Split(valid, ".")
+	unsigned := "eyJhbGciOiJub25lIn0." + parts[1] + "."
+	tampered := parts[0] + "." + strings.Split(testToken(t, map[string]any{"tenant": "evil", "exp": now.Add(time.Hour).Unix()}), ".")[1] + "." + parts[2]
+
+	// Execute
+	claims, err := verifyJWT(valid, testJWTSecret, now)
+
+	// Validate
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+	assert.Equal(t, "acme", claims.Tenant)
+	for name, token := range map[string]string{"expired": expired, "no expiry": noExpiry, "alg none": unsigned, "tampered": tampered, "garbage": "a.b"} {
+		_, err := verifyJWT(token, testJWTSecret, now)
+		assert.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+	_, err = verifyJWT(valid, []byte("other-secret"), now)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestTenantResolver(t *testing.T) {
+	// Setup
+	resolver := NewTenantResolver(testJWTSecret, "api.example.com")
+	token := testToken(t, map[string]any{"tenant": "acme", "exp": time.Now().Add(time.Hour).Unix()})
+	tests := []struct {
+		name, host, tenantHeader, authorization string
+		status                                  int
+		tenant                                  string
+	}{
+		{name: "token", authorization: "Bearer " + token, status: http.StatusOK, tenant: "acme"},
+		{name: "token and matching header", authorization: "Bearer " + token, tenantHeader: "acme", status: http.StatusOK, tenant: "acme"},
+		{name: "token and other header", authorization: "Bearer " + token, tenantHeader: "globex", status: http.StatusForbidden},
+		{name: "invalid token", authorization: "Bearer x.y.z", status: http.StatusUnauthorized},
+		{name: "header", tenantHeader: "globex", status: http.StatusOK, tenant: "globex"},
+		{name: "invalid header", tenantHeader: "Globex Corp", status: http.StatusBadRequest},
+		{name: "subdomain", host: "initech.api.example.com:8080", status: http.StatusOK, tenant: "initech"},
+		{name: "foreign domain", host: "initech.example.org", status: http.StatusBadRequest},
+		{name: "none", status: http.StatusBadRequest},
+	}
+	var tenant string
+	handler := resolver.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = tenantFrom(r.Context())
+	}))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenant = ""
+			req := httptest.NewRequest("GET", "/v1/users", nil)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			if tt.tenantHeader != "" {
+				req.Header.Set(tenantHeader, tt.tenantHeader)
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+
+			// Execute
+			handler.ServeHTTP(rr, req)
+
+			// Validate
+			assert.Equal(t, tt.status, rr.Code)
+			assert.Equal(t, tt.tenant, tenant)
+		})
+	}
+}
+
+func TestSQLStoreScopesStatementsToTenant(t *testing.T) {
+	// Setup
+	storeDB, storeMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer storeDB.Close()
+	s := newSQLStore(storeDB)
+	ctx := withTenant(context.Background(), "acme")
+
+	// Mock DB response
+	storeMock.ExpectBegin()
+	storeMock.ExpectExec("SELECT set_config\\('app.tenant_id', \\$1, true\\)").WithArgs("acme").WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectQuery("SELECT id, name FROM users WHERE id = \\$1").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}))
+	storeMock.ExpectRollback()
+	storeMock.ExpectBegin()
+	storeMock.ExpectExec("SELECT set_config\\('app.tenant_id', \\$1, true\\)").WithArgs("acme").WillReturnResult(sqlmock.NewResult(0, 1))
+	storeMock.ExpectQuery("INSERT INTO users \\(name\\) VALUES \\(\\$1\\) RETURNING id").WithArgs("Alice").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	storeMock.ExpectCommit()
+
+	// Execute
+	_, getErr := s.GetUser(ctx, 1)
+	created, createErr := s.CreateUser(ctx, User{Name: "Alice"})
+
+	// Validate
+	assert.ErrorIs(t, getErr, ErrUserNotFound, "rows of other tenants are invisible")
+	assert.NoError(t, createErr)
+	assert.Equal(t, 1, created.ID)
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
+
+func TestTenantsCannotAccessEachOthersUsers(t *testing.T) {
+	// Setup
+	handler := NewServer(WithTenancy(NewTenantResolver(nil, "")))
+	serve := func(method, path, tenant, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(tenantHeader, tenant)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Execute
+	created := serve("POST", "/v1/users", "acme", `{"name":"Alice"}`)
+	own := serve("GET", "/v1/users/1", "acme", "")
+	foreign := serve("GET", "/v1/users/1", "globex", "")
+	foreignUpdate := serve("PUT", "/v1/users/1", "globex", `{"name":"Mallory"}`)
+	foreignDelete := serve("DELETE", "/v1/users/1", "globex", "")
+	foreignList := serve("GET", "/v1/users", "globex", "")
+
+	// Validate
+	assert.Equal(t, http.StatusOK, created.Code)
+	assert.Equal(t, http.StatusOK, own.Code)
+	assert.JSONEq(t, `{"id":1,"name":"Alice"}`, own.Body.String())
+	assert.Equal(t, http.StatusNotFound, foreign.Code)
+	assert.Equal(t, http.StatusNotFound, foreignUpdate.Code)
+	assert.Equal(t, http.StatusNotFound, foreignDelete.Code)
+	assert.JSONEq(t, `[]`, foreignList.Body.String())
+}
+
+func TestCacheKeyIsTenantScoped(t *testing.T) {
+	// Setup
+	req := httptest.NewRequest("GET", "/v1/users/1", nil)
+
+	// Execute
+	acme := cacheKey(req.WithContext(withTenant(req.Context(), "acme")))
+	globex := cacheKey(req.WithContext(withTenant(req.Context(), "globex")))
+
+	// Validate
+	assert.Equal(t, "/v1/users/1", cacheKey(req))
+	assert.NotEqual(t, acme, globex)
+}
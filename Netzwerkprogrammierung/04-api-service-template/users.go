@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// User represents a user in the system.
+type User struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// writeStoreError reports an error of the business layer that is not caused
+// by the request data: 403 if the caller lacks a permission, 504 if the
+// database timed out, 503 if it is unreachable and 500 otherwise.
+func writeStoreError(w http.ResponseWriter, err error) {
+	var permissionErr *PermissionError
+	switch {
+	case errors.As(err, &permissionErr):
+		writeProblem(w, problem{Type: problemBaseURI + "forbidden", Title: "Forbidden", Status: http.StatusForbidden,
+			Detail: permissionErr.Error(), MissingPermission: permissionErr.Permission})
+	case errors.Is(err, ErrStoreTimeout):
+		writeProblem(w, problem{Type: problemBaseURI + "database-timeout", Title: "Database timeout",
+			Status: http.StatusGatewayTimeout, Detail: err.Error()})
+	case errors.Is(err, ErrStoreUnavailable):
+		w.Header().Set("Retry-After", "5")
+		writeProblem(w, problem{Type: problemBaseURI + "database-unavailable", Title: "Database unavailable",
+			Status: http.StatusServiceUnavailable, Detail: err.Error()})
+	default:
+		writeProblem(w, problem{Type: problemBaseURI + "internal-error", Title: "Internal server error",
+			Status: http.StatusInternalServerError, Detail: err.Error()})
+	}
+}
+
+// getUsersV1 handles the GET /v1/users endpoint. Users are encoded while they
+// are read from the store, so memory use does not grow with the table size.
+func (s *Server) getUsersV1(w http.ResponseWriter, r *http.Request) {
+	flusher, _ := w.(http.Flusher)
+	users := newJSONArrayWriter(w, flusher)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := s.users.listUsers(r.Context(), func(user User) error {
+		return users.Write(user)
+	})
+	if err == nil {
+		err = users.Close()
+	}
+	if err != nil {
+		s.abortStream(w, users.Sent(), err, "Listing users aborted", users.Len())
+	}
+}
+
+// createUser handles the POST /v1/users endpoint.
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.users.addUserV1(r.Context(), user)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	response, _ := json.Marshal(user)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// getUser handles the GET /v1/users/{id} endpoint.
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.users.findUser(r.Context(), id)
+	if errors.Is(err, ErrUserNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	response, _ := json.Marshal(user)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// updateUser handles the PUT /v1/users/{id} endpoint.
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var updatedUser User
+	if err := json.NewDecoder(r.Body).Decode(&updatedUser); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updatedUser.ID = id
+	err = s.users.saveUserV1(r.Context(), updatedUser)
+	if errors.Is(err, ErrUserNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	response, _ := json.Marshal(updatedUser)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// deleteUser handles the DELETE /v1/users/{id} endpoint.
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	err = s.users.removeUser(r.Context(), id)
+	if errors.Is(err, ErrUserNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
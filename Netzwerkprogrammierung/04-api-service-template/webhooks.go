@@ -0,0 +1,1260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+
+	// maxWebhookDeliveryLog is the number of finished deliveries kept per
+	// subscription.
+	maxWebhookDeliveryLog = 100
+)
+
+// Webhook delivery states.
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+var (
+	errWebhookNotFound   = errors.New("webhook subscription not found")
+	errDeliveryNotFound  = errors.New("webhook delivery not found")
+	errWebhookInactive   = errors.New("webhook subscription is disabled")
+	errWebhookInvalidURL = errors.New("url must be an absolute http or https URL")
+	errWebhookPrivateURL = errors.New("url must not point to a loopback, link-local or private address")
+)
+
+// WebhookSubscription is an endpoint receiving user lifecycle events of its
+// tenant. The secret is only returned when the subscription is created or
+// rotated.
+type WebhookSubscription struct {
+	ID                  int       `json:"id"`
+	Tenant              string    `json:"-"`
+	URL                 string    `json:"url"`
+	Events              []string  `json:"events"`
+	Secret              string    `json:"secret,omitempty"`
+	Active              bool      `json:"active"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	DisabledReason      string    `json:"disabled_reason,omitempty"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+// wants reports whether the subscription receives events of eventType.
+func (s *WebhookSubscription) wants(eventType string) bool {
+	return slices.Contains(s.Events, eventType)
+}
+
+// redacted returns a copy of the subscription without its secret.
+func (s *WebhookSubscription) redacted() WebhookSubscription {
+	c := *s
+	c.Events = slices.Clone(s.Events)
+	c.Secret = ""
+	return c
+}
+
+// WebhookDelivery is the delivery of one event to one subscription,
+// including its retries. A pending delivery is attempted at NextAttemptAt
+// by whichever instance claims it first.
+type WebhookDelivery struct {
+	ID             int        `json:"id"`
+	SubscriptionID int        `json:"subscription_id"`
+	Tenant         string     `json:"-"`
+	Event          UserEvent  `json:"event"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// webhookClaimLease is how long a delivery stays with the instance that
+// claimed it. If the instance does not finish it in time, for example
+// because it stopped, another instance attempts it again.
+const webhookClaimLease = time.Minute
+
+// WebhookDispatcher manages webhook subscriptions and delivers user events
+// to them from background workers. Subscriptions and deliveries are kept in
+// a WebhookStore, so that every instance sharing the store delivers to all
+// subscriptions and picks up the retries of the others. Failed attempts are
+// retried with exponential backoff, and subscriptions failing too often in
+// a row are disabled.
+type WebhookDispatcher struct {
+	store        WebhookStore
+	client       *http.Client
+	maxAttempts  int
+	disableAfter int
+	baseBackoff  time.Duration
+	maxBackoff   time.Duration
+	// pollInterval is how often the store is checked for deliveries that
+	// are due.
+	pollInterval time.Duration
+	// allowPrivate accepts URLs of loopback, link-local and private
+	// addresses, which are refused to keep subscribers from reaching
+	// internal services.
+	allowPrivate bool
+	logger       *slog.Logger
+	now          func() time.Time
+
+	mu       sync.Mutex
+	queue    []webhookJob
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// webhookJob is a delivery claimed by this instance.
+type webhookJob struct {
+	id     int
+	tenant string
+}
+
+// NewWebhookDispatcher returns a dispatcher keeping subscriptions in process
+// memory and sending requests with client. Deliveries are attempted up to
+// maxAttempts times, waiting baseBackoff after the first failure and
+// doubling up to maxBackoff; a subscription is disabled after disableAfter
+// consecutive failed attempts.
+func NewWebhookDispatcher(client *http.Client, maxAttempts, disableAfter int, baseBackoff, maxBackoff time.Duration) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		store:        newMemoryWebhookStore(),
+		client:       client,
+		maxAttempts:  maxAttempts,
+		disableAfter: disableAfter,
+		baseBackoff:  baseBackoff,
+		maxBackoff:   maxBackoff,
+		pollInterval: time.Second,
+		logger:       slog.Default(),
+		now:          time.Now,
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+}
+
+// Start launches the given number of delivery workers and, if there are
+// any, polls the store for deliveries that are due.
+func (d *WebhookDispatcher) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	if workers > 0 {
+		d.wg.Add(1)
+		go d.poll()
+	}
+}
+
+// Stop waits for the workers to finish their current attempt. Deliveries
+// still pending stay in the store for the next start or another instance;
+// those queued here are released, so that other instances need not wait for
+// their claim to expire. It can be called more than once.
+func (d *WebhookDispatcher) Stop() {
+	d.stopOnce.Do(func() { close(d.stop) })
+	d.wg.Wait()
+	d.release()
+}
+
+// release makes the deliveries queued but not attempted due now.
+func (d *WebhookDispatcher) release() {
+	d.mu.Lock()
+	queue := d.queue
+	d.queue = nil
+	d.mu.Unlock()
+	for _, job := range queue {
+		ctx := withTenant(context.Background(), job.tenant)
+		delivery, err := d.store.GetDelivery(ctx, job.id)
+		if err == nil && delivery.Status == deliveryPending {
+			now := d.now().UTC()
+			delivery.NextAttemptAt = &now
+			err = d.store.UpdateDelivery(ctx, delivery)
+		}
+		if err != nil && !errors.Is(err, errDeliveryNotFound) {
+			d.logger.Warn("Failed to release webhook delivery", "delivery", job.id, "tenant", job.tenant, "error", err)
+		}
+	}
+}
+
+// Publish queues a delivery of event to every active subscription of its
+// tenant wanting it. Failures of the store are logged, as the event was
+// already written.
+func (d *WebhookDispatcher) Publish(event UserEvent) {
+	deliveries, err := d.newDeliveries(context.Background(), event)
+	if err != nil {
+		d.logger.Error("Failed to queue webhook deliveries", "event", event.ID, "type", event.Type, "error", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, delivery := range deliveries {
+		d.enqueueLocked(webhookJob{delivery.ID, delivery.Tenant})
+	}
+}
+
+// Deliver sends event to every active subscription of its tenant wanting it
+// and waits for the attempts. Failed deliveries are not retried; Deliver
+// returns an error instead, so that the caller retries the event. The
+// outbox relay delivers this way, so that events only leave the outbox
+// once they reached the subscribers.
+func (d *WebhookDispatcher) Deliver(ctx context.Context, event UserEvent) error {
+	deliveries, err := d.newDeliveries(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(deliveries))
+	var wg sync.WaitGroup
+	for i, delivery := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = d.attempt(ctx, webhookJob{delivery.ID, delivery.Tenant}, false)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// newDeliveries records a pending delivery of event, claimed by this
+// instance, to every active subscription of its tenant wanting it.
+func (d *WebhookDispatcher) newDeliveries(ctx context.Context, event UserEvent) ([]WebhookDelivery, error) {
+	tenant := event.Tenant
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	ctx = withTenant(ctx, tenant)
+	subs, err := d.store.ListSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []WebhookDelivery
+	for _, sub := range subs {
+		if sub.Active && sub.wants(event.Type) {
+			delivery, err := d.newDelivery(ctx, sub.ID, event)
+			if err != nil {
+				return deliveries, err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+// newDelivery records a pending delivery in the tenant of ctx, claimed by
+// this instance.
+func (d *WebhookDispatcher) newDelivery(ctx context.Context, subscriptionID int, event UserEvent) (WebhookDelivery, error) {
+	now := d.now().UTC()
+	lease := now.Add(webhookClaimLease)
+	return d.store.CreateDelivery(ctx, WebhookDelivery{
+		SubscriptionID: subscriptionID,
+		Tenant:         tenantOrDefault(ctx),
+		Event:          event,
+		Status:         deliveryPending,
+		NextAttemptAt:  &lease,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	})
+}
+
+// Create registers a new subscription in the tenant of ctx. A secret is
+// generated unless one is given.
+func (d *WebhookDispatcher) Create(ctx context.Context, sub WebhookSubscription) (WebhookSubscription, error) {
+	if err := d.normalize(&sub); err != nil {
+		return WebhookSubscription{}, err
+	}
+	if sub.Secret == "" {
+		sub.Secret = randomHex(32)
+	}
+	sub.Tenant = tenantOrDefault(ctx)
+	sub.Active = true
+	sub.ConsecutiveFailures = 0
+	sub.DisabledReason = ""
+	sub.CreatedAt = d.now().UTC()
+	return d.store.CreateSubscription(ctx, sub)
+}
+
+// List returns the subscriptions of the tenant of ctx ordered by id,
+// without their secrets.
+func (d *WebhookDispatcher) List(ctx context.Context) ([]WebhookSubscription, error) {
+	subs, err := d.store.ListSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	redacted := make([]WebhookSubscription, len(subs))
+	for i := range subs {
+		redacted[i] = subs[i].redacted()
+	}
+	return redacted, nil
+}
+
+// Get returns the subscription with the given id without its secret.
+func (d *WebhookDispatcher) Get(ctx context.Context, id int) (WebhookSubscription, error) {
+	sub, err := d.store.GetSubscription(ctx, id)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	return sub.redacted(), nil
+}
+
+// Update replaces url, events and active flag of a subscription. A non-empty
+// secret rotates the signing secret. Re-activating a subscription resets its
+// failure count.
+func (d *WebhookDispatcher) Update(ctx context.Context, sub WebhookSubscription) (WebhookSubscription, error) {
+	if err := d.normalize(&sub); err != nil {
+		return WebhookSubscription{}, err
+	}
+	existing, err := d.store.GetSubscription(ctx, sub.ID)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	existing.URL = sub.URL
+	existing.Events = sub.Events
+	if sub.Active && !existing.Active {
+		existing.ConsecutiveFailures = 0
+		existing.DisabledReason = ""
+	}
+	existing.Active = sub.Active
+	if sub.Secret != "" {
+		existing.Secret = sub.Secret
+	}
+	if err := d.store.UpdateSubscription(ctx, existing); err != nil {
+		return WebhookSubscription{}, err
+	}
+	updated := existing.redacted()
+	updated.Secret = sub.Secret
+	return updated, nil
+}
+
+// Delete removes a subscription together with its delivery log.
+func (d *WebhookDispatcher) Delete(ctx context.Context, id int) error {
+	return d.store.DeleteSubscription(ctx, id)
+}
+
+// Deliveries returns the delivery log of a subscription, newest first.
+func (d *WebhookDispatcher) Deliveries(ctx context.Context, subscriptionID int) ([]WebhookDelivery, error) {
+	if _, err := d.store.GetSubscription(ctx, subscriptionID); err != nil {
+		return nil, err
+	}
+	return d.store.ListDeliveries(ctx, subscriptionID)
+}
+
+// Redeliver queues a new delivery of the event of an earlier delivery.
+func (d *WebhookDispatcher) Redeliver(ctx context.Context, subscriptionID, deliveryID int) (WebhookDelivery, error) {
+	sub, err := d.store.GetSubscription(ctx, subscriptionID)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	original, err := d.store.GetDelivery(ctx, deliveryID)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	if original.SubscriptionID != subscriptionID {
+		return WebhookDelivery{}, errDeliveryNotFound
+	}
+	if !sub.Active {
+		return WebhookDelivery{}, errWebhookInactive
+	}
+	delivery, err := d.newDelivery(ctx, subscriptionID, original.Event)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	d.mu.Lock()
+	d.enqueueLocked(webhookJob{delivery.ID, delivery.Tenant})
+	d.mu.Unlock()
+	return delivery, nil
+}
+
+// enqueueLocked hands a delivery to the workers. The caller must hold d.mu.
+func (d *WebhookDispatcher) enqueueLocked(job webhookJob) {
+	d.queue = append(d.queue, job)
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// poll claims the deliveries that are due, such as retries and deliveries
+// left by stopped instances, until the dispatcher is stopped.
+func (d *WebhookDispatcher) poll() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		due, err := d.store.ClaimDeliveries(context.Background(), d.now().UTC(), webhookClaimLease, 100)
+		if err != nil {
+			d.logger.Warn("Failed to claim webhook deliveries", "error", err)
+			continue
+		}
+		d.mu.Lock()
+		for _, delivery := range due {
+			d.enqueueLocked(webhookJob{delivery.ID, delivery.Tenant})
+		}
+		d.mu.Unlock()
+	}
+}
+
+// work runs deliveries until the dispatcher is stopped.
+func (d *WebhookDispatcher) work() {
+	defer d.wg.Done()
+	for {
+		d.mu.Lock()
+		if len(d.queue) == 0 {
+			d.mu.Unlock()
+			select {
+			case <-d.wake:
+				continue
+			case <-d.stop:
+				return
+			}
+		}
+		job := d.queue[0]
+		d.queue = d.queue[1:]
+		if len(d.queue) > 0 {
+			// Pass the wake-up on so idle workers pick up the rest.
+			select {
+			case d.wake <- struct{}{}:
+			default:
+			}
+		}
+		d.mu.Unlock()
+
+		if err := d.attempt(context.Background(), job, true); errors.Is(err, errWebhookStore) {
+			d.logger.Warn("Webhook delivery failed", "delivery", job.id, "tenant", job.tenant, "error", err)
+		}
+	}
+}
+
+// errWebhookStore marks errors of the store during an attempt, as opposed
+// to errors of the receiver.
+var errWebhookStore = errors.New("webhook store")
+
+// attempt performs one delivery attempt and returns its error. With retry
+// it schedules a retry if needed, otherwise a failed attempt fails the
+// delivery. Deliveries to removed or disabled subscriptions are dropped
+// without an error.
+func (d *WebhookDispatcher) attempt(ctx context.Context, job webhookJob, retry bool) error {
+	ctx = withTenant(ctx, job.tenant)
+	delivery, err := d.store.GetDelivery(ctx, job.id)
+	if errors.Is(err, errDeliveryNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%w: %w", errWebhookStore, err)
+	}
+	if delivery.Status != deliveryPending {
+		return nil
+	}
+	sub, err := d.store.GetSubscription(ctx, delivery.SubscriptionID)
+	if errors.Is(err, errWebhookNotFound) || (err == nil && !sub.Active) {
+		delivery.Status = deliveryFailed
+		delivery.LastError = errWebhookInactive.Error()
+		delivery.NextAttemptAt = nil
+		return d.saveDelivery(ctx, delivery, nil)
+	} else if err != nil {
+		return fmt.Errorf("%w: %w", errWebhookStore, err)
+	}
+
+	status, sendErr := d.send(ctx, sub.URL, sub.Secret, delivery.ID, delivery.Event)
+
+	delivery.Attempts++
+	delivery.ResponseStatus = status
+	delivery.UpdatedAt = d.now().UTC()
+	delivery.NextAttemptAt = nil
+	if sendErr == nil {
+		delivery.Status = deliverySucceeded
+		delivery.LastError = ""
+		if err := d.store.SubscriptionSucceeded(ctx, sub.ID); err != nil {
+			return fmt.Errorf("%w: %w", errWebhookStore, err)
+		}
+		return d.saveDelivery(ctx, delivery, nil)
+	}
+
+	delivery.LastError = sendErr.Error()
+	reason := fmt.Sprintf("disabled after %d consecutive failed deliveries, last error: %v", d.disableAfter, sendErr)
+	sub, err = d.store.SubscriptionFailed(ctx, sub.ID, d.disableAfter, reason)
+	if err != nil && !errors.Is(err, errWebhookNotFound) {
+		return fmt.Errorf("%w: %w", errWebhookStore, err)
+	}
+	if err == nil && !sub.Active {
+		d.logger.Warn("Disabled webhook", "webhook", sub.ID, "tenant", sub.Tenant, "url", sub.URL, "reason", sub.DisabledReason)
+	}
+	if !retry || !sub.Active || delivery.Attempts >= d.maxAttempts {
+		delivery.Status = deliveryFailed
+		return d.saveDelivery(ctx, delivery, sendErr)
+	}
+	next := delivery.UpdatedAt.Add(d.backoff(delivery.Attempts))
+	delivery.NextAttemptAt = &next
+	return d.saveDelivery(ctx, delivery, sendErr)
+}
+
+// saveDelivery stores the outcome of an attempt and returns its error.
+func (d *WebhookDispatcher) saveDelivery(ctx context.Context, delivery WebhookDelivery, attemptErr error) error {
+	if err := d.store.UpdateDelivery(ctx, delivery); err != nil && !errors.Is(err, errDeliveryNotFound) {
+		return fmt.Errorf("%w: %w", errWebhookStore, err)
+	}
+	return attemptErr
+}
+
+// backoff returns the wait before the retry following the given number of
+// attempts: baseBackoff doubled per attempt, capped at maxBackoff, plus up to
+// 10% jitter so retries of many deliveries spread out.
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	wait := d.maxBackoff
+	if attempts <= 30 {
+		wait = min(d.baseBackoff<<(attempts-1), d.maxBackoff)
+	}
+	return wait + rand.N(wait/10+1)
+}
+
+// send posts event to target and returns the response status.
+func (d *WebhookDispatcher) send(ctx context.Context, target, secret string, deliveryID int, event UserEvent) (int, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event.Type)
+	req.Header.Set(webhookDeliveryHeader, strconv.Itoa(deliveryID))
+	req.Header.Set(webhookSignatureHeader, signWebhook(secret, time.Now(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the signature header value for body: the signing time
+// and the hex HMAC-SHA256 of "<unix time>.<body>" keyed with secret. Receivers
+// recompute it and should reject stale timestamps to prevent replays.
+func signWebhook(secret string, at time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, timestamp)
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// normalize validates a subscription and fills in defaults.
+func (d *WebhookDispatcher) normalize(sub *WebhookSubscription) error {
+	target, err := url.Parse(sub.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return errWebhookInvalidURL
+	}
+	if !d.allowPrivate && !publicHost(target.Hostname()) {
+		return errWebhookPrivateURL
+	}
+	if len(sub.Events) == 0 {
+		sub.Events = slices.Clone(userEventTypes)
+		return nil
+	}
+	events := make([]string, 0, len(sub.Events))
+	for _, event := range sub.Events {
+		if !slices.Contains(userEventTypes, event) {
+			return &ValidationError{Field: "events", Message: fmt.Sprintf("unknown event type %q", event)}
+		}
+		if !slices.Contains(events, event) {
+			events = append(events, event)
+		}
+	}
+	sub.Events = events
+	return nil
+}
+
+// publicHost reports whether host may be the target of a webhook: it must
+// not be localhost or an address that is not publicly routable. Names are
+// checked again for the addresses they resolve to when connecting.
+func publicHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return publicIP(ip)
+	}
+	return true
+}
+
+// publicIP reports whether ip is neither loopback, link-local, private,
+// unspecified nor multicast.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsPrivate() &&
+		!ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// newWebhookClient returns the client delivering webhooks. It refuses to
+// connect to addresses that are not public, whatever name resolved to
+// them, so that redirects and DNS cannot point deliveries at internal
+// services.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+			return errWebhookPrivateURL
+		}
+		return nil
+	}}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// writeWebhookError maps dispatcher errors to HTTP responses.
+func writeWebhookError(w http.ResponseWriter, r *http.Request, err error) {
+	var validationErr *ValidationError
+	switch {
+	case errors.Is(err, errWebhookNotFound), errors.Is(err, errDeliveryNotFound):
+		http.NotFound(w, r)
+	case errors.Is(err, errWebhookInactive):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errWebhookInvalidURL), errors.Is(err, errWebhookPrivateURL), errors.As(err, &validationErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		writeStoreError(w, err)
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	response, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// createWebhook handles the POST /v1/webhooks endpoint.
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var sub WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sub, err := s.webhooks.Create(r.Context(), sub)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, sub)
+}
+
+// listWebhooks handles the GET /v1/webhooks endpoint.
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	subs, err := s.webhooks.List(r.Context())
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, subs)
+}
+
+// getWebhook handles the GET /v1/webhooks/{id} endpoint.
+func (s *Server) getWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	sub, err := s.webhooks.Get(r.Context(), id)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// updateWebhook handles the PUT /v1/webhooks/{id} endpoint.
+func (s *Server) updateWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	var sub WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub.ID = id
+	sub, err = s.webhooks.Update(r.Context(), sub)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// deleteWebhook handles the DELETE /v1/webhooks/{id} endpoint.
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.webhooks.Delete(r.Context(), id); err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listWebhookDeliveries handles the GET /v1/webhooks/{id}/deliveries endpoint.
+func (s *Server) listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	deliveries, err := s.webhooks.Deliveries(r.Context(), id)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// redeliverWebhook handles the
+// POST /v1/webhooks/{id}/deliveries/{deliveryID}/redeliver endpoint.
+func (s *Server) redeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	deliveryID, err := strconv.Atoi(vars["deliveryID"])
+	if err != nil {
+		http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := s.webhooks.Redeliver(r.Context(), id, deliveryID)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, delivery)
+}
+
+// WebhookStore persists webhook subscriptions and their delivery logs,
+// limited to the tenant of ctx unless noted otherwise. Deliveries go away
+// with their subscription.
+type WebhookStore interface {
+	// CreateSubscription stores a new subscription and returns it with its
+	// assigned id.
+	CreateSubscription(ctx context.Context, sub WebhookSubscription) (WebhookSubscription, error)
+	// ListSubscriptions returns the subscriptions with their secrets,
+	// ordered by id.
+	ListSubscriptions(ctx context.Context) ([]WebhookSubscription, error)
+	// GetSubscription returns the subscription with the given id or
+	// errWebhookNotFound.
+	GetSubscription(ctx context.Context, id int) (WebhookSubscription, error)
+	// UpdateSubscription replaces url, events, secret, active flag, failure
+	// count and disabled reason of a subscription.
+	UpdateSubscription(ctx context.Context, sub WebhookSubscription) error
+	// DeleteSubscription removes a subscription with its deliveries.
+	DeleteSubscription(ctx context.Context, id int) error
+	// SubscriptionSucceeded resets the failure count of a subscription.
+	SubscriptionSucceeded(ctx context.Context, id int) error
+	// SubscriptionFailed counts a failed attempt of a subscription and
+	// disables it with reason once disableAfter attempts in a row failed.
+	// It returns the updated subscription.
+	SubscriptionFailed(ctx context.Context, id, disableAfter int, reason string) (WebhookSubscription, error)
+
+	// CreateDelivery stores a new delivery and returns it with its assigned
+	// id. The oldest finished deliveries of its subscription are dropped
+	// beyond maxWebhookDeliveryLog.
+	CreateDelivery(ctx context.Context, delivery WebhookDelivery) (WebhookDelivery, error)
+	// GetDelivery returns the delivery with the given id or
+	// errDeliveryNotFound.
+	GetDelivery(ctx context.Context, id int) (WebhookDelivery, error)
+	// ListDeliveries returns the deliveries of a subscription, newest first.
+	ListDeliveries(ctx context.Context, subscriptionID int) ([]WebhookDelivery, error)
+	// UpdateDelivery stores the outcome of an attempt.
+	UpdateDelivery(ctx context.Context, delivery WebhookDelivery) error
+	// ClaimDeliveries returns at most limit pending deliveries of all
+	// tenants that are due at now, oldest first, and moves their next
+	// attempt to now plus lease, so that no other instance claims them
+	// meanwhile.
+	ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error)
+}
+
+// memoryWebhookStore is a WebhookStore kept in process memory.
+type memoryWebhookStore struct {
+	mu                 sync.Mutex
+	subscriptions      map[int]WebhookSubscription
+	deliveries         map[int]WebhookDelivery
+	logs               map[int][]int // delivery ids per subscription, oldest first
+	nextSubscriptionID int
+	nextDeliveryID     int
+}
+
+// newMemoryWebhookStore returns an empty in-memory WebhookStore.
+func newMemoryWebhookStore() *memoryWebhookStore {
+	return &memoryWebhookStore{
+		subscriptions:      make(map[int]WebhookSubscription),
+		deliveries:         make(map[int]WebhookDelivery),
+		logs:               make(map[int][]int),
+		nextSubscriptionID: 1,
+		nextDeliveryID:     1,
+	}
+}
+
+// subscriptionLocked returns the subscription with the given id if it
+// belongs to the tenant of ctx. The caller must hold s.mu.
+func (s *memoryWebhookStore) subscriptionLocked(ctx context.Context, id int) (WebhookSubscription, error) {
+	sub, found := s.subscriptions[id]
+	if !found || sub.Tenant != tenantOrDefault(ctx) {
+		return WebhookSubscription{}, errWebhookNotFound
+	}
+	return sub, nil
+}
+
+func (s *memoryWebhookStore) CreateSubscription(ctx context.Context, sub WebhookSubscription) (WebhookSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub.ID = s.nextSubscriptionID
+	s.nextSubscriptionID++
+	sub.Events = slices.Clone(sub.Events)
+	s.subscriptions[sub.ID] = sub
+	return sub, nil
+}
+
+func (s *memoryWebhookStore) ListSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tenant := tenantOrDefault(ctx)
+	subs := []WebhookSubscription{}
+	for _, sub := range s.subscriptions {
+		if sub.Tenant == tenant {
+			sub.Events = slices.Clone(sub.Events)
+			subs = append(subs, sub)
+		}
+	}
+	slices.SortFunc(subs, func(a, b WebhookSubscription) int { return a.ID - b.ID })
+	return subs, nil
+}
+
+func (s *memoryWebhookStore) GetSubscription(ctx context.Context, id int) (WebhookSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, err := s.subscriptionLocked(ctx, id)
+	sub.Events = slices.Clone(sub.Events)
+	return sub, err
+}
+
+func (s *memoryWebhookStore) UpdateSubscription(ctx context.Context, sub WebhookSubscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.subscriptionLocked(ctx, sub.ID)
+	if err != nil {
+		return err
+	}
+	existing.URL, existing.Events, existing.Secret = sub.URL, slices.Clone(sub.Events), sub.Secret
+	existing.Active, existing.ConsecutiveFailures, existing.DisabledReason = sub.Active, sub.ConsecutiveFailures, sub.DisabledReason
+	s.subscriptions[sub.ID] = existing
+	return nil
+}
+
+func (s *memoryWebhookStore) DeleteSubscription(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.subscriptionLocked(ctx, id); err != nil {
+		return err
+	}
+	delete(s.subscriptions, id)
+	for _, deliveryID := range s.logs[id] {
+		delete(s.deliveries, deliveryID)
+	}
+	delete(s.logs, id)
+	return nil
+}
+
+func (s *memoryWebhookStore) SubscriptionSucceeded(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, err := s.subscriptionLocked(ctx, id)
+	if err != nil {
+		return err
+	}
+	sub.ConsecutiveFailures = 0
+	s.subscriptions[id] = sub
+	return nil
+}
+
+func (s *memoryWebhookStore) SubscriptionFailed(ctx context.Context, id, disableAfter int, reason string) (WebhookSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, err := s.subscriptionLocked(ctx, id)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	sub.ConsecutiveFailures++
+	if sub.Active && sub.ConsecutiveFailures >= disableAfter {
+		sub.Active = false
+		sub.DisabledReason = reason
+	}
+	s.subscriptions[id] = sub
+	sub.Events = slices.Clone(sub.Events)
+	return sub, nil
+}
+
+func (s *memoryWebhookStore) CreateDelivery(ctx context.Context, delivery WebhookDelivery) (WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.subscriptionLocked(ctx, delivery.SubscriptionID); err != nil {
+		return WebhookDelivery{}, err
+	}
+	delivery.ID = s.nextDeliveryID
+	s.nextDeliveryID++
+	s.deliveries[delivery.ID] = delivery
+
+	// Trim the oldest finished deliveries once the log is full.
+	ids := append(s.logs[delivery.SubscriptionID], delivery.ID)
+	for excess := len(ids) - maxWebhookDeliveryLog; excess > 0; excess-- {
+		i := slices.IndexFunc(ids, func(id int) bool { return s.deliveries[id].Status != deliveryPending })
+		if i < 0 {
+			break
+		}
+		delete(s.deliveries, ids[i])
+		ids = slices.Delete(ids, i, i+1)
+	}
+	s.logs[delivery.SubscriptionID] = ids
+	return delivery, nil
+}
+
+func (s *memoryWebhookStore) GetDelivery(ctx context.Context, id int) (WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivery, found := s.deliveries[id]
+	if !found || delivery.Tenant != tenantOrDefault(ctx) {
+		return WebhookDelivery{}, errDeliveryNotFound
+	}
+	return delivery, nil
+}
+
+func (s *memoryWebhookStore) ListDeliveries(ctx context.Context, subscriptionID int) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.subscriptionLocked(ctx, subscriptionID); err != nil {
+		return nil, err
+	}
+	ids := s.logs[subscriptionID]
+	deliveries := make([]WebhookDelivery, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		deliveries = append(deliveries, s.deliveries[ids[i]])
+	}
+	return deliveries, nil
+}
+
+func (s *memoryWebhookStore) UpdateDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, found := s.deliveries[delivery.ID]
+	if !found || existing.Tenant != tenantOrDefault(ctx) {
+		return errDeliveryNotFound
+	}
+	s.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (s *memoryWebhookStore) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []WebhookDelivery
+	for _, delivery := range s.deliveries {
+		if delivery.Status == deliveryPending && delivery.NextAttemptAt != nil && !now.Before(*delivery.NextAttemptAt) {
+			due = append(due, delivery)
+		}
+	}
+	slices.SortFunc(due, func(a, b WebhookDelivery) int { return a.NextAttemptAt.Compare(*b.NextAttemptAt) })
+	due = due[:min(limit, len(due))]
+	next := now.Add(lease)
+	for i := range due {
+		due[i].NextAttemptAt = &next
+		s.deliveries[due[i].ID] = due[i]
+	}
+	return due, nil
+}
+
+// sqlWebhookStore is a WebhookStore backed by the webhook_subscriptions and
+// webhook_deliveries tables.
+type sqlWebhookStore struct {
+	db           *sql.DB
+	queryTimeout time.Duration
+}
+
+// newSQLWebhookStore returns a WebhookStore using the given database handle.
+func newSQLWebhookStore(db *sql.DB) *sqlWebhookStore {
+	return &sqlWebhookStore{db: db, queryTimeout: 5 * time.Second}
+}
+
+const webhookSubscriptionColumns = "id, tenant_id, url, events, secret, active, consecutive_failures, COALESCE(disabled_reason, ''), created_at"
+
+// scanWebhookSubscription reads a row selected with
+// webhookSubscriptionColumns.
+func scanWebhookSubscription(scan func(dest ...any) error) (WebhookSubscription, error) {
+	var sub WebhookSubscription
+	var events string
+	err := scan(&sub.ID, &sub.Tenant, &sub.URL, &events, &sub.Secret, &sub.Active, &sub.ConsecutiveFailures, &sub.DisabledReason, &sub.CreatedAt)
+	sub.Events = strings.Fields(events)
+	return sub, err
+}
+
+func (s *sqlWebhookStore) CreateSubscription(ctx context.Context, sub WebhookSubscription) (WebhookSubscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	err := s.db.QueryRowContext(ctx,
+		"INSERT INTO webhook_subscriptions (tenant_id, url, events, secret, active, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		sub.Tenant, sub.URL, strings.Join(sub.Events, " "), sub.Secret, sub.Active, sub.CreatedAt).Scan(&sub.ID)
+	return sub, classify(ctx, err)
+}
+
+func (s *sqlWebhookStore) ListSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT "+webhookSubscriptionColumns+" FROM webhook_subscriptions WHERE tenant_id = $1 ORDER BY id", tenantOrDefault(ctx))
+	if err != nil {
+		return nil, classify(ctx, err)
+	}
+	defer rows.Close()
+
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		sub, err := scanWebhookSubscription(rows.Scan)
+		if err != nil {
+			return nil, classify(ctx, err)
+		}
+		subs = append(subs, sub)
+	}
+	return subs, classify(ctx, rows.Err())
+}
+
+func (s *sqlWebhookStore) GetSubscription(ctx context.Context, id int) (WebhookSubscription, error) {
+	return s.subscription(ctx, "SELECT "+webhookSubscriptionColumns+" FROM webhook_subscriptions WHERE id = $1 AND tenant_id = $2", id, tenantOrDefault(ctx))
+}
+
+func (s *sqlWebhookStore) UpdateSubscription(ctx context.Context, sub WebhookSubscription) error {
+	return s.exec(ctx, errWebhookNotFound,
+		"UPDATE webhook_subscriptions SET url = $1, events = $2, secret = $3, active = $4, consecutive_failures = $5, disabled_reason = NULLIF($6, '') WHERE id = $7 AND tenant_id = $8",
+		sub.URL, strings.Join(sub.Events, " "), sub.Secret, sub.Active, sub.ConsecutiveFailures, sub.DisabledReason, sub.ID, tenantOrDefault(ctx))
+}
+
+func (s *sqlWebhookStore) DeleteSubscription(ctx context.Context, id int) error {
+	return s.exec(ctx, errWebhookNotFound, "DELETE FROM webhook_subscriptions WHERE id = $1 AND tenant_id = $2", id, tenantOrDefault(ctx))
+}
+
+func (s *sqlWebhookStore) SubscriptionSucceeded(ctx context.Context, id int) error {
+	return s.exec(ctx, errWebhookNotFound,
+		"UPDATE webhook_subscriptions SET consecutive_failures = 0 WHERE id = $1 AND tenant_id = $2", id, tenantOrDefault(ctx))
+}
+
+func (s *sqlWebhookStore) SubscriptionFailed(ctx context.Context, id, disableAfter int, reason string) (WebhookSubscription, error) {
+	return s.subscription(ctx,
+		`UPDATE webhook_subscriptions SET consecutive_failures = consecutive_failures + 1,
+			disabled_reason = CASE WHEN active AND consecutive_failures + 1 >= $3 THEN $4 ELSE disabled_reason END,
+			active = active AND consecutive_failures + 1 < $3
+		WHERE id = $1 AND tenant_id = $2 RETURNING `+webhookSubscriptionColumns,
+		id, tenantOrDefault(ctx), disableAfter, reason)
+}
+
+// subscription runs a query returning a single subscription.
+func (s *sqlWebhookStore) subscription(ctx context.Context, query string, args ...any) (WebhookSubscription, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	sub, err := scanWebhookSubscription(s.db.QueryRowContext(ctx, query, args...).Scan)
+	if err == sql.ErrNoRows {
+		return WebhookSubscription{}, errWebhookNotFound
+	}
+	return sub, classify(ctx, err)
+}
+
+const webhookDeliveryColumns = "id, subscription_id, tenant_id, event, status, attempts, COALESCE(response_status, 0), COALESCE(last_error, ''), next_attempt_at, created_at, updated_at"
+
+// scanWebhookDelivery reads a row selected with webhookDeliveryColumns.
+func scanWebhookDelivery(scan func(dest ...any) error) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var event []byte
+	var nextAttemptAt sql.NullTime
+	err := scan(&delivery.ID, &delivery.SubscriptionID, &delivery.Tenant, &event, &delivery.Status, &delivery.Attempts,
+		&delivery.ResponseStatus, &delivery.LastError, &nextAttemptAt, &delivery.CreatedAt, &delivery.UpdatedAt)
+	if err != nil {
+		return delivery, err
+	}
+	if nextAttemptAt.Valid {
+		delivery.NextAttemptAt = &nextAttemptAt.Time
+	}
+	return delivery, json.Unmarshal(event, &delivery.Event)
+}
+
+func (s *sqlWebhookStore) CreateDelivery(ctx context.Context, delivery WebhookDelivery) (WebhookDelivery, error) {
+	event, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return WebhookDelivery{}, classify(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO webhook_deliveries (subscription_id, tenant_id, event, status, next_attempt_at, created_at, updated_at)
+		SELECT id, tenant_id, $3, $4, $5, $6, $7 FROM webhook_subscriptions WHERE id = $1 AND tenant_id = $2 RETURNING id`,
+		delivery.SubscriptionID, delivery.Tenant, string(event), delivery.Status, delivery.NextAttemptAt, delivery.CreatedAt, delivery.UpdatedAt).Scan(&delivery.ID)
+	if err == sql.ErrNoRows {
+		return WebhookDelivery{}, errWebhookNotFound
+	} else if err != nil {
+		return WebhookDelivery{}, classify(ctx, err)
+	}
+	// Trim the oldest finished deliveries once the log is full.
+	_, err = tx.ExecContext(ctx,
+		`DELETE FROM webhook_deliveries WHERE subscription_id = $1 AND status <> $2 AND id <= (
+			SELECT id FROM webhook_deliveries WHERE subscription_id = $1 ORDER BY id DESC OFFSET $3 LIMIT 1)`,
+		delivery.SubscriptionID, deliveryPending, maxWebhookDeliveryLog)
+	if err != nil {
+		return WebhookDelivery{}, classify(ctx, err)
+	}
+	return delivery, classify(ctx, tx.Commit())
+}
+
+func (s *sqlWebhookStore) GetDelivery(ctx context.Context, id int) (WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	delivery, err := scanWebhookDelivery(s.db.QueryRowContext(ctx,
+		"SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = $1 AND tenant_id = $2", id, tenantOrDefault(ctx)).Scan)
+	if err == sql.ErrNoRows {
+		return WebhookDelivery{}, errDeliveryNotFound
+	}
+	return delivery, classify(ctx, err)
+}
+
+func (s *sqlWebhookStore) ListDeliveries(ctx context.Context, subscriptionID int) ([]WebhookDelivery, error) {
+	return s.deliveries(ctx, "SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE subscription_id = $1 AND tenant_id = $2 ORDER BY id DESC",
+		subscriptionID, tenantOrDefault(ctx))
+}
+
+func (s *sqlWebhookStore) UpdateDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	return s.exec(ctx, errDeliveryNotFound,
+		`UPDATE webhook_deliveries SET status = $1, attempts = $2, response_status = NULLIF($3, 0), last_error = NULLIF($4, ''),
+			next_attempt_at = $5, updated_at = $6 WHERE id = $7 AND tenant_id = $8`,
+		delivery.Status, delivery.Attempts, delivery.ResponseStatus, delivery.LastError, delivery.NextAttemptAt, delivery.UpdatedAt,
+		delivery.ID, tenantOrDefault(ctx))
+}
+
+func (s *sqlWebhookStore) ClaimDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	deliveries, err := s.deliveries(ctx,
+		`UPDATE webhook_deliveries SET next_attempt_at = $2 WHERE id IN (
+			SELECT id FROM webhook_deliveries WHERE status = $3 AND next_attempt_at <= $1
+			ORDER BY next_attempt_at LIMIT $4 FOR UPDATE SKIP LOCKED)
+		RETURNING `+webhookDeliveryColumns,
+		now, now.Add(lease), deliveryPending, limit)
+	slices.SortFunc(deliveries, func(a, b WebhookDelivery) int { return a.ID - b.ID })
+	return deliveries, err
+}
+
+// deliveries runs a query returning deliveries.
+func (s *sqlWebhookStore) deliveries(ctx context.Context, query string, args ...any) ([]WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, classify(ctx, err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows.Scan)
+		if err != nil {
+			return nil, classify(ctx, err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, classify(ctx, rows.Err())
+}
+
+// exec runs a statement changing a single row and returns notFound if
+// there was none.
+func (s *sqlWebhookStore) exec(ctx context.Context, notFound error, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return classify(ctx, err)
+	}
+	if requireAffected(result) != nil {
+		return notFound
+	}
+	return nil
+}
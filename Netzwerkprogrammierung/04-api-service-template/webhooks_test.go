@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// webhookReceiver is an httptest server answering webhook deliveries with
+// the statuses in responses, repeating the last one.
+type webhookReceiver struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses []int
+	requests  []*http.Request
+	bodies    [][]byte
+}
+
+func newWebhookReceiver(responses ...int) *webhookReceiver {
+	receiver := &webhookReceiver{responses: responses}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		status := receiver.responses[min(len(receiver.requests), len(receiver.responses)-1)]
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, body)
+		w.WriteHeader(status)
+	}))
+	return receiver
+}
+
+func (w *webhookReceiver) received() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.requests)
+}
+
+// waitFor polls condition until it holds or a second has passed.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newTestDispatcher(workers, maxAttempts, disableAfter int) *WebhookDispatcher {
+	d := NewWebhookDispatcher(&http.Client{Timeout: time.Second}, maxAttempts, disableAfter, time.Millisecond, 5*time.Millisecond)
+	// The receivers of the tests listen on the loopback interface.
+	d.allowPrivate = true
+	d.pollInterval = time.Millisecond
+	d.Start(workers)
+	return d
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	// Setup
+	receiver := newWebhookReceiver(http.StatusNoContent)
+	defer receiver.Close()
+	d := newTestDispatcher(2, 3, 10)
+	defer d.Stop()
+	sub, err := d.Create(context.Background(), WebhookSubscription{URL: receiver.URL, Events: []string{EventUserCreated}, Secret: "s3cret"})
+	assert.NoError(t, err)
+
+	// Execute
+	d.Publish(newUserEvent(EventUserDeleted, User{ID: 1}))
+	d.Publish(newUserEvent(EventUserCreated, User{ID: 1, Name: "John Doe"}))
+	waitFor(t, func() bool {
+		deliveries, _ := d.Deliveries(context.Background(), sub.ID)
+		return len(deliveries) == 1 && deliveries[0].Status == deliverySucceeded
+	})
+
+	// Validate
+	assert.Equal(t, 1, receiver.received())
+	req, body := receiver.requests[0], receiver.bodies[0]
+	assert.Equal(t, EventUserCreated, req.Header.Get(webhookEventHeader))
+	var timestamp int64
+	fmt.Sscanf(req.Header.Get(webhookSignatureHeader), "t=%d,", &timestamp)
+	assert.Equal(t, signWebhook("s3cret", time.Unix(timestamp, 0), body), req.Header.Get(webhookSignatureHeader))
+	var event UserEvent
+	assert.NoError(t, json.Unmarshal(body, &event))
+	assert.Equal(t, "John Doe", event.Data.Name)
+}
+
+func TestWebhookDeliveryRetriesWithBackoff(t *testing.T) {
+	// Setup
+	receiver := newWebhookReceiver(http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK)
+	defer receiver.Close()
+	d := newTestDispatcher(2, 5, 10)
+	defer d.Stop()
+	sub, _ := d.Create(context.Background(), WebhookSubscription{URL: receiver.URL})
+
+	// Execute
+	d.Publish(newUserEvent(EventUserUpdated, User{ID: 1, Name: "John Doe"}))
+	waitFor(t, func() bool {
+		deliveries, _ := d.Deliveries(context.Background(), sub.ID)
+		return deliveries[0].Status != deliveryPending
+	})
+
+	// Validate
+	deliveries, _ := d.Deliveries(context.Background(), sub.ID)
+	assert.Equal(t, deliverySucceeded, deliveries[0].Status)
+	assert.Equal(t, 3, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusOK, deliveries[0].ResponseStatus)
+	current, _ := d.Get(context.Background(), sub.ID)
+	assert.Equal(t, 0, current.ConsecutiveFailures)
+}
+
+func TestWebhookDeliverWaitsForTheAttempts(t *testing.T) {
+	// Setup
+	receiver := newWebhookReceiver(http.StatusInternalServerError, http.StatusNoContent)
+	defer receiver.Close()
+	d := newTestDispatcher(0, 8, 20)
+	defer d.Stop()
+	sub, _ := d.Create(context.Background(), WebhookSubscription{URL: receiver.URL})
+	d.Create(withTenant(context.Background(), "acme"), WebhookSubscription{URL: receiver.URL})
+
+	// Execute
+	failed := d.Deliver(context.Background(), newUserEvent(EventUserCreated, User{ID: 1}))
+	time.Sleep(20 * time.Millisecond)
+	receivedAfterFailure := receiver.received()
+	delivered := d.Deliver(context.Background(), newUserEvent(EventUserCreated, User{ID: 1}))
+
+	// Validate
+	assert.Error(t, failed)
+	assert.Equal(t, 1, receivedAfterFailure, "the caller retries, not the dispatcher")
+	assert.NoError(t, delivered)
+	assert.Equal(t, 2, receiver.received(), "only subscriptions of the tenant of the event receive it")
+	deliveries, _ := d.Deliveries(context.Background(), sub.ID)
+	if assert.Len(t, deliveries, 2) {
+		assert.Equal(t, deliverySucceeded, deliveries[0].Status)
+		assert.Equal(t, deliveryFailed, deliveries[1].Status)
+	}
+}
+
+func TestWebhookBackoffIsExponentialAndCapped(t *testing.T) {
+	// Setup
+	d := NewWebhookDispatcher(http.DefaultClient, 10, 10, time.Second, 10*time.Second)
+
+	// Validate
+	for attempts, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 5: 10 * time.Second, 64: 10 * time.Second} {
+		backoff := d.backoff(attempts)
+		assert.GreaterOrEqual(t, backoff, expected)
+		assert.LessOrEqual(t, backoff, expected+expected/10)
+	}
+}
+
+func TestWebhookFailingEndpointIsDisabled(t *testing.T) {
+	// Setup
+	receiver := newWebhookReceiver(http.StatusInternalServerError)
+	defer receiver.Close()
+	// A single worker keeps the order of attempts deterministic.
+	d := newTestDispatcher(1, 2, 3)
+	defer d.Stop()
+	sub, _ := d.Create(context.Background(), WebhookSubscription{URL: receiver.URL})
+
+	// Execute
+	d.Publish(newUserEvent(EventUserCreated, User{ID: 1}))
+	d.Publish(newUserEvent(EventUserCreated, User{ID: 2}))
+	waitFor(t, func() bool {
+		current, _ := d.Get(context.Background(), sub.ID)
+		return !current.Active
+	})
+	waitFor(t, func() bool {
+		deliveries, _ := d.Deliveries(context.Background(), sub.ID)
+		return deliveries[0].Status == deliveryFailed && deliveries[1].Status == deliveryFailed
+	})
+	d.Publish(newUserEvent(EventUserCreated, User{ID: 3}))
+
+	// Validate
+	current, _ := d.Get(context.Background(), sub.ID)
+	assert.Equal(t, 3, current.ConsecutiveFailures)
+	assert.Contains(t, current.DisabledReason, "3 consecutive failed deliveries")
+	deliveries, _ := d.Deliveries(context.Background(), sub.ID)
+	assert.Len(t, deliveries, 2)
+	assert.Equal(t, 3, receiver.received())
+	_, err := d.Redeliver(context.Background(), sub.ID, deliveries[0].ID)
+	assert.ErrorIs(t, err, errWebhookInactive)
+}
+
+func TestWebhookInstancesShareSubscriptionsAndRetries(t *testing.T) {
+	// Setup
+	receiver := newWebhookReceiver(http.StatusServiceUnavailable, http.StatusNoContent)
+	defer receiver.Close()
+	store := newMemoryWebhookStore()
+	a := NewWebhookDispatcher(&http.Client{Timeout: time.Second}, 3, 10, time.Millisecond, time.Millisecond)
+	b := NewWebhookDispatcher(&http.Client{Timeout: time.Second}, 3, 10, time.Millisecond, time.Millisecond)
+	for _, d := range []*WebhookDispatcher{a, b} {
+		d.store, d.allowPrivate, d.pollInterval = store, true, time.Millisecond
+	}
+	b.Start(1)
+	defer b.Stop()
+	sub, err := b.Create(context.Background(), WebhookSubscription{URL: receiver.URL})
+	assert.NoError(t, err)
+
+	// Execute
+	a.Start(1)
+	a.Publish(newUserEvent(EventUserCreated, User{ID: 1}))
+	waitFor(t, func() bool { return receiver.received() == 1 })
+	a.Stop()
+	waitFor(t, func() bool {
+		deliveries, _ := b.Deliveries(context.Background(), sub.ID)
+		return deliveries[0].Status == deliverySucceeded
+	})
+
+	// Validate
+	assert.Equal(t, 2, receiver.received(), "the retry of a stopped instance is picked up by another one")
+}
+
+func TestSQLWebhookStore(t *testing.T) {
+	// Setup
+	storeDB, storeMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer storeDB.Close()
+	s := newSQLWebhookStore(storeDB)
+	ctx := withTenant(context.Background(), "acme")
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	sub := WebhookSubscription{Tenant: "acme", URL: "https://example.com/hook", Events: []string{EventUserCreated, EventUserDeleted},
+		Secret: "s3cret", Active: true, CreatedAt: createdAt}
+	event := UserEvent{ID: "1", Type: EventUserCreated, Tenant: "acme", OccurredAt: createdAt, Data: User{ID: 7, Name: "John Doe"}}
+	payload, _ := json.Marshal(event)
+	deliveryColumns := []string{"id", "subscription_id", "tenant_id", "event", "status", "attempts", "response_status", "last_error", "next_attempt_at", "created_at", "updated_at"}
+
+	// Mock DB response
+	storeMock.ExpectQuery("INSERT INTO webhook_subscriptions \\(tenant_id, url, events, secret, active, created_at\\)").
+		WithArgs("acme", sub.URL, "user.created user.deleted", "s3cret", true, createdAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	storeMock.ExpectQuery("UPDATE webhook_subscriptions SET consecutive_failures = consecutive_failures \\+ 1,.*active = active AND consecutive_failures \\+ 1 < \\$3\\s+WHERE id = \\$1 AND tenant_id = \\$2 RETURNING id").
+		WithArgs(3, "acme", 2, "disabled").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "tenant_id", "url", "events", "secret", "active", "consecutive_failures", "disabled_reason", "created_at"}).
+			AddRow(3, "acme", sub.URL, "user.created user.deleted", "s3cret", false, 2, "disabled", createdAt))
+	storeMock.ExpectBegin()
+	storeMock.ExpectQuery("INSERT INTO webhook_deliveries .* FROM webhook_subscriptions WHERE id = \\$1 AND tenant_id = \\$2 RETURNING id").
+		WithArgs(3, "acme", string(payload), deliveryPending, sqlmock.AnyArg(), createdAt, createdAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(11))
+	storeMock.ExpectExec("DELETE FROM webhook_deliveries WHERE subscription_id = \\$1 AND status <> \\$2").
+		WithArgs(3, deliveryPending, maxWebhookDeliveryLog).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	storeMock.ExpectCommit()
+	storeMock.ExpectQuery("UPDATE webhook_deliveries SET next_attempt_at = \\$2 WHERE id IN \\(.*FOR UPDATE SKIP LOCKED\\)").
+		WithArgs(createdAt, createdAt.Add(time.Minute), deliveryPending, 100).
+		WillReturnRows(sqlmock.NewRows(deliveryColumns).
+			AddRow(12, 3, "acme", payload, deliveryPending, 1, 503, "unexpected response status 503", createdAt.Add(time.Minute), createdAt, createdAt).
+			AddRow(11, 3, "acme", payload, deliveryPending, 0, 0, "", createdAt.Add(time.Minute), createdAt, createdAt))
+	storeMock.ExpectExec("DELETE FROM webhook_subscriptions WHERE id = \\$1 AND tenant_id = \\$2").
+		WithArgs(3, "acme").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Execute
+	created, createErr := s.CreateSubscription(ctx, sub)
+	failed, failErr := s.SubscriptionFailed(ctx, 3, 2, "disabled")
+	delivery, deliveryErr := s.CreateDelivery(ctx, WebhookDelivery{SubscriptionID: 3, Tenant: "acme", Event: event, Status: deliveryPending,
+		CreatedAt: createdAt, UpdatedAt: createdAt})
+	claimed, claimErr := s.ClaimDeliveries(context.Background(), createdAt, time.Minute, 100)
+	deleteErr := s.DeleteSubscription(ctx, 3)
+
+	// Validate
+	assert.NoError(t, createErr)
+	assert.Equal(t, 3, created.ID)
+	assert.NoError(t, failErr)
+	assert.False(t, failed.Active)
+	assert.Equal(t, []string{EventUserCreated, EventUserDeleted}, failed.Events)
+	assert.NoError(t, deliveryErr)
+	assert.Equal(t, 11, delivery.ID)
+	assert.NoError(t, claimErr)
+	if assert.Len(t, claimed, 2) {
+		assert.Equal(t, []int{11, 12}, []int{claimed[0].ID, claimed[1].ID}, "oldest first")
+		assert.Equal(t, event, claimed[0].Event)
+		assert.Equal(t, 503, claimed[1].ResponseStatus)
+	}
+	assert.ErrorIs(t, deleteErr, errWebhookNotFound)
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
+
+func TestWebhookEndpoints(t *testing.T) {
+	// Setup
+	router := NewServer()
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, target, strings.NewReader(body))
+		assert.NoError(t, err)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Execute
+	created := serve("POST", "/v1/webhooks", `{"url":"https://example.com/hook","events":["user.deleted"]}`)
+	invalid := serve("POST", "/v1/webhooks", `{"url":"ftp://example.com/hook"}`)
+	var sub WebhookSubscription
+	json.Unmarshal(created.Body.Bytes(), &sub)
+	listed := serve("GET", "/v1/webhooks", "")
+	router.webhooks.Publish(newUserEvent(EventUserDeleted, User{ID: 42}))
+	deliveries := serve("GET", fmt.Sprintf("/v1/webhooks/%d/deliveries", sub.ID), "")
+	var log []WebhookDelivery
+	json.Unmarshal(deliveries.Body.Bytes(), &log)
+	redelivered := serve("POST", fmt.Sprintf("/v1/webhooks/%d/deliveries/%d/redeliver", sub.ID, log[0].ID), "")
+	updated := serve("PUT", fmt.Sprintf("/v1/webhooks/%d", sub.ID), `{"url":"https://example.com/other","active":false}`)
+	deleted := serve("DELETE", fmt.Sprintf("/v1/webhooks/%d", sub.ID), "")
+	missing := serve("GET", fmt.Sprintf("/v1/webhooks/%d", sub.ID), "")
+
+	// Validate
+	assert.Equal(t, http.StatusCreated, created.Code)
+	assert.Len(t, sub.Secret, 64)
+	assert.Equal(t, http.StatusBadRequest, invalid.Code)
+	assert.Equal(t, http.StatusOK, listed.Code)
+	assert.NotContains(t, listed.Body.String(), sub.Secret)
+	assert.Len(t, log, 1)
+	assert.Equal(t, 42, log[0].Event.Data.ID)
+	assert.Equal(t, http.StatusAccepted, redelivered.Code)
+	assert.Equal(t, http.StatusOK, updated.Code)
+	assert.True(t, bytes.Contains(updated.Body.Bytes(), []byte(`"active":false`)))
+	assert.Equal(t, http.StatusNoContent, deleted.Code)
+	assert.Equal(t, http.StatusNotFound, missing.Code)
+}
+
+func TestWebhooksAreTenantScoped(t *testing.T) {
+	// Setup
+	router := NewServer(WithTenancy(NewTenantResolver(nil, "")))
+	serve := func(tenant, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(tenantHeader, tenant)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	created := serve("acme", "POST", "/v1/webhooks", `{"url":"https://example.com/hook"}`)
+	var sub WebhookSubscription
+	json.Unmarshal(created.Body.Bytes(), &sub)
+	path := fmt.Sprintf("/v1/webhooks/%d", sub.ID)
+
+	// Execute
+	router.webhooks.Publish(UserEvent{ID: "1", Type: EventUserCreated, Tenant: "globex", Data: User{ID: 1}})
+	router.webhooks.Publish(UserEvent{ID: "2", Type: EventUserCreated, Tenant: "acme", Data: User{ID: 2}})
+	listed := serve("globex", "GET", "/v1/webhooks", "")
+	read := serve("globex", "GET", path, "")
+	repointed := serve("globex", "PUT", path, `{"url":"https://attacker.example/hook","active":true}`)
+	deliveries := serve("globex", "GET", path+"/deliveries", "")
+	deleted := serve("globex", "DELETE", path, "")
+	own := serve("acme", "GET", path+"/deliveries", "")
+
+	// Validate
+	assert.Equal(t, http.StatusCreated, created.Code)
+	assert.JSONEq(t, "[]", listed.Body.String())
+	assert.Equal(t, http.StatusNotFound, read.Code)
+	assert.Equal(t, http.StatusNotFound, repointed.Code)
+	assert.Equal(t, http.StatusNotFound, deliveries.Code)
+	assert.Equal(t, http.StatusNotFound, deleted.Code)
+	var log []WebhookDelivery
+	assert.NoError(t, json.Unmarshal(own.Body.Bytes(), &log))
+	if assert.Len(t, log, 1, "only the events of its own tenant are delivered") {
+		assert.Equal(t, 2, log[0].Event.Data.ID)
+	}
+	current, err := router.webhooks.Get(withTenant(context.Background(), "acme"), sub.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/hook", current.URL)
+}
+
+func TestWebhookURLsMustBePublic(t *testing.T) {
+	// Setup
+	d := NewWebhookDispatcher(newWebhookClient(time.Second), 1, 1, time.Millisecond, time.Millisecond)
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://example.com/hook", true},
+		{"https://203.0.113.10/hook", true},
+		{"http://localhost:8080/hook", false},
+		{"http://api.localhost/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://10.0.0.5/hook", false},
+		{"http://192.168.1.1/hook", false},
+		{"http://[fd00::1]/hook", false},
+		{"http://0.0.0.0/hook", false},
+	}
+
+	for _, test := range tests {
+		// Execute
+		_, err := d.Create(context.Background(), WebhookSubscription{URL: test.url})
+
+		// Validate
+		if test.valid {
+			assert.NoError(t, err, test.url)
+		} else {
+			assert.ErrorIs(t, err, errWebhookPrivateURL, test.url)
+		}
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	// Setup
+	receiver := newWebhookReceiver(http.StatusNoContent)
+	defer receiver.Close()
+	d := NewWebhookDispatcher(newWebhookClient(time.Second), 1, 1, time.Millisecond, time.Millisecond)
+
+	// Execute
+	_, err := d.send(context.Background(), receiver.URL, "s3cret", 1, newUserEvent(EventUserCreated, User{ID: 1}))
+
+	// Validate
+	assert.ErrorIs(t, err, errWebhookPrivateURL, "names resolving to private addresses are refused too")
+	assert.Zero(t, receiver.received())
+}
+
+func TestWebhookDispatcherStopsTwice(t *testing.T) {
+	// Setup
+	d := newTestDispatcher(2, 1, 1)
+
+	// Execute and validate
+	d.Stop()
+	assert.NotPanics(t, d.Stop)
+}
+
+func TestEventingStoreEmitsLifecycleEvents(t *testing.T) {
+	// Setup
+	var events []UserEvent
+	var emitted int32
+	s := newEventingStore(newMemoryStore(), func(event UserEvent) {
+		atomic.AddInt32(&emitted, 1)
+		events = append(events, event)
+	})
+	ctx := context.Background()
+
+	// Execute
+	user, _ := s.CreateUser(ctx, User{Name: "John Doe"})
+	s.UpdateUser(ctx, User{ID: user.ID, Name: "John Smith"})
+	s.UpdateUser(ctx, User{ID: 99, Name: "Nobody"})
+	s.UpsertUser(ctx, User{ID: 5, Name: "Jane Doe"})
+	s.DeleteUser(ctx, user.ID)
+
+	// Validate
+	assert.Equal(t, int32(4), emitted)
+	assert.Equal(t, []string{EventUserCreated, EventUserUpdated, EventUserCreated, EventUserDeleted},
+		[]string{events[0].Type, events[1].Type, events[2].Type, events[3].Type})
+	assert.Equal(t, "John Smith", events[1].Data.Name)
+	assert.Equal(t, User{ID: user.ID}, events[3].Data)
+	assert.NotEqual(t, events[0].ID, events[1].ID)
+}